@@ -0,0 +1,84 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/krake-labs/krake/api/record"
+)
+
+// Acks is how durable a produce must be before it is acknowledged, like
+// the acks producer setting. The zero value is acks=1.
+type Acks int8
+
+const (
+	// acks=1, the batch is written to the leader's log. It is on disk
+	// once the flush policy says so.
+	AcksLeader Acks = iota
+	// acks=0, the producer does not wait for the batch to be written or
+	// learn its offsets.
+	AcksNone
+	// acks=all, the batch is on disk on every in-sync replica. We are
+	// the only replica so the log is fsynced whatever the flush policy.
+	AcksAll
+)
+
+var (
+	ErrRequestTimeout = errors.New("request timed out")
+	ErrInvalidAcks    = errors.New("invalid acks")
+)
+
+func (a Acks) String() string {
+	switch a {
+	case AcksNone:
+		return "0"
+	case AcksLeader:
+		return "1"
+	case AcksAll:
+		return "all"
+	}
+	return fmt.Sprintf("Acks(%d)", int8(a))
+}
+
+// ParseAcks parses the acks producer setting, 0, 1 or all (-1). An
+// empty setting is acks=1.
+func ParseAcks(s string) (Acks, error) {
+	switch s {
+	case "", "1":
+		return AcksLeader, nil
+	case "0":
+		return AcksNone, nil
+	case "all", "-1":
+		return AcksAll, nil
+	}
+	return AcksLeader, fmt.Errorf("%w: %q", ErrInvalidAcks, s)
+}
+
+// ProduceOptions control when a produce is acknowledged.
+type ProduceOptions struct {
+	Acks Acks
+	// how long to wait for the acknowledgement, zero uses the broker's
+	// request.timeout.ms.
+	Timeout time.Duration
+	// the idempotent producer sending the messages, retries of its
+	// batches are not written twice. The messages of each partition
+	// must have consecutive sequence numbers so the partitions should
+	// be picked by the producer, not a Partitioner that is not keyed.
+	Producer ProducerIdentity
+	// the transaction of Producer the messages are written in, see
+	// BeginTransaction. Their partitions must have been added to it.
+	TransactionalID string
+	// the codec the producer compresses the batches with, see
+	// TopicConfiguration.CompressionType.
+	Compression record.Compression
+}
+
+// requestTimeout is request.timeout.ms, how long a produce waits for
+// its acknowledgement by default.
+func (k *KrakeBroker) requestTimeout() time.Duration {
+	if v, ok := k.Config["request.timeout.ms"].(int); ok {
+		return time.Duration(v) * time.Millisecond
+	}
+	return 30 * time.Second
+}
@@ -0,0 +1,108 @@
+package api
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseAcks(t *testing.T) {
+	for s, want := range map[string]Acks{
+		"":    AcksLeader,
+		"1":   AcksLeader,
+		"0":   AcksNone,
+		"all": AcksAll,
+		"-1":  AcksAll,
+	} {
+		acks, err := ParseAcks(s)
+		assert.NoError(t, err)
+		assert.Equal(t, want, acks)
+	}
+
+	_, err := ParseAcks("2")
+	assert.ErrorIs(t, err, ErrInvalidAcks)
+	assert.Equal(t, "all", AcksAll.String())
+}
+
+func TestKrakeBroker_ProduceBatch_Acks(t *testing.T) {
+	b, _ := newTestBroker(t, nil, myTopic)
+	key := TopicPartitionKey{"my-topic", 0}
+	msgs := []*Message{{Message: []byte("a")}, {Message: []byte("b")}}
+
+	// acks=1 leaves flushing to the flush policy, which is the OS
+	results, err := b.ProduceBatch("my-topic", msgs, ProduceOptions{Acks: AcksLeader})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), results[1].Offset)
+	assert.Zero(t, b.committer.syncs)
+
+	// acks=all waits for the fsync
+	results, err = b.ProduceBatch("my-topic", msgs, ProduceOptions{Acks: AcksAll})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), results[1].Offset)
+	assert.NoError(t, results[1].Err)
+	assert.Equal(t, int64(1), b.committer.syncs)
+	assert.Zero(t, b.logs[key].unflushed)
+
+	// acks=0 is written but the offsets are not known
+	results, err = b.ProduceBatch("my-topic", msgs, ProduceOptions{Acks: AcksNone})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(-1), results[0].Offset)
+	assert.Equal(t, int32(0), results[0].Partition)
+	assert.Equal(t, int64(6), b.logs[key].nextOffset)
+}
+
+func TestKrakeBroker_ProduceBatch_AcksAllGroupCommit(t *testing.T) {
+	b, _ := newTestBroker(t, map[string]interface{}{
+		"flush.messages": 100,
+	}, myTopic)
+
+	_, err := b.ProduceBatch("my-topic", []*Message{{Message: []byte("a")}}, ProduceOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, b.logs[TopicPartitionKey{"my-topic", 0}].unflushed)
+
+	// acks=all flushes whatever the policy and resets it
+	_, err = b.ProduceBatch("my-topic", []*Message{{Message: []byte("b")}}, ProduceOptions{Acks: AcksAll})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), b.committer.syncs)
+	assert.Zero(t, b.logs[TopicPartitionKey{"my-topic", 0}].unflushed)
+}
+
+func TestKrakeBroker_ProduceBatch_Timeout(t *testing.T) {
+	b, _ := newTestBroker(t, map[string]interface{}{
+		"request.timeout.ms": 20,
+	}, myTopic)
+
+	// a disk that hangs until the test is done with it
+	release := make(chan struct{})
+	synced := make(chan struct{}, 2)
+	b.committer.fsync = func(f SegmentFile) error {
+		<-release
+		synced <- struct{}{}
+		return nil
+	}
+
+	start := time.Now()
+	_, err := b.ProduceBatch("my-topic", []*Message{{Message: []byte("a")}}, ProduceOptions{Acks: AcksAll})
+	assert.ErrorIs(t, err, ErrRequestTimeout)
+	assert.GreaterOrEqual(t, time.Since(start), 20*time.Millisecond)
+
+	// the producer's own timeout wins over request.timeout.ms
+	_, err = b.ProduceBatch("my-topic", []*Message{{Message: []byte("b")}}, ProduceOptions{Acks: AcksAll, Timeout: time.Millisecond})
+	assert.ErrorIs(t, err, ErrRequestTimeout)
+
+	// acks=1 does not wait for the disk
+	_, err = b.ProduceBatch("my-topic", []*Message{{Message: []byte("c")}}, ProduceOptions{})
+	assert.NoError(t, err)
+
+	// the writes went through, only the acknowledgements timed out
+	assert.Eventually(t, func() bool {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		return b.logs[TopicPartitionKey{"my-topic", 0}].nextOffset == 3
+	}, time.Second, time.Millisecond)
+
+	close(release)
+	<-synced
+	<-synced
+}
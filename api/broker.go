@@ -4,19 +4,32 @@ import (
 	"errors"
 	"fmt"
 	"github.com/google/uuid"
-	"hash/fnv"
-	"io"
+	"github.com/krake-labs/krake/api/record"
 	"log"
 	"os"
+	"path/filepath"
+	"sync"
 	"time"
 )
 
 type Broker interface {
-	Produce(s string, msg *Message) error
+	Produce(s string, msg *Message) (RecordMetadata, error)
+	ProduceBatch(topic string, msgs []*Message, opts ProduceOptions) ([]ProduceResult, error)
+	InitProducerID() (ProducerIdentity, error)
+	BeginTransaction(transactionalID string) (ProducerIdentity, error)
+	AddPartitionsToTxn(transactionalID string, p ProducerIdentity, partitions []TopicPartitionKey) error
+	CommitTransaction(transactionalID string, p ProducerIdentity) error
+	AbortTransaction(transactionalID string, p ProducerIdentity) error
 	CreateTopic(configuration TopicConfiguration) error
 	Configure(m map[string]interface{})
 	ReadMessage(s string, consumerId uint32, timeout int) (*Message, error)
 	Subscribe(strings []string) uint32
+	JoinGroup(groupID string, memberID uint32, topics []string) (GroupMembership, error)
+	Heartbeat(groupID string, memberID uint32, generation int32) error
+	LeaveGroup(groupID string, memberID uint32) error
+	CommitOffsets(groupID string, memberID uint32, generation int32, offsets map[TopicPartitionKey]int64) error
+	FetchOffsets(groupID string) (map[TopicPartitionKey]int64, error)
+	OffsetsForTimes(topic string, partition int32, ts time.Time) (int64, error)
 }
 
 type TopicPartitionKey struct {
@@ -24,46 +37,90 @@ type TopicPartitionKey struct {
 	PartitionIndex int32
 }
 
-type FilePool struct {
-	// partition index -> file
-	data map[TopicPartitionKey]*os.File
+type PartitionWriter struct {
+	store    SegmentStore
+	filePool *FilePool
+
+	logs map[TopicPartitionKey]*partitionLog
+
+	// the directory holding each partition's segments
+	partitionDirs map[TopicPartitionKey]string
+
+	// used to place partitions across log dirs, overridden in tests.
+	diskFree func(dir string) (uint64, error)
+
+	// closed segments of tiered topics are copied here, nil if tiered
+	// storage is disabled.
+	remote RemoteStorage
 }
 
-// Open creates a new segment
-func (f FilePool) Open(segSize int, fileName string) *os.File {
-	// FIXME(FELIX): /tmp/ dir should be taken from config.
+// NewPartitionWriter returns a PartitionWriter keeping segments in
+// files on disk.
+func NewPartitionWriter() *PartitionWriter {
+	return NewPartitionWriterWithStore(NewFileStore())
+}
 
-	temp, err := os.Create(fileName)
-	if err != nil {
-		panic(err)
+func NewPartitionWriterWithStore(store SegmentStore) *PartitionWriter {
+	return &PartitionWriter{
+		store:         store,
+		filePool:      newFilePool(store),
+		logs:          map[TopicPartitionKey]*partitionLog{},
+		partitionDirs: map[TopicPartitionKey]string{},
+		diskFree:      storeDiskFree(store),
 	}
-	if err = temp.Truncate(int64(segSize)); err != nil {
-		temp.Close()
-		panic(err)
+}
+
+// segmentPath is the path of the file with the given suffix belonging
+// to the segment at baseOffs.
+func (pw *PartitionWriter) segmentPath(key TopicPartitionKey, baseOffs int64, suffix string) string {
+	return filepath.Join(pw.partitionDirs[key], segmentFileName(baseOffs, suffix))
+}
+
+func (pw *PartitionWriter) partitionLog(key TopicPartitionKey) *partitionLog {
+	l, ok := pw.logs[key]
+	if !ok {
+		l = &partitionLog{}
+		pw.logs[key] = l
 	}
-	return temp
-	//return internal.NewMemoryFile(segSize)
+	return l
 }
 
-type PartitionWriter struct {
-	filePool *FilePool
+// Fetch returns the batch containing offset in the given partition,
+// downloading it from remote storage if needed.
+func (pw *PartitionWriter) Fetch(key TopicPartitionKey, offset int64) (*record.Batch, error) {
+	for {
+		batch, err := pw.fetch(key, offset)
+		var miss *remoteMiss
+		if !errors.As(err, &miss) {
+			return batch, err
+		}
+		data, err := pw.downloadRemoteLog(miss.key, miss.rs)
+		if err != nil {
+			return nil, err
+		}
+		pw.cacheRemoteLog(miss.key, miss.rs, data)
+	}
 }
 
-func NewPartitionWriter() *PartitionWriter {
-	return &PartitionWriter{
-		filePool: &FilePool{
-			data: map[TopicPartitionKey]*os.File{},
-		},
+// fetch is Fetch without downloading remote segments, it returns a
+// *remoteMiss instead.
+func (pw *PartitionWriter) fetch(key TopicPartitionKey, offset int64) (*record.Batch, error) {
+	l, ok := pw.logs[key]
+	if !ok {
+		return nil, ErrOffsetOutOfRange
+	}
+	if pw.remote != nil && l.remoteOffset(offset) {
+		return l.readRemote(key, offset)
 	}
+	return l.read(offset)
 }
 
-func (pw *PartitionWriter) loadSegment(key TopicPartitionKey, offs int64) (*os.File, error) {
-	k := fmt.Sprintf("/tmp/krake/%s-%d.%d.log", key.Topic, offs, key.PartitionIndex)
-	file, _ := os.Open(k)
-	return file, nil
+func (pw *PartitionWriter) loadSegment(key TopicPartitionKey, offs int64) (SegmentFile, error) {
+	k := pw.segmentPath(key, offs, logFileSuffix)
+	return pw.store.Open(k)
 }
 
-func (pw *PartitionWriter) ActiveSegment(key TopicPartitionKey) (*os.File, error) {
+func (pw *PartitionWriter) ActiveSegment(key TopicPartitionKey) (SegmentFile, error) {
 	seg, ok := pw.filePool.data[key]
 	if !ok {
 		return nil, errors.New("no such segment")
@@ -72,15 +129,67 @@ func (pw *PartitionWriter) ActiveSegment(key TopicPartitionKey) (*os.File, error
 }
 
 type TopicConfiguration struct {
-	Name            string
-	PartitionCount  int
+	Name           string
+	PartitionCount int
+	// segments whose newest record is older than this are deleted,
+	// zero keeps them forever.
 	RetentionPeriod time.Duration
+	// retention.bytes, the oldest segments of a partition are deleted
+	// while it is larger than this. zero means no limit.
+	RetentionBytes int64
+	// cleanup.policy, a comma separated list of CleanupPolicyDelete and
+	// CleanupPolicyCompact. defaults to delete.
+	CleanupPolicy string
+	// delete.retention.ms, how long a tombstone is kept after it was
+	// written before compaction removes it. defaults to a day.
+	DeleteRetention time.Duration
+	// segment.ms, the active segment is rolled once it is this old
+	// so it can be deleted or compacted. defaults to log.roll.ms.
+	SegmentPeriod time.Duration
+	// remote.storage.enable, closed segments are copied to the remote
+	// storage of the broker. compacted topics are never copied.
+	RemoteStorage bool
+	// local.retention.ms, how long segments copied to remote storage
+	// are kept locally. zero keeps them for the retention period.
+	LocalRetentionPeriod time.Duration
+	// compression.type, the codec batches are written with. one of
+	// CompressionTypeProducer (the default), CompressionTypeUncompressed
+	// or a codec name such as zstd.
+	CompressionType string
+	// message.timestamp.type, CreateTime (the default) to keep the
+	// timestamps set by producers or LogAppendTime to use the time the
+	// broker appends each batch.
+	MessageTimestampType string
+}
+
+const (
+	// batches are written with the codec the producer chose.
+	CompressionTypeProducer = "producer"
+	// batches are written uncompressed.
+	CompressionTypeUncompressed = "uncompressed"
+)
+
+// compression returns the codec a batch compressed with producer by the
+// producer is written with.
+func (cfg TopicConfiguration) compression(producer record.Compression) (record.Compression, error) {
+	switch cfg.CompressionType {
+	case "", CompressionTypeProducer:
+		return producer, nil
+	case CompressionTypeUncompressed:
+		return record.CompressionNone, nil
+	}
+	return record.ParseCompression(cfg.CompressionType)
 }
 
 type ConsumerConfiguration struct {
 	ID                 uint32
 	AssignedPartitions []int32
 	Offsets            map[int32]int
+	IsolationLevel     IsolationLevel
+
+	// GroupID is the consumer group of a member, whose partitions are
+	// assigned by the group coordinator.
+	GroupID string
 }
 
 type KrakeBroker struct {
@@ -88,27 +197,58 @@ type KrakeBroker struct {
 
 	topics map[string]TopicConfiguration
 
-	// used for round-robin partitioning
-	currPartitionIndex int32
+	// picks the partition of each message
+	partitioner Partitioner
 
-	// TODO this should handle consumer groups
+	// consumers by id, including the members of consumer groups.
 	offs map[uint32]ConsumerConfiguration
 
+	// the consumer groups with members and the offsets committed by
+	// each group, loaded on first use.
+	groups       map[string]*consumerGroup
+	groupOffsets map[string]map[TopicPartitionKey]int64
+
 	Config map[string]interface{}
+
+	// now is used to timestamp records, overridden in tests.
+	now func() time.Time
+
+	// guards the topics and partition logs, which are shared with the
+	// retention cleaner.
+	mu sync.Mutex
+
+	retentionStats RetentionStats
+
+	committer *groupCommitter
+
+	// the next producer id to hand out and the end of the block
+	// reserved on disk.
+	nextProducerID  int64
+	producerIDLimit int64
+
+	// the transaction coordinator's state by transactional id, loaded
+	// on first use.
+	transactions map[string]*transaction
 }
 
 func NewKrakeBroker(writeStrategy *PartitionWriter) *KrakeBroker {
 	return &KrakeBroker{
-		PartitionWriter:    writeStrategy,
-		topics:             map[string]TopicConfiguration{},
-		currPartitionIndex: 0,
-		offs:               map[uint32]ConsumerConfiguration{},
+		PartitionWriter: writeStrategy,
+		topics:          map[string]TopicConfiguration{},
+		partitioner:     NewDefaultPartitioner(),
+		offs:            map[uint32]ConsumerConfiguration{},
+		groups:          map[string]*consumerGroup{},
 		// TODO(FELIX): defaults
-		Config: map[string]interface{}{},
+		Config:    map[string]interface{}{},
+		now:       time.Now,
+		committer: newGroupCommitter(),
 	}
 }
 
 func (k *KrakeBroker) Subscribe(topics []string) uint32 {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
 	// TODO(FELIX): multiple topic subscriptions
 	topic := topics[0]
 
@@ -145,167 +285,613 @@ func (k *KrakeBroker) ReadMessage(topic string, consumerId uint32, timeout int)
 
 	// 1. if leader is not avail => err
 	// 2. check cons offs in partition that is not yet consumed
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	var msg *Message
+	err := k.withRemote(func() (err error) {
+		msg, err = k.readMessage(topic, consumerId)
+		return err
+	})
+	return msg, err
+}
+
+// readMessage is ReadMessage with the lock held.
+func (k *KrakeBroker) readMessage(topic string, consumerId uint32) (*Message, error) {
 	consumerCfg, ok := k.offs[consumerId]
 	if !ok {
-		panic("unhandled edgecase")
+		return nil, ErrUnknownConsumer
+	}
+	if consumerCfg.GroupID != "" {
+		return k.readGroupMessage(topic, consumerCfg)
+	}
+
+	// subscribed to a topic that does not exist
+	if len(consumerCfg.AssignedPartitions) == 0 {
+		return nil, ErrNoSuchTopic
 	}
 
 	partitionIndex := consumerCfg.AssignedPartitions[0]
 
 	// TODO handle multiple partitions.
 
-	segment, err := k.ActiveSegment(TopicPartitionKey{topic, partitionIndex})
-	if err != nil {
-		panic(err)
+	offs, ok := consumerCfg.Offsets[partitionIndex]
+	if !ok {
+		panic("unhandled edgecase")
 	}
 
-	// TODO handle loading offset/segment from index.
-	// for now this is technically earliest
+	// TODO: update consumer offs (if ac enable)
+
+	return k.readMessageAt(TopicPartitionKey{topic, partitionIndex}, int64(offs), consumerCfg.IsolationLevel)
+}
 
-	// FIXME we need to encode Record into the file
-	// Record should contain the length
+// readMessageAt returns the first message at or after offset a consumer
+// with the isolation level sees.
+func (k *KrakeBroker) readMessageAt(key TopicPartitionKey, offset int64, level IsolationLevel) (*Message, error) {
+	for {
+		batch, err := k.fetchVisible(key, offset, level)
+		if err != nil {
+			return nil, err
+		}
 
-	offs, ok := consumerCfg.Offsets[partitionIndex]
-	if !ok {
-		panic("unhandled edgecase")
+		// compaction may have removed records from the batch and markers
+		// may have been skipped, so take the first one at or after the
+		// offset. if compaction removed all of them the next batch is
+		// read instead.
+		for _, rec := range batch.Records {
+			if batch.BaseOffset+int64(rec.OffsetDelta) < offset {
+				continue
+			}
+			log.Println("read", string(rec.Value))
+
+			return &Message{
+				Key:           rec.Key,
+				Message:       rec.Value,
+				Headers:       rec.Headers,
+				Timestamp:     time.UnixMilli(batch.Timestamp(&rec)),
+				TimestampType: batch.TimestampType(),
+				Compression:   batch.Compression(),
+				Partition:     key.PartitionIndex,
+				Offset:        batch.BaseOffset + int64(rec.OffsetDelta),
+			}, nil
+		}
+		offset = batch.NextOffset()
 	}
+}
 
-	buf := make([]byte, 123)
-	n, err := segment.ReadAt(buf, int64(offs))
-	if err != nil && err != io.EOF {
-		panic(err)
+// fetchVisible returns the first batch at or after offset a consumer
+// with the isolation level sees. Markers are never seen,
+// read_committed consumers do not see aborted transactions or read past
+// the last stable offset.
+func (k *KrakeBroker) fetchVisible(key TopicPartitionKey, offset int64, level IsolationLevel) (*record.Batch, error) {
+	for {
+		if l, ok := k.logs[key]; ok && level == ReadCommitted && offset >= l.lastStableOffset() {
+			return nil, ErrOffsetOutOfRange
+		}
+		batch, err := k.fetch(key, offset)
+		if err != nil {
+			return nil, err
+		}
+		if !batch.IsControl() && !(level == ReadCommitted && k.logs[key].aborted(batch)) {
+			return batch, nil
+		}
+		offset = batch.NextOffset()
 	}
+}
 
-	log.Println("read", string(buf[:n]))
+// OffsetsForTimes returns the earliest offset in the partition whose
+// timestamp is at or after ts. If no such record exists -1 is returned.
+func (k *KrakeBroker) OffsetsForTimes(topic string, partition int32, ts time.Time) (int64, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	var offset int64
+	err := k.withRemote(func() (err error) {
+		offset, err = k.offsetsForTimes(topic, partition, ts)
+		return err
+	})
+	return offset, err
+}
 
-	// TODO: update consumer offs (if ac enable)
+// offsetsForTimes is OffsetsForTimes with the lock held.
+func (k *KrakeBroker) offsetsForTimes(topic string, partition int32, ts time.Time) (int64, error) {
+	topicCfg, ok := k.topics[topic]
+	if !ok {
+		return -1, ErrNoSuchTopic
+	}
+	if partition < 0 || int(partition) >= topicCfg.PartitionCount {
+		return -1, fmt.Errorf("%w: %s-%d", ErrUnknownPartition, topic, partition)
+	}
 
-	return &Message{
-		Key:     nil,
-		Message: buf[:n],
-	}, nil
+	key := TopicPartitionKey{topic, partition}
+	l, ok := k.logs[key]
+	if !ok {
+		return -1, nil
+	}
+	return l.offsetForTimestamp(key, ts.UnixMilli())
 }
 
 func (k *KrakeBroker) Configure(m map[string]interface{}) {
 	// FIXME(FELIX): overwrite configurations with the values
 	// or append?
 	k.Config = m
-}
-
-func (k *KrakeBroker) partitionIndex(key []byte, partitionCount int) int32 {
-	if len(key) == 0 {
-		curr := k.currPartitionIndex
-		k.currPartitionIndex++
-		if k.currPartitionIndex >= int32(partitionCount) {
-			k.currPartitionIndex = 0
-		}
-		return curr
+	if v, ok := m["log.open.files.max"].(int); ok {
+		k.filePool.maxOpen = v
 	}
-
-	hash := fnv.New32a()
-	_, err := hash.Write(key)
-	if err != nil {
-		log.Println("failed to compute partition index")
-		return -1
-	}
-	return int32(hash.Sum32())
 }
 
 var (
 	ErrWriteFailed        = errors.New("failed to write bytes")
 	ErrTopicAlreadyExists = errors.New("topic already exists")
 	ErrNoSuchTopic        = errors.New("no such topic")
+	ErrUnknownConsumer    = errors.New("unknown consumer")
+	ErrUnknownPartition   = errors.New("unknown partition")
+	ErrInvalidPartitions  = errors.New("invalid number of partitions")
 )
 
-func (k *KrakeBroker) Produce(topic string, msg *Message) error {
-	topicCfg, ok := k.topics[topic]
-	if !ok {
-		return ErrNoSuchTopic
+// RecordMetadata describes where a produced record was written.
+type RecordMetadata struct {
+	Partition int32
+	Offset    int64
+}
+
+// ProduceResult is where a message of a batch was written, or why it
+// was not.
+type ProduceResult struct {
+	RecordMetadata
+	Err error
+}
+
+func (k *KrakeBroker) Produce(topic string, msg *Message) (RecordMetadata, error) {
+	results, err := k.ProduceBatch(topic, []*Message{msg}, ProduceOptions{})
+	if err != nil {
+		return RecordMetadata{}, err
+	}
+	return results[0].RecordMetadata, results[0].Err
+}
+
+// ProduceBatch appends msgs to the topic with a single batch, and a
+// single write, per partition. The batches are compressed with
+// opts.Compression. The results are in
+// the order of msgs, a message fails on its own if its partition does
+// not exist or the write to its partition fails.
+//
+// It returns once the batches are as durable as opts.Acks asks, or
+// fails with ErrRequestTimeout if that takes longer than the timeout.
+// The batches may still be written after a timeout. With AcksNone the
+// offsets are not known and are -1.
+func (k *KrakeBroker) ProduceBatch(topic string, msgs []*Message, opts ProduceOptions) ([]ProduceResult, error) {
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = k.requestTimeout()
 	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
 
-	partitionIdx := k.partitionIndex(msg.Key, topicCfg.PartitionCount)
-	log.Println("partition index", partitionIdx)
+	type produced struct {
+		results []ProduceResult
+		err     error
+	}
+	done := make(chan produced, 1)
+	go func() {
+		results, err := k.produceBatch(topic, msgs, opts)
+		done <- produced{results, err}
+	}()
+
+	select {
+	case p := <-done:
+		return p.results, p.err
+	case <-timer.C:
+		return nil, fmt.Errorf("%w after %v", ErrRequestTimeout, timeout)
+	}
+}
 
-	if partitionIdx == -1 {
-		panic("unhandled error")
+func (k *KrakeBroker) produceBatch(topic string, msgs []*Message, opts ProduceOptions) ([]ProduceResult, error) {
+	results, flushes, err := k.produce(topic, msgs, opts)
+	if err != nil {
+		return nil, err
 	}
 
-	segSize, ok := k.Config["log.segment.bytes"].(int)
+	if opts.Acks == AcksNone {
+		// nobody waits for the flush or the offsets.
+		go func() {
+			for _, err := range k.syncFlushes(flushes) {
+				log.Println("failed to flush log", err)
+			}
+		}()
+		for i := range results {
+			results[i].Offset = -1
+		}
+		return results, nil
+	}
+
+	for partition, err := range k.syncFlushes(flushes) {
+		for i := range results {
+			if results[i].Partition == partition && results[i].Err == nil {
+				results[i].Err = err
+			}
+		}
+	}
+	return results, nil
+}
+
+// syncFlushes waits for the group commit of each file, returning the
+// partitions that failed. It is called without holding the lock so
+// other producers can join the commits.
+func (k *KrakeBroker) syncFlushes(flushes map[int32]SegmentFile) map[int32]error {
+	errs := map[int32]error{}
+	for partition, flush := range flushes {
+		if err := k.committer.sync(flush); err != nil {
+			errs[partition] = err
+		}
+	}
+	return errs
+}
+
+// produce appends msgs to the partitions of the topic. If the flush
+// policy or acks require a group commit the files to sync are returned
+// by partition.
+func (k *KrakeBroker) produce(topic string, msgs []*Message, opts ProduceOptions) ([]ProduceResult, map[int32]SegmentFile, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	topicCfg, ok := k.topics[topic]
 	if !ok {
-		segSize = 1_000_000 // 1MiB
+		return nil, nil, ErrNoSuchTopic
+	}
+	if err := opts.Compression.Validate(); err != nil {
+		return nil, nil, err
+	}
+	if opts.Producer.idempotent() {
+		if err := k.checkProducerID(opts.Producer); err != nil {
+			return nil, nil, err
+		}
+	}
+	var txn *transaction
+	if opts.TransactionalID != "" {
+		var err error
+		if txn, err = k.ongoingTransaction(opts.TransactionalID, opts.Producer); err != nil {
+			return nil, nil, err
+		}
 	}
 
-	toWrite := len(msg.Message)
-	for toWrite != 0 {
-		// for now this only handles writing to the latest segment in the partition
+	// group the messages by partition, keeping their order.
+	results := make([]ProduceResult, len(msgs))
+	var partitions []int32
+	groups := map[int32][]*Message{}
+	for i, msg := range msgs {
+		partition, err := k.partitionFor(topic, topicCfg, msg)
+		results[i].Partition = partition
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+		if _, ok := groups[partition]; !ok {
+			partitions = append(partitions, partition)
+		}
+		groups[partition] = append(groups[partition], msg)
+	}
+
+	flushes := map[int32]SegmentFile{}
+	for _, partition := range partitions {
 		key := TopicPartitionKey{
 			Topic:          topic,
-			PartitionIndex: partitionIdx,
+			PartitionIndex: partition,
+		}
+		var offset int64
+		var flush SegmentFile
+		var err error
+		if txn != nil && !txn.includes(key) {
+			err = fmt.Errorf("%w: partition %d of %s was not added to the transaction", ErrInvalidTxnState, partition, topic)
+		} else {
+			offset, flush, err = k.appendMessages(key, groups[partition], opts)
+		}
+		if flush != nil {
+			flushes[partition] = flush
 		}
 
-		// cases:
-		// 1. active segment is nul because we've just started the app
-		// if so we have to find it.
-		// 2. we have no active segment at all
-		seg, err := k.ActiveSegment(key)
-		if err != nil {
-			baseOffs := 0 // for case 1 this changes.
-			seg = k.openNewSegment(segSize, baseOffs, key)
+		for i := range results {
+			if results[i].Partition != partition || results[i].Err != nil {
+				continue
+			}
+			if err != nil {
+				results[i].Err = err
+				continue
+			}
+			results[i].Offset = offset
+			offset++
 		}
+	}
+	return results, flushes, nil
+}
+
+// partitionFor returns the partition the producer asked for, or the
+// one picked by the partitioner.
+func (k *KrakeBroker) partitionFor(topic string, topicCfg TopicConfiguration, msg *Message) (int32, error) {
+	if msg.TargetPartition == nil {
+		partition := k.partitioner.Partition(topic, msg, topicCfg.PartitionCount)
+		log.Println("partition index", partition)
+		return partition, nil
+	}
 
-		// calc remaining space
-		fileInfo, err := seg.Stat()
+	partition := *msg.TargetPartition
+	if partition < 0 || int(partition) >= topicCfg.PartitionCount {
+		return partition, fmt.Errorf("%w: %s-%d", ErrUnknownPartition, topic, partition)
+	}
+	return partition, nil
+}
+
+// appendMessages writes msgs to the partition as a single batch and
+// applies the flush policy. It returns the offset of the first message.
+func (k *KrakeBroker) appendMessages(key TopicPartitionKey, msgs []*Message, opts ProduceOptions) (int64, SegmentFile, error) {
+	if opts.Producer.idempotent() {
+		offset, duplicate, err := k.checkProducerBatch(key, opts.Producer, msgs)
 		if err != nil {
-			panic(err)
+			return 0, nil, err
 		}
+		if duplicate {
+			// the retry is acknowledged like the original batch.
+			if opts.Acks == AcksAll {
+				return offset, k.logs[key].activeSegment().log, nil
+			}
+			return offset, nil, nil
+		}
+	}
 
-		currentPosition, err := seg.Seek(0, io.SeekCurrent)
-		if err != nil {
-			fmt.Println("Error getting current position in file:", err)
+	now := k.now()
+	records := make([]record.Record, len(msgs))
+	timestamps := make([]int64, len(msgs))
+	for i, msg := range msgs {
+		records[i] = record.Record{
+			Key:     msg.Key,
+			Value:   msg.Message,
+			Headers: msg.Headers,
+		}
+		timestamp := now
+		if !msg.Timestamp.IsZero() {
+			timestamp = msg.Timestamp
 		}
+		timestamps[i] = timestamp.UnixMilli()
+	}
+
+	batch := record.NewBatch(0, timestamps[0], records...)
+	batch.SetTimestamps(timestamps)
+	batch.SetCompression(opts.Compression)
+	if opts.Producer.idempotent() {
+		batch.ProducerID = opts.Producer.ID
+		batch.ProducerEpoch = opts.Producer.Epoch
+		batch.BaseSequence = msgs[0].Sequence
+	}
+	if opts.TransactionalID != "" {
+		batch.SetTransactional()
+	}
+	offset, err := k.append(key, batch)
+	if err != nil {
+		return 0, nil, err
+	}
 
-		bytesLeft := fileInfo.Size() - currentPosition
+	flush, err := k.flushAfterAppend(key, len(msgs), opts.Acks)
+	if err != nil {
+		return 0, nil, err
+	}
+	return offset, flush, nil
+}
 
-		log.Println(toWrite, "...", bytesLeft)
+// flushAfterAppend applies the flush policy once n messages have been
+// appended to the partition. The active segment is synced straight
+// away unless group commit is enabled, in which case it is returned
+// for the caller to sync once the lock is released. With acks=all it is
+// always returned.
+func (k *KrakeBroker) flushAfterAppend(key TopicPartitionKey, n int, acks Acks) (SegmentFile, error) {
+	if acks == AcksAll {
+		// every in-sync replica must have the batch on disk and we are
+		// the only one.
+		l := k.logs[key]
+		l.markFlushed(k.now())
+		return l.activeSegment().log, nil
+	}
 
-		if int64(toWrite) >= bytesLeft {
-			// FIXME kafka will write to a segment
-			// until we exceed the maximum file size for an OS
-			// we don't allow for messages over than 1MB so this should be fine
-			// and an edge case that is not often encountered. that said
-			// we should consider a safeguard for this.
-			writtenBytes, err := seg.Write(msg.Message)
-			if err != nil {
-				panic(err)
-			}
-			toWrite -= writtenBytes
+	cfg := k.flushConfig()
+	if !cfg.enabled() {
+		return nil, nil
+	}
 
-			seg.Close()
+	l := k.logs[key]
+	now := k.now()
+	if l.lastFlush.IsZero() {
+		l.lastFlush = now
+	}
+	l.unflushed += n
+	if !l.flushDue(cfg, now) {
+		return nil, nil
+	}
 
-			// FIXME baseOffs is wrong here
-			seg = k.openNewSegment(segSize, writtenBytes, key)
-		} else {
-			log.Println("plenty of space writing whole thang")
-			seg.Write(msg.Message)
-			toWrite -= len(msg.Message)
+	f := l.activeSegment().log
+	l.markFlushed(now)
+	if cfg.groupCommit {
+		return f, nil
+	}
+	return nil, f.Sync()
+}
+
+// append writes a batch from a producer to the partition at the log
+// end offset, rolling the active segment if it is full. The batch is
+// recompressed and given the log append time as the topic is
+// configured. It returns the offset of the first record.
+func (k *KrakeBroker) append(key TopicPartitionKey, batch *record.Batch) (int64, error) {
+	cfg := k.segmentConfig()
+	pl := k.partitionLog(key)
+	topicCfg := k.topics[key.Topic]
+
+	codec, err := topicCfg.compression(batch.Compression())
+	if err != nil {
+		return 0, err
+	}
+	timestampType, err := record.ParseTimestampType(topicCfg.MessageTimestampType)
+	if err != nil {
+		return 0, err
+	}
+	batch.BaseOffset = pl.nextOffset
+	batch.SetCompression(codec)
+	if timestampType == record.LogAppendTime {
+		batch.SetLogAppendTime(k.now().UnixMilli())
+	}
+	data := batch.Encode()
+
+	// cases:
+	// 1. active segment is nul because we've just started the app
+	// if so we have to find it.
+	// 2. we have no active segment at all
+	seg, err := k.ActiveSegment(key)
+	if err != nil {
+		// case 1 is handled by LoadLogs on startup.
+		seg = k.openNewSegment(cfg.segmentBytes, key)
+	}
+
+	// the log is preallocated so the write position is the end of the
+	// last batch rather than the end of the file.
+	active := pl.activeSegment()
+	position := active.size
+	bytesLeft := int64(cfg.segmentBytes) - position
+
+	log.Println(len(data), "...", bytesLeft)
+
+	// roll when the batch does not fit or the segment is older than
+	// segment.ms. a batch is always written to an empty segment.
+	// FIXME kafka will write to a segment
+	// until we exceed the maximum file size for an OS
+	// we don't allow for messages over than 1MB so this should be fine
+	// and an edge case that is not often encountered. that said
+	// we should consider a safeguard for this.
+	rollPeriod := cfg.rollPeriod
+	if topicCfg.SegmentPeriod > 0 {
+		rollPeriod = topicCfg.SegmentPeriod
+	}
+	if position > 0 && (int64(len(data)) > bytesLeft || active.indexFull() || active.expired(batch.MaxTimestamp, rollPeriod)) {
+		if err = active.roll(); err != nil {
+			return 0, err
 		}
+		if err = k.writeProducerSnapshot(key, pl); err != nil {
+			return 0, err
+		}
+
+		// the new segment is named after the first offset it contains.
+		seg = k.openNewSegment(cfg.segmentBytes, key)
+		k.filePool.track(active)
+		active = pl.activeSegment()
+		position = 0
 	}
 
-	return nil
+	if _, err = seg.WriteAt(data, position); err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrWriteFailed, err)
+	}
+
+	if err = active.append(batch, position, cfg.indexInterval); err != nil {
+		return 0, err
+	}
+	pl.nextOffset = batch.NextOffset()
+	pl.appendProducerBatch(batch)
+	if err = pl.appendTxnBatch(batch); err != nil {
+		return 0, err
+	}
+
+	return batch.BaseOffset, nil
+}
+
+// segmentConfig collects the settings used when writing segments.
+func (k *KrakeBroker) segmentConfig() segmentConfig {
+	cfg := segmentConfig{
+		segmentBytes:  1_000_000, // 1MiB
+		indexInterval: 4096,
+		maxIndexSize:  10 * 1024 * 1024, // 10MiB
+		rollPeriod:    7 * 24 * time.Hour,
+	}
+	if v, ok := k.Config["log.segment.bytes"].(int); ok {
+		cfg.segmentBytes = v
+	}
+	if v, ok := k.Config["index.interval.bytes"].(int); ok {
+		cfg.indexInterval = v
+	}
+	if v, ok := k.Config["log.index.size.max.bytes"].(int); ok {
+		cfg.maxIndexSize = v
+	}
+	if v, ok := k.Config["log.roll.ms"].(int); ok {
+		cfg.rollPeriod = time.Duration(v) * time.Millisecond
+	}
+	return cfg
 }
 
-func (k *KrakeBroker) openNewSegment(segSize int, baseOffs int, key TopicPartitionKey) *os.File {
-	path := fmt.Sprintf("/tmp/krake/%s-%d.%d.log", key.Topic, baseOffs, key.PartitionIndex)
+// openNewSegment creates a segment starting at the next offset of the
+// partition and makes it the active segment.
+func (k *KrakeBroker) openNewSegment(segSize int, key TopicPartitionKey) SegmentFile {
+	if err := k.createPartitionDir(key, k.logDirs(), k.topics[key.Topic]); err != nil {
+		panic(err)
+	}
+
+	pl := k.partitionLog(key)
+	baseOffs := pl.nextOffset
+
+	path := k.segmentPath(key, baseOffs, logFileSuffix)
 	log.Println("opening a new segment file", path)
 	f := k.filePool.Open(segSize, path)
 	k.filePool.data[key] = f
+
+	cfg := k.segmentConfig()
+
+	// the log was just created so any index left behind for it is stale.
+	indexPath := k.segmentPath(key, baseOffs, indexFileSuffix)
+	timeIndexPath := k.segmentPath(key, baseOffs, timeIndexFileSuffix)
+	for _, p := range []string{indexPath, timeIndexPath} {
+		if err := k.store.Remove(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+			panic(err)
+		}
+	}
+
+	index, err := openOffsetIndex(k.store, indexPath, baseOffs, cfg.maxIndexSize)
+	if err != nil {
+		panic(err)
+	}
+	timeIndex, err := openTimeIndex(k.store, timeIndexPath, baseOffs, cfg.maxIndexSize)
+	if err != nil {
+		panic(err)
+	}
+
+	pl.segments = append(pl.segments, &segment{
+		baseOffset:       baseOffs,
+		store:            k.store,
+		path:             path,
+		log:              f,
+		index:            index,
+		timeIndex:        timeIndex,
+		maxTimestamp:     -1,
+		rollingTimestamp: -1,
+	})
 	return f
 }
 
 func (k *KrakeBroker) CreateTopic(cfg TopicConfiguration) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
 	if _, ok := k.topics[cfg.Name]; ok {
 		return ErrTopicAlreadyExists
 	}
+	// partitioners pick a partition modulo the partition count.
+	if cfg.PartitionCount < 1 {
+		return fmt.Errorf("%w: %d", ErrInvalidPartitions, cfg.PartitionCount)
+	}
+	if _, err := cfg.compression(record.CompressionNone); err != nil {
+		return err
+	}
+	if _, err := record.ParseTimestampType(cfg.MessageTimestampType); err != nil {
+		return err
+	}
+	for i := 0; i < cfg.PartitionCount; i++ {
+		key := TopicPartitionKey{cfg.Name, int32(i)}
+		if err := k.createPartitionDir(key, k.logDirs(), cfg); err != nil {
+			return err
+		}
+	}
 	k.topics[cfg.Name] = cfg
 	return nil
 }
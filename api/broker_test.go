@@ -1,9 +1,12 @@
 package api
 
 import (
+	"errors"
 	"fmt"
+	"github.com/krake-labs/krake/api/record"
 	"github.com/stretchr/testify/assert"
 	"io"
+	"math"
 	"testing"
 	"time"
 )
@@ -14,17 +17,58 @@ import (
 // Unsubscribe() => unsub from a topic
 // Pause() => stop consumption
 
+// memoryLogDir is the log dir of brokers using a MemoryStore.
+const memoryLogDir = "/var/lib/krake"
+
 func newInMemoryBroker() (*PartitionWriter, Broker) {
 	// given a broker with an in memory write strategy
-	pw := NewPartitionWriter()
+	pw := NewPartitionWriterWithStore(NewMemoryStore())
 	b := NewKrakeBroker(pw)
 	b.Configure(map[string]interface{}{
-		"log.dirs":          "/tmp/",
+		"log.dirs":          memoryLogDir,
 		"log.segment.bytes": 100,
 	})
 	return pw, b
 }
 
+// myTopic is the topic of tests that only need one partition.
+var myTopic = TopicConfiguration{Name: "my-topic", PartitionCount: 1}
+
+// newTestBroker returns a broker configured with cfg, which may be nil,
+// and the given topics. The logs are kept in a MemoryStore unless cfg
+// sets log.dirs. The clock of the broker stands still until the test
+// moves the returned time.
+func newTestBroker(t testing.TB, cfg map[string]interface{}, topics ...TopicConfiguration) (*KrakeBroker, *time.Time) {
+	pw := NewPartitionWriterWithStore(NewMemoryStore())
+	config := map[string]interface{}{
+		"log.dirs": memoryLogDir,
+		// indexes are preallocated in memory
+		"log.index.size.max.bytes": 4096,
+	}
+	if _, ok := cfg["log.dirs"]; ok {
+		pw = NewPartitionWriter()
+		config = map[string]interface{}{}
+	}
+	for k, v := range cfg {
+		config[k] = v
+	}
+	b := NewKrakeBroker(pw)
+	b.Configure(config)
+	t.Cleanup(func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		pw.Close()
+	})
+
+	now := time.Date(2023, 5, 1, 9, 0, 0, 0, time.UTC)
+	b.now = func() time.Time { return now }
+
+	for _, topic := range topics {
+		assert.NoError(t, b.CreateTopic(topic))
+	}
+	return b, &now
+}
+
 // TODO consume from offset
 
 // TODO consume from offset (in a different segment)
@@ -50,7 +94,7 @@ func TestKrakeBroker_Consume_Consume(t *testing.T) {
 		RetentionPeriod: 2 * time.Hour,
 	})
 
-	b.Produce("my-fancy-topic", &Message{nil, []byte("hello world")})
+	b.Produce("my-fancy-topic", &Message{Message: []byte("hello world")})
 
 	consumerId := b.Subscribe([]string{"my-fancy-topic"})
 
@@ -64,19 +108,146 @@ func TestKrakeBroker_Produce_MultipleSegments(t *testing.T) {
 
 	SegmentSizeInBytes := 2
 	b.Configure(map[string]interface{}{
-		"log.dirs":          "/tmp/",
+		"log.dirs":          memoryLogDir,
 		"log.segment.bytes": SegmentSizeInBytes,
 	})
 
-	b.CreateTopic(TopicConfiguration{Name: "my-topic"})
+	b.CreateTopic(TopicConfiguration{Name: "my-topic", PartitionCount: 1})
+
+	values := []string{"swag", "yolo", "bling"}
+	for i, value := range values {
+		md, err := b.Produce("my-topic", &Message{Message: []byte(value)})
+		assert.NoError(t, err)
+		assert.Equal(t, int64(i), md.Offset)
+	}
+
+	key := TopicPartitionKey{"my-topic", 0}
+
+	// every batch overflows the segment so each gets its own, named
+	// after the offset of the batch.
+	assert.Len(t, pw.logs[key].segments, len(values))
+	for i, value := range values {
+		assert.Equal(t, int64(i), pw.logs[key].segments[i].baseOffset)
+
+		seg, _ := pw.loadSegment(key, int64(i))
+		assert.Equal(t, []string{value}, segmentValues(t, seg))
+	}
+}
+
+func TestKrakeBroker_Produce_AssignsOffsets(t *testing.T) {
+	pw, b := newInMemoryBroker()
+	b.Configure(map[string]interface{}{
+		"log.dirs":             memoryLogDir,
+		"log.segment.bytes":    500,
+		"index.interval.bytes": 100,
+	})
+
+	b.CreateTopic(TopicConfiguration{Name: "my-topic", PartitionCount: 2})
 
-	b.Produce("my-topic", &Message{nil, []byte("swag")})
+	// offsets are consecutive within each partition
+	for i := 0; i < 40; i++ {
+		md, err := b.Produce("my-topic", &Message{Message: []byte(fmt.Sprintf("message: %d", i))})
+		assert.NoError(t, err)
+		assert.Equal(t, int32(i%2), md.Partition)
+		assert.Equal(t, int64(i/2), md.Offset)
+	}
+
+	for p := int32(0); p < 2; p++ {
+		key := TopicPartitionKey{"my-topic", p}
+		l := pw.logs[key]
+		assert.Equal(t, int64(20), l.nextOffset)
+		assert.Greater(t, len(l.segments), 1)
+
+		// each segment starts where the previous one ended
+		next := int64(0)
+		for _, seg := range l.segments {
+			assert.Equal(t, next, seg.baseOffset)
+			_, err := pw.store.Stat(pw.segmentPath(key, seg.baseOffset, logFileSuffix))
+			assert.NoError(t, err)
+
+			f, _ := pw.loadSegment(key, seg.baseOffset)
+			next += int64(len(segmentValues(t, f)))
+			f.Close()
+		}
+		assert.Equal(t, l.nextOffset, next)
+
+		// and every offset can be fetched across segments
+		for offs := int64(0); offs < 20; offs++ {
+			batch, err := pw.Fetch(key, offs)
+			assert.NoError(t, err)
+			assert.Equal(t, offs, batch.BaseOffset)
+			assert.Equal(t, fmt.Sprintf("message: %d", offs*2+int64(p)), string(batch.Records[0].Value))
+		}
+	}
+}
+
+func TestKrakeBroker_Fetch_AnyOffset(t *testing.T) {
+	pw, b := newInMemoryBroker()
+	b.Configure(map[string]interface{}{
+		"log.dirs":             memoryLogDir,
+		"log.segment.bytes":    10_000,
+		"index.interval.bytes": 100,
+	})
+
+	b.CreateTopic(TopicConfiguration{Name: "my-topic", PartitionCount: 1})
+
+	for i := 0; i < 50; i++ {
+		_, err := b.Produce("my-topic", &Message{Message: []byte(fmt.Sprintf("message: %d", i))})
+		assert.NoError(t, err)
+	}
 
 	key := TopicPartitionKey{"my-topic", 0}
+	assert.Greater(t, pw.logs[key].activeSegment().index.entries, 1)
+
+	for i := 49; i >= 0; i-- {
+		batch, err := pw.Fetch(key, int64(i))
+		assert.NoError(t, err)
+		assert.Equal(t, int64(i), batch.BaseOffset)
+		assert.Equal(t, fmt.Sprintf("message: %d", i), string(batch.Records[0].Value))
+	}
+
+	_, err := pw.Fetch(key, 50)
+	assert.ErrorIs(t, err, ErrOffsetOutOfRange)
+}
+
+func TestKrakeBroker_OffsetsForTimes(t *testing.T) {
+	b, now := newTestBroker(t, map[string]interface{}{
+		"log.segment.bytes":    10_000,
+		"index.interval.bytes": 100,
+	}, myTopic)
+	start := *now
+
+	// one message a minute
+	for i := 0; i < 60; i++ {
+		*now = start.Add(time.Duration(i) * time.Minute)
+		_, err := b.Produce("my-topic", &Message{Message: []byte(fmt.Sprintf("message: %d", i))})
+		assert.NoError(t, err)
+	}
+	assert.Greater(t, b.logs[TopicPartitionKey{"my-topic", 0}].activeSegment().timeIndex.entries, 1)
+
+	offs, err := b.OffsetsForTimes("my-topic", 0, start.Add(-time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), offs)
+
+	for i := 0; i < 60; i++ {
+		offs, err = b.OffsetsForTimes("my-topic", 0, start.Add(time.Duration(i)*time.Minute))
+		assert.NoError(t, err)
+		assert.Equal(t, int64(i), offs)
+	}
+
+	// rounds up to the next record
+	offs, err = b.OffsetsForTimes("my-topic", 0, start.Add(90*time.Second))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), offs)
 
-	seg, _ := pw.loadSegment(key, 0)
-	data, _ := io.ReadAll(seg)
-	assert.Equal(t, "swag", string(data))
+	offs, err = b.OffsetsForTimes("my-topic", 0, start.Add(2*time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(-1), offs)
+
+	_, err = b.OffsetsForTimes("no-topic", 0, start)
+	assert.ErrorIs(t, err, ErrNoSuchTopic)
+	_, err = b.OffsetsForTimes("my-topic", 1, start)
+	assert.ErrorIs(t, err, ErrUnknownPartition)
 }
 
 // blobStartsWith is a helper util to only check the given string is
@@ -85,6 +256,26 @@ func blobStartsWith(t *testing.T, expected string, blob []byte) {
 	assert.Equal(t, expected, string(blob[:len(expected)]))
 }
 
+// segmentValues decodes every batch in the segment and returns
+// the record values in order.
+func segmentValues(t *testing.T, seg io.ReaderAt) []string {
+	r := io.NewSectionReader(seg, 0, math.MaxInt64)
+	var values []string
+	for {
+		batch, err := record.ReadBatch(r)
+		// segments are preallocated so the tail is zeroed.
+		if errors.Is(err, io.EOF) || errors.Is(err, record.ErrCorruptBatch) {
+			return values
+		}
+		if !assert.NoError(t, err) {
+			return values
+		}
+		for _, r := range batch.Records {
+			values = append(values, string(r.Value))
+		}
+	}
+}
+
 func TestKrakeBroker_Produce_PartitionIndexingWrapAround(t *testing.T) {
 	// ensures that the functionality for round robin partition
 	// keying wraps around to 0
@@ -96,17 +287,23 @@ func TestKrakeBroker_Produce_PartitionIndexingWrapAround(t *testing.T) {
 		RetentionPeriod: 0,
 	})
 
-	b.Produce("my-topic", &Message{nil, []byte("hello")})
-	b.Produce("my-topic", &Message{nil, []byte("world")})
-	b.Produce("my-topic", &Message{nil, []byte("my")})
+	var partitions []int32
+	for _, value := range []string{"hello", "world", "my"} {
+		md, err := b.Produce("my-topic", &Message{Message: []byte(value)})
+		assert.NoError(t, err)
+		partitions = append(partitions, md.Partition)
+	}
+	assert.Equal(t, []int32{0, 1, 0}, partitions)
 
+	// "my" does not fit in the first segment so it is rolled.
 	segment, _ := pw.loadSegment(TopicPartitionKey{"my-topic", 0}, 0)
-	data, _ := io.ReadAll(segment)
-	blobStartsWith(t, "hellomy", data)
+	assert.Equal(t, []string{"hello"}, segmentValues(t, segment))
+
+	segment, _ = pw.loadSegment(TopicPartitionKey{"my-topic", 0}, 1)
+	assert.Equal(t, []string{"my"}, segmentValues(t, segment))
 
 	segment, _ = pw.loadSegment(TopicPartitionKey{"my-topic", 1}, 0)
-	data, _ = io.ReadAll(segment)
-	blobStartsWith(t, "world", data)
+	assert.Equal(t, []string{"world"}, segmentValues(t, segment))
 }
 
 func TestKrakeBroker_Produce_MultipleTopics(t *testing.T) {
@@ -143,16 +340,13 @@ func TestKrakeBroker_Produce_MultipleTopics(t *testing.T) {
 
 	// assumes the active segment contains our writes
 	segment, _ := pw.loadSegment(TopicPartitionKey{"topic-a", 0}, 0)
-	data, _ := io.ReadAll(segment)
-	blobStartsWith(t, "hello", data)
+	assert.Equal(t, []string{"hello"}, segmentValues(t, segment))
 
 	segment, _ = pw.loadSegment(TopicPartitionKey{"topic-a", 1}, 0)
-	data, _ = io.ReadAll(segment)
-	blobStartsWith(t, "world", data)
+	assert.Equal(t, []string{"world"}, segmentValues(t, segment))
 
 	segment, _ = pw.loadSegment(TopicPartitionKey{"topic-b", 0}, 0)
-	data, _ = io.ReadAll(segment)
-	blobStartsWith(t, "world", data)
+	assert.Equal(t, []string{"world"}, segmentValues(t, segment))
 }
 
 func TestKrakeBroker_Produce_MemoryLayout(t *testing.T) {
@@ -170,7 +364,7 @@ func TestKrakeBroker_Produce_MemoryLayout(t *testing.T) {
 
 	// when i produce {PartitionCount} messages
 	for i := 0; i < PartitionCount; i++ {
-		err = b.Produce("my-topic", &Message{
+		_, err = b.Produce("my-topic", &Message{
 			Key:     nil,
 			Message: []byte(fmt.Sprintf("message: %d", i)),
 		})
@@ -181,10 +375,9 @@ func TestKrakeBroker_Produce_MemoryLayout(t *testing.T) {
 	for i := 0; i < PartitionCount; i++ {
 		seg, _ :=
 			pw.loadSegment(TopicPartitionKey{"my-topic", int32(i)}, 0)
-		data, _ := io.ReadAll(seg)
 
 		msg := fmt.Sprintf("message: %d", i)
-		blobStartsWith(t, msg, data)
+		assert.Equal(t, []string{msg}, segmentValues(t, seg))
 	}
 }
 
@@ -220,6 +413,19 @@ func TestKrakeBroker_CreateTopic(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestKrakeBroker_CreateTopic_InvalidPartitionCount(t *testing.T) {
+	_, b := newInMemoryBroker()
+
+	for _, count := range []int{0, -1} {
+		err := b.CreateTopic(TopicConfiguration{Name: "my-topic", PartitionCount: count})
+		assert.ErrorIs(t, err, ErrInvalidPartitions)
+	}
+
+	// the topic was not created
+	_, err := b.Produce("my-topic", &Message{Key: []byte("key"), Message: []byte("foo")})
+	assert.ErrorIs(t, err, ErrNoSuchTopic)
+}
+
 func TestKrakeBroker_Produce(t *testing.T) {
 	pw, b := newInMemoryBroker()
 
@@ -235,15 +441,13 @@ func TestKrakeBroker_Produce(t *testing.T) {
 	}
 
 	// when i produce a message to the broker
-	err := b.Produce("my-topic", &msg)
+	_, err := b.Produce("my-topic", &msg)
 
 	// the message is stored to disk
 	assert.NoError(t, err)
 
 	seg, _ := pw.loadSegment(TopicPartitionKey{"my-topic", 0}, 0)
-	data, err := io.ReadAll(seg)
-	assert.NoError(t, err)
-	blobStartsWith(t, "foo", data)
+	assert.Equal(t, []string{"foo"}, segmentValues(t, seg))
 }
 
 func TestKrakeBroker_Produce_NoTopicExists(t *testing.T) {
@@ -255,7 +459,7 @@ func TestKrakeBroker_Produce_NoTopicExists(t *testing.T) {
 	}
 
 	// when i produce a message to the broker
-	err := b.Produce("my-topic", &msg)
+	_, err := b.Produce("my-topic", &msg)
 
 	assert.ErrorIs(t, err, ErrNoSuchTopic)
 }
@@ -263,3 +467,104 @@ func TestKrakeBroker_Produce_NoTopicExists(t *testing.T) {
 func TestKrakeBroker_Consume(t *testing.T) {
 
 }
+
+func TestKrakeBroker_Produce_RollsSegmentsByTime(t *testing.T) {
+	b, now := newTestBroker(t, map[string]interface{}{
+		"log.segment.bytes": 10_000,
+		"log.roll.ms":       int(time.Hour.Milliseconds()),
+	}, myTopic, TopicConfiguration{Name: "my-fast-topic", PartitionCount: 1, SegmentPeriod: time.Minute})
+	start := *now
+
+	// one message every half an hour
+	for i := 0; i < 7; i++ {
+		*now = start.Add(time.Duration(i) * 30 * time.Minute)
+		_, err := b.Produce("my-topic", &Message{Message: []byte(fmt.Sprintf("message: %d", i))})
+		assert.NoError(t, err)
+		_, err = b.Produce("my-fast-topic", &Message{Message: []byte(fmt.Sprintf("message: %d", i))})
+		assert.NoError(t, err)
+	}
+
+	// segments are rolled once they are more than an hour old
+	var baseOffsets []int64
+	for _, seg := range b.logs[TopicPartitionKey{"my-topic", 0}].segments {
+		baseOffsets = append(baseOffsets, seg.baseOffset)
+	}
+	assert.Equal(t, []int64{0, 3, 6}, baseOffsets)
+
+	// ... unless the topic sets segment.ms
+	assert.Len(t, b.logs[TopicPartitionKey{"my-fast-topic", 0}].segments, 7)
+
+	// the age of the active segment survives a restart
+	assert.NoError(t, b.Close())
+	pw, restarted := newRestartBroker(b.store, memoryLogDir)
+	k := restarted.(*KrakeBroker)
+	k.Configure(b.Config)
+	k.now = b.now
+	assert.NoError(t, k.LoadLogs())
+	defer pw.Close()
+
+	*now = now.Add(61 * time.Minute)
+	md, err := k.Produce("my-topic", &Message{Message: []byte("message: 7")})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(7), md.Offset)
+	assert.Equal(t, int64(7), pw.logs[TopicPartitionKey{"my-topic", 0}].activeSegment().baseOffset)
+}
+
+func TestKrakeBroker_Produce_TracksWritePosition(t *testing.T) {
+	pw, b := newInMemoryBroker()
+	logDir := memoryLogDir
+	cfg := map[string]interface{}{
+		"log.dirs":          logDir,
+		"log.segment.bytes": 300,
+	}
+	b.Configure(cfg)
+	b.CreateTopic(TopicConfiguration{Name: "my-topic", PartitionCount: 1})
+
+	for i := 0; i < 10; i++ {
+		_, err := b.Produce("my-topic", &Message{Message: []byte(fmt.Sprintf("message: %d", i))})
+		assert.NoError(t, err)
+	}
+
+	key := TopicPartitionKey{"my-topic", 0}
+	l := pw.logs[key]
+	assert.Greater(t, len(l.segments), 1)
+
+	fileSize := func(s *segment) int64 {
+		info, err := s.store.Stat(s.path)
+		assert.NoError(t, err)
+		return info.Size()
+	}
+
+	// rolled segments are trimmed to their last batch
+	for _, s := range l.segments[:len(l.segments)-1] {
+		assert.Equal(t, s.size, fileSize(s))
+	}
+
+	// while the active segment is preallocated
+	active := l.activeSegment()
+	assert.Less(t, active.size, fileSize(active))
+	assert.Equal(t, int64(300), fileSize(active))
+
+	// when the broker crashes, without closing anything, and restarts
+	pw, restarted := newRestartBroker(pw.store, logDir)
+	k := restarted.(*KrakeBroker)
+	k.Configure(cfg)
+	assert.NoError(t, k.LoadLogs())
+
+	// then it writes from the end of the last batch, not the end of the file
+	_, err := k.Produce("my-topic", &Message{Message: []byte("message: 10")})
+	assert.NoError(t, err)
+
+	var values []string
+	for offs := int64(0); offs < 11; offs++ {
+		batch, err := pw.Fetch(key, offs)
+		assert.NoError(t, err)
+		values = append(values, string(batch.Records[0].Value))
+	}
+	assert.Equal(t, "message: 10", values[10])
+
+	// and a clean shutdown trims the active segment too
+	active = pw.logs[key].activeSegment()
+	assert.NoError(t, pw.Close())
+	assert.Equal(t, active.size, fileSize(active))
+}
@@ -0,0 +1,443 @@
+package api
+
+import (
+	"context"
+	"crypto/md5"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/krake-labs/krake/api/record"
+)
+
+// cleanup.policy values. A topic may use both, "compact,delete".
+const (
+	CleanupPolicyDelete  = "delete"
+	CleanupPolicyCompact = "compact"
+)
+
+const (
+	// cleanedFileSuffix is added to a log while it is being compacted.
+	cleanedFileSuffix = ".cleaned"
+	// swapFileSuffix marks a compacted log that is replacing the
+	// segments it was cleaned from.
+	swapFileSuffix = ".swap"
+)
+
+// defaultDeleteRetention is how long tombstones are kept when
+// delete.retention.ms is not set.
+const defaultDeleteRetention = 24 * time.Hour
+
+func (c TopicConfiguration) hasCleanupPolicy(policy string) bool {
+	if c.CleanupPolicy == "" {
+		return policy == CleanupPolicyDelete
+	}
+	for _, p := range strings.Split(c.CleanupPolicy, ",") {
+		if strings.TrimSpace(p) == policy {
+			return true
+		}
+	}
+	return false
+}
+
+func (c TopicConfiguration) deleteRetention() time.Duration {
+	if c.DeleteRetention > 0 {
+		return c.DeleteRetention
+	}
+	return defaultDeleteRetention
+}
+
+// offsetMapEntrySize is the memory used by each key in the offset map,
+// an md5 of the key and its offset.
+const offsetMapEntrySize = md5.Size + 8
+
+// offsetMap holds the latest offset of each key in the dirty part of a
+// log. Like Kafka only a hash of the key is stored and the number of
+// keys is capped, keys that do not fit are left for the next pass.
+type offsetMap struct {
+	offsets    map[[md5.Size]byte]int64
+	maxEntries int
+}
+
+func newOffsetMap(bufferSize int) *offsetMap {
+	maxEntries := bufferSize / offsetMapEntrySize
+	return &offsetMap{
+		offsets:    make(map[[md5.Size]byte]int64, maxEntries),
+		maxEntries: maxEntries,
+	}
+}
+
+// put records offset as the latest offset of key. It returns false if
+// the map is full.
+func (m *offsetMap) put(key []byte, offset int64) bool {
+	hash := md5.Sum(key)
+	if _, ok := m.offsets[hash]; !ok && len(m.offsets) >= m.maxEntries {
+		return false
+	}
+	m.offsets[hash] = offset
+	return true
+}
+
+func (m *offsetMap) get(key []byte) (int64, bool) {
+	offset, ok := m.offsets[md5.Sum(key)]
+	return offset, ok
+}
+
+// cleanerConfig collects the settings of the log cleaner.
+type cleanerConfig struct {
+	// log.cleaner.dedupe.buffer.size
+	dedupeBufferSize int
+	// log.cleaner.backoff.ms
+	backoff time.Duration
+}
+
+func (k *KrakeBroker) cleanerConfig() cleanerConfig {
+	cfg := cleanerConfig{
+		dedupeBufferSize: 128 * 1024 * 1024, // 128MiB
+		backoff:          15 * time.Second,
+	}
+	if v, ok := k.Config["log.cleaner.dedupe.buffer.size"].(int); ok {
+		cfg.dedupeBufferSize = v
+	}
+	if v, ok := k.Config["log.cleaner.backoff.ms"].(int); ok {
+		cfg.backoff = time.Duration(v) * time.Millisecond
+	}
+	return cfg
+}
+
+// StartCleaner runs the log cleaner in the background until ctx is
+// cancelled.
+func (k *KrakeBroker) StartCleaner(ctx context.Context) {
+	ticker := time.NewTicker(k.cleanerConfig().backoff)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := k.CompactLogs(); err != nil {
+					log.Println("failed to compact logs", err)
+				}
+			}
+		}
+	}()
+}
+
+// CompactLogs cleans the closed segments of every partition of the
+// topics with cleanup.policy=compact, keeping only the latest record
+// for each key.
+// FIXME(FELIX): this blocks produce for the whole pass.
+func (k *KrakeBroker) CompactLogs() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	cfg := k.cleanerConfig()
+	for key, l := range k.logs {
+		topicCfg, ok := k.topics[key.Topic]
+		if !ok || !topicCfg.hasCleanupPolicy(CleanupPolicyCompact) {
+			continue
+		}
+		if err := k.compact(key, l, topicCfg, cfg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compact builds an offset map of the dirty part of the log, the
+// closed segments written since the last pass, and rewrites every
+// closed segment without the records it shadows. Offsets are kept so
+// the cleaned log has gaps where records were removed.
+func (k *KrakeBroker) compact(key TopicPartitionKey, l *partitionLog, topicCfg TopicConfiguration, cfg cleanerConfig) error {
+	active := l.activeSegment()
+	if active == nil || l.firstDirtyOffset >= active.baseOffset {
+		return nil
+	}
+
+	offsets := newOffsetMap(cfg.dedupeBufferSize)
+	endOffset, err := l.buildOffsetMap(offsets)
+	if err != nil {
+		return err
+	}
+	if endOffset <= l.firstDirtyOffset {
+		log.Println("nothing to compact in", partitionDirName(key), "before offset", endOffset)
+		return nil
+	}
+
+	deleteHorizon := k.now().Add(-topicCfg.deleteRetention()).UnixMilli()
+	segCfg := k.segmentConfig()
+
+	// the segments before endOffset are cleaned, grouping small ones
+	// together so the log does not fill up with tiny segments.
+	var dirty []*segment
+	for _, s := range l.segments {
+		if s != active && s.baseOffset < endOffset {
+			dirty = append(dirty, s)
+		}
+	}
+	rest := l.segments[len(dirty):]
+
+	var segments []*segment
+	for _, group := range groupSegments(dirty, segCfg.segmentBytes) {
+		cleaned, err := k.cleanSegments(key, group, offsets, endOffset, deleteHorizon, segCfg)
+		if err != nil {
+			return err
+		}
+		segments = append(segments, cleaned)
+	}
+	l.segments = append(segments, rest...)
+	l.firstDirtyOffset = endOffset
+	return nil
+}
+
+// groupSegments splits segments into runs whose combined size fits in
+// a single segment.
+func groupSegments(segments []*segment, segmentBytes int) [][]*segment {
+	var groups [][]*segment
+	var size int64
+	for _, s := range segments {
+		if len(groups) == 0 || size+s.size > int64(segmentBytes) {
+			groups = append(groups, nil)
+			size = 0
+		}
+		groups[len(groups)-1] = append(groups[len(groups)-1], s)
+		size += s.size
+	}
+	return groups
+}
+
+// buildOffsetMap adds the keys of the closed segments from the first
+// dirty offset to offsets. It returns the offset it stopped at, either
+// the start of the active segment, the last stable offset or the first
+// key that did not fit. Records of open transactions may still be
+// aborted and those of aborted ones are never read, so neither
+// replaces an earlier value.
+func (l *partitionLog) buildOffsetMap(offsets *offsetMap) (int64, error) {
+	lso := l.lastStableOffset()
+	for i, s := range l.segments[:len(l.segments)-1] {
+		// a segment ends where the next one starts.
+		if l.segments[i+1].baseOffset <= l.firstDirtyOffset {
+			continue
+		}
+
+		f, err := s.file()
+		if err != nil {
+			return 0, err
+		}
+		var position int64
+		for position < s.size {
+			batch, err := record.ReadBatchAt(f, position)
+			if err != nil {
+				return 0, err
+			}
+			aborted := l.aborted(batch)
+			for _, r := range batch.Records {
+				offset := batch.BaseOffset + int64(r.OffsetDelta)
+				if offset >= lso {
+					return offset, nil
+				}
+				// every marker has the same key.
+				if offset < l.firstDirtyOffset || r.Key == nil || batch.IsControl() || aborted {
+					continue
+				}
+				if !offsets.put(r.Key, offset) {
+					return offset, nil
+				}
+			}
+			position += int64(batch.Size())
+		}
+	}
+	return l.activeSegment().baseOffset, nil
+}
+
+// cleanSegments rewrites a group of segments into one, named after the
+// first, without the records shadowed by a later record with the same
+// key and without tombstones older than deleteHorizon. Records from
+// endOffset onwards were not added to the offset map so they are all
+// kept. The cleaned segment may be empty.
+func (k *KrakeBroker) cleanSegments(key TopicPartitionKey, group []*segment, offsets *offsetMap, endOffset, deleteHorizon int64, cfg segmentConfig) (*segment, error) {
+	dir := k.partitionDirs[key]
+	l := k.logs[key]
+	baseOffset := group[0].baseOffset
+	logPath := filepath.Join(dir, segmentFileName(baseOffset, logFileSuffix))
+	cleanedPath := logPath + cleanedFileSuffix
+
+	f, err := k.store.Create(cleanedPath)
+	if err != nil {
+		return nil, err
+	}
+	defer k.store.Remove(cleanedPath)
+
+	var before, after int64
+	for _, s := range group {
+		before += s.size
+
+		src, err := s.file()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		var position int64
+		for position < s.size {
+			batch, err := record.ReadBatchAt(src, position)
+			if err != nil {
+				f.Close()
+				return nil, err
+			}
+			position += int64(batch.Size())
+
+			aborted := l.aborted(batch)
+			var retained []record.Record
+			for _, r := range batch.Records {
+				if shouldRetain(batch, aborted, r, offsets, endOffset, deleteHorizon) {
+					retained = append(retained, r)
+				}
+			}
+			if len(retained) == 0 {
+				continue
+			}
+
+			// the last offset delta is kept so the offsets of the batch
+			// stay the same.
+			batch.Records = retained
+			n, err := f.WriteAt(batch.Encode(), after)
+			after += int64(n)
+			if err != nil {
+				f.Close()
+				return nil, err
+			}
+		}
+	}
+	if err = f.Close(); err != nil {
+		return nil, err
+	}
+
+	// swap in the cleaned log, the indexes are rebuilt when it is
+	// reopened. once the swap file exists the cleaned log replaces the
+	// group even if we stop before finishing, see completeSwaps.
+	swapPath := logPath + swapFileSuffix
+	if err = k.store.Rename(cleanedPath, swapPath); err != nil {
+		return nil, err
+	}
+	for _, s := range group {
+		if _, err = s.delete(); err != nil {
+			return nil, err
+		}
+	}
+	if err = k.store.Rename(swapPath, logPath); err != nil {
+		return nil, err
+	}
+
+	cleaned, _, err := openSegment(k.store, dir, baseOffset, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if err = cleaned.roll(); err != nil {
+		return nil, err
+	}
+	k.filePool.track(cleaned)
+	log.Println("compacted", len(group), "segments into", logPath, "from", before, "to", after, "bytes")
+	return cleaned, nil
+}
+
+func shouldRetain(batch *record.Batch, aborted bool, r record.Record, offsets *offsetMap, endOffset, deleteHorizon int64) bool {
+	offset := batch.BaseOffset + int64(r.OffsetDelta)
+	// markers are kept so the transactions they end are still known.
+	if offset >= endOffset || batch.IsControl() {
+		return true
+	}
+	// aborted records are never read by read_committed consumers.
+	if aborted {
+		return false
+	}
+	if r.Key == nil {
+		return true
+	}
+	if latest, ok := offsets.get(r.Key); ok && latest > offset {
+		return false
+	}
+	// tombstones are kept for delete.retention.ms so consumers have a
+	// chance to see the key was deleted.
+	if r.Value == nil {
+		return batch.Timestamp(&r) >= deleteHorizon
+	}
+	return true
+}
+
+// completeSwaps finishes replacing segments with their compacted log if
+// the broker stopped part way through. The segments covered by a swap
+// file are deleted along with their indexes and the swap file takes
+// the place of the first.
+func completeSwaps(store SegmentStore, dir string) error {
+	entries, err := store.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	var baseOffsets []int64
+	for _, e := range entries {
+		if baseOffs, ok := parseSegmentFileName(e.Name(), logFileSuffix); ok {
+			baseOffsets = append(baseOffsets, baseOffs)
+		}
+	}
+
+	for _, e := range entries {
+		swapBase, ok := parseSegmentFileName(e.Name(), logFileSuffix+swapFileSuffix)
+		if !ok {
+			continue
+		}
+		swapPath := filepath.Join(dir, e.Name())
+
+		lastOffset, err := lastOffsetOf(store, swapPath)
+		if err != nil {
+			return err
+		}
+		if lastOffset < swapBase {
+			lastOffset = swapBase
+		}
+
+		for _, baseOffs := range baseOffsets {
+			if baseOffs < swapBase || baseOffs > lastOffset {
+				continue
+			}
+			for _, suffix := range []string{logFileSuffix, indexFileSuffix, timeIndexFileSuffix} {
+				err = store.Remove(filepath.Join(dir, segmentFileName(baseOffs, suffix)))
+				if err != nil && !errors.Is(err, os.ErrNotExist) {
+					return err
+				}
+			}
+		}
+
+		log.Println("completing compaction of", swapPath)
+		if err = store.Rename(swapPath, filepath.Join(dir, segmentFileName(swapBase, logFileSuffix))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lastOffsetOf returns the last offset in a log, or -1 if it is empty.
+func lastOffsetOf(store SegmentStore, path string) (int64, error) {
+	f, err := store.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	lastOffset := int64(-1)
+	var position int64
+	for {
+		batch, err := record.ReadBatchAt(f, position)
+		if err != nil {
+			// anything that cannot be read is truncated when the
+			// segment is opened.
+			return lastOffset, nil
+		}
+		lastOffset = batch.LastOffset()
+		position += int64(batch.Size())
+	}
+}
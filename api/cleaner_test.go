@@ -0,0 +1,234 @@
+package api
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/krake-labs/krake/api/record"
+	"github.com/stretchr/testify/assert"
+)
+
+var compactKey = TopicPartitionKey{"changelog", 0}
+
+// newCompactedBroker creates the compacted topic of compactKey with
+// segments of a few records.
+func newCompactedBroker(t *testing.T, cfg map[string]interface{}) (*KrakeBroker, *time.Time) {
+	cfg["log.segment.bytes"] = 300
+	return newTestBroker(t, cfg, TopicConfiguration{
+		Name:            compactKey.Topic,
+		PartitionCount:  1,
+		CleanupPolicy:   CleanupPolicyCompact,
+		DeleteRetention: time.Hour,
+	})
+}
+
+// appendKeyed writes a record to the compacted partition, a nil value
+// is a tombstone.
+func appendKeyed(t *testing.T, b *KrakeBroker, key string, value []byte) {
+	_, err := b.append(compactKey, record.NewBatch(0, b.now().UnixMilli(), record.Record{Key: []byte(key), Value: value}))
+	assert.NoError(t, err)
+}
+
+// logRecords returns every record in the log as offset:key=value.
+func logRecords(t *testing.T, l *partitionLog) []string {
+	var records []string
+	for _, s := range l.segments {
+		f, err := s.file()
+		if !assert.NoError(t, err) {
+			return records
+		}
+		var position int64
+		for position < s.size {
+			batch, err := record.ReadBatchAt(f, position)
+			if !assert.NoError(t, err) {
+				return records
+			}
+			for _, r := range batch.Records {
+				offset := batch.BaseOffset + int64(r.OffsetDelta)
+				records = append(records, fmt.Sprintf("%d:%s=%s", offset, r.Key, r.Value))
+			}
+			position += int64(batch.Size())
+		}
+	}
+	return records
+}
+
+func TestKrakeBroker_CompactLogs(t *testing.T) {
+	b, _ := newCompactedBroker(t, map[string]interface{}{})
+
+	for i := 0; i < 30; i++ {
+		appendKeyed(t, b, fmt.Sprintf("key-%d", i%3), []byte(fmt.Sprintf("value-%d", i)))
+	}
+	l := b.logs[compactKey]
+	active := l.activeSegment()
+	assert.Greater(t, len(l.segments), 3)
+
+	assert.NoError(t, b.CompactLogs())
+
+	// only the latest value of each key in the closed segments is kept,
+	// the active segment is left alone.
+	var expected []string
+	for i := 0; i < int(active.baseOffset); i++ {
+		if int64(i) >= active.baseOffset-3 {
+			expected = append(expected, fmt.Sprintf("%d:key-%d=value-%d", i, i%3, i))
+		}
+	}
+	for i := active.baseOffset; i < 30; i++ {
+		expected = append(expected, fmt.Sprintf("%d:key-%d=value-%d", i, i%3, i))
+	}
+	assert.Equal(t, expected, logRecords(t, l))
+	assert.Same(t, active, l.activeSegment())
+	assert.Equal(t, int64(30), l.nextOffset)
+
+	// reading a removed offset returns the next record
+	batch, err := b.Fetch(compactKey, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, active.baseOffset-3, batch.BaseOffset)
+
+	// a second pass has nothing to do
+	assert.NoError(t, b.CompactLogs())
+	assert.Equal(t, expected, logRecords(t, l))
+
+	// and the compacted log is reloaded on restart
+	assert.NoError(t, b.Close())
+	pw, restarted := newRestartBroker(b.store, b.logDirs()[0])
+	k := restarted.(*KrakeBroker)
+	k.Configure(b.Config)
+	assert.NoError(t, k.LoadLogs())
+	defer pw.Close()
+	assert.Equal(t, expected, logRecords(t, pw.logs[compactKey]))
+	assert.Equal(t, int64(30), pw.logs[compactKey].nextOffset)
+}
+
+func TestKrakeBroker_CompactLogs_Tombstones(t *testing.T) {
+	b, now := newCompactedBroker(t, map[string]interface{}{})
+
+	appendKeyed(t, b, "deleted", []byte("value"))
+	appendKeyed(t, b, "deleted", nil)
+	for i := 0; i < 10; i++ {
+		appendKeyed(t, b, "kept", []byte(fmt.Sprintf("value-%d", i)))
+	}
+	l := b.logs[compactKey]
+
+	// the tombstone is kept until delete.retention.ms has passed
+	assert.NoError(t, b.CompactLogs())
+	assert.Contains(t, logRecords(t, l), "1:deleted=")
+	assert.NotContains(t, logRecords(t, l), "0:deleted=value")
+
+	*now = now.Add(2 * time.Hour)
+	for i := 10; i < 20; i++ {
+		appendKeyed(t, b, "kept", []byte(fmt.Sprintf("value-%d", i)))
+	}
+	assert.NoError(t, b.CompactLogs())
+	for _, r := range logRecords(t, l) {
+		assert.NotContains(t, r, "deleted")
+	}
+}
+
+func TestKrakeBroker_ReadMessage_CompactedBatchEnd(t *testing.T) {
+	b, _ := newCompactedBroker(t, map[string]interface{}{})
+
+	_, err := b.append(compactKey, record.NewBatch(0, b.now().UnixMilli(),
+		record.Record{Key: []byte("a"), Value: []byte("a0")},
+		record.Record{Key: []byte("b"), Value: []byte("b0")},
+		record.Record{Key: []byte("c"), Value: []byte("c0")},
+	))
+	assert.NoError(t, err)
+	appendKeyed(t, b, "c", []byte("c1"))
+	for i := 0; i < 10; i++ {
+		appendKeyed(t, b, "filler", []byte(fmt.Sprintf("value-%d", i)))
+	}
+	assert.NoError(t, b.CompactLogs())
+	assert.NotContains(t, logRecords(t, b.logs[compactKey]), "2:c=c0")
+
+	// the offset removed from the end of the batch is read from the
+	// next one
+	msg, err := b.readMessageAt(compactKey, 2, ReadUncommitted)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), msg.Offset)
+	assert.Equal(t, []byte("c1"), msg.Message)
+}
+
+func TestKrakeBroker_CompactLogs_BoundedOffsetMap(t *testing.T) {
+	produce := func(b *KrakeBroker) {
+		for i := 0; i < 40; i++ {
+			appendKeyed(t, b, fmt.Sprintf("key-%d", i%5), []byte(fmt.Sprintf("value-%d", i)))
+		}
+	}
+
+	unbounded, _ := newCompactedBroker(t, map[string]interface{}{})
+	produce(unbounded)
+	assert.NoError(t, unbounded.CompactLogs())
+
+	// an offset map with room for only two keys
+	bounded, _ := newCompactedBroker(t, map[string]interface{}{
+		"log.cleaner.dedupe.buffer.size": 2 * offsetMapEntrySize,
+	})
+	produce(bounded)
+	l := bounded.logs[compactKey]
+
+	// a pass only cleans as far as the map reaches
+	assert.NoError(t, bounded.CompactLogs())
+	assert.Less(t, l.firstDirtyOffset, l.activeSegment().baseOffset)
+
+	// but later passes catch up with the unbounded cleaner
+	for passes := 0; l.firstDirtyOffset < l.activeSegment().baseOffset; passes++ {
+		assert.Less(t, passes, 40)
+		assert.NoError(t, bounded.CompactLogs())
+	}
+	assert.Equal(t, logRecords(t, unbounded.logs[compactKey]), logRecords(t, l))
+}
+
+func TestKrakeBroker_EnforceRetention_SkipsCompactedTopics(t *testing.T) {
+	b, now := newCompactedBroker(t, map[string]interface{}{})
+	cfg := b.topics[compactKey.Topic]
+	cfg.RetentionPeriod = time.Hour
+	b.topics[compactKey.Topic] = cfg
+
+	for i := 0; i < 30; i++ {
+		appendKeyed(t, b, fmt.Sprintf("key-%d", i), []byte("value"))
+	}
+	segments := len(b.logs[compactKey].segments)
+
+	*now = now.Add(24 * time.Hour)
+	assert.NoError(t, b.EnforceRetention())
+	assert.Len(t, b.logs[compactKey].segments, segments)
+}
+
+func TestKrakeBroker_LoadLogs_CompletesInterruptedCompaction(t *testing.T) {
+	b, _ := newCompactedBroker(t, map[string]interface{}{})
+	for i := 0; i < 30; i++ {
+		appendKeyed(t, b, fmt.Sprintf("key-%d", i%3), []byte(fmt.Sprintf("value-%d", i)))
+	}
+	l := b.logs[compactKey]
+	second := l.segments[1].baseOffset
+	before := logRecords(t, l)
+	assert.NoError(t, b.Close())
+
+	// we stopped after writing the swap file for the first two segments
+	// but before deleting them.
+	swap := record.NewBatch(second, 0, record.Record{Key: []byte("key-0"), Value: []byte("cleaned")})
+	dir := b.partitionDirs[compactKey]
+	swapPath := filepath.Join(dir, segmentFileName(0, logFileSuffix+swapFileSuffix))
+	f, err := b.store.Create(swapPath)
+	assert.NoError(t, err)
+	_, err = f.WriteAt(swap.Encode(), 0)
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+
+	pw, restarted := newRestartBroker(b.store, b.logDirs()[0])
+	k := restarted.(*KrakeBroker)
+	k.Configure(b.Config)
+	assert.NoError(t, k.LoadLogs())
+	defer pw.Close()
+
+	// the swap file replaces both segments
+	after := logRecords(t, pw.logs[compactKey])
+	assert.Equal(t, fmt.Sprintf("%d:key-0=cleaned", second), after[0])
+	assert.Equal(t, before[len(before)-len(after)+1:], after[1:])
+	assertNotStored(t, pw.store, swapPath)
+	assertNotStored(t, pw.store, filepath.Join(dir, segmentFileName(second, logFileSuffix)))
+	assert.Equal(t, int64(0), pw.logs[compactKey].segments[0].baseOffset)
+}
@@ -0,0 +1,140 @@
+package api
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/krake-labs/krake/api/record"
+	"github.com/stretchr/testify/assert"
+)
+
+func newCompressionBroker(t *testing.T, compressionType string) *KrakeBroker {
+	b, _ := newTestBroker(t, map[string]interface{}{"log.segment.bytes": 1 << 20}, TopicConfiguration{
+		Name:            "events",
+		PartitionCount:  1,
+		CompressionType: compressionType,
+	})
+	return b
+}
+
+// produceEvents produces chatty JSON events and returns the size of the
+// partition.
+func produceEvents(t *testing.T, b *KrakeBroker, compression record.Compression) int64 {
+	for i := 0; i < 50; i++ {
+		value := fmt.Sprintf(`{"event":"page_view","path":"/products/%d","items":[`, i)
+		for j := 0; j < 10; j++ {
+			value += fmt.Sprintf(`{"user":"user-%d","agent":"Mozilla/5.0 (X11; Linux x86_64)","referrer":"https://example.com/"},`, j)
+		}
+		value += `{}]}`
+		results, err := b.ProduceBatch("events", []*Message{{Message: []byte(value)}}, ProduceOptions{Compression: compression})
+		assert.NoError(t, err)
+		assert.NoError(t, results[0].Err)
+	}
+	return b.logs[TopicPartitionKey{"events", 0}].activeSegment().size
+}
+
+func TestKrakeBroker_Produce_Compression(t *testing.T) {
+	plain := newCompressionBroker(t, "")
+	uncompressed := produceEvents(t, plain, record.CompressionNone)
+
+	for _, tc := range []struct {
+		compressionType string
+		producer        record.Compression
+		stored          record.Compression
+	}{
+		{"", record.CompressionZstd, record.CompressionZstd},
+		{CompressionTypeProducer, record.CompressionGzip, record.CompressionGzip},
+		{CompressionTypeUncompressed, record.CompressionSnappy, record.CompressionNone},
+		{"lz4", record.CompressionNone, record.CompressionLZ4},
+		{"zstd", record.CompressionGzip, record.CompressionZstd},
+	} {
+		t.Run(fmt.Sprintf("%s/%s", tc.compressionType, tc.producer), func(t *testing.T) {
+			b := newCompressionBroker(t, tc.compressionType)
+			size := produceEvents(t, b, tc.producer)
+			if tc.stored == record.CompressionNone {
+				assert.Equal(t, uncompressed, size)
+			} else {
+				assert.Less(t, size, uncompressed/3)
+			}
+
+			batch, err := b.Fetch(TopicPartitionKey{"events", 0}, 7)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.stored, batch.Compression())
+			assert.Contains(t, string(batch.Records[0].Value), `"path":"/products/7"`)
+		})
+	}
+}
+
+func TestKrakeBroker_FetchFile_Compressed(t *testing.T) {
+	b := newCompressionBroker(t, "")
+	for i := 0; i < 5; i++ {
+		msg := &Message{Message: []byte(fmt.Sprintf("message-%d", i))}
+		_, err := b.ProduceBatch("events", []*Message{msg}, ProduceOptions{Compression: record.CompressionLZ4})
+		assert.NoError(t, err)
+	}
+
+	// batches are handed back as they were written
+	r, err := b.FetchFile("events", 0, 0, 1<<20)
+	assert.NoError(t, err)
+	batches := readRange(t, r)
+	assert.Len(t, batches, 5)
+	for i, batch := range batches {
+		assert.Equal(t, record.CompressionLZ4, batch.Compression())
+		assert.Equal(t, []byte(fmt.Sprintf("message-%d", i)), batch.Records[0].Value)
+	}
+}
+
+func TestKrakeBroker_Produce_InvalidCompression(t *testing.T) {
+	b := newCompressionBroker(t, "")
+	_, err := b.ProduceBatch("events", []*Message{{Message: []byte("event")}}, ProduceOptions{Compression: record.Compression(7)})
+	assert.ErrorIs(t, err, record.ErrUnsupportedCompression)
+	_, err = b.Fetch(TopicPartitionKey{"events", 0}, 0)
+	assert.ErrorIs(t, err, ErrOffsetOutOfRange)
+}
+
+func TestKrakeBroker_CreateTopic_InvalidCompressionType(t *testing.T) {
+	_, b := newInMemoryBroker()
+	err := b.CreateTopic(TopicConfiguration{Name: "events", PartitionCount: 1, CompressionType: "brotli"})
+	assert.ErrorIs(t, err, record.ErrUnsupportedCompression)
+}
+
+func TestKrakeBroker_LoadLogs_Compressed(t *testing.T) {
+	b := newCompressionBroker(t, "gzip")
+	produceEvents(t, b, record.CompressionNone)
+	assert.NoError(t, b.Close())
+
+	// the topic keeps its compression.type and the segments recover
+	pw, restarted := newRestartBroker(b.store, b.logDirs()[0])
+	k := restarted.(*KrakeBroker)
+	assert.NoError(t, k.LoadLogs())
+	defer pw.Close()
+
+	assert.Equal(t, "gzip", k.topics["events"].CompressionType)
+	assert.Equal(t, int64(50), pw.logs[TopicPartitionKey{"events", 0}].nextOffset)
+	batch, err := k.Fetch(TopicPartitionKey{"events", 0}, 49)
+	assert.NoError(t, err)
+	assert.Equal(t, record.CompressionGzip, batch.Compression())
+}
+
+func TestKrakeBroker_CompactLogs_KeepsCompression(t *testing.T) {
+	b, _ := newCompactedBroker(t, map[string]interface{}{})
+	cfg := b.topics[compactKey.Topic]
+	cfg.CompressionType = "snappy"
+	b.topics[compactKey.Topic] = cfg
+
+	for i := 0; i < 30; i++ {
+		appendKeyed(t, b, fmt.Sprintf("key-%d", i%3), []byte(fmt.Sprintf("value-%d", i)))
+	}
+	before := logRecords(t, b.logs[compactKey])
+	assert.NoError(t, b.CompactLogs())
+	assert.Less(t, len(logRecords(t, b.logs[compactKey])), len(before))
+
+	for _, s := range b.logs[compactKey].segments {
+		if s.size == 0 {
+			continue
+		}
+		batch, err := record.ReadHeaderAt(s.log, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, record.CompressionSnappy, batch.Compression())
+	}
+}
@@ -0,0 +1,184 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/krake-labs/krake/api/record"
+)
+
+// FileRange is a run of encoded batches in a segment file. Segments
+// use the wire format so the batches are sent to consumers as they
+// are on disk, without being decoded.
+type FileRange struct {
+	file     SegmentFile
+	position int64
+	size     int64
+}
+
+// Size is the number of bytes in the range.
+func (r *FileRange) Size() int64 {
+	return r.size
+}
+
+// WriteTo copies the batches to w. For segments in files on disk the
+// reader handed to w is a limited *os.File, which lets a net.Conn or
+// an HTTP/1 response send them with sendfile instead of copying them
+// through user space.
+func (r *FileRange) WriteTo(w io.Writer) (int64, error) {
+	file := r.file
+	if b, ok := file.(*borrowedFile); ok {
+		file = b.SegmentFile
+	}
+	f, ok := file.(*os.File)
+	if !ok {
+		return io.Copy(w, io.NewSectionReader(r.file, r.position, r.size))
+	}
+	if _, err := f.Seek(r.position, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return io.Copy(w, &io.LimitedReader{R: f, N: r.size})
+}
+
+// Close releases the file backing the range.
+func (r *FileRange) Close() error {
+	return r.file.Close()
+}
+
+// FetchFile returns the batches of the partition from the one
+// containing offset, up to maxBytes. The first batch is always
+// returned, even if it is larger than maxBytes, so consumers can make
+// progress. The range never spans more than one segment.
+//
+// The caller must Close the range once it has been written.
+func (k *KrakeBroker) FetchFile(topic string, partition int32, offset int64, maxBytes int64) (*FileRange, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	var r *FileRange
+	err := k.withRemote(func() (err error) {
+		r, err = k.fetchFile(topic, partition, offset, maxBytes)
+		return err
+	})
+	return r, err
+}
+
+// fetchFile is FetchFile with the lock held.
+func (k *KrakeBroker) fetchFile(topic string, partition int32, offset int64, maxBytes int64) (*FileRange, error) {
+	topicCfg, ok := k.topics[topic]
+	if !ok {
+		return nil, ErrNoSuchTopic
+	}
+	if partition < 0 || int(partition) >= topicCfg.PartitionCount {
+		return nil, fmt.Errorf("%w: %s-%d", ErrUnknownPartition, topic, partition)
+	}
+	// an existing partition without a log has nothing to fetch yet.
+	l, ok := k.logs[TopicPartitionKey{topic, partition}]
+	if !ok {
+		return nil, ErrOffsetOutOfRange
+	}
+	if k.remote != nil && l.remoteOffset(offset) {
+		return l.fetchRemoteFile(TopicPartitionKey{topic, partition}, offset, maxBytes)
+	}
+
+	seg, position, size, err := l.span(offset, maxBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	// the range is sent once the lock is released, so it gets its own
+	// descriptor. It has its own file position and keeps the data
+	// readable if the segment is deleted or compacted meanwhile.
+	f, err := k.filePool.borrow(seg.path)
+	if err != nil {
+		return nil, err
+	}
+	return &FileRange{file: f, position: position, size: size}, nil
+}
+
+// span returns the segment and byte range of the batches from the one
+// containing offset, see FetchFile.
+func (l *partitionLog) span(offset int64, maxBytes int64) (*segment, int64, int64, error) {
+	if offset >= l.nextOffset {
+		return nil, 0, 0, ErrOffsetOutOfRange
+	}
+	seg := l.segmentFor(offset)
+	if seg == nil {
+		return nil, 0, 0, ErrOffsetOutOfRange
+	}
+	for i := l.indexOf(seg); i < len(l.segments); i++ {
+		position, size, err := l.segments[i].span(offset, maxBytes)
+		if !errors.Is(err, io.EOF) {
+			return l.segments[i], position, size, err
+		}
+	}
+	return nil, 0, 0, ErrOffsetOutOfRange
+}
+
+// span returns the byte range in the segment of the batches from the
+// one containing offset. Only the batch headers are read.
+func (s *segment) span(offset int64, maxBytes int64) (int64, int64, error) {
+	f, err := s.file()
+	if err != nil {
+		return 0, 0, err
+	}
+	_, position := s.index.lookup(offset)
+	return spanBatches(f, position, s.size, offset, maxBytes)
+}
+
+// spanBatches scans the batches of a log from position up to size, see
+// segment.span.
+func spanBatches(f io.ReaderAt, position, size int64, offset int64, maxBytes int64) (int64, int64, error) {
+	for {
+		if position >= size {
+			return 0, 0, io.EOF
+		}
+		batch, err := record.ReadHeaderAt(f, position)
+		if err != nil {
+			return 0, 0, err
+		}
+		if batch.LastOffset() >= offset {
+			break
+		}
+		position += int64(batch.Size())
+	}
+
+	end := position
+	for end < size {
+		batch, err := record.ReadHeaderAt(f, end)
+		if err != nil {
+			return 0, 0, err
+		}
+		if end > position && end+int64(batch.Size())-position > maxBytes {
+			break
+		}
+		end += int64(batch.Size())
+	}
+	return position, end - position, nil
+}
+
+// fetchRemoteFile returns the range of batches from a segment that is
+// only in remote storage. It is served from memory once downloaded, or
+// a *remoteMiss is returned.
+func (l *partitionLog) fetchRemoteFile(key TopicPartitionKey, offset int64, maxBytes int64) (*FileRange, error) {
+	rs, ok := l.remoteSegmentFor(offset)
+	if !ok {
+		return nil, ErrOffsetOutOfRange
+	}
+	data, err := l.cachedRemoteLog(key, rs)
+	if err != nil {
+		return nil, err
+	}
+
+	f := newMemoryFile(remoteObjectName(key, rs.baseOffset, logFileSuffix), data)
+	position, size, err := spanBatches(f, 0, int64(len(data)), offset, maxBytes)
+	if errors.Is(err, io.EOF) {
+		return nil, ErrOffsetOutOfRange
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &FileRange{file: f, position: position, size: size}, nil
+}
@@ -0,0 +1,140 @@
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/krake-labs/krake/api/record"
+	"github.com/stretchr/testify/assert"
+)
+
+// readRange writes out the range and decodes the batches in it.
+func readRange(t *testing.T, r *FileRange) []*record.Batch {
+	var buf bytes.Buffer
+	n, err := r.WriteTo(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, r.Size(), n)
+	assert.NoError(t, r.Close())
+
+	var batches []*record.Batch
+	for buf.Len() > 0 {
+		batch, err := record.ReadBatch(&buf)
+		if !assert.NoError(t, err) {
+			break
+		}
+		batches = append(batches, batch)
+	}
+	return batches
+}
+
+func TestKrakeBroker_FetchFile(t *testing.T) {
+	b, _ := newTestBroker(t, map[string]interface{}{
+		"log.segment.bytes": 1000,
+	}, myTopic)
+	for i := 0; i < 30; i++ {
+		_, err := b.Produce("my-topic", &Message{Message: []byte(fmt.Sprintf("message-%d", i))})
+		assert.NoError(t, err)
+	}
+	l := b.logs[TopicPartitionKey{"my-topic", 0}]
+	assert.Greater(t, len(l.segments), 1)
+	second := l.segments[1].baseOffset
+
+	// the range stops at the end of the segment
+	r, err := b.FetchFile("my-topic", 0, 3, 1<<20)
+	assert.NoError(t, err)
+	batches := readRange(t, r)
+	assert.Equal(t, int64(3), batches[0].BaseOffset)
+	assert.Equal(t, second-1, batches[len(batches)-1].LastOffset())
+	assert.Equal(t, []byte("message-3"), batches[0].Records[0].Value)
+
+	// and holds at most max bytes
+	size := int64(batches[0].Size())
+	r, err = b.FetchFile("my-topic", 0, 3, 2*size+1)
+	assert.NoError(t, err)
+	assert.Len(t, readRange(t, r), 2)
+
+	// unless the first batch alone is larger
+	r, err = b.FetchFile("my-topic", 0, 3, 1)
+	assert.NoError(t, err)
+	assert.Len(t, readRange(t, r), 1)
+
+	r, err = b.FetchFile("my-topic", 0, second, 1<<20)
+	assert.NoError(t, err)
+	assert.Equal(t, second, readRange(t, r)[0].BaseOffset)
+
+	_, err = b.FetchFile("my-topic", 0, 30, 1<<20)
+	assert.ErrorIs(t, err, ErrOffsetOutOfRange)
+	_, err = b.FetchFile("other-topic", 0, 0, 1<<20)
+	assert.ErrorIs(t, err, ErrNoSuchTopic)
+	for _, partition := range []int32{-1, 1} {
+		_, err = b.FetchFile("my-topic", partition, 0, 1<<20)
+		assert.ErrorIs(t, err, ErrUnknownPartition)
+	}
+}
+
+func TestKrakeBroker_FetchFile_NoSegments(t *testing.T) {
+	b, _ := newTestBroker(t, nil, myTopic)
+	// a tiered partition whose segments all expired from remote storage
+	l := b.partitionLog(TopicPartitionKey{"my-topic", 0})
+	assert.Empty(t, l.segments)
+
+	_, err := b.FetchFile("my-topic", 0, 0, 1<<20)
+	assert.ErrorIs(t, err, ErrOffsetOutOfRange)
+
+	b.SetRemoteStorage(NewLocalStorage(t.TempDir()))
+	_, err = b.FetchFile("my-topic", 0, 0, 1<<20)
+	assert.ErrorIs(t, err, ErrOffsetOutOfRange)
+}
+
+func TestKrakeBroker_FetchFile_DeletedSegment(t *testing.T) {
+	b, _ := newTestBroker(t, map[string]interface{}{
+		"log.segment.bytes": 1000,
+	}, myTopic)
+	for i := 0; i < 30; i++ {
+		_, err := b.Produce("my-topic", &Message{Message: []byte(fmt.Sprintf("message-%d", i))})
+		assert.NoError(t, err)
+	}
+	r, err := b.FetchFile("my-topic", 0, 0, 1<<20)
+	assert.NoError(t, err)
+
+	// retention deletes the segment before the range is sent
+	l := b.logs[TopicPartitionKey{"my-topic", 0}]
+	_, err = l.segments[0].delete()
+	assert.NoError(t, err)
+
+	batches := readRange(t, r)
+	assert.Equal(t, []byte("message-0"), batches[0].Records[0].Value)
+}
+
+func TestFileRange_WriteTo_UsesFile(t *testing.T) {
+	// sendfile needs the logs on disk
+	b, _ := newTestBroker(t, map[string]interface{}{
+		"log.dirs": t.TempDir(),
+	}, myTopic)
+	_, err := b.Produce("my-topic", &Message{Message: []byte("message")})
+	assert.NoError(t, err)
+
+	r, err := b.FetchFile("my-topic", 0, 0, 1<<20)
+	assert.NoError(t, err)
+	defer r.Close()
+
+	// writers implementing io.ReaderFrom are handed the file itself,
+	// which is what lets the kernel send it.
+	w := &readerFrom{}
+	_, err = r.WriteTo(w)
+	assert.NoError(t, err)
+	assert.IsType(t, &io.LimitedReader{}, w.src)
+	assert.Same(t, r.file.(*borrowedFile).SegmentFile, w.src.(*io.LimitedReader).R)
+}
+
+type readerFrom struct {
+	bytes.Buffer
+	src io.Reader
+}
+
+func (w *readerFrom) ReadFrom(r io.Reader) (int64, error) {
+	w.src = r
+	return w.Buffer.ReadFrom(r)
+}
@@ -0,0 +1,159 @@
+package api
+
+import (
+	"container/list"
+	"log"
+	"sync/atomic"
+)
+
+// filesPerSegment is the log and the two indexes of a segment.
+const filesPerSegment = 3
+
+// FilePool tracks the open segment files. Like Kafka every segment is
+// kept open by default. With log.open.files.max set, the log and
+// indexes of inactive segments are closed once the limit is reached,
+// least recently used first, and reopened when they are next read.
+// Active segments always stay open. Files opened for a single read,
+// like a range sent to a consumer, count against the limit until they
+// are closed.
+type FilePool struct {
+	store SegmentStore
+
+	// partition index -> file of the active segment
+	data map[TopicPartitionKey]SegmentFile
+
+	// log.open.files.max, 0 for no limit
+	maxOpen int
+
+	// inactive segments with open files, most recently used first.
+	lru *list.List
+
+	// files handed out by borrow and not yet released, which may happen
+	// without the broker lock.
+	borrowed atomic.Int64
+
+	stats FilePoolStats
+}
+
+// FilePoolStats counts the segments opened and closed by the pool.
+type FilePoolStats struct {
+	// files currently open, the logs and indexes of segments including
+	// the active ones and any borrowed files
+	Open int
+	// segments closed to stay under log.open.files.max
+	Evicted int64
+	// evicted segments opened again to be read
+	Reopened int64
+}
+
+func newFilePool(store SegmentStore) *FilePool {
+	return &FilePool{
+		store: store,
+		data:  map[TopicPartitionKey]SegmentFile{},
+		lru:   list.New(),
+	}
+}
+
+// Open creates a new segment
+func (f *FilePool) Open(segSize int, fileName string) SegmentFile {
+	temp, err := f.store.Create(fileName)
+	if err != nil {
+		panic(err)
+	}
+	if err = temp.Truncate(int64(segSize)); err != nil {
+		temp.Close()
+		panic(err)
+	}
+	return temp
+}
+
+func (f *FilePool) open() int {
+	return filesPerSegment*(len(f.data)+f.lru.Len()) + int(f.borrowed.Load())
+}
+
+// track hands the open files of an inactive segment to the pool, which
+// may close them straight away.
+func (f *FilePool) track(s *segment) {
+	s.files = f
+	s.elem = f.lru.PushFront(s)
+	f.evict(0)
+}
+
+// file returns the log of s, reopening it and its indexes if they were
+// evicted.
+func (f *FilePool) file(s *segment) (SegmentFile, error) {
+	if s.log != nil {
+		if s.elem != nil {
+			f.lru.MoveToFront(s.elem)
+		}
+		return s.log, nil
+	}
+
+	f.evict(filesPerSegment)
+	if err := s.reopen(); err != nil {
+		return nil, err
+	}
+	f.stats.Reopened++
+	s.elem = f.lru.PushFront(s)
+	return s.log, nil
+}
+
+// borrow opens a file for a read that happens outside the pool, such
+// as a range sent to a consumer once the lock is released. It counts
+// against the limit until it is closed.
+func (f *FilePool) borrow(path string) (SegmentFile, error) {
+	f.evict(1)
+	file, err := f.store.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	f.borrowed.Add(1)
+	return &borrowedFile{SegmentFile: file, pool: f}, nil
+}
+
+// borrowedFile is a file handed out by FilePool.borrow.
+type borrowedFile struct {
+	SegmentFile
+	pool   *FilePool
+	closed atomic.Bool
+}
+
+func (b *borrowedFile) Close() error {
+	if !b.closed.CompareAndSwap(false, true) {
+		return nil
+	}
+	b.pool.borrowed.Add(-1)
+	return b.SegmentFile.Close()
+}
+
+// forget stops tracking s, which is being closed.
+func (f *FilePool) forget(s *segment) {
+	if s.elem != nil {
+		f.lru.Remove(s.elem)
+		s.elem = nil
+	}
+}
+
+// evict closes the least recently used segments until n more files can
+// be opened without going over the limit.
+func (f *FilePool) evict(n int) {
+	for f.maxOpen > 0 && f.open()+n > f.maxOpen && f.lru.Len() > 0 {
+		s := f.lru.Remove(f.lru.Back()).(*segment)
+		s.elem = nil
+		if err := s.closeFiles(); err != nil {
+			log.Println("failed to close", s.path, err)
+		}
+		f.stats.Evicted++
+	}
+}
+
+// FilePoolStats returns the number of open segment files and the totals
+// since the broker started.
+func (k *KrakeBroker) FilePoolStats() FilePoolStats {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	stats := k.filePool.stats
+	stats.Open = k.filePool.open()
+	return stats
+}
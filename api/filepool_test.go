@@ -0,0 +1,174 @@
+package api
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// openLogs counts the segments whose log is open, their indexes are
+// open along with it.
+func openLogs(t *testing.T, l *partitionLog) int {
+	var open int
+	for _, s := range l.segments {
+		assert.Equal(t, s.log != nil, s.index != nil)
+		assert.Equal(t, s.log != nil, s.timeIndex != nil)
+		if s.log != nil {
+			open++
+		}
+	}
+	return open
+}
+
+func produceMessages(t *testing.T, b *KrakeBroker, from, to int) {
+	for i := from; i < to; i++ {
+		_, err := b.Produce("my-topic", &Message{Message: []byte(fmt.Sprintf("message-%d", i))})
+		assert.NoError(t, err)
+	}
+}
+
+func TestFilePool_EvictsLeastRecentlyUsed(t *testing.T) {
+	b, _ := newTestBroker(t, map[string]interface{}{
+		"log.segment.bytes":  300,
+		"log.open.files.max": 9,
+	}, myTopic)
+	produceMessages(t, b, 0, 30)
+	l := b.logs[TopicPartitionKey{"my-topic", 0}]
+	assert.Greater(t, len(l.segments), 5)
+
+	// only the log and indexes of the active segment and the two most
+	// recently rolled segments are open.
+	stats := b.FilePoolStats()
+	assert.Equal(t, 9, stats.Open)
+	assert.Equal(t, int64(len(l.segments)-3), stats.Evicted)
+	assert.Equal(t, 3, openLogs(t, l))
+	for _, s := range l.segments[len(l.segments)-3:] {
+		assert.NotNil(t, s.log)
+	}
+
+	// reading an evicted segment reopens it
+	first := l.segments[0]
+	assert.Nil(t, first.log)
+	batch, err := b.Fetch(TopicPartitionKey{"my-topic", 0}, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("message-0"), batch.Records[0].Value)
+	assert.NotNil(t, first.log)
+
+	stats = b.FilePoolStats()
+	assert.Equal(t, 9, stats.Open)
+	assert.Equal(t, int64(1), stats.Reopened)
+
+	// it is now the most recently used so rolling another segment
+	// evicts something else.
+	segments := len(l.segments)
+	for i := 30; len(l.segments) == segments; i++ {
+		produceMessages(t, b, i, i+1)
+	}
+	assert.NotNil(t, first.log)
+	assert.Equal(t, 3, openLogs(t, l))
+}
+
+func TestFilePool_Unlimited(t *testing.T) {
+	b, _ := newTestBroker(t, map[string]interface{}{
+		"log.segment.bytes": 300,
+	}, myTopic)
+	produceMessages(t, b, 0, 30)
+	l := b.logs[TopicPartitionKey{"my-topic", 0}]
+
+	stats := b.FilePoolStats()
+	assert.Equal(t, filesPerSegment*len(l.segments), stats.Open)
+	assert.Zero(t, stats.Evicted)
+	assert.Equal(t, len(l.segments), openLogs(t, l))
+}
+
+func TestFilePool_DeletesEvictedSegments(t *testing.T) {
+	b, now := newTestBroker(t, map[string]interface{}{
+		"log.segment.bytes":  300,
+		"log.open.files.max": 2,
+	}, myTopic)
+	cfg := b.topics["my-topic"]
+	cfg.RetentionPeriod = time.Hour
+	b.topics["my-topic"] = cfg
+
+	produceMessages(t, b, 0, 30)
+	l := b.logs[TopicPartitionKey{"my-topic", 0}]
+	first := l.segments[0]
+	assert.Nil(t, first.log)
+
+	*now = now.Add(2 * time.Hour)
+	assert.NoError(t, b.EnforceRetention())
+	assert.Len(t, l.segments, 1)
+	assertNotStored(t, b.store, first.path)
+	assert.Equal(t, filesPerSegment, b.FilePoolStats().Open)
+}
+
+func TestFilePool_CompactsEvictedSegments(t *testing.T) {
+	produce := func(b *KrakeBroker) {
+		for i := 0; i < 30; i++ {
+			appendKeyed(t, b, fmt.Sprintf("key-%d", i%3), []byte(fmt.Sprintf("value-%d", i)))
+		}
+	}
+
+	unbounded, _ := newCompactedBroker(t, map[string]interface{}{})
+	produce(unbounded)
+	assert.NoError(t, unbounded.CompactLogs())
+
+	bounded, _ := newCompactedBroker(t, map[string]interface{}{
+		"log.open.files.max": 6,
+	})
+	produce(bounded)
+	assert.NoError(t, bounded.CompactLogs())
+
+	l := bounded.logs[compactKey]
+	assert.Equal(t, logRecords(t, unbounded.logs[compactKey]), logRecords(t, l))
+	assert.LessOrEqual(t, openLogs(t, l), 2)
+}
+
+func TestFilePool_LoadLogs(t *testing.T) {
+	b, _ := newTestBroker(t, map[string]interface{}{
+		"log.segment.bytes":  300,
+		"log.open.files.max": 6,
+	}, myTopic)
+	produceMessages(t, b, 0, 30)
+	segments := len(b.logs[TopicPartitionKey{"my-topic", 0}].segments)
+	b.mu.Lock()
+	assert.NoError(t, b.Close())
+	b.mu.Unlock()
+
+	pw, restarted := newRestartBroker(b.store, b.logDirs()[0])
+	k := restarted.(*KrakeBroker)
+	k.Configure(b.Config)
+	assert.NoError(t, k.LoadLogs())
+	defer pw.Close()
+
+	l := pw.logs[TopicPartitionKey{"my-topic", 0}]
+	assert.Len(t, l.segments, segments)
+	assert.Equal(t, 6, k.FilePoolStats().Open)
+	assert.Equal(t, 2, openLogs(t, l))
+
+	batch, err := k.Fetch(TopicPartitionKey{"my-topic", 0}, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("message-0"), batch.Records[0].Value)
+}
+
+func TestFilePool_Borrow(t *testing.T) {
+	b, _ := newTestBroker(t, map[string]interface{}{
+		"log.segment.bytes":  300,
+		"log.open.files.max": 6,
+	}, myTopic)
+	produceMessages(t, b, 0, 30)
+	l := b.logs[TopicPartitionKey{"my-topic", 0}]
+	assert.Equal(t, 2, openLogs(t, l))
+
+	// a range being sent counts against the limit until it is closed
+	r, err := b.FetchFile("my-topic", 0, 0, 1<<20)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, openLogs(t, l))
+	assert.Equal(t, filesPerSegment+1, b.FilePoolStats().Open)
+
+	assert.NoError(t, r.Close())
+	assert.NoError(t, r.Close())
+	assert.Equal(t, filesPerSegment, b.FilePoolStats().Open)
+}
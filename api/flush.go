@@ -0,0 +1,186 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// flushConfig is the durability policy of the partition logs. By
+// default nothing is flushed and, like Kafka, we rely on the OS to
+// write the page cache back.
+type flushConfig struct {
+	// flush.messages, the active segment is fsynced once this many
+	// messages have been written since the last flush.
+	messages int
+	// flush.ms, the active segment is fsynced once the last flush is
+	// this old.
+	interval time.Duration
+	// flush.group.commit, producers waiting on a flush share a single
+	// fsync instead of taking turns.
+	groupCommit bool
+}
+
+func (k *KrakeBroker) flushConfig() flushConfig {
+	var cfg flushConfig
+	if v, ok := k.Config["flush.messages"].(int); ok {
+		cfg.messages = v
+	}
+	if v, ok := k.Config["flush.ms"].(int); ok {
+		cfg.interval = time.Duration(v) * time.Millisecond
+	}
+	if v, ok := k.Config["flush.group.commit"].(bool); ok {
+		cfg.groupCommit = v
+	}
+	return cfg
+}
+
+func (cfg flushConfig) enabled() bool {
+	return cfg.messages > 0 || cfg.interval > 0
+}
+
+// flushDue reports whether the policy requires the partition to be
+// flushed.
+func (l *partitionLog) flushDue(cfg flushConfig, now time.Time) bool {
+	if l.unflushed == 0 {
+		return false
+	}
+	if cfg.messages > 0 && l.unflushed >= cfg.messages {
+		return true
+	}
+	return cfg.interval > 0 && now.Sub(l.lastFlush) >= cfg.interval
+}
+
+// markFlushed resets the flush policy of the partition. The active
+// segment must be synced by the caller.
+func (l *partitionLog) markFlushed(now time.Time) {
+	l.unflushed = 0
+	l.lastFlush = now
+}
+
+// StartFlusher flushes partitions whose last flush is older than
+// flush.ms in the background, so writes to idle partitions do not wait
+// for the next produce. It stops when ctx is cancelled.
+func (k *KrakeBroker) StartFlusher(ctx context.Context) {
+	cfg := k.flushConfig()
+	if cfg.interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(cfg.interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := k.flushDueLogs(cfg); err != nil {
+					log.Println("failed to flush logs", err)
+				}
+			}
+		}
+	}()
+}
+
+func (k *KrakeBroker) flushDueLogs(cfg flushConfig) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	now := k.now()
+	for _, l := range k.logs {
+		if !l.flushDue(cfg, now) {
+			continue
+		}
+		if err := k.committer.sync(l.activeSegment().log); err != nil {
+			return err
+		}
+		l.markFlushed(now)
+	}
+	return nil
+}
+
+// groupCommitter fsyncs files on behalf of concurrent writers. The
+// first writer to arrive leads a group and waits for any fsync already
+// in flight. Everyone arriving meanwhile joins the group and the leader
+// then fsyncs once for all of them.
+type groupCommitter struct {
+	mu    sync.Mutex
+	files map[SegmentFile]*commitQueue
+
+	// number of fsyncs issued.
+	syncs int64
+
+	// overridden in tests.
+	fsync func(f SegmentFile) error
+}
+
+type commitQueue struct {
+	// held by the leader while it fsyncs.
+	syncing sync.Mutex
+	// the group new writers join, nil if there is none.
+	next *commitGroup
+	// writers using the queue, it is removed once this is zero.
+	refs int
+}
+
+type commitGroup struct {
+	done chan struct{}
+	err  error
+}
+
+func newGroupCommitter() *groupCommitter {
+	return &groupCommitter{
+		files: map[SegmentFile]*commitQueue{},
+		fsync: SegmentFile.Sync,
+	}
+}
+
+// sync returns once everything written to f before the call is on
+// disk.
+func (c *groupCommitter) sync(f SegmentFile) error {
+	c.mu.Lock()
+	q, ok := c.files[f]
+	if !ok {
+		q = &commitQueue{}
+		c.files[f] = q
+	}
+	q.refs++
+	g := q.next
+	leader := g == nil
+	if leader {
+		g = &commitGroup{done: make(chan struct{})}
+		q.next = g
+	}
+	c.mu.Unlock()
+
+	if leader {
+		q.syncing.Lock()
+		c.mu.Lock()
+		q.next = nil
+		c.syncs++
+		c.mu.Unlock()
+
+		g.err = c.fsync(f)
+		// the segment was rolled, which flushes it, and then deleted
+		// or compacted.
+		if errors.Is(g.err, os.ErrClosed) {
+			g.err = nil
+		}
+		q.syncing.Unlock()
+		close(g.done)
+	} else {
+		<-g.done
+	}
+
+	c.mu.Lock()
+	q.refs--
+	if q.refs == 0 {
+		delete(c.files, f)
+	}
+	c.mu.Unlock()
+	return g.err
+}
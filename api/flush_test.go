@@ -0,0 +1,163 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKrakeBroker_Produce_FlushMessages(t *testing.T) {
+	b, _ := newTestBroker(t, map[string]interface{}{
+		"flush.messages": 3,
+	}, myTopic)
+
+	var unflushed []int
+	for i := 0; i < 7; i++ {
+		_, err := b.Produce("my-topic", &Message{Message: []byte("message")})
+		assert.NoError(t, err)
+		unflushed = append(unflushed, b.logs[TopicPartitionKey{"my-topic", 0}].unflushed)
+	}
+
+	// every third message is flushed
+	assert.Equal(t, []int{1, 2, 0, 1, 2, 0, 1}, unflushed)
+}
+
+func TestKrakeBroker_Produce_FlushMs(t *testing.T) {
+	b, now := newTestBroker(t, map[string]interface{}{
+		"flush.ms": 1000,
+	}, myTopic)
+	l := func() *partitionLog { return b.logs[TopicPartitionKey{"my-topic", 0}] }
+	start := *now
+
+	var unflushed []int
+	for i := 0; i < 5; i++ {
+		*now = start.Add(time.Duration(i) * 400 * time.Millisecond)
+		_, err := b.Produce("my-topic", &Message{Message: []byte("message")})
+		assert.NoError(t, err)
+		unflushed = append(unflushed, l().unflushed)
+	}
+
+	// the message written a second after the last flush is flushed
+	assert.Equal(t, []int{1, 2, 3, 0, 1}, unflushed)
+
+	// the flusher picks up partitions nobody writes to
+	assert.NoError(t, b.flushDueLogs(b.flushConfig()))
+	assert.Equal(t, 1, l().unflushed)
+
+	*now = now.Add(time.Second)
+	assert.NoError(t, b.flushDueLogs(b.flushConfig()))
+	assert.Equal(t, 0, l().unflushed)
+	assert.Equal(t, *now, l().lastFlush)
+}
+
+func TestKrakeBroker_StartFlusher(t *testing.T) {
+	b, now := newTestBroker(t, map[string]interface{}{
+		"flush.ms": 1,
+	}, myTopic)
+
+	_, err := b.Produce("my-topic", &Message{Message: []byte("message")})
+	assert.NoError(t, err)
+
+	b.mu.Lock()
+	*now = now.Add(time.Second)
+	b.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	b.StartFlusher(ctx)
+
+	assert.Eventually(t, func() bool {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		return b.logs[TopicPartitionKey{"my-topic", 0}].unflushed == 0
+	}, time.Second, time.Millisecond)
+}
+
+func TestKrakeBroker_Produce_GroupCommit(t *testing.T) {
+	b, _ := newTestBroker(t, map[string]interface{}{
+		"flush.messages":     1,
+		"flush.group.commit": true,
+	}, myTopic)
+
+	// a slow disk so producers pile up behind the fsync in flight
+	b.committer.fsync = func(f SegmentFile) error {
+		time.Sleep(20 * time.Millisecond)
+		return f.Sync()
+	}
+
+	const producers = 16
+	var wg sync.WaitGroup
+	for i := 0; i < producers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := b.Produce("my-topic", &Message{Message: []byte(fmt.Sprintf("message: %d", i))})
+			assert.NoError(t, err)
+		}(i)
+	}
+	wg.Wait()
+
+	// every producer waited for an fsync but they were shared
+	assert.Less(t, b.committer.syncs, int64(producers/2))
+	assert.Empty(t, b.committer.files)
+
+	for offs := int64(0); offs < producers; offs++ {
+		_, err := b.Fetch(TopicPartitionKey{"my-topic", 0}, offs)
+		assert.NoError(t, err)
+	}
+}
+
+func TestGroupCommitter_ClosedFile(t *testing.T) {
+	f, err := os.Create(t.TempDir() + "/segment.log")
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+
+	// the file was closed after being rolled
+	c := newGroupCommitter()
+	assert.NoError(t, c.sync(f))
+}
+
+func BenchmarkKrakeBroker_Produce(b *testing.B) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	modes := []struct {
+		name string
+		cfg  map[string]interface{}
+	}{
+		{"no-flush", map[string]interface{}{}},
+		{"flush.ms=10", map[string]interface{}{"flush.ms": 10}},
+		{"flush.messages=100", map[string]interface{}{"flush.messages": 100}},
+		{"flush.messages=1", map[string]interface{}{"flush.messages": 1}},
+		{"flush.messages=1,group-commit", map[string]interface{}{"flush.messages": 1, "flush.group.commit": true}},
+	}
+
+	payload := make([]byte, 100)
+	for _, mode := range modes {
+		b.Run(mode.name, func(b *testing.B) {
+			mode.cfg["log.segment.bytes"] = 64 * 1024 * 1024
+			mode.cfg["log.dirs"] = b.TempDir()
+			k, _ := newTestBroker(b, mode.cfg, myTopic)
+			k.now = time.Now
+
+			b.SetBytes(int64(len(payload)))
+			b.SetParallelism(8)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if _, err := k.Produce("my-topic", &Message{Message: payload}); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
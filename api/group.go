@@ -0,0 +1,455 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	ErrInvalidGroupID    = errors.New("invalid group id")
+	ErrUnknownMemberID   = errors.New("unknown member id")
+	ErrIllegalGeneration = errors.New("illegal generation")
+)
+
+// groupOffsetsFile in the first log dir holds the offsets committed by
+// each consumer group.
+const groupOffsetsFile = "consumer-offsets"
+
+// GroupMembership is a member of a consumer group and the partitions
+// assigned to it in the current generation of the group.
+type GroupMembership struct {
+	MemberID   uint32
+	Generation int32
+	Assignment []TopicPartitionKey
+}
+
+// consumerGroup is what the coordinator knows of a group.id. Every
+// member joining or leaving starts a new generation whose partitions
+// are assigned again.
+type consumerGroup struct {
+	id         string
+	generation int32
+	members    map[uint32]*groupMember
+}
+
+type groupMember struct {
+	id            uint32
+	topics        []string
+	lastHeartbeat time.Time
+	assignment    []TopicPartitionKey
+
+	// the next offset to read from each assigned partition, starting
+	// at the committed offset of the group.
+	positions map[TopicPartitionKey]int64
+}
+
+func (g *consumerGroup) membership(m *groupMember) GroupMembership {
+	return GroupMembership{
+		MemberID:   m.id,
+		Generation: g.generation,
+		Assignment: append([]TopicPartitionKey(nil), m.assignment...),
+	}
+}
+
+// JoinGroup adds a consumer to a group, or updates the topics of a
+// member when memberID is set. The partitions of the group are assigned
+// again when a member joins or its topics change, which starts a new
+// generation. The member reads with ReadMessage using its member id.
+func (k *KrakeBroker) JoinGroup(groupID string, memberID uint32, topics []string) (GroupMembership, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if groupID == "" {
+		return GroupMembership{}, ErrInvalidGroupID
+	}
+	topics = append([]string(nil), topics...)
+	sort.Strings(topics)
+
+	g, ok := k.groups[groupID]
+	if !ok {
+		g = &consumerGroup{id: groupID, members: map[uint32]*groupMember{}}
+	}
+	m, ok := g.members[memberID]
+	switch {
+	case memberID == 0:
+		m = &groupMember{id: k.newConsumerID(), topics: topics}
+		g.members[m.id] = m
+		k.groups[groupID] = g
+		k.offs[m.id] = ConsumerConfiguration{ID: m.id, GroupID: groupID}
+		m.lastHeartbeat = k.now()
+		k.rebalance(g)
+		return g.membership(m), nil
+	case !ok:
+		return GroupMembership{}, fmt.Errorf("%w: %d in group %s", ErrUnknownMemberID, memberID, groupID)
+	}
+
+	m.lastHeartbeat = k.now()
+	if !equalTopics(m.topics, topics) {
+		m.topics = topics
+		k.rebalance(g)
+	}
+	return g.membership(m), nil
+}
+
+// newConsumerID returns an id not used by any consumer.
+func (k *KrakeBroker) newConsumerID() uint32 {
+	for {
+		u, _ := uuid.NewUUID()
+		if _, ok := k.offs[u.ID()]; !ok && u.ID() != 0 {
+			return u.ID()
+		}
+	}
+}
+
+func equalTopics(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// rebalance starts a new generation of the group and assigns the
+// partitions of each topic in ranges across the members subscribed to
+// it, like Kafka's RangeAssignor. Members read their new partitions
+// from the committed offsets of the group.
+func (k *KrakeBroker) rebalance(g *consumerGroup) {
+	g.generation++
+
+	subscribers := map[string][]*groupMember{}
+	for _, m := range g.members {
+		m.assignment = nil
+		m.positions = map[TopicPartitionKey]int64{}
+		for _, topic := range m.topics {
+			subscribers[topic] = append(subscribers[topic], m)
+		}
+	}
+
+	for topic, members := range subscribers {
+		cfg, ok := k.topics[topic]
+		if !ok {
+			continue
+		}
+		sort.Slice(members, func(i, j int) bool {
+			return members[i].id < members[j].id
+		})
+		per, extra := cfg.PartitionCount/len(members), cfg.PartitionCount%len(members)
+		next := 0
+		for i, m := range members {
+			n := per
+			if i < extra {
+				n++
+			}
+			for ; n > 0; n-- {
+				m.assignment = append(m.assignment, TopicPartitionKey{topic, int32(next)})
+				next++
+			}
+		}
+	}
+
+	for _, m := range g.members {
+		sort.Slice(m.assignment, func(i, j int) bool {
+			a, b := m.assignment[i], m.assignment[j]
+			if a.Topic != b.Topic {
+				return a.Topic < b.Topic
+			}
+			return a.PartitionIndex < b.PartitionIndex
+		})
+	}
+	log.Println("group", g.id, "rebalanced to generation", g.generation, "with", len(g.members), "members")
+}
+
+// member returns a member of a group.
+func (k *KrakeBroker) member(groupID string, memberID uint32) (*consumerGroup, *groupMember, error) {
+	g, ok := k.groups[groupID]
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: %d in group %s", ErrUnknownMemberID, memberID, groupID)
+	}
+	m, ok := g.members[memberID]
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: %d in group %s", ErrUnknownMemberID, memberID, groupID)
+	}
+	return g, m, nil
+}
+
+// Heartbeat keeps a member in its group. It fails with
+// ErrIllegalGeneration once the group has moved on to a new generation,
+// the member then joins again to learn its new partitions.
+func (k *KrakeBroker) Heartbeat(groupID string, memberID uint32, generation int32) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	g, m, err := k.member(groupID, memberID)
+	if err != nil {
+		return err
+	}
+	m.lastHeartbeat = k.now()
+	if generation != g.generation {
+		return fmt.Errorf("%w: %d, group %s is at %d", ErrIllegalGeneration, generation, groupID, g.generation)
+	}
+	return nil
+}
+
+// LeaveGroup removes a member from its group and assigns its
+// partitions to the other members.
+func (k *KrakeBroker) LeaveGroup(groupID string, memberID uint32) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	g, _, err := k.member(groupID, memberID)
+	if err != nil {
+		return err
+	}
+	k.removeMembers(g, memberID)
+	return nil
+}
+
+func (k *KrakeBroker) removeMembers(g *consumerGroup, memberIDs ...uint32) {
+	for _, id := range memberIDs {
+		delete(g.members, id)
+		delete(k.offs, id)
+	}
+	if len(g.members) == 0 {
+		// the committed offsets outlive the group's members.
+		delete(k.groups, g.id)
+		return
+	}
+	k.rebalance(g)
+}
+
+// groupSessionTimeout is group.consumer.session.timeout.ms, how long a
+// member may go without a heartbeat before it is removed from its
+// group.
+func (k *KrakeBroker) groupSessionTimeout() time.Duration {
+	if v, ok := k.Config["group.consumer.session.timeout.ms"].(int); ok {
+		return time.Duration(v) * time.Millisecond
+	}
+	return 45 * time.Second
+}
+
+// groupCheckInterval is group.consumer.heartbeat.interval.ms, how often
+// members are checked for their session timeout.
+func (k *KrakeBroker) groupCheckInterval() time.Duration {
+	if v, ok := k.Config["group.consumer.heartbeat.interval.ms"].(int); ok {
+		return time.Duration(v) * time.Millisecond
+	}
+	return 5 * time.Second
+}
+
+// StartGroupExpiry removes members whose session times out in the
+// background until ctx is cancelled.
+func (k *KrakeBroker) StartGroupExpiry(ctx context.Context) {
+	ticker := time.NewTicker(k.groupCheckInterval())
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				k.ExpireGroupMembers()
+			}
+		}
+	}()
+}
+
+// ExpireGroupMembers removes the members that have not sent a heartbeat
+// for group.consumer.session.timeout.ms and assigns their partitions to
+// the rest of their group.
+func (k *KrakeBroker) ExpireGroupMembers() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	timeout := k.groupSessionTimeout()
+	cutoff := k.now().Add(-timeout)
+	for _, g := range k.groups {
+		var expired []uint32
+		for id, m := range g.members {
+			if m.lastHeartbeat.Before(cutoff) {
+				expired = append(expired, id)
+			}
+		}
+		if len(expired) == 0 {
+			continue
+		}
+		log.Println("removing", len(expired), "members of group", g.id, "without a heartbeat for", timeout)
+		k.removeMembers(g, expired...)
+	}
+}
+
+// readGroupMessage reads the next message of the topic from the
+// partitions assigned to a member, in order, and moves the member past
+// it.
+func (k *KrakeBroker) readGroupMessage(topic string, cfg ConsumerConfiguration) (*Message, error) {
+	if _, ok := k.topics[topic]; !ok {
+		return nil, ErrNoSuchTopic
+	}
+	_, m, err := k.member(cfg.GroupID, cfg.ID)
+	if err != nil {
+		return nil, err
+	}
+	if err = k.loadGroupOffsets(); err != nil {
+		return nil, err
+	}
+
+	for _, key := range m.assignment {
+		if key.Topic != topic {
+			continue
+		}
+		position, ok := m.positions[key]
+		if !ok {
+			// FIXME(FELIX): handle auto.offset.reset latest.
+			position = k.groupOffsets[cfg.GroupID][key]
+		}
+		msg, err := k.readMessageAt(key, position, cfg.IsolationLevel)
+		if errors.Is(err, ErrOffsetOutOfRange) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		m.positions[key] = msg.Offset + 1
+		return msg, nil
+	}
+	return nil, ErrOffsetOutOfRange
+}
+
+// committedOffset is an offset committed by a group, as saved to the
+// consumer-offsets file.
+type committedOffset struct {
+	Group     string
+	Topic     string
+	Partition int32
+	Offset    int64
+}
+
+func (k *KrakeBroker) groupOffsetsPath() string {
+	return filepath.Join(k.logDirs()[0], groupOffsetsFile)
+}
+
+func (k *KrakeBroker) loadGroupOffsets() error {
+	if k.groupOffsets != nil {
+		return nil
+	}
+
+	groupOffsets := map[string]map[TopicPartitionKey]int64{}
+	data, err := readFile(k.store, k.groupOffsetsPath())
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err == nil {
+		var saved []committedOffset
+		if err = json.Unmarshal(data, &saved); err != nil {
+			return fmt.Errorf("%s: %w", groupOffsetsFile, err)
+		}
+		for _, c := range saved {
+			if groupOffsets[c.Group] == nil {
+				groupOffsets[c.Group] = map[TopicPartitionKey]int64{}
+			}
+			groupOffsets[c.Group][TopicPartitionKey{c.Topic, c.Partition}] = c.Offset
+		}
+	}
+	k.groupOffsets = groupOffsets
+	return nil
+}
+
+func (k *KrakeBroker) writeGroupOffsets() error {
+	var saved []committedOffset
+	for group, offsets := range k.groupOffsets {
+		for key, offset := range offsets {
+			saved = append(saved, committedOffset{group, key.Topic, key.PartitionIndex, offset})
+		}
+	}
+	sort.Slice(saved, func(i, j int) bool {
+		a, b := saved[i], saved[j]
+		if a.Group != b.Group {
+			return a.Group < b.Group
+		}
+		if a.Topic != b.Topic {
+			return a.Topic < b.Topic
+		}
+		return a.Partition < b.Partition
+	})
+	data, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+
+	if err = k.store.MkdirAll(k.logDirs()[0]); err != nil {
+		return err
+	}
+	path := k.groupOffsetsPath()
+	tmp := path + ".tmp"
+	if err = writeFile(k.store, tmp, data); err != nil {
+		return err
+	}
+	return k.store.Rename(tmp, path)
+}
+
+// CommitOffsets saves the offsets a member of a group has consumed up
+// to, the next offset to read from each partition. Members of an older
+// generation are rejected as their partitions may have been assigned to
+// another member since.
+func (k *KrakeBroker) CommitOffsets(groupID string, memberID uint32, generation int32, offsets map[TopicPartitionKey]int64) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	g, _, err := k.member(groupID, memberID)
+	if err != nil {
+		return err
+	}
+	if generation != g.generation {
+		return fmt.Errorf("%w: %d, group %s is at %d", ErrIllegalGeneration, generation, groupID, g.generation)
+	}
+	for key := range offsets {
+		cfg, ok := k.topics[key.Topic]
+		if !ok {
+			return fmt.Errorf("%w: %s", ErrNoSuchTopic, key.Topic)
+		}
+		if key.PartitionIndex < 0 || int(key.PartitionIndex) >= cfg.PartitionCount {
+			return fmt.Errorf("%w: %d of %s", ErrUnknownPartition, key.PartitionIndex, key.Topic)
+		}
+	}
+
+	if err = k.loadGroupOffsets(); err != nil {
+		return err
+	}
+	if k.groupOffsets[groupID] == nil {
+		k.groupOffsets[groupID] = map[TopicPartitionKey]int64{}
+	}
+	for key, offset := range offsets {
+		k.groupOffsets[groupID][key] = offset
+	}
+	return k.writeGroupOffsets()
+}
+
+// FetchOffsets returns the offsets committed by a group.
+func (k *KrakeBroker) FetchOffsets(groupID string) (map[TopicPartitionKey]int64, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if groupID == "" {
+		return nil, ErrInvalidGroupID
+	}
+	if err := k.loadGroupOffsets(); err != nil {
+		return nil, err
+	}
+	offsets := map[TopicPartitionKey]int64{}
+	for key, offset := range k.groupOffsets[groupID] {
+		offsets[key] = offset
+	}
+	return offsets, nil
+}
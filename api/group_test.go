@@ -0,0 +1,161 @@
+package api
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newGroupBroker writes two messages to each of the three partitions
+// of the events topic.
+func newGroupBroker(t *testing.T) (*KrakeBroker, *time.Time) {
+	b, now := newTestBroker(t, map[string]interface{}{"log.segment.bytes": 10_000},
+		TopicConfiguration{Name: "events", PartitionCount: 3})
+	for p := int32(0); p < 3; p++ {
+		for i := 0; i < 2; i++ {
+			_, err := b.Produce("events", &Message{
+				Message:         []byte(fmt.Sprintf("%d-%d", p, i)),
+				TargetPartition: partition(p),
+			})
+			assert.NoError(t, err)
+		}
+	}
+	return b, now
+}
+
+// readAll reads every message a member can read until the end of its
+// partitions.
+func readAll(t *testing.T, b *KrakeBroker, memberID uint32) []string {
+	var read []string
+	for {
+		msg, err := b.ReadMessage("events", memberID, -1)
+		if err != nil {
+			assert.ErrorIs(t, err, ErrOffsetOutOfRange)
+			return read
+		}
+		read = append(read, string(msg.Message))
+	}
+}
+
+func TestKrakeBroker_JoinGroup(t *testing.T) {
+	b, _ := newGroupBroker(t)
+
+	first, err := b.JoinGroup("billing", 0, []string{"events"})
+	assert.NoError(t, err)
+	assert.Equal(t, int32(1), first.Generation)
+	assert.Len(t, first.Assignment, 3)
+
+	// a second member splits the partitions and starts a generation
+	second, err := b.JoinGroup("billing", 0, []string{"events"})
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), second.Generation)
+	assert.ErrorIs(t, b.Heartbeat("billing", first.MemberID, first.Generation), ErrIllegalGeneration)
+
+	first, err = b.JoinGroup("billing", first.MemberID, []string{"events"})
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), first.Generation)
+	assert.NoError(t, b.Heartbeat("billing", first.MemberID, first.Generation))
+	assert.ElementsMatch(t, []int{1, 2}, []int{len(first.Assignment), len(second.Assignment)})
+	assert.ElementsMatch(t,
+		[]TopicPartitionKey{{"events", 0}, {"events", 1}, {"events", 2}},
+		append(first.Assignment, second.Assignment...))
+
+	// groups are independent of each other
+	other, err := b.JoinGroup("audit", 0, []string{"events"})
+	assert.NoError(t, err)
+	assert.Len(t, other.Assignment, 3)
+
+	_, err = b.JoinGroup("", 0, []string{"events"})
+	assert.ErrorIs(t, err, ErrInvalidGroupID)
+	_, err = b.JoinGroup("billing", 42, []string{"events"})
+	assert.ErrorIs(t, err, ErrUnknownMemberID)
+	assert.ErrorIs(t, b.Heartbeat("audit", first.MemberID, 1), ErrUnknownMemberID)
+}
+
+func TestKrakeBroker_ReadMessage_Group(t *testing.T) {
+	b, _ := newGroupBroker(t)
+
+	first, err := b.JoinGroup("billing", 0, []string{"events"})
+	assert.NoError(t, err)
+	second, err := b.JoinGroup("billing", 0, []string{"events"})
+	assert.NoError(t, err)
+
+	// each member reads its own partitions
+	read := append(readAll(t, b, first.MemberID), readAll(t, b, second.MemberID)...)
+	assert.ElementsMatch(t, []string{"0-0", "0-1", "1-0", "1-1", "2-0", "2-1"}, read)
+
+	// the partitions of a member that leaves are read again from the
+	// committed offsets by the rest of the group
+	assert.NoError(t, b.CommitOffsets("billing", second.MemberID, second.Generation, map[TopicPartitionKey]int64{
+		{"events", 0}: 1,
+		{"events", 1}: 1,
+		{"events", 2}: 1,
+	}))
+	assert.NoError(t, b.LeaveGroup("billing", second.MemberID))
+	_, err = b.ReadMessage("events", second.MemberID, -1)
+	assert.ErrorIs(t, err, ErrUnknownConsumer)
+	assert.ElementsMatch(t, []string{"0-1", "1-1", "2-1"}, readAll(t, b, first.MemberID))
+}
+
+func TestKrakeBroker_CommitOffsets(t *testing.T) {
+	b, _ := newGroupBroker(t)
+
+	member, err := b.JoinGroup("billing", 0, []string{"events"})
+	assert.NoError(t, err)
+	offsets := map[TopicPartitionKey]int64{{"events", 0}: 2, {"events", 2}: 1}
+	assert.NoError(t, b.CommitOffsets("billing", member.MemberID, member.Generation, offsets))
+
+	// members of an older generation may no longer own the partitions
+	err = b.CommitOffsets("billing", member.MemberID, member.Generation-1, offsets)
+	assert.ErrorIs(t, err, ErrIllegalGeneration)
+	err = b.CommitOffsets("billing", member.MemberID, member.Generation, map[TopicPartitionKey]int64{{"events", 5}: 1})
+	assert.ErrorIs(t, err, ErrUnknownPartition)
+	err = b.CommitOffsets("audit", member.MemberID, member.Generation, offsets)
+	assert.ErrorIs(t, err, ErrUnknownMemberID)
+
+	// the offsets are kept after the broker restarts
+	assert.NoError(t, b.Close())
+	restartedPW, restarted := newRestartBroker(b.store, memoryLogDir)
+	k := restarted.(*KrakeBroker)
+	assert.NoError(t, k.LoadLogs())
+	defer restartedPW.Close()
+
+	committed, err := k.FetchOffsets("billing")
+	assert.NoError(t, err)
+	assert.Equal(t, offsets, committed)
+	committed, err = k.FetchOffsets("audit")
+	assert.NoError(t, err)
+	assert.Empty(t, committed)
+
+	member, err = k.JoinGroup("billing", 0, []string{"events"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"1-0", "1-1", "2-1"}, readAll(t, k, member.MemberID))
+}
+
+func TestKrakeBroker_ExpireGroupMembers(t *testing.T) {
+	b, now := newGroupBroker(t)
+	b.Config["group.consumer.session.timeout.ms"] = 1000
+
+	first, err := b.JoinGroup("billing", 0, []string{"events"})
+	assert.NoError(t, err)
+	second, err := b.JoinGroup("billing", 0, []string{"events"})
+	assert.NoError(t, err)
+
+	*now = now.Add(800 * time.Millisecond)
+	assert.NoError(t, b.Heartbeat("billing", first.MemberID, second.Generation))
+	*now = now.Add(800 * time.Millisecond)
+	b.ExpireGroupMembers()
+
+	// the member that stopped sending heartbeats is removed
+	assert.ErrorIs(t, b.Heartbeat("billing", second.MemberID, second.Generation), ErrUnknownMemberID)
+	assert.ErrorIs(t, b.Heartbeat("billing", first.MemberID, second.Generation), ErrIllegalGeneration)
+	first, err = b.JoinGroup("billing", first.MemberID, []string{"events"})
+	assert.NoError(t, err)
+	assert.Len(t, first.Assignment, 3)
+
+	*now = now.Add(2 * time.Second)
+	b.ExpireGroupMembers()
+	assert.Empty(t, b.groups)
+}
@@ -0,0 +1,257 @@
+package api
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+)
+
+var errIndexFull = errors.New("index is full")
+
+// indexFile is a preallocated, memory-mapped file made up of fixed
+// size entries. Entries are appended in order and the file is trimmed
+// to the entries actually written once the segment is rolled.
+type indexFile struct {
+	file      SegmentFile
+	mmap      []byte
+	entrySize int
+	entries   int
+}
+
+// openIndexFile opens an index, preallocating maxIndexSize bytes for
+// new entries. An index opened with a maxIndexSize of 0 is only read
+// and keeps its size.
+func openIndexFile(store SegmentStore, path string, entrySize int, maxIndexSize int) (*indexFile, error) {
+	f, err := openOrCreate(store, path)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	// an existing index may have been trimmed when its segment was
+	// rolled, in which case every entry in it is valid.
+	entries := int(info.Size()) / entrySize
+	if maxIndexSize == 0 {
+		idx := &indexFile{file: f, entrySize: entrySize, entries: entries}
+		if entries == 0 {
+			return idx, nil
+		}
+		if idx.mmap, err = mapFile(f, entries*entrySize); err != nil {
+			f.Close()
+			return nil, err
+		}
+		return idx, nil
+	}
+
+	size := maxIndexSize - maxIndexSize%entrySize
+	if size < entries*entrySize {
+		size = entries * entrySize
+	}
+	if size < entrySize {
+		size = entrySize
+	}
+
+	if err = f.Truncate(int64(size)); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	m, err := mapFile(f, size)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &indexFile{
+		file:      f,
+		mmap:      m,
+		entrySize: entrySize,
+		entries:   entries,
+	}, nil
+}
+
+func (idx *indexFile) isFull() bool {
+	return (idx.entries+1)*idx.entrySize > len(idx.mmap)
+}
+
+func (idx *indexFile) entry(n int) []byte {
+	return idx.mmap[n*idx.entrySize : (n+1)*idx.entrySize]
+}
+
+// next returns the slot for the next entry, or errIndexFull.
+func (idx *indexFile) next() ([]byte, error) {
+	if idx.isFull() {
+		return nil, errIndexFull
+	}
+	b := idx.entry(idx.entries)
+	idx.entries++
+	return b, nil
+}
+
+// search returns the last entry for which greater returns false, or -1
+// if greater is true for every entry. greater must be monotonic over
+// the entries.
+func (idx *indexFile) search(greater func(entry []byte) bool) int {
+	return sort.Search(idx.entries, func(i int) bool {
+		return greater(idx.entry(i))
+	}) - 1
+}
+
+// trim unmaps the index and shrinks the file to the written entries.
+// The index stays readable.
+func (idx *indexFile) trim() error {
+	size := idx.entries * idx.entrySize
+	if size == len(idx.mmap) {
+		return nil
+	}
+	if err := unmapFile(idx.file, idx.mmap); err != nil {
+		return err
+	}
+	if err := idx.file.Truncate(int64(size)); err != nil {
+		return err
+	}
+	if size == 0 {
+		idx.mmap = nil
+		return nil
+	}
+	m, err := mapFile(idx.file, size)
+	if err != nil {
+		return err
+	}
+	idx.mmap = m
+	return nil
+}
+
+func (idx *indexFile) close() error {
+	if err := idx.trim(); err != nil {
+		return err
+	}
+	if idx.mmap != nil {
+		if err := unmapFile(idx.file, idx.mmap); err != nil {
+			return err
+		}
+		idx.mmap = nil
+	}
+	return idx.file.Close()
+}
+
+// offsetIndexEntrySize is a 4 byte offset relative to the segment
+// base offset followed by a 4 byte position in the log.
+const offsetIndexEntrySize = 8
+
+// offsetIndex is a sparse index mapping offsets in a segment to their
+// position in the log file. An entry is only added once every
+// index.interval.bytes so lookups land near, but not necessarily on,
+// the requested offset.
+type offsetIndex struct {
+	*indexFile
+	baseOffset int64
+}
+
+func openOffsetIndex(store SegmentStore, path string, baseOffset int64, maxIndexSize int) (*offsetIndex, error) {
+	f, err := openIndexFile(store, path, offsetIndexEntrySize, maxIndexSize)
+	if err != nil {
+		return nil, err
+	}
+	return &offsetIndex{indexFile: f, baseOffset: baseOffset}, nil
+}
+
+func (idx *offsetIndex) read(n int) (int64, int64) {
+	e := idx.entry(n)
+	relOffset := binary.BigEndian.Uint32(e[0:4])
+	position := binary.BigEndian.Uint32(e[4:8])
+	return idx.baseOffset + int64(relOffset), int64(position)
+}
+
+// append adds an entry for offset at the given log position. Offsets
+// must be appended in increasing order.
+func (idx *offsetIndex) append(offset int64, position int64) error {
+	if idx.entries > 0 {
+		if last, _ := idx.read(idx.entries - 1); offset <= last {
+			return nil
+		}
+	}
+	e, err := idx.next()
+	if err != nil {
+		return err
+	}
+	binary.BigEndian.PutUint32(e[0:4], uint32(offset-idx.baseOffset))
+	binary.BigEndian.PutUint32(e[4:8], uint32(position))
+	return nil
+}
+
+// lookup finds the largest indexed offset less than or equal to
+// offset and returns it with its log position. If no such entry
+// exists the start of the segment is returned.
+func (idx *offsetIndex) lookup(offset int64) (int64, int64) {
+	rel := offset - idx.baseOffset
+	n := idx.search(func(e []byte) bool {
+		return int64(binary.BigEndian.Uint32(e[0:4])) > rel
+	})
+	if n < 0 {
+		return idx.baseOffset, 0
+	}
+	return idx.read(n)
+}
+
+// timeIndexEntrySize is an 8 byte timestamp followed by a 4 byte
+// offset relative to the segment base offset.
+const timeIndexEntrySize = 12
+
+// timeIndex maps the largest timestamp seen so far in a segment to
+// the offset of the record that carried it. Like the offset index it
+// is sparse and entries are only appended when the timestamp grows.
+type timeIndex struct {
+	*indexFile
+	baseOffset int64
+}
+
+func openTimeIndex(store SegmentStore, path string, baseOffset int64, maxIndexSize int) (*timeIndex, error) {
+	f, err := openIndexFile(store, path, timeIndexEntrySize, maxIndexSize)
+	if err != nil {
+		return nil, err
+	}
+	return &timeIndex{indexFile: f, baseOffset: baseOffset}, nil
+}
+
+func (idx *timeIndex) read(n int) (int64, int64) {
+	e := idx.entry(n)
+	timestamp := int64(binary.BigEndian.Uint64(e[0:8]))
+	relOffset := binary.BigEndian.Uint32(e[8:12])
+	return timestamp, idx.baseOffset + int64(relOffset)
+}
+
+// append adds an entry if timestamp is larger than the last one.
+func (idx *timeIndex) append(timestamp int64, offset int64) error {
+	if idx.entries > 0 {
+		if last, _ := idx.read(idx.entries - 1); timestamp <= last {
+			return nil
+		}
+	}
+	e, err := idx.next()
+	if err != nil {
+		return err
+	}
+	binary.BigEndian.PutUint64(e[0:8], uint64(timestamp))
+	binary.BigEndian.PutUint32(e[8:12], uint32(offset-idx.baseOffset))
+	return nil
+}
+
+// lookup finds the largest indexed timestamp less than or equal to
+// timestamp and returns the offset to start scanning from. If no such
+// entry exists the segment base offset is returned.
+func (idx *timeIndex) lookup(timestamp int64) int64 {
+	n := idx.search(func(e []byte) bool {
+		return int64(binary.BigEndian.Uint64(e[0:8])) > timestamp
+	})
+	if n < 0 {
+		return idx.baseOffset
+	}
+	_, offset := idx.read(n)
+	return offset
+}
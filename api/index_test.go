@@ -0,0 +1,100 @@
+package api
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOffsetIndex_Lookup(t *testing.T) {
+	idx, err := openOffsetIndex(NewFileStore(), filepath.Join(t.TempDir(), "0.index"), 100, 1024)
+	assert.NoError(t, err)
+	defer idx.close()
+
+	// nothing indexed yet so we scan from the start of the segment
+	offs, pos := idx.lookup(150)
+	assert.Equal(t, int64(100), offs)
+	assert.Equal(t, int64(0), pos)
+
+	assert.NoError(t, idx.append(110, 400))
+	assert.NoError(t, idx.append(120, 800))
+	assert.NoError(t, idx.append(130, 1200))
+
+	offs, pos = idx.lookup(105)
+	assert.Equal(t, int64(100), offs)
+	assert.Equal(t, int64(0), pos)
+
+	offs, pos = idx.lookup(120)
+	assert.Equal(t, int64(120), offs)
+	assert.Equal(t, int64(800), pos)
+
+	offs, pos = idx.lookup(129)
+	assert.Equal(t, int64(120), offs)
+	assert.Equal(t, int64(800), pos)
+
+	offs, pos = idx.lookup(1_000)
+	assert.Equal(t, int64(130), offs)
+	assert.Equal(t, int64(1200), pos)
+}
+
+func TestOffsetIndex_IgnoresOutOfOrderEntries(t *testing.T) {
+	idx, err := openOffsetIndex(NewFileStore(), filepath.Join(t.TempDir(), "0.index"), 0, 1024)
+	assert.NoError(t, err)
+	defer idx.close()
+
+	assert.NoError(t, idx.append(10, 100))
+	assert.NoError(t, idx.append(5, 50))
+	assert.Equal(t, 1, idx.entries)
+}
+
+func TestOffsetIndex_Full(t *testing.T) {
+	idx, err := openOffsetIndex(NewFileStore(), filepath.Join(t.TempDir(), "0.index"), 0, 2*offsetIndexEntrySize)
+	assert.NoError(t, err)
+	defer idx.close()
+
+	assert.NoError(t, idx.append(1, 10))
+	assert.False(t, idx.isFull())
+	assert.NoError(t, idx.append(2, 20))
+	assert.True(t, idx.isFull())
+	assert.ErrorIs(t, idx.append(3, 30), errIndexFull)
+}
+
+func TestOffsetIndex_TrimAndReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "0.index")
+
+	idx, err := openOffsetIndex(NewFileStore(), path, 0, 1024)
+	assert.NoError(t, err)
+	assert.NoError(t, idx.append(10, 100))
+	assert.NoError(t, idx.append(20, 200))
+	assert.NoError(t, idx.close())
+
+	idx, err = openOffsetIndex(NewFileStore(), path, 0, 1024)
+	assert.NoError(t, err)
+	defer idx.close()
+
+	assert.Equal(t, 2, idx.entries)
+	offs, pos := idx.lookup(25)
+	assert.Equal(t, int64(20), offs)
+	assert.Equal(t, int64(200), pos)
+}
+
+func TestTimeIndex_Lookup(t *testing.T) {
+	idx, err := openTimeIndex(NewFileStore(), filepath.Join(t.TempDir(), "0.timeindex"), 100, 1024)
+	assert.NoError(t, err)
+	defer idx.close()
+
+	assert.Equal(t, int64(100), idx.lookup(5_000))
+
+	assert.NoError(t, idx.append(1_000, 110))
+	assert.NoError(t, idx.append(2_000, 120))
+	// timestamps that go backwards are not indexed
+	assert.NoError(t, idx.append(1_500, 125))
+	assert.NoError(t, idx.append(3_000, 130))
+	assert.Equal(t, 3, idx.entries)
+
+	assert.Equal(t, int64(100), idx.lookup(999))
+	assert.Equal(t, int64(110), idx.lookup(1_000))
+	assert.Equal(t, int64(120), idx.lookup(2_999))
+	assert.Equal(t, int64(130), idx.lookup(10_000))
+}
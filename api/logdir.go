@@ -0,0 +1,285 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// defaultLogDir is used when log.dirs is not configured.
+const defaultLogDir = "/tmp/krake"
+
+// partitionMetadataFile holds the configuration of the topic a
+// partition directory belongs to, so every directory can be loaded
+// on its own.
+const partitionMetadataFile = "partition.metadata"
+
+// logDirs returns the directories listed in log.dirs. Like Kafka this
+// is a comma separated list, each partition lives in exactly one of
+// them.
+func (k *KrakeBroker) logDirs() []string {
+	var dirs []string
+	switch v := k.Config["log.dirs"].(type) {
+	case string:
+		for _, d := range strings.Split(v, ",") {
+			if d = strings.TrimSpace(d); d != "" {
+				dirs = append(dirs, filepath.Clean(d))
+			}
+		}
+	case []string:
+		for _, d := range v {
+			dirs = append(dirs, filepath.Clean(d))
+		}
+	}
+	if len(dirs) == 0 {
+		dirs = []string{defaultLogDir}
+	}
+	return dirs
+}
+
+// partitionDirName is the name of the directory holding the segments
+// of a partition, <topic>-<partition>.
+func partitionDirName(key TopicPartitionKey) string {
+	return fmt.Sprintf("%s-%d", key.Topic, key.PartitionIndex)
+}
+
+// parsePartitionDirName splits a partition directory name into its
+// topic and partition. Topics may contain '-' so the name is parsed
+// from the right.
+func parsePartitionDirName(name string) (TopicPartitionKey, bool) {
+	dash := strings.LastIndexByte(name, '-')
+	if dash <= 0 {
+		return TopicPartitionKey{}, false
+	}
+	partition, err := strconv.ParseInt(name[dash+1:], 10, 32)
+	if err != nil || partition < 0 {
+		return TopicPartitionKey{}, false
+	}
+	return TopicPartitionKey{
+		Topic:          name[:dash],
+		PartitionIndex: int32(partition),
+	}, true
+}
+
+// segmentFileName is the name of a segment file, the zero padded
+// base offset of the segment followed by suffix.
+func segmentFileName(baseOffs int64, suffix string) string {
+	return fmt.Sprintf("%020d%s", baseOffs, suffix)
+}
+
+func parseSegmentFileName(name string, suffix string) (int64, bool) {
+	if !strings.HasSuffix(name, suffix) {
+		return 0, false
+	}
+	baseOffs, err := strconv.ParseInt(strings.TrimSuffix(name, suffix), 10, 64)
+	if err != nil || baseOffs < 0 {
+		return 0, false
+	}
+	return baseOffs, true
+}
+
+// placePartition picks the log dir for a new partition. The directory
+// with the most free space wins, ties (such as directories on the same
+// disk) go to the one with the fewest partitions.
+func (pw *PartitionWriter) placePartition(dirs []string) (string, error) {
+	counts := map[string]int{}
+	for _, dir := range pw.partitionDirs {
+		counts[filepath.Dir(dir)]++
+	}
+
+	best := ""
+	var bestFree uint64
+	for _, dir := range dirs {
+		free, err := pw.diskFree(dir)
+		if err != nil {
+			return "", err
+		}
+		if best == "" || free > bestFree || (free == bestFree && counts[dir] < counts[best]) {
+			best, bestFree = dir, free
+		}
+	}
+	return best, nil
+}
+
+// createPartitionDir places the partition in one of dirs and writes
+// the topic configuration into it.
+func (pw *PartitionWriter) createPartitionDir(key TopicPartitionKey, dirs []string, cfg TopicConfiguration) error {
+	if _, ok := pw.partitionDirs[key]; ok {
+		return nil
+	}
+
+	for _, dir := range dirs {
+		if err := pw.store.MkdirAll(dir); err != nil {
+			return err
+		}
+	}
+
+	logDir, err := pw.placePartition(dirs)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Join(logDir, partitionDirName(key))
+	if err = pw.store.MkdirAll(dir); err != nil {
+		return err
+	}
+	if err = writePartitionMetadata(pw.store, dir, cfg); err != nil {
+		return err
+	}
+
+	pw.partitionDirs[key] = dir
+	return nil
+}
+
+func writePartitionMetadata(store SegmentStore, dir string, cfg TopicConfiguration) error {
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(dir, partitionMetadataFile)
+	tmp := path + ".tmp"
+	if err = writeFile(store, tmp, data); err != nil {
+		return err
+	}
+	return store.Rename(tmp, path)
+}
+
+func readPartitionMetadata(store SegmentStore, dir string) (TopicConfiguration, error) {
+	var cfg TopicConfiguration
+	data, err := readFile(store, filepath.Join(dir, partitionMetadataFile))
+	if err != nil {
+		return cfg, err
+	}
+	err = json.Unmarshal(data, &cfg)
+	return cfg, err
+}
+
+// LoadLogs scans every log dir and restores the topics, segments and
+// next offset of every partition written before the broker was last
+// stopped. The active segment of each partition is reopened for
+// appending and transactions that were being committed or aborted are
+// completed.
+func (k *KrakeBroker) LoadLogs() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	cfg := k.segmentConfig()
+
+	for _, logDir := range k.logDirs() {
+		entries, err := k.store.ReadDir(logDir)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, e := range entries {
+			if !e.IsDir() {
+				continue
+			}
+			key, ok := parsePartitionDirName(e.Name())
+			if !ok {
+				continue
+			}
+			if _, ok := k.partitionDirs[key]; ok {
+				continue
+			}
+
+			dir := filepath.Join(logDir, e.Name())
+			if err = k.loadPartition(key, dir, cfg); err != nil {
+				return err
+			}
+		}
+	}
+	// markers are only written once every partition is loaded.
+	return k.completePreparedTransactions()
+}
+
+func (k *KrakeBroker) loadPartition(key TopicPartitionKey, dir string, cfg segmentConfig) error {
+	topicCfg, err := readPartitionMetadata(k.store, dir)
+	if errors.Is(err, os.ErrNotExist) {
+		log.Println("ignoring", dir, "as it has no", partitionMetadataFile)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if existing, ok := k.topics[key.Topic]; ok && existing.PartitionCount > topicCfg.PartitionCount {
+		topicCfg.PartitionCount = existing.PartitionCount
+	}
+	k.topics[key.Topic] = topicCfg
+	k.partitionDirs[key] = dir
+
+	if err = completeSwaps(k.store, dir); err != nil {
+		return err
+	}
+
+	entries, err := k.store.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	var baseOffsets []int64
+	for _, e := range entries {
+		if baseOffs, ok := parseSegmentFileName(e.Name(), logFileSuffix); ok {
+			baseOffsets = append(baseOffsets, baseOffs)
+		}
+		// left behind if we stopped while compacting.
+		if strings.HasSuffix(e.Name(), cleanedFileSuffix) {
+			if err = k.store.Remove(filepath.Join(dir, e.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	if len(baseOffsets) == 0 {
+		// the segments of a tiered partition may all be remote.
+		if _, ok := k.tiered(key); ok && k.remote != nil {
+			return k.loadRemoteSegments(key, k.partitionLog(key))
+		}
+		return nil
+	}
+
+	sort.Slice(baseOffsets, func(i, j int) bool {
+		return baseOffsets[i] < baseOffsets[j]
+	})
+
+	if err = k.recoverLog(key, baseOffsets, cfg); err != nil {
+		return err
+	}
+	if err = k.recoverProducerState(key); err != nil {
+		return err
+	}
+	if err = k.logs[key].recoverTransactions(); err != nil {
+		return err
+	}
+	if _, ok := k.tiered(key); ok && k.remote != nil {
+		if err = k.loadRemoteSegments(key, k.logs[key]); err != nil {
+			return err
+		}
+	}
+
+	// recovery trims the active segment to its last batch, give it
+	// back its preallocated space so we keep appending to it.
+	active := k.logs[key].activeSegment()
+	info, err := active.log.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() < int64(cfg.segmentBytes) {
+		if err = active.log.Truncate(int64(cfg.segmentBytes)); err != nil {
+			return err
+		}
+	}
+
+	log.Println("loaded", dir, "with", len(baseOffsets), "segments, next offset", k.logs[key].nextOffset)
+	return nil
+}
@@ -0,0 +1,205 @@
+package api
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePartitionDirName(t *testing.T) {
+	key, ok := parsePartitionDirName("my-fancy.topic-3")
+	assert.True(t, ok)
+	assert.Equal(t, TopicPartitionKey{"my-fancy.topic", 3}, key)
+
+	for _, name := range []string{"topic", "topic-x", "-0", "topic-"} {
+		_, ok = parsePartitionDirName(name)
+		assert.False(t, ok, name)
+	}
+}
+
+func TestParseSegmentFileName(t *testing.T) {
+	baseOffs, ok := parseSegmentFileName(segmentFileName(120, logFileSuffix), logFileSuffix)
+	assert.True(t, ok)
+	assert.Equal(t, int64(120), baseOffs)
+
+	for _, name := range []string{"00000000000000000120.index", "x.log", ".log", "-1.log"} {
+		_, ok = parseSegmentFileName(name, logFileSuffix)
+		assert.False(t, ok, name)
+	}
+}
+
+func newRestartBroker(store SegmentStore, logDir string) (*PartitionWriter, Broker) {
+	pw := NewPartitionWriterWithStore(store)
+	b := NewKrakeBroker(pw)
+	b.Configure(map[string]interface{}{
+		"log.dirs":          logDir,
+		"log.segment.bytes": 10_000,
+	})
+	return pw, b
+}
+
+func TestKrakeBroker_LogDirs(t *testing.T) {
+	k := NewKrakeBroker(NewPartitionWriter())
+	assert.Equal(t, []string{defaultLogDir}, k.logDirs())
+
+	k.Configure(map[string]interface{}{"log.dirs": "/data/a, /data/b/,"})
+	assert.Equal(t, []string{"/data/a", "/data/b"}, k.logDirs())
+
+	k.Configure(map[string]interface{}{"log.dirs": []string{"/data/c"}})
+	assert.Equal(t, []string{"/data/c"}, k.logDirs())
+}
+
+func TestKrakeBroker_CreateTopic_MultipleLogDirs(t *testing.T) {
+	small, large := t.TempDir(), t.TempDir()
+
+	pw := NewPartitionWriter()
+	free := map[string]uint64{small: 100, large: 1000}
+	pw.diskFree = func(dir string) (uint64, error) {
+		return free[dir], nil
+	}
+	b := NewKrakeBroker(pw)
+	b.Configure(map[string]interface{}{
+		"log.dirs": small + "," + large,
+	})
+
+	// the directory with the most free space wins
+	assert.NoError(t, b.CreateTopic(TopicConfiguration{Name: "jbod-topic", PartitionCount: 1}))
+	assert.DirExists(t, filepath.Join(large, "jbod-topic-0"))
+	assert.FileExists(t, filepath.Join(large, "jbod-topic-0", partitionMetadataFile))
+	assert.NoDirExists(t, filepath.Join(small, "jbod-topic-0"))
+
+	// with equal free space the directory with the fewest partitions wins
+	free[small] = 1000
+	assert.NoError(t, b.CreateTopic(TopicConfiguration{Name: "spread-topic", PartitionCount: 3}))
+	assert.DirExists(t, filepath.Join(small, "spread-topic-0"))
+	assert.DirExists(t, filepath.Join(small, "spread-topic-1"))
+	assert.DirExists(t, filepath.Join(large, "spread-topic-2"))
+
+	// and segments are written in the partition directory
+	_, err := b.Produce("jbod-topic", &Message{Message: []byte("message")})
+	assert.NoError(t, err)
+	assert.FileExists(t, filepath.Join(large, "jbod-topic-0", segmentFileName(0, logFileSuffix)))
+	assert.FileExists(t, filepath.Join(large, "jbod-topic-0", segmentFileName(0, indexFileSuffix)))
+	assert.FileExists(t, filepath.Join(large, "jbod-topic-0", segmentFileName(0, timeIndexFileSuffix)))
+	assert.NoError(t, pw.Close())
+
+	// partitions are found in every log dir on restart
+	pw, restarted := newRestartBroker(NewFileStore(), small+","+large)
+	k := restarted.(*KrakeBroker)
+	assert.NoError(t, k.LoadLogs())
+	defer pw.Close()
+
+	assert.Equal(t, 1, k.topics["jbod-topic"].PartitionCount)
+	assert.Equal(t, 3, k.topics["spread-topic"].PartitionCount)
+	assert.Equal(t, filepath.Join(large, "spread-topic-2"), pw.partitionDirs[TopicPartitionKey{"spread-topic", 2}])
+
+	batch, err := pw.Fetch(TopicPartitionKey{"jbod-topic", 0}, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, "message", string(batch.Records[0].Value))
+}
+
+func TestKrakeBroker_LoadLogs(t *testing.T) {
+	logDir := t.TempDir()
+	pw, b := newRestartBroker(NewFileStore(), logDir)
+
+	topicCfg := TopicConfiguration{
+		Name:            "restart-topic",
+		PartitionCount:  2,
+		RetentionPeriod: 2 * time.Hour,
+	}
+	assert.NoError(t, b.CreateTopic(topicCfg))
+	assert.NoError(t, b.CreateTopic(TopicConfiguration{Name: "restart-empty-topic", PartitionCount: 1}))
+
+	for i := 0; i < 10; i++ {
+		_, err := b.Produce("restart-topic", &Message{Message: []byte(fmt.Sprintf("message: %d", i))})
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, pw.Close())
+
+	// when the broker restarts
+	pw, b = newRestartBroker(NewFileStore(), logDir)
+	k := b.(*KrakeBroker)
+	assert.NoError(t, k.LoadLogs())
+	defer pw.Close()
+
+	// then the topics are restored
+	assert.Equal(t, topicCfg, k.topics["restart-topic"])
+	assert.Equal(t, 1, k.topics["restart-empty-topic"].PartitionCount)
+	assert.ErrorIs(t, b.CreateTopic(topicCfg), ErrTopicAlreadyExists)
+
+	// ... along with the next offset of each partition
+	for p := int32(0); p < 2; p++ {
+		key := TopicPartitionKey{"restart-topic", p}
+		assert.Equal(t, int64(5), pw.logs[key].nextOffset)
+	}
+
+	// and new messages are appended to the active segment
+	for i := 10; i < 14; i++ {
+		_, err := b.Produce("restart-topic", &Message{Message: []byte(fmt.Sprintf("message: %d", i))})
+		assert.NoError(t, err)
+	}
+
+	for p := int32(0); p < 2; p++ {
+		key := TopicPartitionKey{"restart-topic", p}
+		assert.Equal(t, int64(7), pw.logs[key].nextOffset)
+		assert.Len(t, pw.logs[key].segments, 1)
+
+		for offs := int64(0); offs < 7; offs++ {
+			batch, err := pw.Fetch(key, offs)
+			assert.NoError(t, err)
+			msg := fmt.Sprintf("message: %d", offs*2+int64(p))
+			assert.Equal(t, msg, string(batch.Records[0].Value))
+		}
+	}
+}
+
+func TestKrakeBroker_LoadLogs_MultipleSegments(t *testing.T) {
+	logDir := t.TempDir()
+	smallSegments := map[string]interface{}{
+		"log.dirs":          logDir,
+		"log.segment.bytes": 300,
+	}
+
+	pw, b := newRestartBroker(NewFileStore(), logDir)
+	b.Configure(smallSegments)
+
+	assert.NoError(t, b.CreateTopic(TopicConfiguration{Name: "restart-topic", PartitionCount: 1}))
+	for i := 0; i < 20; i++ {
+		_, err := b.Produce("restart-topic", &Message{Message: []byte(fmt.Sprintf("message: %d", i))})
+		assert.NoError(t, err)
+	}
+	key := TopicPartitionKey{"restart-topic", 0}
+	var baseOffsets []int64
+	for _, seg := range pw.logs[key].segments {
+		baseOffsets = append(baseOffsets, seg.baseOffset)
+	}
+	assert.Greater(t, len(baseOffsets), 1)
+	assert.NoError(t, pw.Close())
+
+	// when the broker restarts the segments are found by their base offset
+	pw, restarted := newRestartBroker(NewFileStore(), logDir)
+	k := restarted.(*KrakeBroker)
+	k.Configure(smallSegments)
+	assert.NoError(t, k.LoadLogs())
+	defer pw.Close()
+
+	var reloaded []int64
+	for _, seg := range pw.logs[key].segments {
+		reloaded = append(reloaded, seg.baseOffset)
+	}
+	assert.Equal(t, baseOffsets, reloaded)
+
+	// and offsets carry on from the log end offset
+	md, err := k.Produce("restart-topic", &Message{Message: []byte("message: 20")})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(20), md.Offset)
+
+	for offs := int64(0); offs <= 20; offs++ {
+		batch, err := pw.Fetch(key, offs)
+		assert.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("message: %d", offs), string(batch.Records[0].Value))
+	}
+}
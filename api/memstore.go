@@ -0,0 +1,262 @@
+package api
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MemoryStore keeps segments in memory. Like files on disk, the data
+// of a removed file stays readable through the handles already open on
+// it. It is safe for concurrent use.
+type MemoryStore struct {
+	mu    sync.Mutex
+	files map[string]*memoryData
+	dirs  map[string]bool
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		files: map[string]*memoryData{},
+		dirs:  map[string]bool{},
+	}
+}
+
+type memoryData struct {
+	mu   sync.RWMutex
+	data []byte
+}
+
+func (m *MemoryStore) Create(name string) (SegmentFile, error) {
+	name = path.Clean(name)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.dirs[path.Dir(name)] {
+		return nil, &fs.PathError{Op: "create", Path: name, Err: fs.ErrNotExist}
+	}
+	d := &memoryData{}
+	m.files[name] = d
+	return &memoryFile{name: name, d: d}, nil
+}
+
+func (m *MemoryStore) Open(name string) (SegmentFile, error) {
+	name = path.Clean(name)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	d, ok := m.files[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return &memoryFile{name: name, d: d}, nil
+}
+
+func (m *MemoryStore) Stat(name string) (fs.FileInfo, error) {
+	name = path.Clean(name)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if d, ok := m.files[name]; ok {
+		return d.stat(name), nil
+	}
+	if m.dirs[name] {
+		return memoryFileInfo{name: path.Base(name), dir: true}, nil
+	}
+	return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+}
+
+func (m *MemoryStore) Remove(name string) error {
+	name = path.Clean(name)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.files[name]; !ok {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	delete(m.files, name)
+	return nil
+}
+
+func (m *MemoryStore) Rename(oldname, newname string) error {
+	oldname, newname = path.Clean(oldname), path.Clean(newname)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	d, ok := m.files[oldname]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: fs.ErrNotExist}
+	}
+	delete(m.files, oldname)
+	m.files[newname] = d
+	return nil
+}
+
+func (m *MemoryStore) MkdirAll(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for dir := path.Clean(name); !m.dirs[dir]; dir = path.Dir(dir) {
+		m.dirs[dir] = true
+	}
+	return nil
+}
+
+func (m *MemoryStore) ReadDir(name string) ([]fs.DirEntry, error) {
+	name = path.Clean(name)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.dirs[name] {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+
+	var entries []fs.DirEntry
+	for dir := range m.dirs {
+		if dir != name && path.Dir(dir) == name {
+			entries = append(entries, fs.FileInfoToDirEntry(memoryFileInfo{name: path.Base(dir), dir: true}))
+		}
+	}
+	for file, d := range m.files {
+		if path.Dir(file) == name {
+			entries = append(entries, fs.FileInfoToDirEntry(d.stat(file)))
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return strings.Compare(entries[i].Name(), entries[j].Name()) < 0
+	})
+	return entries, nil
+}
+
+func (d *memoryData) stat(name string) memoryFileInfo {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return memoryFileInfo{name: path.Base(name), size: int64(len(d.data))}
+}
+
+// memoryFile is a handle on a file of a MemoryStore.
+type memoryFile struct {
+	name   string
+	d      *memoryData
+	closed atomic.Bool
+}
+
+// newMemoryFile returns a file holding data, which must not be
+// modified afterwards.
+func newMemoryFile(name string, data []byte) *memoryFile {
+	return &memoryFile{name: name, d: &memoryData{data: data}}
+}
+
+func (f *memoryFile) Name() string {
+	return f.name
+}
+
+func (f *memoryFile) ReadAt(b []byte, off int64) (int, error) {
+	if f.closed.Load() {
+		return 0, os.ErrClosed
+	}
+	f.d.mu.RLock()
+	defer f.d.mu.RUnlock()
+	if off >= int64(len(f.d.data)) {
+		return 0, io.EOF
+	}
+	n := copy(b, f.d.data[off:])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memoryFile) WriteAt(b []byte, off int64) (int, error) {
+	if f.closed.Load() {
+		return 0, os.ErrClosed
+	}
+	f.d.mu.Lock()
+	defer f.d.mu.Unlock()
+	if end := off + int64(len(b)); end > int64(len(f.d.data)) {
+		f.d.resize(end)
+	}
+	return copy(f.d.data[off:], b), nil
+}
+
+func (f *memoryFile) Truncate(size int64) error {
+	if f.closed.Load() {
+		return os.ErrClosed
+	}
+	f.d.mu.Lock()
+	defer f.d.mu.Unlock()
+	f.d.resize(size)
+	return nil
+}
+
+// resize grows the file with zeroes or shrinks it to size.
+func (d *memoryData) resize(size int64) {
+	if size <= int64(len(d.data)) {
+		d.data = d.data[:size]
+		return
+	}
+	d.data = append(d.data, make([]byte, size-int64(len(d.data)))...)
+}
+
+func (f *memoryFile) Stat() (fs.FileInfo, error) {
+	if f.closed.Load() {
+		return nil, os.ErrClosed
+	}
+	return f.d.stat(f.name), nil
+}
+
+func (f *memoryFile) Sync() error {
+	if f.closed.Load() {
+		return os.ErrClosed
+	}
+	return nil
+}
+
+func (f *memoryFile) Close() error {
+	if f.closed.Swap(true) {
+		return os.ErrClosed
+	}
+	return nil
+}
+
+// Map returns the data of the file itself, so writes to it change the
+// file until it is next truncated.
+func (f *memoryFile) Map(size int) ([]byte, error) {
+	if f.closed.Load() {
+		return nil, os.ErrClosed
+	}
+	f.d.mu.Lock()
+	defer f.d.mu.Unlock()
+	if int64(size) > int64(len(f.d.data)) {
+		f.d.resize(int64(size))
+	}
+	return f.d.data[:size:size], nil
+}
+
+func (f *memoryFile) Unmap(b []byte) error {
+	return nil
+}
+
+type memoryFileInfo struct {
+	name string
+	size int64
+	dir  bool
+}
+
+func (i memoryFileInfo) Name() string       { return i.name }
+func (i memoryFileInfo) Size() int64        { return i.size }
+func (i memoryFileInfo) ModTime() time.Time { return time.Time{} }
+func (i memoryFileInfo) IsDir() bool        { return i.dir }
+func (i memoryFileInfo) Sys() interface{}   { return nil }
+
+func (i memoryFileInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0755
+	}
+	return 0644
+}
@@ -0,0 +1,92 @@
+package api
+
+import (
+	"testing"
+	"time"
+
+	"github.com/krake-labs/krake/api/record"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTimestampBroker(t *testing.T, timestampType string) (*KrakeBroker, time.Time) {
+	b, now := newTestBroker(t, map[string]interface{}{"log.segment.bytes": 100}, TopicConfiguration{
+		Name:                 "events",
+		PartitionCount:       1,
+		MessageTimestampType: timestampType,
+	})
+	return b, *now
+}
+
+func TestKrakeBroker_ReadMessage_HeadersAndTimestamp(t *testing.T) {
+	b, _ := newTimestampBroker(t, "")
+	created := time.Date(2023, 4, 30, 12, 0, 0, 0, time.UTC)
+	headers := []record.Header{
+		{Key: "trace-id", Value: []byte("abc")},
+		{Key: "empty", Value: nil},
+	}
+	md, err := b.Produce("events", &Message{
+		Message:   []byte("hello"),
+		Headers:   headers,
+		Timestamp: created,
+	})
+	assert.NoError(t, err)
+
+	consumerId := b.Subscribe([]string{"events"})
+	msg, err := b.ReadMessage("events", consumerId, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("hello"), msg.Message)
+	assert.Equal(t, headers, msg.Headers)
+	assert.True(t, created.Equal(msg.Timestamp))
+	assert.Equal(t, record.CreateTime, msg.TimestampType)
+	assert.Equal(t, md.Partition, msg.Partition)
+	assert.Equal(t, md.Offset, msg.Offset)
+
+	// producer timestamps are used to look up offsets
+	offset, err := b.OffsetsForTimes("events", 0, created)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), offset)
+}
+
+func TestKrakeBroker_Produce_BrokerTimestamp(t *testing.T) {
+	b, now := newTimestampBroker(t, "CreateTime")
+	_, err := b.Produce("events", &Message{Message: []byte("hello")})
+	assert.NoError(t, err)
+
+	msg, err := b.ReadMessage("events", b.Subscribe([]string{"events"}), -1)
+	assert.NoError(t, err)
+	assert.True(t, now.Equal(msg.Timestamp))
+	assert.Equal(t, record.CreateTime, msg.TimestampType)
+}
+
+func TestKrakeBroker_Produce_LogAppendTime(t *testing.T) {
+	b, now := newTimestampBroker(t, "LogAppendTime")
+	_, err := b.Produce("events", &Message{
+		Message:   []byte("hello"),
+		Timestamp: now.Add(-time.Hour),
+	})
+	assert.NoError(t, err)
+
+	msg, err := b.ReadMessage("events", b.Subscribe([]string{"events"}), -1)
+	assert.NoError(t, err)
+	assert.True(t, now.Equal(msg.Timestamp))
+	assert.Equal(t, record.LogAppendTime, msg.TimestampType)
+
+	offset, err := b.OffsetsForTimes("events", 0, now.Add(-time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), offset)
+}
+
+func TestKrakeBroker_CreateTopic_InvalidTimestampType(t *testing.T) {
+	_, b := newInMemoryBroker()
+	err := b.CreateTopic(TopicConfiguration{Name: "events", PartitionCount: 1, MessageTimestampType: "Now"})
+	assert.ErrorIs(t, err, record.ErrUnknownTimestampType)
+}
+
+func TestKrakeBroker_ReadMessage_UnknownConsumer(t *testing.T) {
+	b, _ := newTimestampBroker(t, "")
+	_, err := b.ReadMessage("events", 42, -1)
+	assert.ErrorIs(t, err, ErrUnknownConsumer)
+
+	_, err = b.ReadMessage("missing", b.Subscribe([]string{"missing"}), -1)
+	assert.ErrorIs(t, err, ErrNoSuchTopic)
+}
@@ -0,0 +1,26 @@
+//go:build !unix
+
+package api
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+// Without mmap an index is read into memory when it is mapped and
+// written back when it is unmapped, once its segment is rolled or
+// closed. Indexes left behind by a crash are rebuilt from the log on
+// recovery.
+func mmap(f *os.File, size int) ([]byte, error) {
+	b := make([]byte, size)
+	if _, err := f.ReadAt(b, 0); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	return b, nil
+}
+
+func munmap(f *os.File, b []byte) error {
+	_, err := f.WriteAt(b, 0)
+	return err
+}
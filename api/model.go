@@ -1,6 +1,31 @@
 package api
 
+import (
+	"time"
+
+	"github.com/krake-labs/krake/api/record"
+)
+
 type Message struct {
 	Key     []byte
 	Message []byte
+	Headers []record.Header
+	// when the producer created the message, the broker uses the time it
+	// appends the message if unset. With LogAppendTime topics it is
+	// always the append time when read.
+	Timestamp     time.Time
+	TimestampType record.TimestampType
+	// the codec the batch holding the message was written with, unset
+	// when producing. See ProduceOptions.Compression.
+	Compression record.Compression
+	// the partition to write the message to, nil to let the broker's
+	// Partitioner choose.
+	TargetPartition *int32
+	// the sequence number of the message on its partition when sent by
+	// an idempotent producer, see ProduceOptions.Producer.
+	Sequence int32
+
+	// where the message was read from, unset when producing.
+	Partition int32
+	Offset    int64
 }
@@ -0,0 +1,346 @@
+package api
+
+import (
+	"container/list"
+	"errors"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/krake-labs/krake/api/record"
+)
+
+var ErrOffsetOutOfRange = errors.New("offset out of range")
+
+const (
+	logFileSuffix       = ".log"
+	indexFileSuffix     = ".index"
+	timeIndexFileSuffix = ".timeindex"
+)
+
+type segmentConfig struct {
+	// log.segment.bytes
+	segmentBytes int
+	// index.interval.bytes
+	indexInterval int
+	// log.index.size.max.bytes
+	maxIndexSize int
+	// log.roll.ms, overridden by the segment.ms of a topic
+	rollPeriod time.Duration
+}
+
+// segment is a single log file in a partition along with its indexes.
+type segment struct {
+	baseOffset int64
+	store      SegmentStore
+	path       string
+	index      *offsetIndex
+	timeIndex  *timeIndex
+
+	// the log and indexes are nil while the segment is evicted from the
+	// file pool, use file to read it.
+	log SegmentFile
+	// the pool tracking the log once the segment is inactive.
+	files *FilePool
+	elem  *list.Element
+
+	// the segment was copied to remote storage
+	uploaded bool
+
+	// bytes appended since the last index entry was written
+	bytesSinceLastIndexEntry int
+
+	// the end of the last batch in the log, anything after it is
+	// preallocated space.
+	size int64
+
+	// the largest timestamp in the segment, or -1 if it is empty
+	maxTimestamp         int64
+	offsetOfMaxTimestamp int64
+
+	// the max timestamp of the first batch, the age of the segment is
+	// measured from it. -1 if the segment is empty.
+	rollingTimestamp int64
+}
+
+// append records that a batch was written at position in the log,
+// adding index entries if at least indexInterval bytes have been
+// written since the previous ones. A full index is rolled along with
+// its segment so the entry is skipped.
+func (s *segment) append(batch *record.Batch, position int64, indexInterval int) error {
+	if position == 0 {
+		s.rollingTimestamp = batch.MaxTimestamp
+	}
+	if batch.MaxTimestamp > s.maxTimestamp {
+		s.maxTimestamp = batch.MaxTimestamp
+		s.offsetOfMaxTimestamp = batch.LastOffset()
+	}
+
+	if s.bytesSinceLastIndexEntry > indexInterval && !s.indexFull() {
+		if err := s.index.append(batch.BaseOffset, position); err != nil {
+			return err
+		}
+		if err := s.timeIndex.append(s.maxTimestamp, s.offsetOfMaxTimestamp); err != nil {
+			return err
+		}
+		s.bytesSinceLastIndexEntry = 0
+	}
+	s.bytesSinceLastIndexEntry += batch.Size()
+	s.size = position + int64(batch.Size())
+	return nil
+}
+
+func (s *segment) indexFull() bool {
+	return s.index.isFull() || s.timeIndex.isFull()
+}
+
+// expired reports whether the segment is older than rollPeriod at
+// timestamp.
+func (s *segment) expired(timestamp int64, rollPeriod time.Duration) bool {
+	return s.rollingTimestamp >= 0 && timestamp-s.rollingTimestamp > rollPeriod.Milliseconds()
+}
+
+// roll is called once the segment stops being the active segment. The
+// log stays open for reads but neither it nor the indexes need their
+// preallocated space.
+func (s *segment) roll() error {
+	if s.maxTimestamp >= 0 && !s.timeIndex.isFull() {
+		if err := s.timeIndex.append(s.maxTimestamp, s.offsetOfMaxTimestamp); err != nil {
+			return err
+		}
+	}
+	if err := s.index.trim(); err != nil {
+		return err
+	}
+	if err := s.timeIndex.trim(); err != nil {
+		return err
+	}
+	if err := s.trimLog(); err != nil {
+		return err
+	}
+	// whatever the flush policy, segments are flushed when rolled.
+	return s.log.Sync()
+}
+
+// trimLog truncates the preallocated space after the last batch.
+func (s *segment) trimLog() error {
+	info, err := s.log.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() == s.size {
+		return nil
+	}
+	return s.log.Truncate(s.size)
+}
+
+// file returns the log of the segment, reopening it if it was evicted
+// from the file pool.
+func (s *segment) file() (SegmentFile, error) {
+	if s.files == nil {
+		return s.log, nil
+	}
+	return s.files.file(s)
+}
+
+// indexPath is the offset index of the segment, next to its log.
+func (s *segment) indexPath() string {
+	return strings.TrimSuffix(s.path, logFileSuffix) + indexFileSuffix
+}
+
+func (s *segment) timeIndexPath() string {
+	return strings.TrimSuffix(s.path, logFileSuffix) + timeIndexFileSuffix
+}
+
+// delete closes the segment and removes its log and indexes. It
+// returns the number of bytes they took up on disk.
+func (s *segment) delete() (int64, error) {
+	paths := []string{s.path, s.indexPath(), s.timeIndexPath()}
+	if err := s.close(); err != nil {
+		return 0, err
+	}
+
+	var reclaimed int64
+	for _, p := range paths {
+		info, err := s.store.Stat(p)
+		if err != nil {
+			return reclaimed, err
+		}
+		if err = s.store.Remove(p); err != nil {
+			return reclaimed, err
+		}
+		reclaimed += info.Size()
+	}
+	return reclaimed, nil
+}
+
+// read returns the batch containing offset, starting the scan from
+// the closest indexed position.
+func (s *segment) read(offset int64) (*record.Batch, error) {
+	f, err := s.file()
+	if err != nil {
+		return nil, err
+	}
+	_, position := s.index.lookup(offset)
+	for {
+		if position >= s.size {
+			return nil, io.EOF
+		}
+		batch, err := record.ReadBatchAt(f, position)
+		if err != nil {
+			return nil, err
+		}
+		if batch.LastOffset() >= offset {
+			return batch, nil
+		}
+		position += int64(batch.Size())
+	}
+}
+
+// offsetForTimestamp returns the offset of the first record in the
+// segment with a timestamp at or after timestamp, or -1 if there is
+// none. Control records are not returned, only the markers of a
+// segment may be recent enough.
+func (s *segment) offsetForTimestamp(timestamp int64) (int64, error) {
+	if s.maxTimestamp < timestamp {
+		return -1, nil
+	}
+
+	f, err := s.file()
+	if err != nil {
+		return -1, err
+	}
+	_, position := s.index.lookup(s.timeIndex.lookup(timestamp))
+	for position < s.size {
+		batch, err := record.ReadBatchAt(f, position)
+		if err != nil {
+			return -1, err
+		}
+		if offset := batchOffsetForTimestamp(batch, timestamp); offset >= 0 {
+			return offset, nil
+		}
+		position += int64(batch.Size())
+	}
+	return -1, nil
+}
+
+// batchOffsetForTimestamp returns the offset of the first record in
+// the batch with a timestamp at or after timestamp, or -1 if there is
+// none or the batch only holds control records.
+func batchOffsetForTimestamp(batch *record.Batch, timestamp int64) int64 {
+	if batch.IsControl() || batch.MaxTimestamp < timestamp {
+		return -1
+	}
+	for i := range batch.Records {
+		r := &batch.Records[i]
+		if batch.Timestamp(r) >= timestamp {
+			return batch.BaseOffset + int64(r.OffsetDelta)
+		}
+	}
+	return -1
+}
+
+// partitionLog is the ordered set of segments for a partition. The
+// last segment is the active segment.
+type partitionLog struct {
+	segments []*segment
+
+	// the log end offset, assigned to the next record appended
+	nextOffset int64
+
+	// compaction has cleaned the log up to this offset
+	firstDirtyOffset int64
+
+	// messages written since the active segment was last flushed
+	unflushed int
+	lastFlush time.Time
+
+	// the idempotent producers that wrote to the partition
+	producers map[int64]*producerState
+
+	// the first offset of the open transaction of each producer, and
+	// the transactions that were aborted.
+	ongoingTxns map[int64]int64
+	abortedTxns []abortedTxn
+
+	// segments older than the first local one, only in remote storage
+	remoteSegments []remoteSegment
+	remoteCache    *remoteLogCache
+}
+
+func (l *partitionLog) activeSegment() *segment {
+	if len(l.segments) == 0 {
+		return nil
+	}
+	return l.segments[len(l.segments)-1]
+}
+
+// size is the number of bytes of batches in the log.
+func (l *partitionLog) size() int64 {
+	var size int64
+	for _, seg := range l.segments {
+		size += seg.size
+	}
+	return size
+}
+
+// segmentFor finds the segment that would contain offset.
+func (l *partitionLog) segmentFor(offset int64) *segment {
+	i := sort.Search(len(l.segments), func(i int) bool {
+		return l.segments[i].baseOffset > offset
+	})
+	if i == 0 {
+		return nil
+	}
+	return l.segments[i-1]
+}
+
+// read returns the batch in the log containing offset. Compaction may
+// have removed offset in which case the next batch is returned.
+func (l *partitionLog) read(offset int64) (*record.Batch, error) {
+	if offset >= l.nextOffset {
+		return nil, ErrOffsetOutOfRange
+	}
+	seg := l.segmentFor(offset)
+	if seg == nil {
+		return nil, ErrOffsetOutOfRange
+	}
+	for i := l.indexOf(seg); i < len(l.segments); i++ {
+		batch, err := l.segments[i].read(offset)
+		if !errors.Is(err, io.EOF) {
+			return batch, err
+		}
+	}
+	return nil, ErrOffsetOutOfRange
+}
+
+func (l *partitionLog) indexOf(seg *segment) int {
+	for i, s := range l.segments {
+		if s == seg {
+			return i
+		}
+	}
+	return -1
+}
+
+// offsetForTimestamp returns the earliest offset in the log whose
+// timestamp is at or after timestamp, or -1 if there is none. Remote
+// segments hold the oldest records so they are searched first, a
+// *remoteMiss is returned if one has to be downloaded.
+func (l *partitionLog) offsetForTimestamp(key TopicPartitionKey, timestamp int64) (int64, error) {
+	offset, err := l.remoteOffsetForTimestamp(key, timestamp)
+	if err != nil || offset >= 0 {
+		return offset, err
+	}
+	for _, seg := range l.segments {
+		if seg.maxTimestamp < timestamp {
+			continue
+		}
+		offset, err := seg.offsetForTimestamp(timestamp)
+		if err != nil || offset >= 0 {
+			return offset, err
+		}
+	}
+	return -1, nil
+}
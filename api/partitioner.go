@@ -0,0 +1,165 @@
+package api
+
+import (
+	"math/rand"
+	"sync"
+)
+
+// Partitioner picks the partition of a topic a message is written to.
+// It is called with the broker lock held and must return a partition
+// below partitionCount.
+type Partitioner interface {
+	Partition(topic string, msg *Message, partitionCount int) int32
+}
+
+// PartitionerFunc lets a function choose partitions explicitly, e.g.
+// from a field of the message.
+type PartitionerFunc func(topic string, msg *Message, partitionCount int) int32
+
+func (f PartitionerFunc) Partition(topic string, msg *Message, partitionCount int) int32 {
+	return f(topic, msg, partitionCount)
+}
+
+// RoundRobinPartitioner spreads messages evenly over the partitions of
+// each topic, ignoring their keys.
+type RoundRobinPartitioner struct {
+	mu   sync.Mutex
+	next map[string]int32
+}
+
+func NewRoundRobinPartitioner() *RoundRobinPartitioner {
+	return &RoundRobinPartitioner{next: map[string]int32{}}
+}
+
+func (p *RoundRobinPartitioner) Partition(topic string, msg *Message, partitionCount int) int32 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// the partition count may have changed since the last message.
+	partition := p.next[topic] % int32(partitionCount)
+	p.next[topic] = (partition + 1) % int32(partitionCount)
+	return partition
+}
+
+// StickyPartitioner writes BatchSize messages in a row to the same
+// partition before moving on to another one picked at random, ignoring
+// their keys. Fewer, larger batches compress better and cost fewer
+// writes than spreading every message.
+type StickyPartitioner struct {
+	BatchSize int
+
+	mu     sync.Mutex
+	sticky map[string]*stickyPartition
+
+	// rand returns a number in [0, n), overridden in tests.
+	rand func(n int) int
+}
+
+type stickyPartition struct {
+	partition int32
+	written   int
+}
+
+func NewStickyPartitioner(batchSize int) *StickyPartitioner {
+	return &StickyPartitioner{
+		BatchSize: batchSize,
+		sticky:    map[string]*stickyPartition{},
+		rand:      rand.Intn,
+	}
+}
+
+func (p *StickyPartitioner) Partition(topic string, msg *Message, partitionCount int) int32 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s, ok := p.sticky[topic]
+	if !ok {
+		s = &stickyPartition{partition: int32(p.rand(partitionCount))}
+		p.sticky[topic] = s
+	}
+	if s.written >= p.BatchSize || s.partition >= int32(partitionCount) {
+		// like the Java client never pick the same partition twice.
+		next := int32(p.rand(partitionCount))
+		if partitionCount > 1 && next == s.partition {
+			next = (next + 1) % int32(partitionCount)
+		}
+		s.partition, s.written = next, 0
+	}
+	s.written++
+	return s.partition
+}
+
+// Murmur2Partitioner places keyed messages on the same partition as
+// the Java client's default partitioner, toPositive(murmur2(key)) % n.
+// Messages with a nil key are handed to Keyless, an empty key is hashed
+// like any other.
+type Murmur2Partitioner struct {
+	Keyless Partitioner
+}
+
+// NewDefaultPartitioner hashes keys with murmur2 and spreads messages
+// without a key round-robin.
+func NewDefaultPartitioner() *Murmur2Partitioner {
+	return &Murmur2Partitioner{Keyless: NewRoundRobinPartitioner()}
+}
+
+func (p *Murmur2Partitioner) Partition(topic string, msg *Message, partitionCount int) int32 {
+	if msg.Key == nil {
+		return p.Keyless.Partition(topic, msg, partitionCount)
+	}
+	return int32(toPositive(murmur2(msg.Key)) % int32(partitionCount))
+}
+
+// toPositive clears the sign bit, unlike abs it maps math.MinInt32 to
+// zero rather than a negative number.
+func toPositive(n int32) int32 {
+	return n & 0x7fffffff
+}
+
+// murmur2 is the 32-bit murmur2 hash of data as implemented by the
+// Java client, seeded with 0x9747b28c.
+func murmur2(data []byte) int32 {
+	const (
+		seed uint32 = 0x9747b28c
+		m    uint32 = 0x5bd1e995
+		r           = 24
+	)
+
+	length := len(data)
+	h := seed ^ uint32(length)
+	for i := 0; i+4 <= length; i += 4 {
+		k := uint32(data[i]) | uint32(data[i+1])<<8 | uint32(data[i+2])<<16 | uint32(data[i+3])<<24
+		k *= m
+		k ^= k >> r
+		k *= m
+		h *= m
+		h ^= k
+	}
+
+	tail := data[length&^3:]
+	switch len(tail) {
+	case 3:
+		h ^= uint32(tail[2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(tail[1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(tail[0])
+		h *= m
+	}
+
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+	return int32(h)
+}
+
+// SetPartitioner changes how messages are assigned to partitions, by
+// default keys are hashed with murmur2 and messages without a key are
+// spread round-robin.
+func (k *KrakeBroker) SetPartitioner(p Partitioner) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.partitioner = p
+}
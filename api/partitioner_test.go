@@ -0,0 +1,135 @@
+package api
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMurmur2(t *testing.T) {
+	// from the Java client's tests
+	for key, hash := range map[string]int32{
+		"21":                         -973932308,
+		"foobar":                     -790332482,
+		"a-little-bit-long-string":   -985981536,
+		"a-little-bit-longer-string": -1486304829,
+		"lkjh234lh9fiuh90y23oiuhsafujhadof229phr9h19h89h8": -58897971,
+		"abc": 479470107,
+	} {
+		assert.Equal(t, hash, murmur2([]byte(key)), key)
+	}
+}
+
+func TestToPositive(t *testing.T) {
+	assert.Equal(t, int32(0), toPositive(-2147483648))
+	assert.Equal(t, int32(2147483647), toPositive(-1))
+	assert.Equal(t, int32(42), toPositive(42))
+}
+
+func TestMurmur2Partitioner(t *testing.T) {
+	p := NewDefaultPartitioner()
+	for key, hash := range map[string]int32{"21": -973932308, "foobar": -790332482, "abc": 479470107} {
+		msg := &Message{Key: []byte(key)}
+		partition := p.Partition("my-topic", msg, 12)
+		assert.Equal(t, (hash&0x7fffffff)%12, partition)
+		// the same key always lands on the same partition
+		assert.Equal(t, partition, p.Partition("my-topic", msg, 12))
+	}
+
+	// an empty key is still a key
+	empty := toPositive(murmur2([]byte{})) % 12
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, empty, p.Partition("my-topic", &Message{Key: []byte{}}, 12))
+	}
+
+	// messages without a key are spread round-robin
+	var partitions []int32
+	for i := 0; i < 4; i++ {
+		partitions = append(partitions, p.Partition("my-topic", &Message{}, 3))
+	}
+	assert.Equal(t, []int32{0, 1, 2, 0}, partitions)
+}
+
+func TestRoundRobinPartitioner(t *testing.T) {
+	p := NewRoundRobinPartitioner()
+	msg := &Message{Key: []byte("key")}
+	assert.Equal(t, int32(0), p.Partition("a", msg, 2))
+	assert.Equal(t, int32(0), p.Partition("b", msg, 2))
+	assert.Equal(t, int32(1), p.Partition("a", msg, 2))
+	assert.Equal(t, int32(0), p.Partition("a", msg, 2))
+	assert.Equal(t, int32(1), p.Partition("b", msg, 2))
+
+	// the topic shrank
+	assert.Equal(t, int32(0), p.Partition("b", msg, 1))
+}
+
+func TestStickyPartitioner(t *testing.T) {
+	p := NewStickyPartitioner(3)
+	next := []int{2, 2, 0}
+	p.rand = func(n int) int {
+		r := next[0]
+		next = next[1:]
+		return r
+	}
+
+	var partitions []int32
+	for i := 0; i < 9; i++ {
+		partitions = append(partitions, p.Partition("my-topic", &Message{Key: []byte(fmt.Sprint(i))}, 4))
+	}
+	// the second pick is the same partition so the next one is used
+	assert.Equal(t, []int32{2, 2, 2, 3, 3, 3, 0, 0, 0}, partitions)
+}
+
+func TestKrakeBroker_Produce_KeyedPartitions(t *testing.T) {
+	b, _ := newTestBroker(t, nil, myTopic)
+	assert.NoError(t, b.CreateTopic(TopicConfiguration{Name: "orders", PartitionCount: 3}))
+
+	for i := 0; i < 20; i++ {
+		key := []byte(fmt.Sprintf("customer-%d", i%5))
+		md, err := b.Produce("orders", &Message{Key: key, Message: []byte("order")})
+		assert.NoError(t, err)
+		assert.Equal(t, toPositive(murmur2(key))%3, md.Partition)
+
+		_, err = b.Fetch(TopicPartitionKey{"orders", md.Partition}, md.Offset)
+		assert.NoError(t, err)
+	}
+}
+
+func TestKrakeBroker_SetPartitioner(t *testing.T) {
+	b, _ := newTestBroker(t, nil, myTopic)
+	assert.NoError(t, b.CreateTopic(TopicConfiguration{Name: "shards", PartitionCount: 4}))
+
+	// pin each table to a partition
+	b.SetPartitioner(PartitionerFunc(func(topic string, msg *Message, partitionCount int) int32 {
+		return int32(len(msg.Key)) % int32(partitionCount)
+	}))
+	md, err := b.Produce("shards", &Message{Key: []byte("users"), Message: []byte("row")})
+	assert.NoError(t, err)
+	assert.Equal(t, int32(1), md.Partition)
+}
+
+func TestKrakeBroker_Produce_TargetPartition(t *testing.T) {
+	b, _ := newTestBroker(t, nil, myTopic)
+	assert.NoError(t, b.CreateTopic(TopicConfiguration{Name: "cdc", PartitionCount: 3}))
+
+	// the target partition wins over the key
+	for i := 0; i < 6; i++ {
+		partition := int32(i % 3)
+		md, err := b.Produce("cdc", &Message{
+			Key:             []byte("users"),
+			Message:         []byte(fmt.Sprintf("row-%d", i)),
+			TargetPartition: &partition,
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, partition, md.Partition)
+		assert.Equal(t, int64(i/3), md.Offset)
+	}
+
+	for _, partition := range []int32{-1, 3} {
+		partition := partition
+		_, err := b.Produce("cdc", &Message{Message: []byte("row"), TargetPartition: &partition})
+		assert.ErrorIs(t, err, ErrUnknownPartition)
+	}
+	assert.Equal(t, int64(2), b.logs[TopicPartitionKey{"cdc", 0}].nextOffset)
+}
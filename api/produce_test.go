@@ -0,0 +1,106 @@
+package api
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/krake-labs/krake/api/record"
+	"github.com/stretchr/testify/assert"
+)
+
+func partition(p int32) *int32 {
+	return &p
+}
+
+func TestKrakeBroker_ProduceBatch(t *testing.T) {
+	b, _ := newTestBroker(t, nil, myTopic)
+	assert.NoError(t, b.CreateTopic(TopicConfiguration{Name: "events", PartitionCount: 3}))
+
+	var msgs []*Message
+	for i := 0; i < 9; i++ {
+		msgs = append(msgs, &Message{
+			Message:         []byte(fmt.Sprintf("event-%d", i)),
+			TargetPartition: partition(int32(i % 2)),
+		})
+	}
+	msgs[4].TargetPartition = partition(7)
+
+	results, err := b.ProduceBatch("events", msgs, ProduceOptions{})
+	assert.NoError(t, err)
+	assert.Len(t, results, len(msgs))
+
+	// offsets are assigned per partition in the order of the messages
+	var offsets []int64
+	for i, r := range results {
+		if i == 4 {
+			assert.ErrorIs(t, r.Err, ErrUnknownPartition)
+			continue
+		}
+		assert.NoError(t, r.Err)
+		assert.Equal(t, int32(i%2), r.Partition)
+		offsets = append(offsets, r.Offset)
+	}
+	assert.Equal(t, []int64{0, 0, 1, 1, 2, 2, 3, 3}, offsets)
+
+	// each partition got a single batch
+	even, err := b.Fetch(TopicPartitionKey{"events", 0}, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), even.LastOffset())
+	var values []string
+	for _, r := range even.Records {
+		values = append(values, string(r.Value))
+	}
+	assert.Equal(t, []string{"event-0", "event-2", "event-6", "event-8"}, values)
+
+	odd, err := b.Fetch(TopicPartitionKey{"events", 1}, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), odd.LastOffset())
+
+	_, err = b.Fetch(TopicPartitionKey{"events", 2}, 0)
+	assert.ErrorIs(t, err, ErrOffsetOutOfRange)
+}
+
+func TestKrakeBroker_ProduceBatch_NoSuchTopic(t *testing.T) {
+	b, _ := newTestBroker(t, nil, myTopic)
+	_, err := b.ProduceBatch("missing", []*Message{{Message: []byte("event")}}, ProduceOptions{})
+	assert.ErrorIs(t, err, ErrNoSuchTopic)
+}
+
+func TestKrakeBroker_ProduceBatch_Timestamps(t *testing.T) {
+	b, now := newTestBroker(t, nil, myTopic)
+	created := now.Add(-time.Hour)
+
+	results, err := b.ProduceBatch("my-topic", []*Message{
+		{Message: []byte("a"), Timestamp: created},
+		{Message: []byte("b")},
+		{Message: []byte("c"), Timestamp: created.Add(time.Minute)},
+	}, ProduceOptions{Compression: record.CompressionZstd})
+	assert.NoError(t, err)
+	for _, r := range results {
+		assert.NoError(t, r.Err)
+	}
+
+	batch, err := b.Fetch(TopicPartitionKey{"my-topic", 0}, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, record.CompressionZstd, batch.Compression())
+	assert.Equal(t, created.UnixMilli(), batch.Timestamp(&batch.Records[0]))
+	assert.Equal(t, now.UnixMilli(), batch.Timestamp(&batch.Records[1]))
+	assert.Equal(t, created.Add(time.Minute).UnixMilli(), batch.Timestamp(&batch.Records[2]))
+	assert.Equal(t, now.UnixMilli(), batch.MaxTimestamp)
+}
+
+func TestKrakeBroker_ProduceBatch_FlushMessages(t *testing.T) {
+	b, _ := newTestBroker(t, map[string]interface{}{
+		"flush.messages": 5,
+	}, myTopic)
+	_, err := b.ProduceBatch("my-topic", []*Message{{Message: []byte("a")}, {Message: []byte("b")}, {Message: []byte("c")}}, ProduceOptions{})
+	assert.NoError(t, err)
+	l := b.logs[TopicPartitionKey{"my-topic", 0}]
+	assert.Equal(t, 3, l.unflushed)
+
+	// every message counts towards flush.messages
+	_, err = b.ProduceBatch("my-topic", []*Message{{Message: []byte("d")}, {Message: []byte("e")}}, ProduceOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, l.unflushed)
+}
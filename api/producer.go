@@ -0,0 +1,368 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/krake-labs/krake/api/record"
+)
+
+var (
+	ErrUnknownProducerID    = errors.New("unknown producer id")
+	ErrOutOfOrderSequence   = errors.New("out of order sequence number")
+	ErrInvalidProducerEpoch = errors.New("producer fenced by a newer epoch")
+)
+
+const (
+	// producerIDBlockFile in the first log dir holds the end of the
+	// block of producer ids being handed out.
+	producerIDBlockFile = "producer-id-block"
+	producerIDBlockSize = 1000
+
+	snapshotFileSuffix = ".snapshot"
+
+	// batches remembered per producer to answer retries, like the
+	// max.in.flight.requests.per.connection an idempotent producer is
+	// allowed.
+	maxProducerBatches = 5
+)
+
+// ProducerIdentity is an idempotent producer, handed out by
+// InitProducerID. The zero value is a producer that is not idempotent
+// and whose retries may be written twice.
+type ProducerIdentity struct {
+	ID    int64
+	Epoch int16
+}
+
+func (p ProducerIdentity) idempotent() bool {
+	return p.ID != 0
+}
+
+// InitProducerID hands out a producer id. Ids are reserved in blocks
+// saved to the first log dir so they are never reused after a
+// restart.
+func (k *KrakeBroker) InitProducerID() (ProducerIdentity, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	id, err := k.allocateProducerID()
+	if err != nil {
+		return ProducerIdentity{}, err
+	}
+	return ProducerIdentity{ID: id}, nil
+}
+
+func (k *KrakeBroker) allocateProducerID() (int64, error) {
+	if err := k.loadProducerIDBlock(); err != nil {
+		return 0, err
+	}
+	if k.nextProducerID == k.producerIDLimit {
+		if err := k.reserveProducerIDs(k.producerIDLimit + producerIDBlockSize); err != nil {
+			return 0, err
+		}
+	}
+	id := k.nextProducerID
+	k.nextProducerID++
+	return id, nil
+}
+
+func (k *KrakeBroker) producerIDBlockPath() string {
+	return filepath.Join(k.logDirs()[0], producerIDBlockFile)
+}
+
+// loadProducerIDBlock skips whatever was left of the block reserved
+// before the broker was stopped.
+func (k *KrakeBroker) loadProducerIDBlock() error {
+	if k.producerIDLimit > 0 {
+		return nil
+	}
+
+	data, err := readFile(k.store, k.producerIDBlockPath())
+	if errors.Is(err, os.ErrNotExist) {
+		// ids start at 1 so the zero ProducerIdentity is not idempotent.
+		k.nextProducerID, k.producerIDLimit = 1, 1
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	limit, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return fmt.Errorf("%s: %w", producerIDBlockFile, err)
+	}
+	k.nextProducerID, k.producerIDLimit = limit, limit
+	return nil
+}
+
+func (k *KrakeBroker) reserveProducerIDs(limit int64) error {
+	if err := k.store.MkdirAll(k.logDirs()[0]); err != nil {
+		return err
+	}
+	path := k.producerIDBlockPath()
+	tmp := path + ".tmp"
+	if err := writeFile(k.store, tmp, []byte(strconv.FormatInt(limit, 10))); err != nil {
+		return err
+	}
+	if err := k.store.Rename(tmp, path); err != nil {
+		return err
+	}
+	k.producerIDLimit = limit
+	return nil
+}
+
+// checkProducerID fails unless the id was handed out by InitProducerID.
+func (k *KrakeBroker) checkProducerID(p ProducerIdentity) error {
+	if err := k.loadProducerIDBlock(); err != nil {
+		return err
+	}
+	if p.ID < 1 || p.ID >= k.nextProducerID {
+		return fmt.Errorf("%w: %d", ErrUnknownProducerID, p.ID)
+	}
+	return nil
+}
+
+// producerBatch is a batch appended by an idempotent producer.
+type producerBatch struct {
+	FirstSequence int32
+	LastSequence  int32
+	FirstOffset   int64
+}
+
+// producerState is what a partition remembers of a producer, its
+// latest epoch and last few batches.
+type producerState struct {
+	ID      int64
+	Epoch   int16
+	Batches []producerBatch
+}
+
+// addSequence adds n to a sequence number, which wraps around to 0
+// after math.MaxInt32 like the Java client.
+func addSequence(sequence int32, n int) int32 {
+	return int32((int64(sequence) + int64(n)) % (math.MaxInt32 + 1))
+}
+
+// checkProducerBatch validates the sequence numbers of the messages a
+// producer sends to a partition. They must follow on from the last
+// batch of the producer, or start at 0 with a new epoch. A retry of
+// one of the last batches is a duplicate and the offset it was written
+// at is returned instead.
+func (k *KrakeBroker) checkProducerBatch(key TopicPartitionKey, p ProducerIdentity, msgs []*Message) (int64, bool, error) {
+	first := msgs[0].Sequence
+	for i, msg := range msgs {
+		if msg.Sequence != addSequence(first, i) {
+			return 0, false, fmt.Errorf("%w: %d follows %d in a batch", ErrOutOfOrderSequence, msg.Sequence, first)
+		}
+	}
+	last := addSequence(first, len(msgs)-1)
+
+	var s *producerState
+	ok := false
+	if l, exists := k.logs[key]; exists {
+		s, ok = l.producers[p.ID]
+	}
+	switch {
+	case !ok || p.Epoch > s.Epoch:
+		if first != 0 {
+			return 0, false, fmt.Errorf("%w: producer %d epoch %d starts at sequence %d", ErrOutOfOrderSequence, p.ID, p.Epoch, first)
+		}
+		return 0, false, nil
+	case p.Epoch < s.Epoch:
+		return 0, false, fmt.Errorf("%w: epoch %d of producer %d is older than %d", ErrInvalidProducerEpoch, p.Epoch, p.ID, s.Epoch)
+	}
+
+	for _, b := range s.Batches {
+		if b.FirstSequence == first && b.LastSequence == last {
+			return b.FirstOffset, true, nil
+		}
+	}
+	if expected := addSequence(s.Batches[len(s.Batches)-1].LastSequence, 1); first != expected {
+		return 0, false, fmt.Errorf("%w: expected %d from producer %d, got %d", ErrOutOfOrderSequence, expected, p.ID, first)
+	}
+	return 0, false, nil
+}
+
+// appendProducerBatch remembers a batch appended to the log if it was
+// written by an idempotent producer.
+func (l *partitionLog) appendProducerBatch(batch *record.Batch) {
+	if batch.ProducerID == record.NoProducerID || batch.IsControl() {
+		return
+	}
+	if l.producers == nil {
+		l.producers = map[int64]*producerState{}
+	}
+
+	s, ok := l.producers[batch.ProducerID]
+	if !ok || batch.ProducerEpoch != s.Epoch {
+		s = &producerState{ID: batch.ProducerID, Epoch: batch.ProducerEpoch}
+		l.producers[batch.ProducerID] = s
+	}
+	s.Batches = append(s.Batches, producerBatch{
+		FirstSequence: batch.BaseSequence,
+		LastSequence:  addSequence(batch.BaseSequence, int(batch.LastOffsetDelta)),
+		FirstOffset:   batch.BaseOffset,
+	})
+	if len(s.Batches) > maxProducerBatches {
+		s.Batches = append(s.Batches[:0], s.Batches[1:]...)
+	}
+}
+
+// writeProducerSnapshot saves the producer state of the partition as
+// of the log end offset, named like the segment starting there.
+// Recovery then only replays the batches after it.
+func (pw *PartitionWriter) writeProducerSnapshot(key TopicPartitionKey, l *partitionLog) error {
+	if len(l.producers) == 0 {
+		return nil
+	}
+
+	producers := make([]*producerState, 0, len(l.producers))
+	for _, s := range l.producers {
+		producers = append(producers, s)
+	}
+	sort.Slice(producers, func(i, j int) bool {
+		return producers[i].ID < producers[j].ID
+	})
+	data, err := json.Marshal(producers)
+	if err != nil {
+		return err
+	}
+
+	path := pw.segmentPath(key, l.nextOffset, snapshotFileSuffix)
+	tmp := path + ".tmp"
+	if err = writeFile(pw.store, tmp, data); err != nil {
+		return err
+	}
+	return pw.store.Rename(tmp, path)
+}
+
+func readProducerSnapshot(store SegmentStore, path string) (map[int64]*producerState, error) {
+	data, err := readFile(store, path)
+	if err != nil {
+		return nil, err
+	}
+	var producers []*producerState
+	if err = json.Unmarshal(data, &producers); err != nil {
+		return nil, err
+	}
+
+	state := map[int64]*producerState{}
+	for _, s := range producers {
+		if len(s.Batches) == 0 {
+			return nil, fmt.Errorf("producer %d has no batches", s.ID)
+		}
+		state[s.ID] = s
+	}
+	return state, nil
+}
+
+// snapshotOffsets lists the offsets of the producer snapshots in dir,
+// latest first.
+func (pw *PartitionWriter) snapshotOffsets(dir string) ([]int64, error) {
+	entries, err := pw.store.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var offsets []int64
+	for _, e := range entries {
+		if offset, ok := parseSegmentFileName(e.Name(), snapshotFileSuffix); ok {
+			offsets = append(offsets, offset)
+		}
+	}
+	sort.Slice(offsets, func(i, j int) bool {
+		return offsets[i] > offsets[j]
+	})
+	return offsets, nil
+}
+
+// recoverProducerState loads the latest producer snapshot of a
+// recovered partition and replays the batches written after it.
+// Snapshots past the log end offset were taken before the log was
+// truncated and are removed, unreadable ones are skipped.
+func (pw *PartitionWriter) recoverProducerState(key TopicPartitionKey) error {
+	dir := pw.partitionDirs[key]
+	l := pw.logs[key]
+	offsets, err := pw.snapshotOffsets(dir)
+	if err != nil {
+		return err
+	}
+
+	l.producers = nil
+	from := l.segments[0].baseOffset
+	for _, offset := range offsets {
+		path := filepath.Join(dir, segmentFileName(offset, snapshotFileSuffix))
+		if offset > l.nextOffset {
+			if err = pw.store.Remove(path); err != nil {
+				return err
+			}
+			continue
+		}
+		// the batches before the first segment can't be replayed.
+		if offset < from {
+			break
+		}
+		producers, err := readProducerSnapshot(pw.store, path)
+		if err != nil {
+			log.Println("ignoring producer snapshot", path, err)
+			continue
+		}
+		l.producers = producers
+		from = offset
+		break
+	}
+	return l.replayProducerBatches(from)
+}
+
+// replayProducerBatches rebuilds the producer state from the batches
+// at or after offset.
+func (l *partitionLog) replayProducerBatches(offset int64) error {
+	for i, s := range l.segments {
+		if i+1 < len(l.segments) && l.segments[i+1].baseOffset <= offset {
+			continue
+		}
+		f, err := s.file()
+		if err != nil {
+			return err
+		}
+		_, position := s.index.lookup(offset)
+		for position < s.size {
+			batch, err := record.ReadHeaderAt(f, position)
+			if err != nil {
+				return err
+			}
+			if batch.BaseOffset >= offset {
+				l.appendProducerBatch(batch)
+			}
+			position += int64(batch.Size())
+		}
+	}
+	return nil
+}
+
+// deleteProducerSnapshots removes the snapshots older than the first
+// local segment, which can no longer be replayed from.
+func (pw *PartitionWriter) deleteProducerSnapshots(key TopicPartitionKey, l *partitionLog) error {
+	dir := pw.partitionDirs[key]
+	offsets, err := pw.snapshotOffsets(dir)
+	if err != nil {
+		return err
+	}
+	for _, offset := range offsets {
+		if offset >= l.segments[0].baseOffset {
+			continue
+		}
+		err := pw.store.Remove(filepath.Join(dir, segmentFileName(offset, snapshotFileSuffix)))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
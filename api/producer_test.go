@@ -0,0 +1,213 @@
+package api
+
+import (
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/krake-labs/krake/api/record"
+	"github.com/stretchr/testify/assert"
+)
+
+// newIdempotentBroker creates a topic with two partitions whose
+// segments only fit a single batch, so every batch rolls the active
+// segment.
+func newIdempotentBroker(t *testing.T) *KrakeBroker {
+	b, _ := newTestBroker(t, map[string]interface{}{"log.segment.bytes": 100}, TopicConfiguration{Name: "events", PartitionCount: 2})
+	return b
+}
+
+// produceSequence produces n messages to partition 0 starting at
+// sequence and returns their results.
+func produceSequence(t *testing.T, b *KrakeBroker, p ProducerIdentity, sequence int32, n int) ([]ProduceResult, error) {
+	msgs := make([]*Message, n)
+	for i := range msgs {
+		msgs[i] = &Message{
+			Message:         []byte(fmt.Sprintf("message-%d", addSequence(sequence, i))),
+			TargetPartition: partition(0),
+			Sequence:        addSequence(sequence, i),
+		}
+	}
+	return b.ProduceBatch("events", msgs, ProduceOptions{Producer: p})
+}
+
+func TestKrakeBroker_InitProducerID(t *testing.T) {
+	b := newIdempotentBroker(t)
+
+	first, err := b.InitProducerID()
+	assert.NoError(t, err)
+	second, err := b.InitProducerID()
+	assert.NoError(t, err)
+	assert.Equal(t, ProducerIdentity{ID: 1}, first)
+	assert.Equal(t, ProducerIdentity{ID: 2}, second)
+
+	// the rest of the block is skipped after a restart
+	_, restarted := newRestartBroker(b.store, memoryLogDir)
+	third, err := restarted.InitProducerID()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(producerIDBlockSize+1), third.ID)
+
+	// ids the broker never handed out are rejected
+	_, err = produceSequence(t, b, ProducerIdentity{ID: 3}, 0, 1)
+	assert.ErrorIs(t, err, ErrUnknownProducerID)
+}
+
+func TestKrakeBroker_ProduceBatch_Idempotent(t *testing.T) {
+	b := newIdempotentBroker(t)
+	p, err := b.InitProducerID()
+	assert.NoError(t, err)
+
+	results, err := produceSequence(t, b, p, 0, 3)
+	assert.NoError(t, err)
+	assert.NoError(t, results[2].Err)
+	results, err = produceSequence(t, b, p, 3, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), results[0].Offset)
+
+	// a retry is acknowledged with the offsets it was first written at
+	results, err = produceSequence(t, b, p, 0, 3)
+	assert.NoError(t, err)
+	assert.NoError(t, results[0].Err)
+	assert.Equal(t, int64(0), results[0].Offset)
+	assert.Equal(t, int64(2), results[2].Offset)
+	assert.Equal(t, int64(5), b.logs[TopicPartitionKey{"events", 0}].nextOffset)
+
+	// a gap means a batch was lost
+	results, err = produceSequence(t, b, p, 7, 1)
+	assert.NoError(t, err)
+	assert.ErrorIs(t, results[0].Err, ErrOutOfOrderSequence)
+
+	// and so does a batch that is not consecutive
+	results, err = b.ProduceBatch("events", []*Message{
+		{Message: []byte("a"), TargetPartition: partition(0), Sequence: 5},
+		{Message: []byte("b"), TargetPartition: partition(0), Sequence: 7},
+	}, ProduceOptions{Producer: p})
+	assert.NoError(t, err)
+	assert.ErrorIs(t, results[1].Err, ErrOutOfOrderSequence)
+
+	// sequences are tracked per partition
+	results, err = b.ProduceBatch("events", []*Message{
+		{Message: []byte("a"), TargetPartition: partition(1), Sequence: 0},
+	}, ProduceOptions{Producer: p})
+	assert.NoError(t, err)
+	assert.NoError(t, results[0].Err)
+
+	// the batches carry the producer
+	batch, err := b.Fetch(TopicPartitionKey{"events", 0}, 3)
+	assert.NoError(t, err)
+	assert.Equal(t, p.ID, batch.ProducerID)
+	assert.Equal(t, int32(3), batch.BaseSequence)
+}
+
+func TestKrakeBroker_ProduceBatch_ProducerEpoch(t *testing.T) {
+	b := newIdempotentBroker(t)
+	p, err := b.InitProducerID()
+	assert.NoError(t, err)
+
+	_, err = produceSequence(t, b, p, 0, 2)
+	assert.NoError(t, err)
+
+	// a new epoch starts its sequence again and fences the old one
+	bumped := ProducerIdentity{ID: p.ID, Epoch: 1}
+	results, err := produceSequence(t, b, bumped, 2, 1)
+	assert.NoError(t, err)
+	assert.ErrorIs(t, results[0].Err, ErrOutOfOrderSequence)
+	results, err = produceSequence(t, b, bumped, 0, 1)
+	assert.NoError(t, err)
+	assert.NoError(t, results[0].Err)
+
+	results, err = produceSequence(t, b, p, 2, 1)
+	assert.NoError(t, err)
+	assert.ErrorIs(t, results[0].Err, ErrInvalidProducerEpoch)
+}
+
+func TestAddSequence(t *testing.T) {
+	assert.Equal(t, int32(5), addSequence(2, 3))
+	assert.Equal(t, int32(0), addSequence(math.MaxInt32, 1))
+	assert.Equal(t, int32(1), addSequence(math.MaxInt32-1, 3))
+}
+
+func TestKrakeBroker_LoadLogs_ProducerState(t *testing.T) {
+	b := newIdempotentBroker(t)
+	p, err := b.InitProducerID()
+	assert.NoError(t, err)
+	for i := int32(0); i < 10; i += 2 {
+		_, err = produceSequence(t, b, p, i, 2)
+		assert.NoError(t, err)
+	}
+	l := b.logs[TopicPartitionKey{"events", 0}]
+	assert.Greater(t, len(l.segments), 2)
+	assert.NoError(t, b.Close())
+
+	// every roll and the shutdown left a snapshot
+	offsets, err := b.snapshotOffsets(b.partitionDirs[TopicPartitionKey{"events", 0}])
+	assert.NoError(t, err)
+	assert.Equal(t, int64(10), offsets[0])
+	assert.Len(t, offsets, len(l.segments))
+
+	restartedPW, restarted := newRestartBroker(b.store, memoryLogDir)
+	k := restarted.(*KrakeBroker)
+	assert.NoError(t, k.LoadLogs())
+	defer restartedPW.Close()
+
+	// the last batches are still known so a retry is not written again
+	results, err := produceSequence(t, k, p, 8, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(8), results[0].Offset)
+	results, err = produceSequence(t, k, p, 10, 1)
+	assert.NoError(t, err)
+	assert.NoError(t, results[0].Err)
+	assert.Equal(t, int64(10), results[0].Offset)
+}
+
+func TestKrakeBroker_LoadLogs_ProducerStateReplayed(t *testing.T) {
+	b := newIdempotentBroker(t)
+	p, err := b.InitProducerID()
+	assert.NoError(t, err)
+	for i := int32(0); i < 10; i += 2 {
+		_, err = produceSequence(t, b, p, i, 2)
+		assert.NoError(t, err)
+	}
+
+	// stop without snapshotting, with a snapshot past the end of the
+	// log as if the log was truncated after it was taken
+	key := TopicPartitionKey{"events", 0}
+	l := b.logs[key]
+	l.nextOffset = 12
+	assert.NoError(t, b.writeProducerSnapshot(key, l))
+	l.nextOffset = 10
+	for _, s := range l.segments {
+		s.close()
+	}
+
+	restartedPW, restarted := newRestartBroker(b.store, memoryLogDir)
+	k := restarted.(*KrakeBroker)
+	assert.NoError(t, k.LoadLogs())
+	defer restartedPW.Close()
+
+	offsets, err := b.snapshotOffsets(b.partitionDirs[key])
+	assert.NoError(t, err)
+	assert.NotContains(t, offsets, int64(12))
+
+	results, err := produceSequence(t, k, p, 8, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(8), results[0].Offset)
+	results, err = produceSequence(t, k, p, 11, 1)
+	assert.NoError(t, err)
+	assert.ErrorIs(t, results[0].Err, ErrOutOfOrderSequence)
+}
+
+func TestPartitionLog_AppendProducerBatch(t *testing.T) {
+	l := &partitionLog{}
+	l.appendProducerBatch(record.NewBatch(0, 0, record.Record{}))
+	assert.Empty(t, l.producers)
+
+	for i := 0; i < maxProducerBatches+2; i++ {
+		batch := record.NewBatch(int64(i*2), 0, record.Record{}, record.Record{})
+		batch.ProducerID, batch.ProducerEpoch, batch.BaseSequence = 7, 0, int32(i*2)
+		l.appendProducerBatch(batch)
+	}
+	s := l.producers[7]
+	assert.Len(t, s.Batches, maxProducerBatches)
+	assert.Equal(t, producerBatch{FirstSequence: 12, LastSequence: 13, FirstOffset: 12}, s.Batches[maxProducerBatches-1])
+}
@@ -0,0 +1,452 @@
+// Package record implements the v2 record batch format used for both
+// segment files on disk and messages sent over the wire.
+//
+// A batch is laid out as follows (all integers big endian):
+//
+//	baseOffset:           int64
+//	batchLength:          int32 (bytes following this field)
+//	partitionLeaderEpoch: int32
+//	magic:                int8  (2)
+//	crc:                  uint32 (crc32c of attributes to the end of the batch)
+//	attributes:           int16
+//	lastOffsetDelta:      int32
+//	firstTimestamp:       int64
+//	maxTimestamp:         int64
+//	producerId:           int64
+//	producerEpoch:        int16
+//	baseSequence:         int32
+//	records:              int32 count followed by each record
+//
+// The lowest three bits of the attributes are the compression codec,
+// when set the records following the count are compressed as a whole.
+// The next bits are the timestamp type and mark batches written in a
+// transaction and batches holding a control record.
+//
+// Records use zigzag varints for their lengths and deltas:
+//
+//	length:         varint
+//	attributes:     int8
+//	timestampDelta: varlong
+//	offsetDelta:    varint
+//	keyLength:      varint (-1 for a nil key)
+//	key:            bytes
+//	valueLength:    varint (-1 for a nil value)
+//	value:          bytes
+//	headers:        varint count of [keyLength varint, key, valueLength varint, value]
+package record
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+)
+
+const (
+	// Magic is the version of the batch format written by this package.
+	Magic int8 = 2
+
+	// LogOverhead is the size of the base offset and batch length
+	// fields that prefix every batch.
+	LogOverhead = 12
+
+	// BatchHeaderSize is the size of a batch with no records.
+	BatchHeaderSize = 61
+
+	// NoProducerID is used when a batch was not written by an
+	// idempotent producer.
+	NoProducerID    int64 = -1
+	NoProducerEpoch int16 = -1
+	NoSequence      int32 = -1
+)
+
+// header field positions relative to the start of a batch.
+const (
+	baseOffsetPos      = 0
+	batchLengthPos     = 8
+	leaderEpochPos     = 12
+	magicPos           = 16
+	crcPos             = 17
+	attributesPos      = 21
+	lastOffsetDeltaPos = 23
+	firstTimestampPos  = 27
+	maxTimestampPos    = 35
+	producerIDPos      = 43
+	producerEpochPos   = 51
+	baseSequencePos    = 53
+	recordsCountPos    = 57
+)
+
+var (
+	ErrCorruptBatch     = errors.New("corrupt record batch")
+	ErrInvalidCRC       = errors.New("record batch crc mismatch")
+	ErrUnsupportedMagic = errors.New("unsupported record batch magic")
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+type Header struct {
+	Key   string
+	Value []byte
+}
+
+type Record struct {
+	Attributes     int8
+	TimestampDelta int64
+	OffsetDelta    int32
+	Key            []byte
+	Value          []byte
+	Headers        []Header
+}
+
+type Batch struct {
+	BaseOffset           int64
+	BatchLength          int32
+	PartitionLeaderEpoch int32
+	Magic                int8
+	CRC                  uint32
+	Attributes           int16
+	LastOffsetDelta      int32
+	FirstTimestamp       int64
+	MaxTimestamp         int64
+	ProducerID           int64
+	ProducerEpoch        int16
+	BaseSequence         int32
+	Records              []Record
+}
+
+// NewBatch builds a batch starting at baseOffset where every record
+// shares the given timestamp (in milliseconds). Offset deltas are
+// assigned in order.
+func NewBatch(baseOffset int64, timestamp int64, records ...Record) *Batch {
+	for i := range records {
+		records[i].OffsetDelta = int32(i)
+		records[i].TimestampDelta = 0
+	}
+	return &Batch{
+		BaseOffset:           baseOffset,
+		PartitionLeaderEpoch: 0,
+		Magic:                Magic,
+		LastOffsetDelta:      int32(len(records) - 1),
+		FirstTimestamp:       timestamp,
+		MaxTimestamp:         timestamp,
+		ProducerID:           NoProducerID,
+		ProducerEpoch:        NoProducerEpoch,
+		BaseSequence:         NoSequence,
+		Records:              records,
+	}
+}
+
+// LastOffset is the offset of the last record in the batch.
+func (b *Batch) LastOffset() int64 {
+	return b.BaseOffset + int64(b.LastOffsetDelta)
+}
+
+// NextOffset is the offset following the last record in the batch.
+func (b *Batch) NextOffset() int64 {
+	return b.LastOffset() + 1
+}
+
+// Size is the number of bytes the batch occupies once encoded. It is
+// only valid after Encode or Decode.
+func (b *Batch) Size() int {
+	return LogOverhead + int(b.BatchLength)
+}
+
+// Encode serialises the batch, computing the batch length and crc.
+// The CRC field of b is updated to match the encoded bytes.
+func (b *Batch) Encode() []byte {
+	buf := make([]byte, BatchHeaderSize, BatchHeaderSize+b.recordsSizeHint())
+
+	binary.BigEndian.PutUint64(buf[baseOffsetPos:], uint64(b.BaseOffset))
+	binary.BigEndian.PutUint32(buf[leaderEpochPos:], uint32(b.PartitionLeaderEpoch))
+	buf[magicPos] = byte(Magic)
+	binary.BigEndian.PutUint16(buf[attributesPos:], uint16(b.Attributes))
+	binary.BigEndian.PutUint32(buf[lastOffsetDeltaPos:], uint32(b.LastOffsetDelta))
+	binary.BigEndian.PutUint64(buf[firstTimestampPos:], uint64(b.FirstTimestamp))
+	binary.BigEndian.PutUint64(buf[maxTimestampPos:], uint64(b.MaxTimestamp))
+	binary.BigEndian.PutUint64(buf[producerIDPos:], uint64(b.ProducerID))
+	binary.BigEndian.PutUint16(buf[producerEpochPos:], uint16(b.ProducerEpoch))
+	binary.BigEndian.PutUint32(buf[baseSequencePos:], uint32(b.BaseSequence))
+	binary.BigEndian.PutUint32(buf[recordsCountPos:], uint32(len(b.Records)))
+
+	if c := b.Compression(); c == CompressionNone {
+		for i := range b.Records {
+			buf = appendRecord(buf, &b.Records[i])
+		}
+	} else {
+		var records []byte
+		for i := range b.Records {
+			records = appendRecord(records, &b.Records[i])
+		}
+		buf = append(buf, compress(c, records)...)
+	}
+
+	b.BatchLength = int32(len(buf) - LogOverhead)
+	binary.BigEndian.PutUint32(buf[batchLengthPos:], uint32(b.BatchLength))
+	b.Magic = Magic
+	b.CRC = crc32.Checksum(buf[attributesPos:], crcTable)
+	binary.BigEndian.PutUint32(buf[crcPos:], b.CRC)
+	return buf
+}
+
+func (b *Batch) recordsSizeHint() int {
+	n := 0
+	for _, r := range b.Records {
+		n += len(r.Key) + len(r.Value) + 16
+		for _, h := range r.Headers {
+			n += len(h.Key) + len(h.Value) + 4
+		}
+	}
+	return n
+}
+
+// Size returns the total size of the encoded batch described by
+// the first LogOverhead bytes of buf.
+func Size(buf []byte) (int, error) {
+	if len(buf) < LogOverhead {
+		return 0, io.ErrUnexpectedEOF
+	}
+	length := int32(binary.BigEndian.Uint32(buf[batchLengthPos:]))
+	if length < BatchHeaderSize-LogOverhead {
+		return 0, ErrCorruptBatch
+	}
+	return LogOverhead + int(length), nil
+}
+
+// Decode parses a single batch from the start of buf and validates
+// its crc. Any bytes following the batch are ignored.
+func Decode(buf []byte) (*Batch, error) {
+	size, err := Size(buf)
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) < size {
+		return nil, io.ErrUnexpectedEOF
+	}
+	buf = buf[:size]
+
+	if int8(buf[magicPos]) != Magic {
+		return nil, ErrUnsupportedMagic
+	}
+
+	b := &Batch{
+		BaseOffset:           int64(binary.BigEndian.Uint64(buf[baseOffsetPos:])),
+		BatchLength:          int32(size - LogOverhead),
+		PartitionLeaderEpoch: int32(binary.BigEndian.Uint32(buf[leaderEpochPos:])),
+		Magic:                int8(buf[magicPos]),
+		CRC:                  binary.BigEndian.Uint32(buf[crcPos:]),
+		Attributes:           int16(binary.BigEndian.Uint16(buf[attributesPos:])),
+		LastOffsetDelta:      int32(binary.BigEndian.Uint32(buf[lastOffsetDeltaPos:])),
+		FirstTimestamp:       int64(binary.BigEndian.Uint64(buf[firstTimestampPos:])),
+		MaxTimestamp:         int64(binary.BigEndian.Uint64(buf[maxTimestampPos:])),
+		ProducerID:           int64(binary.BigEndian.Uint64(buf[producerIDPos:])),
+		ProducerEpoch:        int16(binary.BigEndian.Uint16(buf[producerEpochPos:])),
+		BaseSequence:         int32(binary.BigEndian.Uint32(buf[baseSequencePos:])),
+	}
+
+	if crc32.Checksum(buf[attributesPos:], crcTable) != b.CRC {
+		return nil, ErrInvalidCRC
+	}
+
+	count := int32(binary.BigEndian.Uint32(buf[recordsCountPos:]))
+	if count < 0 {
+		return nil, ErrCorruptBatch
+	}
+
+	rest := buf[BatchHeaderSize:]
+	if c := b.Compression(); c != CompressionNone {
+		if rest, err = decompress(c, rest); err != nil {
+			return nil, err
+		}
+	}
+	b.Records = make([]Record, 0, count)
+	for i := int32(0); i < count; i++ {
+		r, n, err := readRecord(rest)
+		if err != nil {
+			return nil, err
+		}
+		b.Records = append(b.Records, r)
+		rest = rest[n:]
+	}
+	if len(rest) != 0 {
+		return nil, ErrCorruptBatch
+	}
+	return b, nil
+}
+
+// ReadBatch reads and decodes the next batch from r.
+func ReadBatch(r io.Reader) (*Batch, error) {
+	head := make([]byte, LogOverhead)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+	size, err := Size(head)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	copy(buf, head)
+	if _, err := io.ReadFull(r, buf[LogOverhead:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return Decode(buf)
+}
+
+// ReadBatchAt reads and decodes the batch starting at pos in r.
+func ReadBatchAt(r io.ReaderAt, pos int64) (*Batch, error) {
+	head := make([]byte, LogOverhead)
+	if _, err := r.ReadAt(head, pos); err != nil {
+		return nil, err
+	}
+	size, err := Size(head)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	if _, err := r.ReadAt(buf, pos); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return Decode(buf)
+}
+
+func appendRecord(buf []byte, r *Record) []byte {
+	body := make([]byte, 0, len(r.Key)+len(r.Value)+16)
+	body = append(body, byte(r.Attributes))
+	body = binary.AppendVarint(body, r.TimestampDelta)
+	body = binary.AppendVarint(body, int64(r.OffsetDelta))
+	body = appendBytes(body, r.Key)
+	body = appendBytes(body, r.Value)
+	body = binary.AppendVarint(body, int64(len(r.Headers)))
+	for _, h := range r.Headers {
+		body = appendBytes(body, []byte(h.Key))
+		body = appendBytes(body, h.Value)
+	}
+
+	buf = binary.AppendVarint(buf, int64(len(body)))
+	return append(buf, body...)
+}
+
+func appendBytes(buf []byte, b []byte) []byte {
+	if b == nil {
+		return binary.AppendVarint(buf, -1)
+	}
+	buf = binary.AppendVarint(buf, int64(len(b)))
+	return append(buf, b...)
+}
+
+// readRecord decodes a record from the start of buf and returns
+// the number of bytes consumed.
+func readRecord(buf []byte) (Record, int, error) {
+	var r Record
+
+	length, n := binary.Varint(buf)
+	if n <= 0 || length < 0 || int64(len(buf)-n) < length {
+		return r, 0, ErrCorruptBatch
+	}
+	total := n + int(length)
+	body := buf[n:total]
+
+	if len(body) < 1 {
+		return r, 0, ErrCorruptBatch
+	}
+	r.Attributes = int8(body[0])
+	body = body[1:]
+
+	tsDelta, n := binary.Varint(body)
+	if n <= 0 {
+		return r, 0, ErrCorruptBatch
+	}
+	r.TimestampDelta = tsDelta
+	body = body[n:]
+
+	offsDelta, n := binary.Varint(body)
+	if n <= 0 {
+		return r, 0, ErrCorruptBatch
+	}
+	r.OffsetDelta = int32(offsDelta)
+	body = body[n:]
+
+	var err error
+	if r.Key, body, err = readBytes(body); err != nil {
+		return r, 0, err
+	}
+	if r.Value, body, err = readBytes(body); err != nil {
+		return r, 0, err
+	}
+
+	count, n := binary.Varint(body)
+	if n <= 0 || count < 0 {
+		return r, 0, ErrCorruptBatch
+	}
+	body = body[n:]
+	for i := int64(0); i < count; i++ {
+		var key, value []byte
+		if key, body, err = readBytes(body); err != nil {
+			return r, 0, err
+		}
+		if value, body, err = readBytes(body); err != nil {
+			return r, 0, err
+		}
+		r.Headers = append(r.Headers, Header{Key: string(key), Value: value})
+	}
+	if len(body) != 0 {
+		return r, 0, ErrCorruptBatch
+	}
+
+	return r, total, nil
+}
+
+func readBytes(buf []byte) ([]byte, []byte, error) {
+	length, n := binary.Varint(buf)
+	if n <= 0 || length < -1 {
+		return nil, nil, ErrCorruptBatch
+	}
+	buf = buf[n:]
+	if length == -1 {
+		return nil, buf, nil
+	}
+	if int64(len(buf)) < length {
+		return nil, nil, ErrCorruptBatch
+	}
+	b := make([]byte, length)
+	copy(b, buf[:length])
+	return b, buf[length:], nil
+}
+
+// ReadHeaderAt reads the header of the batch starting at pos in r
+// without reading its records or checking its crc. It is used to walk
+// a log without copying the records into memory.
+func ReadHeaderAt(r io.ReaderAt, pos int64) (*Batch, error) {
+	buf := make([]byte, BatchHeaderSize)
+	if _, err := r.ReadAt(buf, pos); err != nil {
+		return nil, err
+	}
+	size, err := Size(buf)
+	if err != nil {
+		return nil, err
+	}
+	if int8(buf[magicPos]) != Magic {
+		return nil, ErrUnsupportedMagic
+	}
+	return &Batch{
+		BaseOffset:           int64(binary.BigEndian.Uint64(buf[baseOffsetPos:])),
+		BatchLength:          int32(size - LogOverhead),
+		PartitionLeaderEpoch: int32(binary.BigEndian.Uint32(buf[leaderEpochPos:])),
+		Magic:                int8(buf[magicPos]),
+		CRC:                  binary.BigEndian.Uint32(buf[crcPos:]),
+		Attributes:           int16(binary.BigEndian.Uint16(buf[attributesPos:])),
+		LastOffsetDelta:      int32(binary.BigEndian.Uint32(buf[lastOffsetDeltaPos:])),
+		FirstTimestamp:       int64(binary.BigEndian.Uint64(buf[firstTimestampPos:])),
+		MaxTimestamp:         int64(binary.BigEndian.Uint64(buf[maxTimestampPos:])),
+		ProducerID:           int64(binary.BigEndian.Uint64(buf[producerIDPos:])),
+		ProducerEpoch:        int16(binary.BigEndian.Uint16(buf[producerEpochPos:])),
+		BaseSequence:         int32(binary.BigEndian.Uint32(buf[baseSequencePos:])),
+	}, nil
+}
@@ -0,0 +1,150 @@
+package record
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBatch_RoundTrip(t *testing.T) {
+	b := NewBatch(42, 1_000,
+		Record{Key: []byte("k1"), Value: []byte("hello")},
+		Record{Key: nil, Value: []byte("world"), Headers: []Header{
+			{Key: "trace-id", Value: []byte("abc")},
+			{Key: "empty", Value: nil},
+		}},
+		Record{Key: []byte("k3"), Value: nil},
+	)
+
+	data := b.Encode()
+
+	decoded, err := Decode(data)
+	assert.NoError(t, err)
+
+	assert.Equal(t, int64(42), decoded.BaseOffset)
+	assert.Equal(t, Magic, decoded.Magic)
+	assert.Equal(t, int32(2), decoded.LastOffsetDelta)
+	assert.Equal(t, int64(44), decoded.LastOffset())
+	assert.Equal(t, int64(1_000), decoded.FirstTimestamp)
+	assert.Equal(t, int64(1_000), decoded.MaxTimestamp)
+	assert.Equal(t, NoProducerID, decoded.ProducerID)
+	assert.Equal(t, NoProducerEpoch, decoded.ProducerEpoch)
+	assert.Equal(t, NoSequence, decoded.BaseSequence)
+	assert.Equal(t, b.CRC, decoded.CRC)
+
+	assert.Equal(t, b.Records, decoded.Records)
+}
+
+func TestBatch_Size(t *testing.T) {
+	b := NewBatch(0, 0, Record{Value: []byte("foo")})
+	data := b.Encode()
+
+	size, err := Size(data)
+	assert.NoError(t, err)
+	assert.Equal(t, len(data), size)
+	assert.Equal(t, len(data), b.Size())
+	assert.Equal(t, uint32(len(data)-LogOverhead), binary.BigEndian.Uint32(data[batchLengthPos:]))
+}
+
+func TestBatch_EmptyBatchIsHeaderOnly(t *testing.T) {
+	data := NewBatch(0, 0).Encode()
+	assert.Len(t, data, BatchHeaderSize)
+
+	decoded, err := Decode(data)
+	assert.NoError(t, err)
+	assert.Empty(t, decoded.Records)
+}
+
+func TestDecode_InvalidCRC(t *testing.T) {
+	data := NewBatch(0, 0, Record{Value: []byte("foo")}).Encode()
+
+	// flip a bit in the value
+	data[len(data)-2] ^= 0xff
+
+	_, err := Decode(data)
+	assert.ErrorIs(t, err, ErrInvalidCRC)
+}
+
+func TestDecode_UnsupportedMagic(t *testing.T) {
+	data := NewBatch(0, 0, Record{Value: []byte("foo")}).Encode()
+	data[magicPos] = 1
+
+	_, err := Decode(data)
+	assert.ErrorIs(t, err, ErrUnsupportedMagic)
+}
+
+func TestDecode_Truncated(t *testing.T) {
+	data := NewBatch(0, 0, Record{Value: []byte("foo")}).Encode()
+
+	_, err := Decode(data[:len(data)-1])
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	_, err = Decode(data[:4])
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+func TestDecode_ZeroedBytes(t *testing.T) {
+	// preallocated segments are padded with zeroes
+	_, err := Decode(make([]byte, 128))
+	assert.ErrorIs(t, err, ErrCorruptBatch)
+}
+
+func TestReadBatch_Sequential(t *testing.T) {
+	var buf bytes.Buffer
+	buf.Write(NewBatch(0, 10, Record{Value: []byte("a")}, Record{Value: []byte("b")}).Encode())
+	buf.Write(NewBatch(2, 20, Record{Value: []byte("c")}).Encode())
+
+	first, err := ReadBatch(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), first.NextOffset())
+	assert.Equal(t, []byte("b"), first.Records[1].Value)
+
+	second, err := ReadBatch(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), second.BaseOffset)
+	assert.Equal(t, []byte("c"), second.Records[0].Value)
+
+	_, err = ReadBatch(&buf)
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestReadBatch_TornWrite(t *testing.T) {
+	data := NewBatch(0, 0, Record{Value: []byte("foo")}).Encode()
+
+	_, err := ReadBatch(bytes.NewReader(data[:len(data)-3]))
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+func TestReadBatchAt(t *testing.T) {
+	first := NewBatch(0, 0, Record{Value: []byte("a")}).Encode()
+	second := NewBatch(1, 0, Record{Value: []byte("b")}).Encode()
+	r := bytes.NewReader(append(first, second...))
+
+	b, err := ReadBatchAt(r, int64(len(first)))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), b.BaseOffset)
+	assert.Equal(t, []byte("b"), b.Records[0].Value)
+
+	_, err = ReadBatchAt(r, int64(len(first)+len(second)))
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestReadHeaderAt(t *testing.T) {
+	first := NewBatch(0, 0, Record{Value: []byte("a")}).Encode()
+	second := NewBatch(1, 5, Record{Value: []byte("b")}, Record{Value: []byte("c")}).Encode()
+	r := bytes.NewReader(append(first, second...))
+
+	b, err := ReadHeaderAt(r, int64(len(first)))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), b.BaseOffset)
+	assert.Equal(t, int64(2), b.LastOffset())
+	assert.Equal(t, int64(5), b.MaxTimestamp)
+	assert.Equal(t, len(second), b.Size())
+	assert.Nil(t, b.Records)
+
+	_, err = ReadHeaderAt(r, int64(len(first)+len(second)))
+	assert.ErrorIs(t, err, io.EOF)
+}
@@ -0,0 +1,202 @@
+package record
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+// Compression is the codec the records of a batch are compressed with,
+// kept in the lowest three bits of the batch attributes. The header is
+// never compressed.
+type Compression int8
+
+const (
+	CompressionNone Compression = iota
+	CompressionGzip
+	CompressionSnappy
+	CompressionLZ4
+	CompressionZstd
+)
+
+const compressionMask = 0x07
+
+var (
+	ErrUnsupportedCompression = errors.New("unsupported compression codec")
+	ErrBatchTooLarge          = errors.New("decompressed record batch too large")
+)
+
+// maxDecompressedSize bounds the records of a batch once decompressed,
+// a small compressed batch can otherwise expand to fill the memory of
+// the broker.
+var maxDecompressedSize = 64 << 20
+
+var compressionNames = map[Compression]string{
+	CompressionNone:   "none",
+	CompressionGzip:   "gzip",
+	CompressionSnappy: "snappy",
+	CompressionLZ4:    "lz4",
+	CompressionZstd:   "zstd",
+}
+
+func (c Compression) String() string {
+	if name, ok := compressionNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("Compression(%d)", int8(c))
+}
+
+// Validate returns an error if the batches cannot be compressed with c.
+func (c Compression) Validate() error {
+	if _, ok := compressionNames[c]; !ok {
+		return fmt.Errorf("%w: %v", ErrUnsupportedCompression, c)
+	}
+	return nil
+}
+
+// ParseCompression returns the codec named like the compression.type
+// producer setting, an empty name is none.
+func ParseCompression(name string) (Compression, error) {
+	if name == "" {
+		return CompressionNone, nil
+	}
+	for c, n := range compressionNames {
+		if n == name {
+			return c, nil
+		}
+	}
+	return CompressionNone, fmt.Errorf("%w: %q", ErrUnsupportedCompression, name)
+}
+
+// Compression is the codec the records of the batch are compressed with.
+func (b *Batch) Compression() Compression {
+	return Compression(b.Attributes & compressionMask)
+}
+
+// SetCompression sets the codec used when the batch is next encoded.
+func (b *Batch) SetCompression(c Compression) {
+	b.Attributes = b.Attributes&^compressionMask | int16(c)&compressionMask
+}
+
+// the zstd encoder and decoder are safe for concurrent use and costly
+// to create.
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(uint64(maxDecompressedSize)))
+)
+
+// xerial is the framing of the snappy-java stream the Java client
+// writes, a magic header followed by length prefixed blocks.
+var xerialHeader = []byte{0x82, 'S', 'N', 'A', 'P', 'P', 'Y', 0}
+
+const xerialHeaderSize = 16
+
+// compress compresses the encoded records of a batch. Batches only get
+// a codec from ParseCompression or that passed Validate so any other
+// codec is a bug.
+func compress(c Compression, src []byte) []byte {
+	var buf bytes.Buffer
+	switch c {
+	case CompressionGzip:
+		w := gzip.NewWriter(&buf)
+		w.Write(src)
+		w.Close()
+	case CompressionSnappy:
+		return snappy.Encode(nil, src)
+	case CompressionLZ4:
+		w := lz4.NewWriter(&buf)
+		w.Write(src)
+		w.Close()
+	case CompressionZstd:
+		return zstdEncoder.EncodeAll(src, nil)
+	default:
+		panic(fmt.Sprintf("record: cannot compress with %v", c))
+	}
+	return buf.Bytes()
+}
+
+// decompress returns the encoded records of a compressed batch.
+func decompress(c Compression, src []byte) ([]byte, error) {
+	var (
+		dst []byte
+		err error
+	)
+	switch c {
+	case CompressionGzip:
+		var r *gzip.Reader
+		if r, err = gzip.NewReader(bytes.NewReader(src)); err == nil {
+			dst, err = readAllLimited(r)
+		}
+	case CompressionSnappy:
+		dst, err = decodeSnappy(src)
+	case CompressionLZ4:
+		dst, err = readAllLimited(lz4.NewReader(bytes.NewReader(src)))
+	case CompressionZstd:
+		dst, err = zstdDecoder.DecodeAll(src, nil)
+		if errors.Is(err, zstd.ErrDecoderSizeExceeded) || len(dst) > maxDecompressedSize {
+			err = ErrBatchTooLarge
+		}
+	default:
+		return nil, fmt.Errorf("%w: %v", ErrUnsupportedCompression, c)
+	}
+	if errors.Is(err, ErrBatchTooLarge) {
+		return nil, fmt.Errorf("%w: %v: over %d bytes", ErrBatchTooLarge, c, maxDecompressedSize)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v: %v", ErrCorruptBatch, c, err)
+	}
+	return dst, nil
+}
+
+// readAllLimited reads r to the end unless it holds more than
+// maxDecompressedSize bytes.
+func readAllLimited(r io.Reader) ([]byte, error) {
+	dst, err := io.ReadAll(io.LimitReader(r, int64(maxDecompressedSize)+1))
+	if err == nil && len(dst) > maxDecompressedSize {
+		return nil, ErrBatchTooLarge
+	}
+	return dst, err
+}
+
+// decodeSnappy decodes a raw snappy block, or the xerial framing used by
+// the Java client.
+func decodeSnappy(src []byte) ([]byte, error) {
+	if !bytes.HasPrefix(src, xerialHeader) {
+		if n, err := snappy.DecodedLen(src); err == nil && n > maxDecompressedSize {
+			return nil, ErrBatchTooLarge
+		}
+		return snappy.Decode(nil, src)
+	}
+	if len(src) < xerialHeaderSize {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	var dst []byte
+	for src = src[xerialHeaderSize:]; len(src) > 0; {
+		if len(src) < 4 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		n := int(binary.BigEndian.Uint32(src))
+		src = src[4:]
+		if n < 0 || n > len(src) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if size, err := snappy.DecodedLen(src[:n]); err == nil && len(dst)+size > maxDecompressedSize {
+			return nil, ErrBatchTooLarge
+		}
+		block, err := snappy.Decode(nil, src[:n])
+		if err != nil {
+			return nil, err
+		}
+		dst = append(dst, block...)
+		src = src[n:]
+	}
+	return dst, nil
+}
@@ -0,0 +1,141 @@
+package record
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"testing"
+
+	"github.com/golang/snappy"
+	"github.com/stretchr/testify/assert"
+)
+
+func jsonRecords(n int) []Record {
+	records := make([]Record, n)
+	for i := range records {
+		records[i] = Record{
+			Key:   []byte(fmt.Sprintf("user-%d", i%10)),
+			Value: []byte(fmt.Sprintf(`{"event":"page_view","user":"user-%d","path":"/products/%d","agent":"Mozilla/5.0"}`, i%10, i)),
+		}
+	}
+	return records
+}
+
+func TestBatch_Compression(t *testing.T) {
+	plain := NewBatch(0, 1_000, jsonRecords(100)...).Encode()
+
+	for _, c := range []Compression{CompressionGzip, CompressionSnappy, CompressionLZ4, CompressionZstd} {
+		t.Run(c.String(), func(t *testing.T) {
+			b := NewBatch(10, 1_000, jsonRecords(100)...)
+			b.SetCompression(c)
+			data := b.Encode()
+			assert.Less(t, len(data), len(plain)/2)
+
+			// the header is left as is
+			header, err := ReadHeaderAt(bytes.NewReader(data), 0)
+			assert.NoError(t, err)
+			assert.Equal(t, c, header.Compression())
+			assert.Equal(t, int64(109), header.LastOffset())
+
+			decoded, err := Decode(data)
+			assert.NoError(t, err)
+			assert.Equal(t, c, decoded.Compression())
+			assert.Equal(t, b.Records, decoded.Records)
+
+			// decoded batches encode to the same bytes
+			assert.Equal(t, data, decoded.Encode())
+		})
+	}
+}
+
+func TestBatch_SetCompression(t *testing.T) {
+	b := NewBatch(0, 0)
+	b.Attributes = 0x10
+	b.SetCompression(CompressionZstd)
+	assert.Equal(t, int16(0x14), b.Attributes)
+	b.SetCompression(CompressionNone)
+	assert.Equal(t, int16(0x10), b.Attributes)
+}
+
+func TestParseCompression(t *testing.T) {
+	for _, c := range []Compression{CompressionNone, CompressionGzip, CompressionSnappy, CompressionLZ4, CompressionZstd} {
+		parsed, err := ParseCompression(c.String())
+		assert.NoError(t, err)
+		assert.Equal(t, c, parsed)
+	}
+	parsed, err := ParseCompression("")
+	assert.NoError(t, err)
+	assert.Equal(t, CompressionNone, parsed)
+
+	_, err = ParseCompression("brotli")
+	assert.ErrorIs(t, err, ErrUnsupportedCompression)
+}
+
+func TestCompression_Validate(t *testing.T) {
+	for _, c := range []Compression{CompressionNone, CompressionGzip, CompressionSnappy, CompressionLZ4, CompressionZstd} {
+		assert.NoError(t, c.Validate())
+	}
+	assert.ErrorIs(t, Compression(7).Validate(), ErrUnsupportedCompression)
+	assert.ErrorIs(t, Compression(-1).Validate(), ErrUnsupportedCompression)
+}
+
+// withRecords replaces the records of an encoded batch and fixes up its
+// length and crc.
+func withRecords(data []byte, attributes int16, records []byte) []byte {
+	data = append(data[:BatchHeaderSize:BatchHeaderSize], records...)
+	binary.BigEndian.PutUint16(data[attributesPos:], uint16(attributes))
+	binary.BigEndian.PutUint32(data[batchLengthPos:], uint32(len(data)-LogOverhead))
+	binary.BigEndian.PutUint32(data[crcPos:], crc32.Checksum(data[attributesPos:], crcTable))
+	return data
+}
+
+func TestDecode_XerialSnappy(t *testing.T) {
+	b := NewBatch(0, 0, jsonRecords(3)...)
+	var records []byte
+	for i := range b.Records {
+		records = appendRecord(records, &b.Records[i])
+	}
+
+	// the Java client frames snappy blocks, here split in two
+	framed := append([]byte{}, xerialHeader...)
+	framed = append(framed, 0, 0, 0, 1, 0, 0, 0, 1)
+	for _, chunk := range [][]byte{records[:50], records[50:]} {
+		block := snappy.Encode(nil, chunk)
+		framed = binary.BigEndian.AppendUint32(framed, uint32(len(block)))
+		framed = append(framed, block...)
+	}
+
+	decoded, err := Decode(withRecords(b.Encode(), int16(CompressionSnappy), framed))
+	assert.NoError(t, err)
+	assert.Equal(t, b.Records, decoded.Records)
+}
+
+func TestDecode_CorruptCompression(t *testing.T) {
+	data := NewBatch(0, 0, Record{Value: []byte("foo")}).Encode()
+
+	_, err := Decode(withRecords(data, int16(CompressionGzip), []byte("not gzip")))
+	assert.ErrorIs(t, err, ErrCorruptBatch)
+
+	_, err = Decode(withRecords(data, 6, []byte("foo")))
+	assert.ErrorIs(t, err, ErrUnsupportedCompression)
+}
+
+func TestDecode_DecompressedTooLarge(t *testing.T) {
+	defer func(size int) { maxDecompressedSize = size }(maxDecompressedSize)
+	maxDecompressedSize = 1 << 10
+
+	small := NewBatch(0, 0, Record{Value: bytes.Repeat([]byte{0}, 100)})
+	large := NewBatch(0, 0, Record{Value: bytes.Repeat([]byte{0}, 100<<10)})
+	for _, c := range []Compression{CompressionGzip, CompressionSnappy, CompressionLZ4, CompressionZstd} {
+		t.Run(c.String(), func(t *testing.T) {
+			small.SetCompression(c)
+			_, err := Decode(small.Encode())
+			assert.NoError(t, err)
+
+			large.SetCompression(c)
+			_, err = Decode(large.Encode())
+			assert.ErrorIs(t, err, ErrBatchTooLarge)
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package record
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// the fifth and sixth bits of the attributes mark batches written in a
+// transaction and batches holding a control record.
+const (
+	transactionalMask = 0x10
+	controlMask       = 0x20
+)
+
+// ControlType is the marker held by a control record, written to each
+// partition of a transaction when it ends.
+type ControlType int16
+
+const (
+	ControlAbort  ControlType = 0
+	ControlCommit ControlType = 1
+)
+
+func (t ControlType) String() string {
+	switch t {
+	case ControlAbort:
+		return "abort"
+	case ControlCommit:
+		return "commit"
+	}
+	return fmt.Sprintf("ControlType(%d)", int16(t))
+}
+
+// IsTransactional reports whether the batch was written in a
+// transaction.
+func (b *Batch) IsTransactional() bool {
+	return b.Attributes&transactionalMask != 0
+}
+
+func (b *Batch) SetTransactional() {
+	b.Attributes |= transactionalMask
+}
+
+// IsControl reports whether the batch holds a control record rather
+// than records from a producer.
+func (b *Batch) IsControl() bool {
+	return b.Attributes&controlMask != 0
+}
+
+// NewControlBatch builds the batch ending a transaction of a producer.
+// It holds a single record whose key is the version and type of the
+// marker and whose value is the version and the coordinator epoch.
+func NewControlBatch(producerID int64, producerEpoch int16, t ControlType, timestamp int64) *Batch {
+	key := make([]byte, 4)
+	binary.BigEndian.PutUint16(key[2:], uint16(t))
+	value := make([]byte, 6)
+
+	b := NewBatch(0, timestamp, Record{Key: key, Value: value})
+	b.Attributes |= transactionalMask | controlMask
+	b.ProducerID = producerID
+	b.ProducerEpoch = producerEpoch
+	return b
+}
+
+// ControlType returns the marker held by a control batch.
+func (b *Batch) ControlType() (ControlType, error) {
+	if !b.IsControl() || len(b.Records) != 1 || len(b.Records[0].Key) < 4 {
+		return 0, fmt.Errorf("%w: not a control batch", ErrCorruptBatch)
+	}
+	return ControlType(binary.BigEndian.Uint16(b.Records[0].Key[2:])), nil
+}
@@ -0,0 +1,44 @@
+package record
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewControlBatch(t *testing.T) {
+	b := NewControlBatch(7, 3, ControlCommit, 1_000)
+	b.BaseOffset = 42
+
+	decoded, err := Decode(b.Encode())
+	assert.NoError(t, err)
+	assert.True(t, decoded.IsControl())
+	assert.True(t, decoded.IsTransactional())
+	assert.Equal(t, int64(7), decoded.ProducerID)
+	assert.Equal(t, int16(3), decoded.ProducerEpoch)
+	assert.Equal(t, int64(42), decoded.LastOffset())
+
+	marker, err := decoded.ControlType()
+	assert.NoError(t, err)
+	assert.Equal(t, ControlCommit, marker)
+
+	abort, err := NewControlBatch(7, 3, ControlAbort, 1_000).ControlType()
+	assert.NoError(t, err)
+	assert.Equal(t, ControlAbort, abort)
+}
+
+func TestBatch_Transactional(t *testing.T) {
+	b := NewBatch(0, 1_000, Record{Value: []byte("a")})
+	assert.False(t, b.IsTransactional())
+	b.SetTransactional()
+	b.SetCompression(CompressionLZ4)
+
+	decoded, err := Decode(b.Encode())
+	assert.NoError(t, err)
+	assert.True(t, decoded.IsTransactional())
+	assert.False(t, decoded.IsControl())
+	assert.Equal(t, CompressionLZ4, decoded.Compression())
+
+	_, err = decoded.ControlType()
+	assert.ErrorIs(t, err, ErrCorruptBatch)
+}
@@ -0,0 +1,81 @@
+package record
+
+import (
+	"errors"
+	"fmt"
+)
+
+// TimestampType is what the timestamps of a batch mean, kept in the
+// fourth bit of the batch attributes.
+type TimestampType int8
+
+const (
+	// CreateTime timestamps are set by the producer when it creates each
+	// record.
+	CreateTime TimestampType = iota
+	// LogAppendTime timestamps are set by the broker when it appends the
+	// batch. Every record has the max timestamp of the batch.
+	LogAppendTime
+)
+
+const timestampTypeMask = 0x08
+
+var ErrUnknownTimestampType = errors.New("unknown timestamp type")
+
+func (t TimestampType) String() string {
+	switch t {
+	case CreateTime:
+		return "CreateTime"
+	case LogAppendTime:
+		return "LogAppendTime"
+	}
+	return fmt.Sprintf("TimestampType(%d)", int8(t))
+}
+
+// ParseTimestampType returns the type named like the
+// message.timestamp.type topic setting, an empty name is CreateTime.
+func ParseTimestampType(name string) (TimestampType, error) {
+	switch name {
+	case "", "CreateTime":
+		return CreateTime, nil
+	case "LogAppendTime":
+		return LogAppendTime, nil
+	}
+	return CreateTime, fmt.Errorf("%w: %q", ErrUnknownTimestampType, name)
+}
+
+func (b *Batch) TimestampType() TimestampType {
+	if b.Attributes&timestampTypeMask != 0 {
+		return LogAppendTime
+	}
+	return CreateTime
+}
+
+// SetLogAppendTime marks the batch as appended at timestamp, in
+// milliseconds. The create time of each record is kept but no longer
+// used.
+func (b *Batch) SetLogAppendTime(timestamp int64) {
+	b.Attributes |= timestampTypeMask
+	b.MaxTimestamp = timestamp
+}
+
+// Timestamp is the timestamp of a record of the batch in milliseconds.
+func (b *Batch) Timestamp(r *Record) int64 {
+	if b.TimestampType() == LogAppendTime {
+		return b.MaxTimestamp
+	}
+	return b.FirstTimestamp + r.TimestampDelta
+}
+
+// SetTimestamps sets the create time of each record in milliseconds,
+// relative to the first.
+func (b *Batch) SetTimestamps(timestamps []int64) {
+	b.FirstTimestamp = timestamps[0]
+	b.MaxTimestamp = timestamps[0]
+	for i := range b.Records {
+		b.Records[i].TimestampDelta = timestamps[i] - b.FirstTimestamp
+		if timestamps[i] > b.MaxTimestamp {
+			b.MaxTimestamp = timestamps[i]
+		}
+	}
+}
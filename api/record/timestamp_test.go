@@ -0,0 +1,64 @@
+package record
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBatch_CreateTime(t *testing.T) {
+	b := NewBatch(0, 1_000, Record{Value: []byte("a")}, Record{Value: []byte("b")})
+	b.Records[1].TimestampDelta = 5
+	b.MaxTimestamp = 1_005
+
+	decoded, err := Decode(b.Encode())
+	assert.NoError(t, err)
+	assert.Equal(t, CreateTime, decoded.TimestampType())
+	assert.Equal(t, int64(1_000), decoded.Timestamp(&decoded.Records[0]))
+	assert.Equal(t, int64(1_005), decoded.Timestamp(&decoded.Records[1]))
+}
+
+func TestBatch_SetTimestamps(t *testing.T) {
+	b := NewBatch(0, 0, Record{Value: []byte("a")}, Record{Value: []byte("b")}, Record{Value: []byte("c")})
+	b.SetTimestamps([]int64{1_000, 3_000, 500})
+
+	decoded, err := Decode(b.Encode())
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1_000), decoded.FirstTimestamp)
+	assert.Equal(t, int64(3_000), decoded.MaxTimestamp)
+	var timestamps []int64
+	for i := range decoded.Records {
+		timestamps = append(timestamps, decoded.Timestamp(&decoded.Records[i]))
+	}
+	assert.Equal(t, []int64{1_000, 3_000, 500}, timestamps)
+}
+
+func TestBatch_LogAppendTime(t *testing.T) {
+	b := NewBatch(0, 1_000, Record{Value: []byte("a")}, Record{Value: []byte("b")})
+	b.Records[1].TimestampDelta = 5
+	b.SetCompression(CompressionZstd)
+	b.SetLogAppendTime(9_000)
+
+	decoded, err := Decode(b.Encode())
+	assert.NoError(t, err)
+	assert.Equal(t, LogAppendTime, decoded.TimestampType())
+	assert.Equal(t, CompressionZstd, decoded.Compression())
+	assert.Equal(t, int64(1_000), decoded.FirstTimestamp)
+	for i := range decoded.Records {
+		assert.Equal(t, int64(9_000), decoded.Timestamp(&decoded.Records[i]))
+	}
+}
+
+func TestParseTimestampType(t *testing.T) {
+	for _, tt := range []TimestampType{CreateTime, LogAppendTime} {
+		parsed, err := ParseTimestampType(tt.String())
+		assert.NoError(t, err)
+		assert.Equal(t, tt, parsed)
+	}
+	parsed, err := ParseTimestampType("")
+	assert.NoError(t, err)
+	assert.Equal(t, CreateTime, parsed)
+
+	_, err = ParseTimestampType("NoTimestampType")
+	assert.ErrorIs(t, err, ErrUnknownTimestampType)
+}
@@ -0,0 +1,319 @@
+package api
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/krake-labs/krake/api/record"
+)
+
+var errCorruptIndex = errors.New("corrupt index")
+
+// openSegment opens an existing segment. Indexes that are missing or
+// do not match the log are rebuilt by re-reading the records, and any
+// torn or corrupt batches at the end of the log are truncated. The
+// offset following the last batch in the segment is returned with it.
+func openSegment(store SegmentStore, dir string, baseOffset int64, cfg segmentConfig) (*segment, int64, error) {
+	f, err := store.Open(filepath.Join(dir, segmentFileName(baseOffset, logFileSuffix)))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	s := &segment{
+		baseOffset:       baseOffset,
+		store:            store,
+		path:             f.Name(),
+		log:              f,
+		maxTimestamp:     -1,
+		rollingTimestamp: -1,
+	}
+
+	indexPath := filepath.Join(dir, segmentFileName(baseOffset, indexFileSuffix))
+	timeIndexPath := filepath.Join(dir, segmentFileName(baseOffset, timeIndexFileSuffix))
+
+	nextOffset, err := s.recoverFromIndexes(indexPath, timeIndexPath, cfg)
+	if err == nil {
+		return s, nextOffset, nil
+	}
+	log.Println("rebuilding indexes for", f.Name(), err)
+
+	for _, p := range []string{indexPath, timeIndexPath} {
+		if err := store.Remove(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+			f.Close()
+			return nil, 0, err
+		}
+	}
+	if err = s.openIndexes(indexPath, timeIndexPath, cfg.maxIndexSize); err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+
+	s.maxTimestamp = -1
+	s.rollingTimestamp = -1
+	s.bytesSinceLastIndexEntry = 0
+	nextOffset, err = s.recover(0, cfg.indexInterval)
+	if err != nil {
+		s.close()
+		return nil, 0, err
+	}
+	return s, nextOffset, nil
+}
+
+// recoverFromIndexes opens the existing indexes and, if they are
+// valid, only recovers the part of the log following the last index
+// entry. The indexes are closed again if an error is returned.
+func (s *segment) recoverFromIndexes(indexPath, timeIndexPath string, cfg segmentConfig) (int64, error) {
+	for _, p := range []string{indexPath, timeIndexPath} {
+		if _, err := s.store.Stat(p); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := s.openIndexes(indexPath, timeIndexPath, cfg.maxIndexSize); err != nil {
+		return 0, err
+	}
+
+	nextOffset, err := func() (int64, error) {
+		if err := s.sanityCheck(); err != nil {
+			return 0, err
+		}
+
+		position := int64(0)
+		if s.index.entries > 0 {
+			_, position = s.index.read(s.index.entries - 1)
+
+			// the first batch is not recovered so read its timestamp.
+			first, err := record.ReadBatchAt(s.log, 0)
+			if err != nil {
+				return 0, fmt.Errorf("%w: first batch: %v", errCorruptIndex, err)
+			}
+			s.rollingTimestamp = first.MaxTimestamp
+		}
+		if s.timeIndex.entries > 0 {
+			s.maxTimestamp, s.offsetOfMaxTimestamp = s.timeIndex.read(s.timeIndex.entries - 1)
+		}
+
+		nextOffset, err := s.recover(position, cfg.indexInterval)
+		if err != nil {
+			return 0, err
+		}
+
+		// a torn write may have been indexed before it was truncated.
+		if s.timeIndex.entries > 0 {
+			if _, offset := s.timeIndex.read(s.timeIndex.entries - 1); offset >= nextOffset {
+				return 0, fmt.Errorf("%w: time index refers to truncated offset %d", errCorruptIndex, offset)
+			}
+		}
+		return nextOffset, nil
+	}()
+	if err != nil {
+		s.index.close()
+		s.timeIndex.close()
+		return 0, err
+	}
+	return nextOffset, nil
+}
+
+func (s *segment) openIndexes(indexPath, timeIndexPath string, maxIndexSize int) error {
+	index, err := openOffsetIndex(s.store, indexPath, s.baseOffset, maxIndexSize)
+	if err != nil {
+		return err
+	}
+	timeIndex, err := openTimeIndex(s.store, timeIndexPath, s.baseOffset, maxIndexSize)
+	if err != nil {
+		index.close()
+		return err
+	}
+	s.index = index
+	s.timeIndex = timeIndex
+	return nil
+}
+
+// recover reads the log from position, validating each batch and
+// adding any missing index entries. The log is truncated at the first
+// batch that cannot be read. It returns the offset following the last
+// valid batch.
+func (s *segment) recover(position int64, indexInterval int) (int64, error) {
+	nextOffset := s.baseOffset
+	for {
+		batch, err := record.ReadBatchAt(s.log, position)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				log.Println("truncating", s.log.Name(), "at", position, err)
+			}
+			break
+		}
+		if err = s.append(batch, position, indexInterval); err != nil {
+			return 0, err
+		}
+		nextOffset = batch.NextOffset()
+		position += int64(batch.Size())
+	}
+
+	info, err := s.log.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if info.Size() > position {
+		if err = s.log.Truncate(position); err != nil {
+			return 0, err
+		}
+	}
+	return nextOffset, nil
+}
+
+// sanityCheck validates the indexes against the log. Entries must be
+// increasing and every offset index entry must point at the start of
+// the batch it names.
+func (s *segment) sanityCheck() error {
+	info, err := s.log.Stat()
+	if err != nil {
+		return err
+	}
+
+	for _, idx := range []*indexFile{s.index.indexFile, s.timeIndex.indexFile} {
+		info, err := idx.file.Stat()
+		if err != nil {
+			return err
+		}
+		if info.Size()%int64(idx.entrySize) != 0 {
+			return fmt.Errorf("%w: %s has a partial entry", errCorruptIndex, idx.file.Name())
+		}
+	}
+
+	head := make([]byte, record.LogOverhead)
+	prevOffset, prevPosition := int64(-1), int64(-1)
+	for i := 0; i < s.index.entries; i++ {
+		offset, position := s.index.read(i)
+		if offset <= prevOffset || position <= prevPosition || position >= info.Size() {
+			return fmt.Errorf("%w: offset index entry %d is out of order", errCorruptIndex, i)
+		}
+		if _, err = s.log.ReadAt(head, position); err != nil {
+			return fmt.Errorf("%w: offset index entry %d: %v", errCorruptIndex, i, err)
+		}
+		if int64(binary.BigEndian.Uint64(head)) != offset {
+			return fmt.Errorf("%w: offset index entry %d does not point at offset %d", errCorruptIndex, i, offset)
+		}
+		prevOffset, prevPosition = offset, position
+	}
+
+	// recovery resumes from the last entry so its batch must be intact.
+	if s.index.entries > 0 {
+		if _, err = record.ReadBatchAt(s.log, prevPosition); err != nil {
+			return fmt.Errorf("%w: last offset index entry: %v", errCorruptIndex, err)
+		}
+	}
+
+	prevTimestamp, prevOffset := int64(-1), s.baseOffset
+	for i := 0; i < s.timeIndex.entries; i++ {
+		timestamp, offset := s.timeIndex.read(i)
+		if timestamp <= prevTimestamp || offset < prevOffset {
+			return fmt.Errorf("%w: time index entry %d is out of order", errCorruptIndex, i)
+		}
+		prevTimestamp, prevOffset = timestamp, offset
+	}
+	return nil
+}
+
+// close trims the segment so a clean shutdown leaves no preallocated
+// space behind, and closes its files.
+func (s *segment) close() error {
+	if s.files != nil {
+		s.files.forget(s)
+	}
+	// evicted segments were trimmed when they were rolled.
+	if s.log == nil {
+		return nil
+	}
+	if err := s.index.close(); err != nil {
+		return err
+	}
+	if err := s.timeIndex.close(); err != nil {
+		return err
+	}
+	if err := s.trimLog(); err != nil {
+		return err
+	}
+	return s.log.Close()
+}
+
+// closeFiles closes the log and indexes of a rolled segment evicted
+// from the file pool.
+func (s *segment) closeFiles() error {
+	err := s.index.close()
+	if e := s.timeIndex.close(); err == nil {
+		err = e
+	}
+	if e := s.log.Close(); err == nil {
+		err = e
+	}
+	s.log, s.index, s.timeIndex = nil, nil, nil
+	return err
+}
+
+// reopen opens the log and indexes of a segment evicted from the file
+// pool. They were trimmed when it was rolled so nothing is
+// preallocated.
+func (s *segment) reopen() error {
+	f, err := s.store.Open(s.path)
+	if err != nil {
+		return err
+	}
+	if err = s.openIndexes(s.indexPath(), s.timeIndexPath(), 0); err != nil {
+		f.Close()
+		return err
+	}
+	s.log = f
+	return nil
+}
+
+// recoverLog opens the existing segments of a partition, recovering
+// each of them, and makes the last one the active segment.
+func (pw *PartitionWriter) recoverLog(key TopicPartitionKey, baseOffsets []int64, cfg segmentConfig) error {
+	l := pw.partitionLog(key)
+	for _, baseOffset := range baseOffsets {
+		s, nextOffset, err := openSegment(pw.store, pw.partitionDirs[key], baseOffset, cfg)
+		if err != nil {
+			return err
+		}
+		// every segment but the last is inactive, roll it again to
+		// trim the indexes preallocated when it was opened.
+		if prev := l.activeSegment(); prev != nil {
+			if err = prev.roll(); err != nil {
+				s.close()
+				return err
+			}
+			pw.filePool.track(prev)
+		}
+		l.segments = append(l.segments, s)
+		l.nextOffset = nextOffset
+	}
+	if active := l.activeSegment(); active != nil {
+		pw.filePool.data[key] = active.log
+		pw.filePool.evict(0)
+	}
+	return nil
+}
+
+// Close closes every segment, trimming their indexes, and snapshots
+// the producer state of every partition.
+func (pw *PartitionWriter) Close() error {
+	for key, l := range pw.logs {
+		if err := pw.writeProducerSnapshot(key, l); err != nil {
+			return err
+		}
+		for _, s := range l.segments {
+			if err := s.close(); err != nil {
+				return err
+			}
+		}
+		delete(pw.logs, key)
+		delete(pw.filePool.data, key)
+	}
+	return nil
+}
@@ -0,0 +1,248 @@
+package api
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/krake-labs/krake/api/record"
+	"github.com/stretchr/testify/assert"
+)
+
+var recoveryKey = TopicPartitionKey{"recovery-topic", 0}
+
+func newRecoveryBroker(logDir string) (*PartitionWriter, *KrakeBroker) {
+	pw := NewPartitionWriter()
+	b := NewKrakeBroker(pw)
+	b.Configure(map[string]interface{}{
+		"log.dirs":             logDir,
+		"log.segment.bytes":    100_000,
+		"index.interval.bytes": 200,
+	})
+	return pw, b
+}
+
+// produceForRecovery produces count messages, one a second, to a
+// single partition and closes the partition writer so the segment can
+// be reopened. It returns the log dir.
+func produceForRecovery(t *testing.T, count int) string {
+	logDir := t.TempDir()
+	pw, b := newRecoveryBroker(logDir)
+
+	start := time.Date(2023, 5, 1, 9, 0, 0, 0, time.UTC)
+	now := start
+	b.now = func() time.Time { return now }
+
+	b.CreateTopic(TopicConfiguration{Name: recoveryKey.Topic, PartitionCount: 1})
+	for i := 0; i < count; i++ {
+		now = start.Add(time.Duration(i) * time.Second)
+		_, err := b.Produce(recoveryKey.Topic, &Message{Message: []byte(fmt.Sprintf("message: %d", i))})
+		assert.NoError(t, err)
+	}
+
+	assert.NoError(t, pw.Close())
+	return logDir
+}
+
+type lookups struct {
+	values  []string
+	offsets []int64
+}
+
+// recoverAndLookup reopens the partition and records the result of
+// fetching every offset and looking up every timestamp.
+func recoverAndLookup(t *testing.T, logDir string, count int) (*PartitionWriter, lookups) {
+	pw, b := newRecoveryBroker(logDir)
+	assert.NoError(t, b.LoadLogs())
+
+	var l lookups
+	for i := 0; i < count; i++ {
+		batch, err := pw.Fetch(recoveryKey, int64(i))
+		if err != nil {
+			l.values = append(l.values, err.Error())
+		} else {
+			l.values = append(l.values, string(batch.Records[0].Value))
+		}
+
+		ts := time.Date(2023, 5, 1, 9, 0, i, 0, time.UTC).UnixMilli()
+		offs, err := pw.logs[recoveryKey].offsetForTimestamp(recoveryKey, ts)
+		assert.NoError(t, err)
+		l.offsets = append(l.offsets, offs)
+	}
+	return pw, l
+}
+
+func recoveryPath(logDir string, suffix string) string {
+	return filepath.Join(logDir, partitionDirName(recoveryKey), segmentFileName(0, suffix))
+}
+
+// validLogSize is the size of the log up to the end of its last batch,
+// the rest of the file is preallocated space.
+func validLogSize(t *testing.T, path string) int64 {
+	f, err := os.Open(path)
+	assert.NoError(t, err)
+	defer f.Close()
+
+	position := int64(0)
+	for {
+		batch, err := record.ReadBatchAt(f, position)
+		if err != nil {
+			return position
+		}
+		position += int64(batch.Size())
+	}
+}
+
+func readIndexFiles(t *testing.T, logDir string) ([]byte, []byte) {
+	index, err := os.ReadFile(recoveryPath(logDir, indexFileSuffix))
+	assert.NoError(t, err)
+	timeIndex, err := os.ReadFile(recoveryPath(logDir, timeIndexFileSuffix))
+	assert.NoError(t, err)
+	return index, timeIndex
+}
+
+func TestRecovery_CleanReopen(t *testing.T) {
+	logDir := produceForRecovery(t, 100)
+
+	pw, l := recoverAndLookup(t, logDir, 100)
+	defer pw.Close()
+
+	for i := 0; i < 100; i++ {
+		assert.Equal(t, fmt.Sprintf("message: %d", i), l.values[i])
+		assert.Equal(t, int64(i), l.offsets[i])
+	}
+	assert.Equal(t, int64(100), pw.logs[recoveryKey].nextOffset)
+	assert.Greater(t, pw.logs[recoveryKey].activeSegment().index.entries, 1)
+}
+
+func TestRecovery_RebuildsDeletedIndexes(t *testing.T) {
+	for _, suffix := range []string{indexFileSuffix, timeIndexFileSuffix} {
+		t.Run(suffix, func(t *testing.T) {
+			logDir := produceForRecovery(t, 100)
+
+			pw, expected := recoverAndLookup(t, logDir, 100)
+			assert.NoError(t, pw.Close())
+			index, timeIndex := readIndexFiles(t, logDir)
+
+			assert.NoError(t, os.Remove(recoveryPath(logDir, suffix)))
+
+			pw, actual := recoverAndLookup(t, logDir, 100)
+			assert.Equal(t, expected, actual)
+			assert.NoError(t, pw.Close())
+
+			rebuiltIndex, rebuiltTimeIndex := readIndexFiles(t, logDir)
+			assert.Equal(t, index, rebuiltIndex)
+			assert.Equal(t, timeIndex, rebuiltTimeIndex)
+		})
+	}
+}
+
+func TestRecovery_RebuildsCorruptIndexes(t *testing.T) {
+	corruptions := map[string]func(t *testing.T, logDir string){
+		"offset index garbage": func(t *testing.T, logDir string) {
+			path := recoveryPath(logDir, indexFileSuffix)
+			data, _ := os.ReadFile(path)
+			for i := range data {
+				data[i] = 0xab
+			}
+			assert.NoError(t, os.WriteFile(path, data, 0644))
+		},
+		"offset index partial entry": func(t *testing.T, logDir string) {
+			path := recoveryPath(logDir, indexFileSuffix)
+			data, _ := os.ReadFile(path)
+			assert.NoError(t, os.WriteFile(path, data[:len(data)-3], 0644))
+		},
+		"offset index wrong position": func(t *testing.T, logDir string) {
+			path := recoveryPath(logDir, indexFileSuffix)
+			data, _ := os.ReadFile(path)
+			data[offsetIndexEntrySize+7]++
+			assert.NoError(t, os.WriteFile(path, data, 0644))
+		},
+		"time index out of order": func(t *testing.T, logDir string) {
+			path := recoveryPath(logDir, timeIndexFileSuffix)
+			data, _ := os.ReadFile(path)
+			copy(data[timeIndexEntrySize:], make([]byte, 8))
+			assert.NoError(t, os.WriteFile(path, data, 0644))
+		},
+		"unclean shutdown with preallocated indexes": func(t *testing.T, logDir string) {
+			for _, suffix := range []string{indexFileSuffix, timeIndexFileSuffix} {
+				assert.NoError(t, os.Truncate(recoveryPath(logDir, suffix), 1024))
+			}
+		},
+	}
+
+	for name, corrupt := range corruptions {
+		t.Run(name, func(t *testing.T) {
+			logDir := produceForRecovery(t, 100)
+
+			pw, expected := recoverAndLookup(t, logDir, 100)
+			assert.NoError(t, pw.Close())
+			index, timeIndex := readIndexFiles(t, logDir)
+
+			corrupt(t, logDir)
+
+			pw, actual := recoverAndLookup(t, logDir, 100)
+			assert.Equal(t, expected, actual)
+			assert.NoError(t, pw.Close())
+
+			rebuiltIndex, rebuiltTimeIndex := readIndexFiles(t, logDir)
+			assert.Equal(t, index, rebuiltIndex)
+			assert.Equal(t, timeIndex, rebuiltTimeIndex)
+		})
+	}
+}
+
+func TestRecovery_TruncatesTornWrite(t *testing.T) {
+	logDir := produceForRecovery(t, 100)
+
+	path := recoveryPath(logDir, logFileSuffix)
+
+	// find where the valid data ends
+	pw, expected := recoverAndLookup(t, logDir, 100)
+	assert.NoError(t, pw.Close())
+	validSize := validLogSize(t, path)
+
+	// a batch that was only partially written when we crashed
+	torn := record.NewBatch(100, 0, record.Record{Value: []byte("torn")}).Encode()
+	f, _ := os.OpenFile(path, os.O_RDWR, 0644)
+	f.WriteAt(torn[:len(torn)-5], validSize)
+	f.Close()
+
+	pw, actual := recoverAndLookup(t, logDir, 100)
+	defer pw.Close()
+
+	assert.Equal(t, expected, actual)
+	assert.Equal(t, int64(100), pw.logs[recoveryKey].nextOffset)
+
+	assert.Equal(t, validSize, validLogSize(t, path))
+	buf := make([]byte, len(torn))
+	f, _ = os.Open(path)
+	f.ReadAt(buf, validSize)
+	f.Close()
+	assert.Equal(t, make([]byte, len(torn)), buf)
+}
+
+func TestRecovery_TruncatesBatchWithInvalidCRC(t *testing.T) {
+	logDir := produceForRecovery(t, 100)
+
+	path := recoveryPath(logDir, logFileSuffix)
+	pw, expected := recoverAndLookup(t, logDir, 100)
+	assert.NoError(t, pw.Close())
+
+	// corrupt the value of the last record
+	f, _ := os.OpenFile(path, os.O_RDWR, 0644)
+	f.WriteAt([]byte{0xff}, validLogSize(t, path)-2)
+	f.Close()
+
+	pw, actual := recoverAndLookup(t, logDir, 100)
+	defer pw.Close()
+
+	// everything but the last message survives
+	assert.Equal(t, expected.values[:99], actual.values[:99])
+	assert.Equal(t, ErrOffsetOutOfRange.Error(), actual.values[99])
+	assert.Equal(t, expected.offsets[:99], actual.offsets[:99])
+	assert.Equal(t, int64(-1), actual.offsets[99])
+	assert.Equal(t, int64(99), pw.logs[recoveryKey].nextOffset)
+}
@@ -0,0 +1,616 @@
+package api
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/krake-labs/krake/api/record"
+)
+
+// RemoteStorage is an object store holding copies of closed segments
+// and their indexes. Objects are named after the partition directory
+// and segment file, e.g. my-topic-0/00000000000000000042.log.
+type RemoteStorage interface {
+	Put(name string, r io.Reader, size int64) error
+	// Get returns an error matching os.ErrNotExist if there is no such
+	// object.
+	Get(name string) (io.ReadCloser, error)
+	Delete(name string) error
+	// List returns the objects whose name starts with prefix, sorted
+	// by name.
+	List(prefix string) ([]RemoteObject, error)
+}
+
+type RemoteObject struct {
+	Name string
+	Size int64
+}
+
+// remoteSegment is a segment that only exists in remote storage, its
+// local copy was deleted after local.retention.ms.
+type remoteSegment struct {
+	baseOffset int64
+	// the base offset of the segment following it
+	nextOffset   int64
+	maxTimestamp int64
+	size         int64
+}
+
+// remoteLogCache is the last remote segment read from a partition.
+// Consumers read old offsets in order so this saves downloading it for
+// every batch.
+type remoteLogCache struct {
+	baseOffset int64
+	data       []byte
+}
+
+func remoteObjectName(key TopicPartitionKey, baseOffset int64, suffix string) string {
+	return path.Join(partitionDirName(key), segmentFileName(baseOffset, suffix))
+}
+
+// SetRemoteStorage enables tiered storage for topics with
+// remote.storage.enable set.
+func (pw *PartitionWriter) SetRemoteStorage(remote RemoteStorage) {
+	pw.remote = remote
+}
+
+// tierInterval is remote.log.manager.task.interval.ms, how often closed
+// segments are copied to remote storage.
+func (k *KrakeBroker) tierInterval() time.Duration {
+	if v, ok := k.Config["remote.log.manager.task.interval.ms"].(int); ok {
+		return time.Duration(v) * time.Millisecond
+	}
+	return 30 * time.Second
+}
+
+// StartTiering copies closed segments to remote storage in the
+// background until ctx is cancelled.
+func (k *KrakeBroker) StartTiering(ctx context.Context) {
+	if k.remote == nil {
+		return
+	}
+
+	ticker := time.NewTicker(k.tierInterval())
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := k.TierSegments(); err != nil {
+					log.Println("failed to tier segments", err)
+				}
+			}
+		}
+	}()
+}
+
+// upload is a closed segment being copied to remote storage.
+type upload struct {
+	key     TopicPartitionKey
+	segment *segment
+}
+
+// TierSegments copies the closed segments of topics with remote
+// storage enabled to remote storage, then deletes local copies older
+// than local.retention.ms. Compacted topics are never tiered.
+func (k *KrakeBroker) TierSegments() error {
+	if k.remote == nil {
+		return nil
+	}
+
+	for _, u := range k.pendingUploads() {
+		if err := k.upload(u); err != nil {
+			return err
+		}
+	}
+	return k.enforceLocalRetention()
+}
+
+func (k *KrakeBroker) tiered(key TopicPartitionKey) (TopicConfiguration, bool) {
+	cfg, ok := k.topics[key.Topic]
+	if !ok || !cfg.RemoteStorage || cfg.hasCleanupPolicy(CleanupPolicyCompact) {
+		return cfg, false
+	}
+	return cfg, true
+}
+
+func (k *KrakeBroker) pendingUploads() []upload {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	var uploads []upload
+	for key, l := range k.logs {
+		if _, ok := k.tiered(key); !ok {
+			continue
+		}
+		for _, s := range l.segments[:len(l.segments)-1] {
+			if !s.uploaded {
+				uploads = append(uploads, upload{key: key, segment: s})
+			}
+		}
+	}
+	return uploads
+}
+
+// openUpload opens the files of a segment to copy them without the
+// lock, along with the number of bytes to copy from each. It returns
+// nil if retention deleted the segment since it was listed.
+func (k *KrakeBroker) openUpload(u upload) (map[string]SegmentFile, map[string]int64, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if l, ok := k.logs[u.key]; !ok || l.indexOf(u.segment) < 0 {
+		return nil, nil, nil
+	}
+	s := u.segment
+	// only the written index entries are copied, whatever is
+	// preallocated after them would read as entries remotely.
+	if _, err := s.file(); err != nil {
+		return nil, nil, err
+	}
+	sizes := map[string]int64{
+		logFileSuffix:       s.size,
+		indexFileSuffix:     int64(s.index.entries * s.index.entrySize),
+		timeIndexFileSuffix: int64(s.timeIndex.entries * s.timeIndex.entrySize),
+	}
+	files := map[string]SegmentFile{}
+	for suffix, p := range map[string]string{
+		logFileSuffix:       s.path,
+		indexFileSuffix:     s.indexPath(),
+		timeIndexFileSuffix: s.timeIndexPath(),
+	} {
+		f, err := k.filePool.borrow(p)
+		if err != nil {
+			closeFiles(files)
+			return nil, nil, err
+		}
+		files[suffix] = f
+	}
+	return files, sizes, nil
+}
+
+func closeFiles(files map[string]SegmentFile) {
+	for _, f := range files {
+		f.Close()
+	}
+}
+
+// upload copies a segment to remote storage. The log goes last, a
+// segment is only considered remote once its log is there.
+func (k *KrakeBroker) upload(u upload) error {
+	files, sizes, err := k.openUpload(u)
+	if files == nil || err != nil {
+		return err
+	}
+	defer closeFiles(files)
+
+	s := u.segment
+	for _, suffix := range []string{indexFileSuffix, timeIndexFileSuffix, logFileSuffix} {
+		size := sizes[suffix]
+		name := remoteObjectName(u.key, s.baseOffset, suffix)
+		if err = k.remote.Put(name, io.NewSectionReader(files[suffix], 0, size), size); err != nil {
+			return fmt.Errorf("uploading %s: %w", name, err)
+		}
+	}
+	log.Println("copied", s.path, "to remote storage")
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	// retention may have deleted the segment while it was copied.
+	if l, ok := k.logs[u.key]; ok && l.indexOf(s) >= 0 {
+		s.uploaded = true
+		return nil
+	}
+	return k.deleteRemoteObjects(u.key, s.baseOffset)
+}
+
+// enforceLocalRetention deletes the local copy of segments that were
+// copied to remote storage once they are older than local.retention.ms.
+func (k *KrakeBroker) enforceLocalRetention() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	now := k.now()
+	for key, l := range k.logs {
+		cfg, ok := k.tiered(key)
+		if !ok || cfg.LocalRetentionPeriod <= 0 {
+			continue
+		}
+		cutoff := now.Add(-cfg.LocalRetentionPeriod).UnixMilli()
+		deleted := false
+		for len(l.segments) > 1 && l.segments[0].uploaded && l.segments[0].maxTimestamp < cutoff {
+			s := l.segments[0]
+			log.Println("deleting local copy of", s.path, "due to local retention")
+
+			l.segments = l.segments[1:]
+			l.remoteSegments = append(l.remoteSegments, remoteSegment{
+				baseOffset:   s.baseOffset,
+				nextOffset:   l.segments[0].baseOffset,
+				maxTimestamp: s.maxTimestamp,
+				size:         s.size,
+			})
+			if _, err := s.delete(); err != nil {
+				return err
+			}
+			deleted = true
+		}
+		if deleted {
+			if err := k.deleteProducerSnapshots(key, l); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// deleteRemoteObjects deletes the copy of a segment in remote storage.
+func (k *KrakeBroker) deleteRemoteObjects(key TopicPartitionKey, baseOffset int64) error {
+	for _, suffix := range []string{logFileSuffix, indexFileSuffix, timeIndexFileSuffix} {
+		err := k.remote.Delete(remoteObjectName(key, baseOffset, suffix))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteRemoteSegments deletes segments that only exist in remote
+// storage from the start of the log for as long as shouldDelete
+// returns true.
+func (k *KrakeBroker) deleteRemoteSegments(key TopicPartitionKey, l *partitionLog, reason string, shouldDelete func(rs remoteSegment) bool) error {
+	for len(l.remoteSegments) > 0 && shouldDelete(l.remoteSegments[0]) {
+		rs := l.remoteSegments[0]
+		log.Println("deleting remote segment", remoteObjectName(key, rs.baseOffset, logFileSuffix), "due to", reason)
+
+		if err := k.deleteRemoteObjects(key, rs.baseOffset); err != nil {
+			return err
+		}
+		l.remoteSegments = l.remoteSegments[1:]
+		if l.remoteCache != nil && l.remoteCache.baseOffset == rs.baseOffset {
+			l.remoteCache = nil
+		}
+		k.retentionStats.SegmentsDeleted++
+		k.retentionStats.BytesReclaimed += rs.size
+	}
+	return nil
+}
+
+// remoteSize is the number of bytes of batches only in remote storage.
+func (l *partitionLog) remoteSize() int64 {
+	var size int64
+	for _, rs := range l.remoteSegments {
+		size += rs.size
+	}
+	return size
+}
+
+// remoteOffset reports whether offset is before the local segments, in
+// which case it can only be read from remote storage.
+func (l *partitionLog) remoteOffset(offset int64) bool {
+	return len(l.segments) == 0 || offset < l.segments[0].baseOffset
+}
+
+// remoteSegmentFor finds the remote segment containing offset.
+func (l *partitionLog) remoteSegmentFor(offset int64) (remoteSegment, bool) {
+	i := sort.Search(len(l.remoteSegments), func(i int) bool {
+		return l.remoteSegments[i].nextOffset > offset
+	})
+	if i == len(l.remoteSegments) || l.remoteSegments[i].baseOffset > offset {
+		return remoteSegment{}, false
+	}
+	return l.remoteSegments[i], true
+}
+
+// remoteMiss is returned by reads of a remote segment that has not been
+// downloaded. Downloads can take a while so they happen without the
+// broker lock, see withRemote.
+type remoteMiss struct {
+	key TopicPartitionKey
+	rs  remoteSegment
+}
+
+func (e *remoteMiss) Error() string {
+	return "remote segment " + remoteObjectName(e.key, e.rs.baseOffset, logFileSuffix) + " is not downloaded"
+}
+
+// cachedRemoteLog returns the log of a remote segment if it was
+// downloaded, or a *remoteMiss.
+func (l *partitionLog) cachedRemoteLog(key TopicPartitionKey, rs remoteSegment) ([]byte, error) {
+	if l.remoteCache != nil && l.remoteCache.baseOffset == rs.baseOffset {
+		return l.remoteCache.data, nil
+	}
+	return nil, &remoteMiss{key: key, rs: rs}
+}
+
+// downloadRemoteLog downloads the log of a remote segment. It does not
+// touch the partition so it is called without the lock.
+func (pw *PartitionWriter) downloadRemoteLog(key TopicPartitionKey, rs remoteSegment) ([]byte, error) {
+	r, err := pw.remote.Get(remoteObjectName(key, rs.baseOffset, logFileSuffix))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// cacheRemoteLog keeps a downloaded log for the next reads, unless
+// retention deleted the segment while it was downloaded.
+func (pw *PartitionWriter) cacheRemoteLog(key TopicPartitionKey, rs remoteSegment, data []byte) {
+	l, ok := pw.logs[key]
+	if !ok {
+		return
+	}
+	if current, ok := l.remoteSegmentFor(rs.baseOffset); ok && current.baseOffset == rs.baseOffset {
+		l.remoteCache = &remoteLogCache{baseOffset: rs.baseOffset, data: data}
+	}
+}
+
+// withRemote calls read, which is called with the lock held, until it
+// no longer needs a remote segment. Segments are downloaded with the
+// lock released so produces and other reads carry on meanwhile.
+func (k *KrakeBroker) withRemote(read func() error) error {
+	for {
+		err := read()
+		var miss *remoteMiss
+		if !errors.As(err, &miss) {
+			return err
+		}
+
+		k.mu.Unlock()
+		data, err := k.downloadRemoteLog(miss.key, miss.rs)
+		k.mu.Lock()
+		if err != nil {
+			return err
+		}
+		k.cacheRemoteLog(miss.key, miss.rs, data)
+	}
+}
+
+// readRemote returns the batch containing offset from remote storage,
+// or a *remoteMiss if its segment has not been downloaded.
+func (l *partitionLog) readRemote(key TopicPartitionKey, offset int64) (*record.Batch, error) {
+	rs, ok := l.remoteSegmentFor(offset)
+	if !ok {
+		return nil, ErrOffsetOutOfRange
+	}
+	data, err := l.cachedRemoteLog(key, rs)
+	if err != nil {
+		return nil, err
+	}
+	for position := 0; position < len(data); {
+		batch, err := record.Decode(data[position:])
+		if err != nil {
+			return nil, err
+		}
+		if batch.LastOffset() >= offset {
+			return batch, nil
+		}
+		position += batch.Size()
+	}
+	return nil, ErrOffsetOutOfRange
+}
+
+// remoteOffsetForTimestamp returns the earliest offset in remote
+// storage whose timestamp is at or after timestamp, or -1 if there is
+// none.
+func (l *partitionLog) remoteOffsetForTimestamp(key TopicPartitionKey, timestamp int64) (int64, error) {
+	for _, rs := range l.remoteSegments {
+		if rs.maxTimestamp < timestamp {
+			continue
+		}
+		data, err := l.cachedRemoteLog(key, rs)
+		if err != nil {
+			return -1, err
+		}
+		for position := 0; position < len(data); {
+			batch, err := record.Decode(data[position:])
+			if err != nil {
+				return -1, err
+			}
+			if offset := batchOffsetForTimestamp(batch, timestamp); offset >= 0 {
+				return offset, nil
+			}
+			position += batch.Size()
+		}
+	}
+	return -1, nil
+}
+
+// loadRemoteSegments restores the remote segments of a partition on
+// startup. Local segments already copied are marked as such, older
+// ones are only remote.
+func (k *KrakeBroker) loadRemoteSegments(key TopicPartitionKey, l *partitionLog) error {
+	objects, err := k.remote.List(partitionDirName(key) + "/")
+	if err != nil {
+		return err
+	}
+
+	local := map[int64]*segment{}
+	for _, s := range l.segments {
+		local[s.baseOffset] = s
+	}
+	// every segment of the partition may have been tiered.
+	localStart := int64(math.MaxInt64)
+	if len(l.segments) > 0 {
+		localStart = l.segments[0].baseOffset
+	}
+
+	var remote []remoteSegment
+	for _, o := range objects {
+		baseOffset, ok := parseSegmentFileName(path.Base(o.Name), logFileSuffix)
+		if !ok {
+			continue
+		}
+		if s, ok := local[baseOffset]; ok {
+			s.uploaded = true
+			continue
+		}
+		if baseOffset > localStart {
+			continue
+		}
+		maxTimestamp, err := k.remoteMaxTimestamp(key, baseOffset)
+		if err != nil {
+			return err
+		}
+		remote = append(remote, remoteSegment{
+			baseOffset:   baseOffset,
+			maxTimestamp: maxTimestamp,
+			size:         o.Size,
+		})
+	}
+
+	sort.Slice(remote, func(i, j int) bool {
+		return remote[i].baseOffset < remote[j].baseOffset
+	})
+	for i := range remote {
+		remote[i].nextOffset = localStart
+		if i+1 < len(remote) {
+			remote[i].nextOffset = remote[i+1].baseOffset
+		}
+	}
+	l.remoteSegments = remote
+
+	// without local segments the log ends with the last remote one.
+	if len(l.segments) == 0 && len(remote) > 0 {
+		last := &l.remoteSegments[len(remote)-1]
+		if last.nextOffset, err = k.remoteNextOffset(key, last.baseOffset); err != nil {
+			return err
+		}
+		l.nextOffset = last.nextOffset
+	}
+	return nil
+}
+
+// remoteNextOffset reads the offset following the last batch of a
+// remote segment.
+func (k *KrakeBroker) remoteNextOffset(key TopicPartitionKey, baseOffset int64) (int64, error) {
+	data, err := k.downloadRemoteLog(key, remoteSegment{baseOffset: baseOffset})
+	if err != nil {
+		return 0, err
+	}
+	nextOffset := baseOffset
+	for position := 0; position < len(data); {
+		batch, err := record.Decode(data[position:])
+		if err != nil {
+			return 0, err
+		}
+		nextOffset = batch.NextOffset()
+		position += batch.Size()
+	}
+	return nextOffset, nil
+}
+
+// remoteMaxTimestamp reads the largest timestamp of a remote segment
+// from the last entry of its time index. Trailing zero entries are
+// skipped, time indexes copied by older brokers may still be padded.
+func (k *KrakeBroker) remoteMaxTimestamp(key TopicPartitionKey, baseOffset int64) (int64, error) {
+	r, err := k.remote.Get(remoteObjectName(key, baseOffset, timeIndexFileSuffix))
+	if err != nil {
+		return -1, err
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return -1, err
+	}
+	for end := len(data) - len(data)%timeIndexEntrySize; end >= timeIndexEntrySize; end -= timeIndexEntrySize {
+		if timestamp := int64(binary.BigEndian.Uint64(data[end-timeIndexEntrySize:])); timestamp != 0 {
+			return timestamp, nil
+		}
+	}
+	return -1, nil
+}
+
+// LocalStorage is a RemoteStorage keeping objects in a local
+// directory, such as a mounted network filesystem.
+type LocalStorage struct {
+	dir string
+}
+
+func NewLocalStorage(dir string) *LocalStorage {
+	return &LocalStorage{dir: dir}
+}
+
+func (s *LocalStorage) path(name string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(name))
+}
+
+func (s *LocalStorage) Put(name string, r io.Reader, size int64) error {
+	p := s.path(name)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+
+	tmp := p + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(f, r)
+	if err == nil && n != size {
+		err = io.ErrUnexpectedEOF
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, p)
+}
+
+func (s *LocalStorage) Get(name string) (io.ReadCloser, error) {
+	return os.Open(s.path(name))
+}
+
+func (s *LocalStorage) Delete(name string) error {
+	return os.Remove(s.path(name))
+}
+
+func (s *LocalStorage) List(prefix string) ([]RemoteObject, error) {
+	var objects []RemoteObject
+	err := filepath.WalkDir(s.dir, func(p string, d os.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || strings.HasSuffix(p, ".tmp") {
+			return nil
+		}
+		rel, err := filepath.Rel(s.dir, p)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if !strings.HasPrefix(name, prefix) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		objects = append(objects, RemoteObject{Name: name, Size: info.Size()})
+		return nil
+	})
+	return objects, err
+}
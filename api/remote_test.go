@@ -0,0 +1,377 @@
+package api
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testRemoteStorages runs test against every RemoteStorage.
+func testRemoteStorages(t *testing.T, test func(t *testing.T, remote RemoteStorage)) {
+	t.Run("local", func(t *testing.T) {
+		test(t, NewLocalStorage(t.TempDir()))
+	})
+	t.Run("s3", func(t *testing.T) {
+		test(t, newFakeS3(t))
+	})
+}
+
+func getObject(t *testing.T, remote RemoteStorage, name string) string {
+	r, err := remote.Get(name)
+	if !assert.NoError(t, err) {
+		return ""
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	assert.NoError(t, err)
+	return string(data)
+}
+
+func TestRemoteStorage_Objects(t *testing.T) {
+	testRemoteStorages(t, func(t *testing.T, remote RemoteStorage) {
+		_, err := remote.Get("my-topic-0/0.log")
+		assert.ErrorIs(t, err, os.ErrNotExist)
+
+		for _, name := range []string{"my-topic-0/1.log", "my-topic-0/0.log", "my-topic-0/0.index", "my-topic-1/0.log", "other-0/0.log"} {
+			assert.NoError(t, remote.Put(name, strings.NewReader(name), int64(len(name))))
+		}
+		assert.Equal(t, "my-topic-0/0.log", getObject(t, remote, "my-topic-0/0.log"))
+
+		objects, err := remote.List("my-topic-0/")
+		assert.NoError(t, err)
+		assert.Equal(t, []RemoteObject{
+			{"my-topic-0/0.index", 18},
+			{"my-topic-0/0.log", 16},
+			{"my-topic-0/1.log", 16},
+		}, objects)
+
+		assert.NoError(t, remote.Delete("my-topic-0/0.log"))
+		_, err = remote.Get("my-topic-0/0.log")
+		assert.ErrorIs(t, err, os.ErrNotExist)
+
+		objects, err = remote.List("my-topic")
+		assert.NoError(t, err)
+		assert.Len(t, objects, 3)
+	})
+}
+
+// newTieredBroker produces 30 messages an hour apart to a topic with
+// remote storage enabled.
+func newTieredBroker(t *testing.T, remote RemoteStorage, cfg TopicConfiguration) (*KrakeBroker, *time.Time) {
+	cfg.Name = "my-topic"
+	cfg.RemoteStorage = true
+	b, now := newRetentionBroker(t, cfg, 30)
+	b.SetRemoteStorage(remote)
+	return b, now
+}
+
+func TestKrakeBroker_TierSegments(t *testing.T) {
+	testRemoteStorages(t, func(t *testing.T, remote RemoteStorage) {
+		b, now := newTieredBroker(t, remote, TopicConfiguration{LocalRetentionPeriod: 48 * time.Hour})
+		key := TopicPartitionKey{"my-topic", 0}
+		l := b.logs[key]
+		segments := append([]*segment{}, l.segments...)
+		assert.Greater(t, len(segments), 3)
+
+		// every closed segment is copied, the active one is not
+		assert.NoError(t, b.TierSegments())
+		objects, err := remote.List("my-topic-0/")
+		assert.NoError(t, err)
+		assert.Len(t, objects, 3*(len(segments)-1))
+		for _, s := range segments[:len(segments)-1] {
+			assert.True(t, s.uploaded)
+			data, err := readFile(s.store, s.path)
+			assert.NoError(t, err)
+			assert.Equal(t, string(data[:s.size]), getObject(t, remote, remoteObjectName(key, s.baseOffset, logFileSuffix)))
+		}
+		assert.False(t, l.activeSegment().uploaded)
+
+		// the local copies are kept until they expire
+		assert.Len(t, l.segments, len(segments))
+		*now = now.Add(30 * time.Hour)
+		assert.NoError(t, b.TierSegments())
+
+		cutoff := now.Add(-48 * time.Hour).UnixMilli()
+		assert.Less(t, len(l.segments), len(segments))
+		assert.NotEmpty(t, l.remoteSegments)
+		for _, s := range segments[:len(segments)-len(l.segments)] {
+			assert.Less(t, s.maxTimestamp, cutoff)
+			assertNotStored(t, b.store, s.path)
+		}
+		assert.Equal(t, segments[0].baseOffset, l.remoteSegments[0].baseOffset)
+
+		// nothing is copied twice
+		objects, err = remote.List("my-topic-0/")
+		assert.NoError(t, err)
+		assert.Len(t, objects, 3*(len(segments)-1))
+	})
+}
+
+func TestKrakeBroker_TierSegments_Disabled(t *testing.T) {
+	remote := NewLocalStorage(t.TempDir())
+	b, _ := newRetentionBroker(t, TopicConfiguration{Name: "my-topic"}, 30)
+	b.SetRemoteStorage(remote)
+
+	assert.NoError(t, b.TierSegments())
+	objects, err := remote.List("")
+	assert.NoError(t, err)
+	assert.Empty(t, objects)
+}
+
+func TestKrakeBroker_Fetch_Remote(t *testing.T) {
+	testRemoteStorages(t, func(t *testing.T, remote RemoteStorage) {
+		b, now := newTieredBroker(t, remote, TopicConfiguration{LocalRetentionPeriod: time.Hour})
+		assert.NoError(t, b.TierSegments())
+		key := TopicPartitionKey{"my-topic", 0}
+		l := b.logs[key]
+		assert.Len(t, l.segments, 1)
+
+		// old offsets are read from remote storage
+		for offset := int64(0); offset < 30; offset++ {
+			batch, err := b.Fetch(key, offset)
+			assert.NoError(t, err)
+			assert.Equal(t, offset, batch.BaseOffset)
+			assert.Equal(t, []byte(fmt.Sprintf("message: %d", offset)), batch.Records[0].Value)
+		}
+
+		r, err := b.FetchFile("my-topic", 0, 2, 1<<20)
+		assert.NoError(t, err)
+		batches := readRange(t, r)
+		assert.Equal(t, int64(2), batches[0].BaseOffset)
+		assert.Equal(t, l.remoteSegments[0].nextOffset, batches[len(batches)-1].LastOffset()+1)
+
+		consumerId := b.Subscribe([]string{"my-topic"})
+		msg, err := b.ReadMessage("my-topic", consumerId, -1)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("message: 0"), msg.Message)
+
+		// remote segments expire like local ones
+		cfg := b.topics["my-topic"]
+		cfg.RetentionPeriod = 10 * time.Hour
+		b.topics["my-topic"] = cfg
+		*now = now.Add(time.Hour)
+		assert.NoError(t, b.EnforceRetention())
+
+		cutoff := now.Add(-10 * time.Hour).UnixMilli()
+		for _, rs := range l.remoteSegments {
+			assert.GreaterOrEqual(t, rs.maxTimestamp, cutoff)
+		}
+		_, err = b.Fetch(key, 0)
+		assert.ErrorIs(t, err, ErrOffsetOutOfRange)
+		_, err = remote.Get(remoteObjectName(key, 0, logFileSuffix))
+		assert.ErrorIs(t, err, os.ErrNotExist)
+		assert.Positive(t, b.RetentionStats().SegmentsDeleted)
+	})
+}
+
+func TestKrakeBroker_LoadLogs_Remote(t *testing.T) {
+	remote := NewLocalStorage(t.TempDir())
+	b, _ := newTieredBroker(t, remote, TopicConfiguration{LocalRetentionPeriod: 10 * time.Hour})
+	assert.NoError(t, b.TierSegments())
+	key := TopicPartitionKey{"my-topic", 0}
+	before := b.logs[key]
+	assert.NotEmpty(t, before.remoteSegments)
+	assert.Greater(t, len(before.segments), 1)
+
+	b.mu.Lock()
+	assert.NoError(t, b.Close())
+	b.mu.Unlock()
+
+	pw, restarted := newRestartBroker(b.store, b.logDirs()[0])
+	pw.SetRemoteStorage(remote)
+	k := restarted.(*KrakeBroker)
+	k.Configure(b.Config)
+	assert.NoError(t, k.LoadLogs())
+	defer pw.Close()
+
+	l := pw.logs[key]
+	assert.Equal(t, before.remoteSegments, l.remoteSegments)
+	for _, s := range l.segments[:len(l.segments)-1] {
+		assert.True(t, s.uploaded)
+	}
+	for offset := int64(0); offset < 30; offset++ {
+		batch, err := k.Fetch(key, offset)
+		assert.NoError(t, err)
+		assert.Equal(t, offset, batch.BaseOffset)
+	}
+}
+
+// blockingStorage holds downloads of segment logs until released.
+type blockingStorage struct {
+	RemoteStorage
+	started chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingStorage) Get(name string) (io.ReadCloser, error) {
+	if strings.HasSuffix(name, logFileSuffix) {
+		s.started <- struct{}{}
+		<-s.release
+	}
+	return s.RemoteStorage.Get(name)
+}
+
+func TestKrakeBroker_ReadMessage_RemoteUnlocked(t *testing.T) {
+	remote := &blockingStorage{
+		RemoteStorage: NewLocalStorage(t.TempDir()),
+		started:       make(chan struct{}),
+		release:       make(chan struct{}),
+	}
+	b, _ := newTieredBroker(t, remote, TopicConfiguration{LocalRetentionPeriod: time.Hour})
+	assert.NoError(t, b.TierSegments())
+	consumerId := b.Subscribe([]string{"my-topic"})
+
+	read := make(chan *Message)
+	go func() {
+		msg, err := b.ReadMessage("my-topic", consumerId, -1)
+		assert.NoError(t, err)
+		read <- msg
+	}()
+
+	// the broker keeps serving while the segment is downloaded
+	<-remote.started
+	meta, err := b.Produce("my-topic", &Message{Message: []byte("message: 30")})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(30), meta.Offset)
+
+	close(remote.release)
+	assert.Equal(t, []byte("message: 0"), (<-read).Message)
+}
+
+func TestKrakeBroker_LoadLogs_FullyRemote(t *testing.T) {
+	remote := NewLocalStorage(t.TempDir())
+	b, _ := newTieredBroker(t, remote, TopicConfiguration{LocalRetentionPeriod: 10 * time.Hour})
+	assert.NoError(t, b.TierSegments())
+	key := TopicPartitionKey{"my-topic", 0}
+	tiered := b.logs[key].segments[len(b.logs[key].segments)-1].baseOffset
+
+	b.mu.Lock()
+	assert.NoError(t, b.Close())
+	b.mu.Unlock()
+
+	// only the metadata of the partition is left locally
+	dir := b.partitionDirs[key]
+	entries, err := b.store.ReadDir(dir)
+	assert.NoError(t, err)
+	for _, e := range entries {
+		if e.Name() != partitionMetadataFile {
+			assert.NoError(t, b.store.Remove(filepath.Join(dir, e.Name())))
+		}
+	}
+
+	pw, restarted := newRestartBroker(b.store, b.logDirs()[0])
+	pw.SetRemoteStorage(remote)
+	k := restarted.(*KrakeBroker)
+	k.Configure(b.Config)
+	assert.NoError(t, k.LoadLogs())
+	defer pw.Close()
+
+	l := pw.logs[key]
+	assert.Empty(t, l.segments)
+	assert.Equal(t, tiered, l.nextOffset)
+	for offset := int64(0); offset < tiered; offset++ {
+		batch, err := k.Fetch(key, offset)
+		assert.NoError(t, err)
+		assert.Equal(t, offset, batch.BaseOffset)
+	}
+	_, err = k.Fetch(key, tiered)
+	assert.ErrorIs(t, err, ErrOffsetOutOfRange)
+
+	r, err := k.FetchFile("my-topic", 0, 0, 1<<20)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), readRange(t, r)[0].BaseOffset)
+
+	// new messages start a local segment after the remote ones
+	meta, err := k.Produce("my-topic", &Message{Message: []byte("new")})
+	assert.NoError(t, err)
+	assert.Equal(t, tiered, meta.Offset)
+}
+
+// restartTieredBroker closes b and loads its logs again in a new
+// broker sharing its store, remote storage and clock.
+func restartTieredBroker(t *testing.T, b *KrakeBroker, remote RemoteStorage) *KrakeBroker {
+	b.mu.Lock()
+	assert.NoError(t, b.Close())
+	b.mu.Unlock()
+
+	pw, restarted := newRestartBroker(b.store, b.logDirs()[0])
+	pw.SetRemoteStorage(remote)
+	k := restarted.(*KrakeBroker)
+	k.Configure(b.Config)
+	k.now = b.now
+	assert.NoError(t, k.LoadLogs())
+	t.Cleanup(func() {
+		k.mu.Lock()
+		defer k.mu.Unlock()
+		pw.Close()
+	})
+	return k
+}
+
+func TestKrakeBroker_EnforceRetention_RemoteAfterRestart(t *testing.T) {
+	remote := NewLocalStorage(t.TempDir())
+	b, _ := newTieredBroker(t, remote, TopicConfiguration{
+		RetentionPeriod:      1000 * time.Hour,
+		LocalRetentionPeriod: 10 * time.Hour,
+	})
+	key := TopicPartitionKey{"my-topic", 0}
+
+	// segments recovered on startup are tiered after a restart
+	b = restartTieredBroker(t, b, remote)
+	b = restartTieredBroker(t, b, remote)
+	assert.NoError(t, b.TierSegments())
+	tiered := b.logs[key].remoteSegments
+	assert.NotEmpty(t, tiered)
+	for _, s := range tiered {
+		data := getObject(t, remote, remoteObjectName(key, s.baseOffset, timeIndexFileSuffix))
+		// the last entry copied is the largest timestamp, not padding
+		last := []byte(data[len(data)-timeIndexEntrySize:])
+		assert.Equal(t, s.maxTimestamp, int64(binary.BigEndian.Uint64(last)))
+	}
+
+	// nothing has expired, locally or remotely
+	b = restartTieredBroker(t, b, remote)
+	l := b.logs[key]
+	assert.Equal(t, tiered, l.remoteSegments)
+	assert.NoError(t, b.EnforceRetention())
+	assert.Equal(t, tiered, l.remoteSegments)
+
+	batch, err := b.Fetch(key, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), batch.BaseOffset)
+}
+
+func TestKrakeBroker_OffsetsForTimes_Remote(t *testing.T) {
+	remote := NewLocalStorage(t.TempDir())
+	b, now := newTieredBroker(t, remote, TopicConfiguration{LocalRetentionPeriod: 10 * time.Hour})
+	start := now.Add(-29 * time.Hour)
+	assert.NoError(t, b.TierSegments())
+	key := TopicPartitionKey{"my-topic", 0}
+	assert.NotEmpty(t, b.logs[key].remoteSegments)
+
+	assertOffsets := func(k *KrakeBroker) {
+		for i := 0; i < 30; i++ {
+			offs, err := k.OffsetsForTimes("my-topic", 0, start.Add(time.Duration(i)*time.Hour))
+			assert.NoError(t, err)
+			assert.Equal(t, int64(i), offs)
+		}
+		offs, err := k.OffsetsForTimes("my-topic", 0, start.Add(-time.Hour))
+		assert.NoError(t, err)
+		assert.Equal(t, int64(0), offs)
+
+		offs, err = k.OffsetsForTimes("my-topic", 0, start.Add(30*time.Hour))
+		assert.NoError(t, err)
+		assert.Equal(t, int64(-1), offs)
+	}
+	assertOffsets(b)
+
+	// the timestamps of remote segments are read back on startup
+	assertOffsets(restartTieredBroker(t, b, remote))
+}
@@ -0,0 +1,139 @@
+package api
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// RetentionStats counts the segments deleted by the retention cleaner.
+type RetentionStats struct {
+	SegmentsDeleted int64
+	BytesReclaimed  int64
+}
+
+// RetentionStats returns the totals since the broker started.
+func (k *KrakeBroker) RetentionStats() RetentionStats {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.retentionStats
+}
+
+// retentionCheckInterval is log.retention.check.interval.ms, how often
+// the cleaner looks for segments to delete.
+func (k *KrakeBroker) retentionCheckInterval() time.Duration {
+	if v, ok := k.Config["log.retention.check.interval.ms"].(int); ok {
+		return time.Duration(v) * time.Millisecond
+	}
+	return 5 * time.Minute
+}
+
+// StartRetention runs the retention cleaner in the background until
+// ctx is cancelled.
+func (k *KrakeBroker) StartRetention(ctx context.Context) {
+	ticker := time.NewTicker(k.retentionCheckInterval())
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := k.EnforceRetention(); err != nil {
+					log.Println("failed to enforce retention", err)
+				}
+			}
+		}
+	}()
+}
+
+// EnforceRetention deletes the oldest segments of every partition that
+// are past the retention period of their topic, or that put the
+// partition over its retention.bytes. Segments only in remote storage
+// are the oldest and go first. Topics that are only compacted are
+// skipped. Like Kafka the active segment is never deleted.
+func (k *KrakeBroker) EnforceRetention() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	now := k.now()
+	for key, l := range k.logs {
+		cfg, ok := k.topics[key.Topic]
+		if !ok || !cfg.hasCleanupPolicy(CleanupPolicyDelete) {
+			continue
+		}
+
+		if cfg.RetentionPeriod > 0 {
+			cutoff := now.Add(-cfg.RetentionPeriod).UnixMilli()
+			err := k.deleteRemoteSegments(key, l, "retention period", func(rs remoteSegment) bool {
+				return rs.maxTimestamp < cutoff
+			})
+			if err != nil {
+				return err
+			}
+			err = k.deleteSegments(key, l, "retention period", func(s *segment) bool {
+				return s.maxTimestamp < cutoff
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		if cfg.RetentionBytes > 0 {
+			// segments only in remote storage count towards the size.
+			excess := l.remoteSize() + l.size() - cfg.RetentionBytes
+			shouldDelete := func(size int64) bool {
+				if excess-size < 0 {
+					return false
+				}
+				excess -= size
+				return true
+			}
+			err := k.deleteRemoteSegments(key, l, "retention bytes", func(rs remoteSegment) bool {
+				return shouldDelete(rs.size)
+			})
+			if err != nil {
+				return err
+			}
+			err = k.deleteSegments(key, l, "retention bytes", func(s *segment) bool {
+				return shouldDelete(s.size)
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// deleteSegments deletes segments from the start of the log for as
+// long as shouldDelete returns true, stopping at the active segment.
+// Copies in remote storage are deleted with them.
+func (k *KrakeBroker) deleteSegments(key TopicPartitionKey, l *partitionLog, reason string, shouldDelete func(s *segment) bool) error {
+	deleted := false
+	for len(l.segments) > 1 && shouldDelete(l.segments[0]) {
+		s := l.segments[0]
+		log.Println("deleting segment", s.path, "due to", reason)
+
+		if s.uploaded {
+			if err := k.deleteRemoteObjects(key, s.baseOffset); err != nil {
+				return err
+			}
+		}
+
+		// the segment is closed even if removing its files fails.
+		l.segments = l.segments[1:]
+		reclaimed, err := s.delete()
+		k.retentionStats.BytesReclaimed += reclaimed
+		if err != nil {
+			return err
+		}
+		k.retentionStats.SegmentsDeleted++
+		deleted = true
+	}
+	if deleted {
+		l.pruneAbortedTxns()
+		return k.deleteProducerSnapshots(key, l)
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newRetentionBroker produces count messages to a single partition,
+// one an hour, rolling a segment every few messages.
+func newRetentionBroker(t *testing.T, cfg TopicConfiguration, count int) (*KrakeBroker, *time.Time) {
+	cfg.PartitionCount = 1
+	b, now := newTestBroker(t, map[string]interface{}{"log.segment.bytes": 300}, cfg)
+	start := *now
+	for i := 0; i < count; i++ {
+		*now = start.Add(time.Duration(i) * time.Hour)
+		_, err := b.Produce(cfg.Name, &Message{Message: []byte(fmt.Sprintf("message: %d", i))})
+		assert.NoError(t, err)
+	}
+	return b, now
+}
+
+func TestKrakeBroker_EnforceRetention_Period(t *testing.T) {
+	b, now := newRetentionBroker(t, TopicConfiguration{
+		Name:            "my-topic",
+		RetentionPeriod: 30 * time.Hour,
+	}, 30)
+
+	key := TopicPartitionKey{"my-topic", 0}
+	l := b.logs[key]
+	before := append([]*segment{}, l.segments...)
+	assert.Greater(t, len(before), 3)
+
+	// nothing has expired yet
+	assert.NoError(t, b.EnforceRetention())
+	assert.Len(t, l.segments, len(before))
+
+	// when enough time passes for the older messages to expire
+	*now = now.Add(15 * time.Hour)
+	assert.NoError(t, b.EnforceRetention())
+
+	// then every segment whose newest message is older than the
+	// retention period is deleted
+	cutoff := now.Add(-30 * time.Hour).UnixMilli()
+	deleted := before[:len(before)-len(l.segments)]
+	assert.NotEmpty(t, deleted)
+	for _, s := range deleted {
+		assert.Less(t, s.maxTimestamp, cutoff)
+		assertNotStored(t, b.store, s.path)
+		assertNotStored(t, b.store, s.indexPath())
+		assertNotStored(t, b.store, s.timeIndexPath())
+	}
+	assert.GreaterOrEqual(t, l.segments[0].maxTimestamp, cutoff)
+
+	_, err := b.Fetch(key, 0)
+	assert.ErrorIs(t, err, ErrOffsetOutOfRange)
+	batch, err := b.Fetch(key, l.segments[0].baseOffset)
+	assert.NoError(t, err)
+	assert.Equal(t, l.segments[0].baseOffset, batch.BaseOffset)
+
+	stats := b.RetentionStats()
+	assert.Equal(t, int64(len(deleted)), stats.SegmentsDeleted)
+	assert.Greater(t, stats.BytesReclaimed, int64(0))
+}
+
+func TestKrakeBroker_EnforceRetention_NeverDeletesActiveSegment(t *testing.T) {
+	b, now := newRetentionBroker(t, TopicConfiguration{
+		Name:            "my-topic",
+		RetentionPeriod: time.Hour,
+		RetentionBytes:  1,
+	}, 30)
+
+	*now = now.Add(24 * time.Hour)
+	assert.NoError(t, b.EnforceRetention())
+
+	l := b.logs[TopicPartitionKey{"my-topic", 0}]
+	assert.Len(t, l.segments, 1)
+	_, err := b.store.Stat(l.activeSegment().path)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(30), l.nextOffset)
+
+	// and new messages still go to it
+	md, err := b.Produce("my-topic", &Message{Message: []byte("message: 30")})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(30), md.Offset)
+}
+
+func TestKrakeBroker_EnforceRetention_Bytes(t *testing.T) {
+	b, _ := newRetentionBroker(t, TopicConfiguration{
+		Name:           "my-topic",
+		RetentionBytes: 500,
+	}, 30)
+
+	l := b.logs[TopicPartitionKey{"my-topic", 0}]
+	segments := len(l.segments)
+	assert.Greater(t, l.size(), int64(500))
+
+	assert.NoError(t, b.EnforceRetention())
+
+	// like Kafka the oldest segments are deleted for as long as the
+	// partition stays at or above retention.bytes without them
+	assert.Less(t, len(l.segments), segments)
+	assert.GreaterOrEqual(t, l.size(), int64(500))
+	assert.Less(t, l.size()-l.segments[0].size, int64(500))
+}
+
+func TestKrakeBroker_StartRetention(t *testing.T) {
+	b, now := newRetentionBroker(t, TopicConfiguration{
+		Name:            "my-topic",
+		RetentionPeriod: time.Hour,
+	}, 30)
+	b.Config["log.retention.check.interval.ms"] = 1
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	b.mu.Lock()
+	*now = now.Add(24 * time.Hour)
+	first := b.logs[TopicPartitionKey{"my-topic", 0}].segments[0].path
+	b.mu.Unlock()
+
+	b.StartRetention(ctx)
+	assert.Eventually(t, func() bool {
+		_, err := b.store.Stat(first)
+		return errors.Is(err, os.ErrNotExist)
+	}, time.Second, time.Millisecond)
+}
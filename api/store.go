@@ -0,0 +1,163 @@
+package api
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+)
+
+// SegmentStore holds the partition directories and the segment logs
+// and indexes inside them. Paths use the layout of the log dirs
+// whatever the store.
+type SegmentStore interface {
+	// Create creates the named file, truncating it if it exists.
+	Create(name string) (SegmentFile, error)
+	// Open opens the named file for reading and writing.
+	Open(name string) (SegmentFile, error)
+	Stat(name string) (fs.FileInfo, error)
+	Remove(name string) error
+	Rename(oldname, newname string) error
+	MkdirAll(path string) error
+	// ReadDir returns the entries of the named directory sorted by
+	// name.
+	ReadDir(name string) ([]fs.DirEntry, error)
+}
+
+// SegmentFile is a file opened by a SegmentStore. Files of the
+// FileStore are *os.File.
+type SegmentFile interface {
+	io.ReaderAt
+	io.WriterAt
+	io.Closer
+	Name() string
+	Stat() (fs.FileInfo, error)
+	Truncate(size int64) error
+	Sync() error
+}
+
+// FileStore keeps segments in files on disk.
+type FileStore struct{}
+
+func NewFileStore() FileStore {
+	return FileStore{}
+}
+
+func (FileStore) Create(name string) (SegmentFile, error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (FileStore) Open(name string) (SegmentFile, error) {
+	f, err := os.OpenFile(name, os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (FileStore) Stat(name string) (fs.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (FileStore) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (FileStore) Rename(oldname, newname string) error {
+	return os.Rename(oldname, newname)
+}
+
+func (FileStore) MkdirAll(path string) error {
+	return os.MkdirAll(path, 0755)
+}
+
+func (FileStore) ReadDir(name string) ([]fs.DirEntry, error) {
+	return os.ReadDir(name)
+}
+
+// storeDiskFree is used to place partitions in the log dirs of store.
+// Stores that do not keep files on disk have the same space everywhere
+// so partitions are spread evenly.
+func storeDiskFree(store SegmentStore) func(dir string) (uint64, error) {
+	if _, ok := store.(FileStore); ok {
+		return diskFree
+	}
+	return func(string) (uint64, error) {
+		return 0, nil
+	}
+}
+
+var errNotMappable = errors.New("segment file cannot be memory mapped")
+
+// mapper is implemented by files that map themselves into memory
+// rather than through mmap.
+type mapper interface {
+	Map(size int) ([]byte, error)
+	Unmap(b []byte) error
+}
+
+// mapFile maps the first size bytes of f into memory. Writes to the
+// returned slice are written to f.
+func mapFile(f SegmentFile, size int) ([]byte, error) {
+	switch f := f.(type) {
+	case mapper:
+		return f.Map(size)
+	case *os.File:
+		return mmap(f, size)
+	}
+	return nil, errNotMappable
+}
+
+// unmapFile unmaps b, mapped from f by mapFile.
+func unmapFile(f SegmentFile, b []byte) error {
+	switch f := f.(type) {
+	case mapper:
+		return f.Unmap(b)
+	case *os.File:
+		return munmap(f, b)
+	}
+	return errNotMappable
+}
+
+// openOrCreate opens the named file, creating it if it does not exist.
+func openOrCreate(store SegmentStore, name string) (SegmentFile, error) {
+	f, err := store.Open(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return store.Create(name)
+	}
+	return f, err
+}
+
+func writeFile(store SegmentStore, name string, data []byte) error {
+	f, err := store.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err = f.WriteAt(data, 0); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func readFile(store SegmentStore, name string) ([]byte, error) {
+	f, err := store.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, info.Size())
+	if _, err = f.ReadAt(data, 0); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	return data, nil
+}
@@ -0,0 +1,181 @@
+package api
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testStores runs test against every SegmentStore, dir is an empty
+// directory in the store.
+func testStores(t *testing.T, test func(t *testing.T, store SegmentStore, dir string)) {
+	t.Run("file", func(t *testing.T) {
+		test(t, NewFileStore(), t.TempDir())
+	})
+	t.Run("memory", func(t *testing.T) {
+		store := NewMemoryStore()
+		assert.NoError(t, store.MkdirAll(memoryLogDir))
+		test(t, store, memoryLogDir)
+	})
+}
+
+// assertNotStored checks that the store has no file named name.
+func assertNotStored(t *testing.T, store SegmentStore, name string) {
+	_, err := store.Stat(name)
+	assert.ErrorIs(t, err, os.ErrNotExist, name)
+}
+
+func TestSegmentStore_Files(t *testing.T) {
+	testStores(t, func(t *testing.T, store SegmentStore, dir string) {
+		name := filepath.Join(dir, "0.log")
+		_, err := store.Open(name)
+		assert.ErrorIs(t, err, os.ErrNotExist)
+
+		f, err := store.Create(name)
+		assert.NoError(t, err)
+		assert.Equal(t, name, f.Name())
+
+		_, err = f.WriteAt([]byte("world"), 6)
+		assert.NoError(t, err)
+		_, err = f.WriteAt([]byte("hello"), 0)
+		assert.NoError(t, err)
+
+		buf := make([]byte, 11)
+		_, err = f.ReadAt(buf, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, "hello\x00world", string(buf))
+
+		// reads past the end are short
+		n, err := f.ReadAt(buf, 6)
+		assert.ErrorIs(t, err, io.EOF)
+		assert.Equal(t, 5, n)
+
+		assert.NoError(t, f.Truncate(5))
+		info, err := f.Stat()
+		assert.NoError(t, err)
+		assert.Equal(t, int64(5), info.Size())
+
+		// growing the file fills it with zeroes
+		assert.NoError(t, f.Truncate(8))
+		_, err = f.ReadAt(buf[:8], 0)
+		assert.NoError(t, err)
+		assert.Equal(t, "hello\x00\x00\x00", string(buf[:8]))
+
+		assert.NoError(t, f.Sync())
+		assert.NoError(t, f.Close())
+		assert.ErrorIs(t, f.Sync(), os.ErrClosed)
+	})
+}
+
+func TestSegmentStore_RemoveKeepsOpenFilesReadable(t *testing.T) {
+	testStores(t, func(t *testing.T, store SegmentStore, dir string) {
+		name := filepath.Join(dir, "0.log")
+		assert.NoError(t, writeFile(store, name, []byte("hello")))
+
+		f, err := store.Open(name)
+		assert.NoError(t, err)
+		defer f.Close()
+
+		assert.NoError(t, store.Remove(name))
+		_, err = store.Stat(name)
+		assert.ErrorIs(t, err, os.ErrNotExist)
+		assert.ErrorIs(t, store.Remove(name), os.ErrNotExist)
+
+		buf := make([]byte, 5)
+		_, err = f.ReadAt(buf, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, "hello", string(buf))
+	})
+}
+
+func TestSegmentStore_Dirs(t *testing.T) {
+	testStores(t, func(t *testing.T, store SegmentStore, dir string) {
+		partition := filepath.Join(dir, "my-topic-0")
+		_, err := store.ReadDir(partition)
+		assert.ErrorIs(t, err, os.ErrNotExist)
+		_, err = store.Create(filepath.Join(partition, "0.log"))
+		assert.ErrorIs(t, err, os.ErrNotExist)
+
+		assert.NoError(t, store.MkdirAll(partition))
+		assert.NoError(t, store.MkdirAll(filepath.Join(dir, "my-topic-1")))
+		for _, name := range []string{"1.log", "0.log.swap", "0.index"} {
+			assert.NoError(t, writeFile(store, filepath.Join(partition, name), []byte(name)))
+		}
+		assert.NoError(t, store.Rename(filepath.Join(partition, "0.log.swap"), filepath.Join(partition, "0.log")))
+
+		var names []string
+		entries, err := store.ReadDir(partition)
+		assert.NoError(t, err)
+		for _, e := range entries {
+			assert.False(t, e.IsDir())
+			names = append(names, e.Name())
+		}
+		assert.Equal(t, []string{"0.index", "0.log", "1.log"}, names)
+
+		data, err := readFile(store, filepath.Join(partition, "0.log"))
+		assert.NoError(t, err)
+		assert.Equal(t, "0.log.swap", string(data))
+
+		entries, err = store.ReadDir(dir)
+		assert.NoError(t, err)
+		if assert.Len(t, entries, 2) {
+			assert.Equal(t, "my-topic-0", entries[0].Name())
+			assert.True(t, entries[0].IsDir())
+		}
+	})
+}
+
+func TestSegmentStore_Indexes(t *testing.T) {
+	testStores(t, func(t *testing.T, store SegmentStore, dir string) {
+		path := filepath.Join(dir, "0.index")
+		idx, err := openOffsetIndex(store, path, 100, 1024)
+		assert.NoError(t, err)
+		assert.NoError(t, idx.append(110, 0))
+		assert.NoError(t, idx.append(120, 4096))
+		assert.NoError(t, idx.close())
+
+		info, err := store.Stat(path)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(2*offsetIndexEntrySize), info.Size())
+
+		idx, err = openOffsetIndex(store, path, 100, 1024)
+		assert.NoError(t, err)
+		defer idx.close()
+		offset, position := idx.lookup(125)
+		assert.Equal(t, int64(120), offset)
+		assert.Equal(t, int64(4096), position)
+	})
+}
+
+func TestMemoryStore_Broker(t *testing.T) {
+	store := NewMemoryStore()
+	pw := NewPartitionWriterWithStore(store)
+	b := NewKrakeBroker(pw)
+	cfg := map[string]interface{}{
+		"log.dirs":          memoryLogDir,
+		"log.segment.bytes": 300,
+	}
+	b.Configure(cfg)
+	assert.NoError(t, b.CreateTopic(TopicConfiguration{Name: "my-topic", PartitionCount: 1}))
+	produceMessages(t, b, 0, 30)
+
+	r, err := b.FetchFile("my-topic", 0, 5, 1<<20)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5), readRange(t, r)[0].BaseOffset)
+	assert.NoError(t, pw.Close())
+
+	// the logs are reloaded from the store
+	restarted := NewKrakeBroker(NewPartitionWriterWithStore(store))
+	restarted.Configure(cfg)
+	assert.NoError(t, restarted.LoadLogs())
+	defer restarted.Close()
+
+	for offset := int64(0); offset < 30; offset++ {
+		batch, err := restarted.Fetch(TopicPartitionKey{"my-topic", 0}, offset)
+		assert.NoError(t, err)
+		assert.Equal(t, offset, batch.BaseOffset)
+	}
+}
@@ -0,0 +1,573 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/krake-labs/krake/api/record"
+)
+
+var (
+	ErrUnknownTransactionalID = errors.New("unknown transactional id")
+	ErrInvalidTxnState        = errors.New("invalid transaction state")
+	ErrInvalidIsolationLevel  = errors.New("invalid isolation level")
+)
+
+// transactionStateFile in the first log dir holds the transactions
+// known to the coordinator.
+const transactionStateFile = "transaction-state"
+
+// txnState is where the latest transaction of a transactional id is.
+// A transaction ends by saving the decision to commit or abort,
+// writing a marker to each of its partitions and completing.
+type txnState string
+
+const (
+	txnEmpty          txnState = "Empty"
+	txnOngoing        txnState = "Ongoing"
+	txnPrepareCommit  txnState = "PrepareCommit"
+	txnPrepareAbort   txnState = "PrepareAbort"
+	txnCompleteCommit txnState = "CompleteCommit"
+	txnCompleteAbort  txnState = "CompleteAbort"
+)
+
+func preparedState(marker record.ControlType) txnState {
+	if marker == record.ControlCommit {
+		return txnPrepareCommit
+	}
+	return txnPrepareAbort
+}
+
+func completedState(marker record.ControlType) txnState {
+	if marker == record.ControlCommit {
+		return txnCompleteCommit
+	}
+	return txnCompleteAbort
+}
+
+// transaction is what the coordinator knows of a transactional id.
+// Every transaction bumps the producer epoch, fencing the producers of
+// the earlier ones.
+type transaction struct {
+	TransactionalID string
+	ProducerID      int64
+	ProducerEpoch   int16
+	State           txnState
+	Partitions      []TopicPartitionKey
+	// when the ongoing transaction began.
+	Started time.Time
+}
+
+func (txn *transaction) producer() ProducerIdentity {
+	return ProducerIdentity{ID: txn.ProducerID, Epoch: txn.ProducerEpoch}
+}
+
+func (txn *transaction) includes(key TopicPartitionKey) bool {
+	for _, k := range txn.Partitions {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// transactionTimeout is transaction.timeout.ms, how long a transaction
+// may stay open before the coordinator aborts it.
+func (k *KrakeBroker) transactionTimeout() time.Duration {
+	if v, ok := k.Config["transaction.timeout.ms"].(int); ok {
+		return time.Duration(v) * time.Millisecond
+	}
+	return time.Minute
+}
+
+func (k *KrakeBroker) transactionStatePath() string {
+	return filepath.Join(k.logDirs()[0], transactionStateFile)
+}
+
+func (k *KrakeBroker) loadTransactions() error {
+	if k.transactions != nil {
+		return nil
+	}
+
+	transactions := map[string]*transaction{}
+	data, err := readFile(k.store, k.transactionStatePath())
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err == nil {
+		var saved []*transaction
+		if err = json.Unmarshal(data, &saved); err != nil {
+			return fmt.Errorf("%s: %w", transactionStateFile, err)
+		}
+		for _, txn := range saved {
+			transactions[txn.TransactionalID] = txn
+		}
+	}
+	k.transactions = transactions
+	return nil
+}
+
+func (k *KrakeBroker) writeTransactions() error {
+	saved := make([]*transaction, 0, len(k.transactions))
+	for _, txn := range k.transactions {
+		saved = append(saved, txn)
+	}
+	sort.Slice(saved, func(i, j int) bool {
+		return saved[i].TransactionalID < saved[j].TransactionalID
+	})
+	data, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+
+	if err = k.store.MkdirAll(k.logDirs()[0]); err != nil {
+		return err
+	}
+	path := k.transactionStatePath()
+	tmp := path + ".tmp"
+	if err = writeFile(k.store, tmp, data); err != nil {
+		return err
+	}
+	return k.store.Rename(tmp, path)
+}
+
+// BeginTransaction starts a transaction for the transactional id and
+// returns the producer to write it with. A transaction left open by an
+// earlier producer is aborted.
+func (k *KrakeBroker) BeginTransaction(transactionalID string) (ProducerIdentity, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if transactionalID == "" {
+		return ProducerIdentity{}, fmt.Errorf("%w: %q", ErrUnknownTransactionalID, transactionalID)
+	}
+	if err := k.loadTransactions(); err != nil {
+		return ProducerIdentity{}, err
+	}
+
+	txn, ok := k.transactions[transactionalID]
+	if !ok {
+		id, err := k.allocateProducerID()
+		if err != nil {
+			return ProducerIdentity{}, err
+		}
+		txn = &transaction{
+			TransactionalID: transactionalID,
+			ProducerID:      id,
+			ProducerEpoch:   -1,
+			State:           txnEmpty,
+		}
+		k.transactions[transactionalID] = txn
+	}
+
+	switch txn.State {
+	case txnOngoing, txnPrepareAbort:
+		if err := k.endTransaction(txn, record.ControlAbort); err != nil {
+			return ProducerIdentity{}, err
+		}
+	case txnPrepareCommit:
+		if err := k.endTransaction(txn, record.ControlCommit); err != nil {
+			return ProducerIdentity{}, err
+		}
+	}
+
+	if err := k.bumpEpoch(txn); err != nil {
+		return ProducerIdentity{}, err
+	}
+	txn.State = txnOngoing
+	txn.Partitions = nil
+	txn.Started = k.now()
+	return txn.producer(), k.writeTransactions()
+}
+
+// bumpEpoch fences the current producer of the transactional id. A new
+// producer id is allocated once the epoch runs out.
+func (k *KrakeBroker) bumpEpoch(txn *transaction) error {
+	if txn.ProducerEpoch < math.MaxInt16 {
+		txn.ProducerEpoch++
+		return nil
+	}
+	id, err := k.allocateProducerID()
+	if err != nil {
+		return err
+	}
+	txn.ProducerID, txn.ProducerEpoch = id, 0
+	return nil
+}
+
+// transaction returns the transaction of a transactional id, failing if
+// p is not its current producer.
+func (k *KrakeBroker) transaction(transactionalID string, p ProducerIdentity) (*transaction, error) {
+	if err := k.loadTransactions(); err != nil {
+		return nil, err
+	}
+	txn, ok := k.transactions[transactionalID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownTransactionalID, transactionalID)
+	}
+	if p != txn.producer() {
+		return nil, fmt.Errorf("%w: producer %d epoch %d is not the producer of %q", ErrInvalidProducerEpoch, p.ID, p.Epoch, transactionalID)
+	}
+	return txn, nil
+}
+
+// ongoingTransaction is the transaction p is producing to.
+func (k *KrakeBroker) ongoingTransaction(transactionalID string, p ProducerIdentity) (*transaction, error) {
+	txn, err := k.transaction(transactionalID, p)
+	if err != nil {
+		return nil, err
+	}
+	if txn.State != txnOngoing {
+		return nil, fmt.Errorf("%w: %q is %s", ErrInvalidTxnState, transactionalID, txn.State)
+	}
+	return txn, nil
+}
+
+// AddPartitionsToTxn adds partitions to the ongoing transaction, which
+// must be done before producing to them.
+func (k *KrakeBroker) AddPartitionsToTxn(transactionalID string, p ProducerIdentity, partitions []TopicPartitionKey) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	txn, err := k.ongoingTransaction(transactionalID, p)
+	if err != nil {
+		return err
+	}
+	for _, key := range partitions {
+		cfg, ok := k.topics[key.Topic]
+		if !ok {
+			return fmt.Errorf("%w: %s", ErrNoSuchTopic, key.Topic)
+		}
+		if key.PartitionIndex < 0 || int(key.PartitionIndex) >= cfg.PartitionCount {
+			return fmt.Errorf("%w: %d of %s", ErrUnknownPartition, key.PartitionIndex, key.Topic)
+		}
+	}
+	for _, key := range partitions {
+		if !txn.includes(key) {
+			txn.Partitions = append(txn.Partitions, key)
+		}
+	}
+	return k.writeTransactions()
+}
+
+// CommitTransaction makes the messages of the ongoing transaction
+// visible to read_committed consumers.
+func (k *KrakeBroker) CommitTransaction(transactionalID string, p ProducerIdentity) error {
+	return k.completeTransaction(transactionalID, p, record.ControlCommit)
+}
+
+// AbortTransaction discards the messages of the ongoing transaction,
+// read_committed consumers skip them.
+func (k *KrakeBroker) AbortTransaction(transactionalID string, p ProducerIdentity) error {
+	return k.completeTransaction(transactionalID, p, record.ControlAbort)
+}
+
+func (k *KrakeBroker) completeTransaction(transactionalID string, p ProducerIdentity, marker record.ControlType) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	txn, err := k.transaction(transactionalID, p)
+	if err != nil {
+		return err
+	}
+	switch txn.State {
+	case txnOngoing, preparedState(marker):
+		return k.endTransaction(txn, marker)
+	case completedState(marker):
+		// a retry of a request that succeeded.
+		return nil
+	}
+	return fmt.Errorf("%w: cannot %s %q as it is %s", ErrInvalidTxnState, marker, transactionalID, txn.State)
+}
+
+// endTransaction writes a marker to each partition of the transaction.
+// The decision is saved first so the markers are still written if the
+// broker stops part way through.
+func (k *KrakeBroker) endTransaction(txn *transaction, marker record.ControlType) error {
+	txn.State = preparedState(marker)
+	if err := k.writeTransactions(); err != nil {
+		return err
+	}
+
+	for _, key := range txn.Partitions {
+		batch := record.NewControlBatch(txn.ProducerID, txn.ProducerEpoch, marker, k.now().UnixMilli())
+		if _, err := k.append(key, batch); err != nil {
+			return err
+		}
+		// like acks=all the marker is on disk before it is acknowledged.
+		if err := k.committer.sync(k.logs[key].activeSegment().log); err != nil {
+			return err
+		}
+	}
+
+	txn.State = completedState(marker)
+	return k.writeTransactions()
+}
+
+// completePreparedTransactions writes the markers of transactions that
+// were decided before the broker stopped.
+func (k *KrakeBroker) completePreparedTransactions() error {
+	if err := k.loadTransactions(); err != nil {
+		return err
+	}
+	for _, txn := range k.transactions {
+		var err error
+		switch txn.State {
+		case txnPrepareCommit:
+			err = k.endTransaction(txn, record.ControlCommit)
+		case txnPrepareAbort:
+			err = k.endTransaction(txn, record.ControlAbort)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// transactionCheckInterval is
+// transaction.abort.timed.out.transaction.cleanup.interval.ms, how
+// often open transactions are checked for their timeout.
+func (k *KrakeBroker) transactionCheckInterval() time.Duration {
+	if v, ok := k.Config["transaction.abort.timed.out.transaction.cleanup.interval.ms"].(int); ok {
+		return time.Duration(v) * time.Millisecond
+	}
+	return 10 * time.Second
+}
+
+// StartTransactionExpiry aborts transactions that time out in the
+// background until ctx is cancelled.
+func (k *KrakeBroker) StartTransactionExpiry(ctx context.Context) {
+	ticker := time.NewTicker(k.transactionCheckInterval())
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := k.AbortExpiredTransactions(); err != nil {
+					log.Println("failed to abort expired transactions", err)
+				}
+			}
+		}
+	}()
+}
+
+// AbortExpiredTransactions aborts the transactions open for longer than
+// transaction.timeout.ms so they stop holding back the last stable
+// offset of their partitions. The producer that left them open is
+// fenced.
+func (k *KrakeBroker) AbortExpiredTransactions() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if err := k.loadTransactions(); err != nil {
+		return err
+	}
+	timeout := k.transactionTimeout()
+	cutoff := k.now().Add(-timeout)
+	for _, txn := range k.transactions {
+		if txn.State != txnOngoing || txn.Started.After(cutoff) {
+			continue
+		}
+		log.Println("aborting transaction", txn.TransactionalID, "open for longer than", timeout)
+		if err := k.endTransaction(txn, record.ControlAbort); err != nil {
+			return err
+		}
+		if err := k.bumpEpoch(txn); err != nil {
+			return err
+		}
+	}
+	return k.writeTransactions()
+}
+
+// abortedTxn is the range of offsets holding the messages a producer
+// wrote to a partition in a transaction that was aborted.
+type abortedTxn struct {
+	producerID  int64
+	firstOffset int64
+	lastOffset  int64
+}
+
+// appendTxnBatch tracks the transactions open on the partition as
+// batches are appended.
+func (l *partitionLog) appendTxnBatch(batch *record.Batch) error {
+	if !batch.IsTransactional() {
+		return nil
+	}
+	if l.ongoingTxns == nil {
+		l.ongoingTxns = map[int64]int64{}
+	}
+
+	if !batch.IsControl() {
+		if _, ok := l.ongoingTxns[batch.ProducerID]; !ok {
+			l.ongoingTxns[batch.ProducerID] = batch.BaseOffset
+		}
+		return nil
+	}
+
+	marker, err := batch.ControlType()
+	if err != nil {
+		return err
+	}
+	first, ok := l.ongoingTxns[batch.ProducerID]
+	if !ok {
+		// the producer wrote nothing here in the transaction.
+		return nil
+	}
+	delete(l.ongoingTxns, batch.ProducerID)
+	if marker == record.ControlAbort {
+		l.abortedTxns = append(l.abortedTxns, abortedTxn{
+			producerID:  batch.ProducerID,
+			firstOffset: first,
+			lastOffset:  batch.BaseOffset,
+		})
+	}
+	return nil
+}
+
+// lastStableOffset is the first offset of the earliest open
+// transaction, read_committed consumers read no further.
+func (l *partitionLog) lastStableOffset() int64 {
+	lso := l.nextOffset
+	for _, first := range l.ongoingTxns {
+		if first < lso {
+			lso = first
+		}
+	}
+	return lso
+}
+
+// aborted reports whether the batch was written in a transaction that
+// was aborted.
+func (l *partitionLog) aborted(batch *record.Batch) bool {
+	if !batch.IsTransactional() {
+		return false
+	}
+	for _, txn := range l.abortedTxns {
+		if txn.producerID == batch.ProducerID && txn.firstOffset <= batch.BaseOffset && batch.BaseOffset <= txn.lastOffset {
+			return true
+		}
+	}
+	return false
+}
+
+// recoverTransactions finds the open and aborted transactions of a
+// recovered partition by reading the headers of its local segments.
+func (l *partitionLog) recoverTransactions() error {
+	l.ongoingTxns, l.abortedTxns = nil, nil
+	for _, s := range l.segments {
+		f, err := s.file()
+		if err != nil {
+			return err
+		}
+		var position int64
+		for position < s.size {
+			batch, err := record.ReadHeaderAt(f, position)
+			if err != nil {
+				return err
+			}
+			// only markers need their record.
+			if batch.IsControl() {
+				if batch, err = record.ReadBatchAt(f, position); err != nil {
+					return err
+				}
+			}
+			if err = l.appendTxnBatch(batch); err != nil {
+				return err
+			}
+			position += int64(batch.Size())
+		}
+	}
+	return nil
+}
+
+// pruneAbortedTxns forgets the aborted transactions that were deleted
+// with the start of the log.
+func (l *partitionLog) pruneAbortedTxns() {
+	start := l.segments[0].baseOffset
+	if len(l.remoteSegments) > 0 {
+		start = l.remoteSegments[0].baseOffset
+	}
+	retained := l.abortedTxns[:0]
+	for _, txn := range l.abortedTxns {
+		if txn.lastOffset >= start {
+			retained = append(retained, txn)
+		}
+	}
+	l.abortedTxns = retained
+}
+
+// LastStableOffset is the offset read_committed consumers of the
+// partition read up to.
+func (k *KrakeBroker) LastStableOffset(topic string, partition int32) (int64, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if _, ok := k.topics[topic]; !ok {
+		return 0, ErrNoSuchTopic
+	}
+	l, ok := k.logs[TopicPartitionKey{topic, partition}]
+	if !ok {
+		return 0, nil
+	}
+	return l.lastStableOffset(), nil
+}
+
+// IsolationLevel is which messages a consumer reads, like its
+// isolation.level setting.
+type IsolationLevel int8
+
+const (
+	// ReadUncommitted consumers read every message, including those of
+	// open and aborted transactions.
+	ReadUncommitted IsolationLevel = iota
+	// ReadCommitted consumers read up to the last stable offset and skip
+	// the messages of aborted transactions.
+	ReadCommitted
+)
+
+func (l IsolationLevel) String() string {
+	switch l {
+	case ReadUncommitted:
+		return "read_uncommitted"
+	case ReadCommitted:
+		return "read_committed"
+	}
+	return fmt.Sprintf("IsolationLevel(%d)", int8(l))
+}
+
+// ParseIsolationLevel parses the isolation.level consumer setting, an
+// empty setting is read_uncommitted.
+func ParseIsolationLevel(s string) (IsolationLevel, error) {
+	switch s {
+	case "", "read_uncommitted":
+		return ReadUncommitted, nil
+	case "read_committed":
+		return ReadCommitted, nil
+	}
+	return ReadUncommitted, fmt.Errorf("%w: %q", ErrInvalidIsolationLevel, s)
+}
+
+// SetIsolationLevel changes which messages a consumer reads.
+func (k *KrakeBroker) SetIsolationLevel(consumerID uint32, level IsolationLevel) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	cfg, ok := k.offs[consumerID]
+	if !ok {
+		return ErrUnknownConsumer
+	}
+	cfg.IsolationLevel = level
+	k.offs[consumerID] = cfg
+	return nil
+}
@@ -0,0 +1,332 @@
+package api
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/krake-labs/krake/api/record"
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	ordersKey = TopicPartitionKey{"orders", 0}
+	outboxKey = TopicPartitionKey{"outbox", 0}
+)
+
+func newTxnBroker(t *testing.T) (*KrakeBroker, *time.Time) {
+	return newTestBroker(t, map[string]interface{}{"log.segment.bytes": 10_000},
+		TopicConfiguration{Name: "orders", PartitionCount: 1},
+		TopicConfiguration{Name: "outbox", PartitionCount: 1})
+}
+
+// produceTxn writes a message to the partition in the transaction.
+func produceTxn(t *testing.T, b *KrakeBroker, id string, p ProducerIdentity, key TopicPartitionKey, sequence int32, value string) error {
+	results, err := b.ProduceBatch(key.Topic, []*Message{{
+		Message:         []byte(value),
+		TargetPartition: partition(key.PartitionIndex),
+		Sequence:        sequence,
+	}}, ProduceOptions{Producer: p, TransactionalID: id})
+	if err != nil {
+		return err
+	}
+	return results[0].Err
+}
+
+func subscribe(t *testing.T, b *KrakeBroker, topic string, level IsolationLevel) uint32 {
+	id := b.Subscribe([]string{topic})
+	assert.NoError(t, b.SetIsolationLevel(id, level))
+	return id
+}
+
+func TestKrakeBroker_CommitTransaction(t *testing.T) {
+	b, _ := newTxnBroker(t)
+	committed := subscribe(t, b, "orders", ReadCommitted)
+	uncommitted := subscribe(t, b, "orders", ReadUncommitted)
+
+	p, err := b.BeginTransaction("checkout")
+	assert.NoError(t, err)
+	assert.NoError(t, b.AddPartitionsToTxn("checkout", p, []TopicPartitionKey{ordersKey, outboxKey}))
+	assert.NoError(t, produceTxn(t, b, "checkout", p, ordersKey, 0, "order"))
+	assert.NoError(t, produceTxn(t, b, "checkout", p, outboxKey, 0, "order created"))
+
+	// the open transaction holds back read_committed consumers
+	lso, err := b.LastStableOffset("orders", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), lso)
+	_, err = b.ReadMessage("orders", committed, -1)
+	assert.ErrorIs(t, err, ErrOffsetOutOfRange)
+	msg, err := b.ReadMessage("orders", uncommitted, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("order"), msg.Message)
+
+	assert.NoError(t, b.CommitTransaction("checkout", p))
+	// a retry of the commit succeeds, aborting it does not
+	assert.NoError(t, b.CommitTransaction("checkout", p))
+	assert.ErrorIs(t, b.AbortTransaction("checkout", p), ErrInvalidTxnState)
+
+	// both partitions end with a commit marker
+	for _, key := range []TopicPartitionKey{ordersKey, outboxKey} {
+		marker, err := b.Fetch(key, 1)
+		assert.NoError(t, err)
+		assert.True(t, marker.IsControl())
+		controlType, err := marker.ControlType()
+		assert.NoError(t, err)
+		assert.Equal(t, record.ControlCommit, controlType)
+
+		lso, err := b.LastStableOffset(key.Topic, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(2), lso)
+	}
+
+	msg, err = b.ReadMessage("orders", committed, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("order"), msg.Message)
+
+	// the transaction is over
+	err = produceTxn(t, b, "checkout", p, ordersKey, 1, "late")
+	assert.ErrorIs(t, err, ErrInvalidTxnState)
+}
+
+func TestKrakeBroker_OffsetsForTimes_Markers(t *testing.T) {
+	b, now := newTxnBroker(t)
+	start := *now
+
+	p, err := b.BeginTransaction("checkout")
+	assert.NoError(t, err)
+	assert.NoError(t, b.AddPartitionsToTxn("checkout", p, []TopicPartitionKey{ordersKey}))
+	assert.NoError(t, produceTxn(t, b, "checkout", p, ordersKey, 0, "order"))
+	*now = now.Add(time.Minute)
+	assert.NoError(t, b.CommitTransaction("checkout", p))
+
+	// only the marker is that recent and it is not a record
+	offset, err := b.OffsetsForTimes("orders", 0, start.Add(time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(-1), offset)
+
+	*now = now.Add(time.Minute)
+	_, err = b.Produce("orders", &Message{Message: []byte("plain")})
+	assert.NoError(t, err)
+	offset, err = b.OffsetsForTimes("orders", 0, start.Add(time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), offset)
+}
+
+func TestKrakeBroker_AbortTransaction(t *testing.T) {
+	b, _ := newTxnBroker(t)
+	committed := subscribe(t, b, "orders", ReadCommitted)
+	uncommitted := subscribe(t, b, "orders", ReadUncommitted)
+
+	p, err := b.BeginTransaction("checkout")
+	assert.NoError(t, err)
+	assert.NoError(t, b.AddPartitionsToTxn("checkout", p, []TopicPartitionKey{ordersKey}))
+	assert.NoError(t, produceTxn(t, b, "checkout", p, ordersKey, 0, "aborted"))
+	assert.NoError(t, b.AbortTransaction("checkout", p))
+
+	// the aborted message and the marker are skipped
+	_, err = b.ReadMessage("orders", committed, -1)
+	assert.ErrorIs(t, err, ErrOffsetOutOfRange)
+	_, err = b.Produce("orders", &Message{Message: []byte("plain")})
+	assert.NoError(t, err)
+
+	msg, err := b.ReadMessage("orders", committed, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("plain"), msg.Message)
+	assert.Equal(t, int64(2), msg.Offset)
+
+	msg, err = b.ReadMessage("orders", uncommitted, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("aborted"), msg.Message)
+}
+
+func TestKrakeBroker_BeginTransaction_Fences(t *testing.T) {
+	b, _ := newTxnBroker(t)
+
+	first, err := b.BeginTransaction("checkout")
+	assert.NoError(t, err)
+	assert.NoError(t, b.AddPartitionsToTxn("checkout", first, []TopicPartitionKey{ordersKey}))
+	assert.NoError(t, produceTxn(t, b, "checkout", first, ordersKey, 0, "zombie"))
+
+	// the next producer aborts what the first left open
+	second, err := b.BeginTransaction("checkout")
+	assert.NoError(t, err)
+	assert.Equal(t, first.ID, second.ID)
+	assert.Equal(t, first.Epoch+1, second.Epoch)
+	lso, err := b.LastStableOffset("orders", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), lso)
+
+	assert.ErrorIs(t, produceTxn(t, b, "checkout", first, ordersKey, 1, "zombie"), ErrInvalidProducerEpoch)
+	assert.ErrorIs(t, b.CommitTransaction("checkout", first), ErrInvalidProducerEpoch)
+
+	// partitions must be added before they are written to
+	assert.ErrorIs(t, produceTxn(t, b, "checkout", second, outboxKey, 0, "event"), ErrInvalidTxnState)
+	assert.ErrorIs(t, b.AddPartitionsToTxn("checkout", second, []TopicPartitionKey{{"orders", 3}}), ErrUnknownPartition)
+	assert.ErrorIs(t, b.AddPartitionsToTxn("payments", second, nil), ErrUnknownTransactionalID)
+
+	// the new epoch starts its sequence again
+	assert.NoError(t, b.AddPartitionsToTxn("checkout", second, []TopicPartitionKey{ordersKey}))
+	assert.NoError(t, produceTxn(t, b, "checkout", second, ordersKey, 0, "order"))
+	assert.NoError(t, b.CommitTransaction("checkout", second))
+}
+
+func TestKrakeBroker_AbortExpiredTransactions(t *testing.T) {
+	b, now := newTxnBroker(t)
+	b.Config["transaction.timeout.ms"] = 1000
+
+	p, err := b.BeginTransaction("checkout")
+	assert.NoError(t, err)
+	assert.NoError(t, b.AddPartitionsToTxn("checkout", p, []TopicPartitionKey{ordersKey}))
+	assert.NoError(t, produceTxn(t, b, "checkout", p, ordersKey, 0, "order"))
+
+	assert.NoError(t, b.AbortExpiredTransactions())
+	lso, err := b.LastStableOffset("orders", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), lso)
+
+	*now = now.Add(2 * time.Second)
+	assert.NoError(t, b.AbortExpiredTransactions())
+	lso, err = b.LastStableOffset("orders", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), lso)
+	assert.ErrorIs(t, b.CommitTransaction("checkout", p), ErrInvalidProducerEpoch)
+}
+
+func TestKrakeBroker_LoadLogs_Transactions(t *testing.T) {
+	b, _ := newTxnBroker(t)
+
+	aborted, err := b.BeginTransaction("aborted")
+	assert.NoError(t, err)
+	assert.NoError(t, b.AddPartitionsToTxn("aborted", aborted, []TopicPartitionKey{ordersKey}))
+	assert.NoError(t, produceTxn(t, b, "aborted", aborted, ordersKey, 0, "aborted"))
+	assert.NoError(t, b.AbortTransaction("aborted", aborted))
+
+	open, err := b.BeginTransaction("open")
+	assert.NoError(t, err)
+	assert.NoError(t, b.AddPartitionsToTxn("open", open, []TopicPartitionKey{ordersKey}))
+	assert.NoError(t, produceTxn(t, b, "open", open, ordersKey, 0, "open"))
+
+	// stop after deciding to commit but before writing the markers
+	decided, err := b.BeginTransaction("decided")
+	assert.NoError(t, err)
+	assert.NoError(t, b.AddPartitionsToTxn("decided", decided, []TopicPartitionKey{outboxKey}))
+	assert.NoError(t, produceTxn(t, b, "decided", decided, outboxKey, 0, "decided"))
+	b.transactions["decided"].State = txnPrepareCommit
+	assert.NoError(t, b.writeTransactions())
+	assert.NoError(t, b.Close())
+
+	restartedPW, restarted := newRestartBroker(b.store, memoryLogDir)
+	k := restarted.(*KrakeBroker)
+	assert.NoError(t, k.LoadLogs())
+	defer restartedPW.Close()
+
+	// the open transaction still holds back the partition
+	lso, err := k.LastStableOffset("orders", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), lso)
+	assert.Len(t, k.logs[ordersKey].abortedTxns, 1)
+
+	// and its producer can still finish it
+	assert.NoError(t, k.CommitTransaction("open", open))
+	lso, err = k.LastStableOffset("orders", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(4), lso)
+
+	// the commit was completed on startup
+	assert.Equal(t, txnCompleteCommit, k.transactions["decided"].State)
+	lso, err = k.LastStableOffset("outbox", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), lso)
+
+	consumer := subscribe(t, k, "orders", ReadCommitted)
+	msg, err := k.ReadMessage("orders", consumer, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("open"), msg.Message)
+}
+
+func TestKrakeBroker_CompactLogs_KeepsMarkers(t *testing.T) {
+	b, _ := newCompactedBroker(t, map[string]interface{}{})
+	for i := 0; i < 6; i++ {
+		marker := record.NewControlBatch(int64(i), 0, record.ControlCommit, b.now().UnixMilli())
+		_, err := b.append(compactKey, marker)
+		assert.NoError(t, err)
+		appendKeyed(t, b, "key", []byte("value"))
+	}
+	assert.NoError(t, b.CompactLogs())
+
+	var markers, values int
+	for _, r := range logRecords(t, b.logs[compactKey]) {
+		switch {
+		case strings.Contains(r, ":\x00\x00\x00\x01="):
+			markers++
+		case strings.HasSuffix(r, ":key=value"):
+			values++
+		}
+	}
+	assert.Equal(t, 6, markers)
+	assert.Less(t, values, 6)
+}
+
+func TestKrakeBroker_CompactLogs_Transactions(t *testing.T) {
+	b, _ := newCompactedBroker(t, map[string]interface{}{})
+	produceKeyed := func(id string, p ProducerIdentity, sequence int32, value string) {
+		results, err := b.ProduceBatch(compactKey.Topic, []*Message{{
+			Key:             []byte("k"),
+			Message:         []byte(value),
+			TargetPartition: partition(0),
+			Sequence:        sequence,
+		}}, ProduceOptions{Producer: p, TransactionalID: id})
+		assert.NoError(t, err)
+		assert.NoError(t, results[0].Err)
+	}
+	fill := func() {
+		for i := 0; i < 10; i++ {
+			appendKeyed(t, b, "filler", []byte(fmt.Sprintf("value-%d", i)))
+		}
+	}
+
+	appendKeyed(t, b, "k", []byte("committed"))
+	aborted, err := b.BeginTransaction("aborted")
+	assert.NoError(t, err)
+	assert.NoError(t, b.AddPartitionsToTxn("aborted", aborted, []TopicPartitionKey{compactKey}))
+	produceKeyed("aborted", aborted, 0, "aborted")
+	assert.NoError(t, b.AbortTransaction("aborted", aborted))
+
+	// an open transaction may still be aborted, so it does not replace
+	// the committed value either
+	open, err := b.BeginTransaction("open")
+	assert.NoError(t, err)
+	assert.NoError(t, b.AddPartitionsToTxn("open", open, []TopicPartitionKey{compactKey}))
+	produceKeyed("open", open, 0, "open")
+	fill()
+
+	assert.NoError(t, b.CompactLogs())
+	records := logRecords(t, b.logs[compactKey])
+	assert.Contains(t, records, "0:k=committed")
+	assert.NotContains(t, records, "1:k=aborted")
+	assert.Contains(t, records, "3:k=open")
+
+	assert.NoError(t, b.AbortTransaction("open", open))
+	fill()
+	assert.NoError(t, b.CompactLogs())
+	records = logRecords(t, b.logs[compactKey])
+	assert.Contains(t, records, "0:k=committed")
+	assert.NotContains(t, records, "3:k=open")
+
+	consumer := subscribe(t, b, compactKey.Topic, ReadCommitted)
+	msg, err := b.ReadMessage(compactKey.Topic, consumer, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("committed"), msg.Message)
+}
+
+func TestParseIsolationLevel(t *testing.T) {
+	level, err := ParseIsolationLevel("read_committed")
+	assert.NoError(t, err)
+	assert.Equal(t, ReadCommitted, level)
+	level, err = ParseIsolationLevel("")
+	assert.NoError(t, err)
+	assert.Equal(t, ReadUncommitted, level)
+	_, err = ParseIsolationLevel("serializable")
+	assert.ErrorIs(t, err, ErrInvalidIsolationLevel)
+}
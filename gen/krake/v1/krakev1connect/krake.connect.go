@@ -36,23 +36,78 @@ const (
 	// KrakeBrokerServiceProduceProcedure is the fully-qualified name of the KrakeBrokerService's
 	// Produce RPC.
 	KrakeBrokerServiceProduceProcedure = "/krake.v1.KrakeBrokerService/Produce"
+	// KrakeBrokerServiceProduceBatchProcedure is the fully-qualified name of the KrakeBrokerService's
+	// ProduceBatch RPC.
+	KrakeBrokerServiceProduceBatchProcedure = "/krake.v1.KrakeBrokerService/ProduceBatch"
+	// KrakeBrokerServiceInitProducerIdProcedure is the fully-qualified name of the KrakeBrokerService's
+	// InitProducerId RPC.
+	KrakeBrokerServiceInitProducerIdProcedure = "/krake.v1.KrakeBrokerService/InitProducerId"
+	// KrakeBrokerServiceBeginTransactionProcedure is the fully-qualified name of the
+	// KrakeBrokerService's BeginTransaction RPC.
+	KrakeBrokerServiceBeginTransactionProcedure = "/krake.v1.KrakeBrokerService/BeginTransaction"
+	// KrakeBrokerServiceAddPartitionsToTxnProcedure is the fully-qualified name of the
+	// KrakeBrokerService's AddPartitionsToTxn RPC.
+	KrakeBrokerServiceAddPartitionsToTxnProcedure = "/krake.v1.KrakeBrokerService/AddPartitionsToTxn"
+	// KrakeBrokerServiceCommitTransactionProcedure is the fully-qualified name of the
+	// KrakeBrokerService's CommitTransaction RPC.
+	KrakeBrokerServiceCommitTransactionProcedure = "/krake.v1.KrakeBrokerService/CommitTransaction"
+	// KrakeBrokerServiceAbortTransactionProcedure is the fully-qualified name of the
+	// KrakeBrokerService's AbortTransaction RPC.
+	KrakeBrokerServiceAbortTransactionProcedure = "/krake.v1.KrakeBrokerService/AbortTransaction"
 	// KrakeBrokerServiceRegisterConsumerProcedure is the fully-qualified name of the
 	// KrakeBrokerService's RegisterConsumer RPC.
 	KrakeBrokerServiceRegisterConsumerProcedure = "/krake.v1.KrakeBrokerService/RegisterConsumer"
 	// KrakeBrokerServiceAddSubscriptionsProcedure is the fully-qualified name of the
 	// KrakeBrokerService's AddSubscriptions RPC.
 	KrakeBrokerServiceAddSubscriptionsProcedure = "/krake.v1.KrakeBrokerService/AddSubscriptions"
+	// KrakeBrokerServiceJoinGroupProcedure is the fully-qualified name of the KrakeBrokerService's
+	// JoinGroup RPC.
+	KrakeBrokerServiceJoinGroupProcedure = "/krake.v1.KrakeBrokerService/JoinGroup"
+	// KrakeBrokerServiceHeartbeatProcedure is the fully-qualified name of the KrakeBrokerService's
+	// Heartbeat RPC.
+	KrakeBrokerServiceHeartbeatProcedure = "/krake.v1.KrakeBrokerService/Heartbeat"
+	// KrakeBrokerServiceLeaveGroupProcedure is the fully-qualified name of the KrakeBrokerService's
+	// LeaveGroup RPC.
+	KrakeBrokerServiceLeaveGroupProcedure = "/krake.v1.KrakeBrokerService/LeaveGroup"
+	// KrakeBrokerServiceCommitOffsetsProcedure is the fully-qualified name of the KrakeBrokerService's
+	// CommitOffsets RPC.
+	KrakeBrokerServiceCommitOffsetsProcedure = "/krake.v1.KrakeBrokerService/CommitOffsets"
+	// KrakeBrokerServiceFetchOffsetsProcedure is the fully-qualified name of the KrakeBrokerService's
+	// FetchOffsets RPC.
+	KrakeBrokerServiceFetchOffsetsProcedure = "/krake.v1.KrakeBrokerService/FetchOffsets"
 	// KrakeBrokerServiceReadMessageProcedure is the fully-qualified name of the KrakeBrokerService's
 	// ReadMessage RPC.
 	KrakeBrokerServiceReadMessageProcedure = "/krake.v1.KrakeBrokerService/ReadMessage"
+	// KrakeBrokerServiceOffsetsForTimesProcedure is the fully-qualified name of the
+	// KrakeBrokerService's OffsetsForTimes RPC.
+	KrakeBrokerServiceOffsetsForTimesProcedure = "/krake.v1.KrakeBrokerService/OffsetsForTimes"
 )
 
 // KrakeBrokerServiceClient is a client for the krake.v1.KrakeBrokerService service.
 type KrakeBrokerServiceClient interface {
 	Produce(context.Context, *connect_go.Request[v1.ProduceRequest]) (*connect_go.Response[v1.ProduceResponse], error)
+	// appends the records with a single write per partition.
+	ProduceBatch(context.Context, *connect_go.Request[v1.ProduceBatchRequest]) (*connect_go.Response[v1.ProduceBatchResponse], error)
+	// hands out a producer id for an idempotent producer, whose retries
+	// are then never written twice.
+	InitProducerId(context.Context, *connect_go.Request[v1.InitProducerIdRequest]) (*connect_go.Response[v1.InitProducerIdResponse], error)
+	// transactions write to several partitions atomically, their
+	// partitions must be added before producing to them.
+	BeginTransaction(context.Context, *connect_go.Request[v1.BeginTransactionRequest]) (*connect_go.Response[v1.BeginTransactionResponse], error)
+	AddPartitionsToTxn(context.Context, *connect_go.Request[v1.AddPartitionsToTxnRequest]) (*connect_go.Response[v1.AddPartitionsToTxnResponse], error)
+	CommitTransaction(context.Context, *connect_go.Request[v1.CommitTransactionRequest]) (*connect_go.Response[v1.CommitTransactionResponse], error)
+	AbortTransaction(context.Context, *connect_go.Request[v1.AbortTransactionRequest]) (*connect_go.Response[v1.AbortTransactionResponse], error)
 	RegisterConsumer(context.Context, *connect_go.Request[v1.RegisterConsumerRequest]) (*connect_go.Response[v1.RegisterConsumerResponse], error)
 	AddSubscriptions(context.Context, *connect_go.Request[v1.AddSubscriptionsRequest]) (*connect_go.Response[v1.AddSubscriptionsResponse], error)
+	// consumer groups share the partitions of their topics between
+	// their members, which send heartbeats to stay in the group.
+	JoinGroup(context.Context, *connect_go.Request[v1.JoinGroupRequest]) (*connect_go.Response[v1.JoinGroupResponse], error)
+	Heartbeat(context.Context, *connect_go.Request[v1.HeartbeatRequest]) (*connect_go.Response[v1.HeartbeatResponse], error)
+	LeaveGroup(context.Context, *connect_go.Request[v1.LeaveGroupRequest]) (*connect_go.Response[v1.LeaveGroupResponse], error)
+	CommitOffsets(context.Context, *connect_go.Request[v1.CommitOffsetsRequest]) (*connect_go.Response[v1.CommitOffsetsResponse], error)
+	FetchOffsets(context.Context, *connect_go.Request[v1.FetchOffsetsRequest]) (*connect_go.Response[v1.FetchOffsetsResponse], error)
 	ReadMessage(context.Context, *connect_go.Request[v1.ReadMessageRequest]) (*connect_go.Response[v1.ReadMessageResponse], error)
+	OffsetsForTimes(context.Context, *connect_go.Request[v1.OffsetsForTimesRequest]) (*connect_go.Response[v1.OffsetsForTimesResponse], error)
 }
 
 // NewKrakeBrokerServiceClient constructs a client for the krake.v1.KrakeBrokerService service. By
@@ -70,6 +125,36 @@ func NewKrakeBrokerServiceClient(httpClient connect_go.HTTPClient, baseURL strin
 			baseURL+KrakeBrokerServiceProduceProcedure,
 			opts...,
 		),
+		produceBatch: connect_go.NewClient[v1.ProduceBatchRequest, v1.ProduceBatchResponse](
+			httpClient,
+			baseURL+KrakeBrokerServiceProduceBatchProcedure,
+			opts...,
+		),
+		initProducerId: connect_go.NewClient[v1.InitProducerIdRequest, v1.InitProducerIdResponse](
+			httpClient,
+			baseURL+KrakeBrokerServiceInitProducerIdProcedure,
+			opts...,
+		),
+		beginTransaction: connect_go.NewClient[v1.BeginTransactionRequest, v1.BeginTransactionResponse](
+			httpClient,
+			baseURL+KrakeBrokerServiceBeginTransactionProcedure,
+			opts...,
+		),
+		addPartitionsToTxn: connect_go.NewClient[v1.AddPartitionsToTxnRequest, v1.AddPartitionsToTxnResponse](
+			httpClient,
+			baseURL+KrakeBrokerServiceAddPartitionsToTxnProcedure,
+			opts...,
+		),
+		commitTransaction: connect_go.NewClient[v1.CommitTransactionRequest, v1.CommitTransactionResponse](
+			httpClient,
+			baseURL+KrakeBrokerServiceCommitTransactionProcedure,
+			opts...,
+		),
+		abortTransaction: connect_go.NewClient[v1.AbortTransactionRequest, v1.AbortTransactionResponse](
+			httpClient,
+			baseURL+KrakeBrokerServiceAbortTransactionProcedure,
+			opts...,
+		),
 		registerConsumer: connect_go.NewClient[v1.RegisterConsumerRequest, v1.RegisterConsumerResponse](
 			httpClient,
 			baseURL+KrakeBrokerServiceRegisterConsumerProcedure,
@@ -80,20 +165,62 @@ func NewKrakeBrokerServiceClient(httpClient connect_go.HTTPClient, baseURL strin
 			baseURL+KrakeBrokerServiceAddSubscriptionsProcedure,
 			opts...,
 		),
+		joinGroup: connect_go.NewClient[v1.JoinGroupRequest, v1.JoinGroupResponse](
+			httpClient,
+			baseURL+KrakeBrokerServiceJoinGroupProcedure,
+			opts...,
+		),
+		heartbeat: connect_go.NewClient[v1.HeartbeatRequest, v1.HeartbeatResponse](
+			httpClient,
+			baseURL+KrakeBrokerServiceHeartbeatProcedure,
+			opts...,
+		),
+		leaveGroup: connect_go.NewClient[v1.LeaveGroupRequest, v1.LeaveGroupResponse](
+			httpClient,
+			baseURL+KrakeBrokerServiceLeaveGroupProcedure,
+			opts...,
+		),
+		commitOffsets: connect_go.NewClient[v1.CommitOffsetsRequest, v1.CommitOffsetsResponse](
+			httpClient,
+			baseURL+KrakeBrokerServiceCommitOffsetsProcedure,
+			opts...,
+		),
+		fetchOffsets: connect_go.NewClient[v1.FetchOffsetsRequest, v1.FetchOffsetsResponse](
+			httpClient,
+			baseURL+KrakeBrokerServiceFetchOffsetsProcedure,
+			opts...,
+		),
 		readMessage: connect_go.NewClient[v1.ReadMessageRequest, v1.ReadMessageResponse](
 			httpClient,
 			baseURL+KrakeBrokerServiceReadMessageProcedure,
 			opts...,
 		),
+		offsetsForTimes: connect_go.NewClient[v1.OffsetsForTimesRequest, v1.OffsetsForTimesResponse](
+			httpClient,
+			baseURL+KrakeBrokerServiceOffsetsForTimesProcedure,
+			opts...,
+		),
 	}
 }
 
 // krakeBrokerServiceClient implements KrakeBrokerServiceClient.
 type krakeBrokerServiceClient struct {
-	produce          *connect_go.Client[v1.ProduceRequest, v1.ProduceResponse]
-	registerConsumer *connect_go.Client[v1.RegisterConsumerRequest, v1.RegisterConsumerResponse]
-	addSubscriptions *connect_go.Client[v1.AddSubscriptionsRequest, v1.AddSubscriptionsResponse]
-	readMessage      *connect_go.Client[v1.ReadMessageRequest, v1.ReadMessageResponse]
+	produce            *connect_go.Client[v1.ProduceRequest, v1.ProduceResponse]
+	produceBatch       *connect_go.Client[v1.ProduceBatchRequest, v1.ProduceBatchResponse]
+	initProducerId     *connect_go.Client[v1.InitProducerIdRequest, v1.InitProducerIdResponse]
+	beginTransaction   *connect_go.Client[v1.BeginTransactionRequest, v1.BeginTransactionResponse]
+	addPartitionsToTxn *connect_go.Client[v1.AddPartitionsToTxnRequest, v1.AddPartitionsToTxnResponse]
+	commitTransaction  *connect_go.Client[v1.CommitTransactionRequest, v1.CommitTransactionResponse]
+	abortTransaction   *connect_go.Client[v1.AbortTransactionRequest, v1.AbortTransactionResponse]
+	registerConsumer   *connect_go.Client[v1.RegisterConsumerRequest, v1.RegisterConsumerResponse]
+	addSubscriptions   *connect_go.Client[v1.AddSubscriptionsRequest, v1.AddSubscriptionsResponse]
+	joinGroup          *connect_go.Client[v1.JoinGroupRequest, v1.JoinGroupResponse]
+	heartbeat          *connect_go.Client[v1.HeartbeatRequest, v1.HeartbeatResponse]
+	leaveGroup         *connect_go.Client[v1.LeaveGroupRequest, v1.LeaveGroupResponse]
+	commitOffsets      *connect_go.Client[v1.CommitOffsetsRequest, v1.CommitOffsetsResponse]
+	fetchOffsets       *connect_go.Client[v1.FetchOffsetsRequest, v1.FetchOffsetsResponse]
+	readMessage        *connect_go.Client[v1.ReadMessageRequest, v1.ReadMessageResponse]
+	offsetsForTimes    *connect_go.Client[v1.OffsetsForTimesRequest, v1.OffsetsForTimesResponse]
 }
 
 // Produce calls krake.v1.KrakeBrokerService.Produce.
@@ -101,6 +228,36 @@ func (c *krakeBrokerServiceClient) Produce(ctx context.Context, req *connect_go.
 	return c.produce.CallUnary(ctx, req)
 }
 
+// ProduceBatch calls krake.v1.KrakeBrokerService.ProduceBatch.
+func (c *krakeBrokerServiceClient) ProduceBatch(ctx context.Context, req *connect_go.Request[v1.ProduceBatchRequest]) (*connect_go.Response[v1.ProduceBatchResponse], error) {
+	return c.produceBatch.CallUnary(ctx, req)
+}
+
+// InitProducerId calls krake.v1.KrakeBrokerService.InitProducerId.
+func (c *krakeBrokerServiceClient) InitProducerId(ctx context.Context, req *connect_go.Request[v1.InitProducerIdRequest]) (*connect_go.Response[v1.InitProducerIdResponse], error) {
+	return c.initProducerId.CallUnary(ctx, req)
+}
+
+// BeginTransaction calls krake.v1.KrakeBrokerService.BeginTransaction.
+func (c *krakeBrokerServiceClient) BeginTransaction(ctx context.Context, req *connect_go.Request[v1.BeginTransactionRequest]) (*connect_go.Response[v1.BeginTransactionResponse], error) {
+	return c.beginTransaction.CallUnary(ctx, req)
+}
+
+// AddPartitionsToTxn calls krake.v1.KrakeBrokerService.AddPartitionsToTxn.
+func (c *krakeBrokerServiceClient) AddPartitionsToTxn(ctx context.Context, req *connect_go.Request[v1.AddPartitionsToTxnRequest]) (*connect_go.Response[v1.AddPartitionsToTxnResponse], error) {
+	return c.addPartitionsToTxn.CallUnary(ctx, req)
+}
+
+// CommitTransaction calls krake.v1.KrakeBrokerService.CommitTransaction.
+func (c *krakeBrokerServiceClient) CommitTransaction(ctx context.Context, req *connect_go.Request[v1.CommitTransactionRequest]) (*connect_go.Response[v1.CommitTransactionResponse], error) {
+	return c.commitTransaction.CallUnary(ctx, req)
+}
+
+// AbortTransaction calls krake.v1.KrakeBrokerService.AbortTransaction.
+func (c *krakeBrokerServiceClient) AbortTransaction(ctx context.Context, req *connect_go.Request[v1.AbortTransactionRequest]) (*connect_go.Response[v1.AbortTransactionResponse], error) {
+	return c.abortTransaction.CallUnary(ctx, req)
+}
+
 // RegisterConsumer calls krake.v1.KrakeBrokerService.RegisterConsumer.
 func (c *krakeBrokerServiceClient) RegisterConsumer(ctx context.Context, req *connect_go.Request[v1.RegisterConsumerRequest]) (*connect_go.Response[v1.RegisterConsumerResponse], error) {
 	return c.registerConsumer.CallUnary(ctx, req)
@@ -111,17 +268,66 @@ func (c *krakeBrokerServiceClient) AddSubscriptions(ctx context.Context, req *co
 	return c.addSubscriptions.CallUnary(ctx, req)
 }
 
+// JoinGroup calls krake.v1.KrakeBrokerService.JoinGroup.
+func (c *krakeBrokerServiceClient) JoinGroup(ctx context.Context, req *connect_go.Request[v1.JoinGroupRequest]) (*connect_go.Response[v1.JoinGroupResponse], error) {
+	return c.joinGroup.CallUnary(ctx, req)
+}
+
+// Heartbeat calls krake.v1.KrakeBrokerService.Heartbeat.
+func (c *krakeBrokerServiceClient) Heartbeat(ctx context.Context, req *connect_go.Request[v1.HeartbeatRequest]) (*connect_go.Response[v1.HeartbeatResponse], error) {
+	return c.heartbeat.CallUnary(ctx, req)
+}
+
+// LeaveGroup calls krake.v1.KrakeBrokerService.LeaveGroup.
+func (c *krakeBrokerServiceClient) LeaveGroup(ctx context.Context, req *connect_go.Request[v1.LeaveGroupRequest]) (*connect_go.Response[v1.LeaveGroupResponse], error) {
+	return c.leaveGroup.CallUnary(ctx, req)
+}
+
+// CommitOffsets calls krake.v1.KrakeBrokerService.CommitOffsets.
+func (c *krakeBrokerServiceClient) CommitOffsets(ctx context.Context, req *connect_go.Request[v1.CommitOffsetsRequest]) (*connect_go.Response[v1.CommitOffsetsResponse], error) {
+	return c.commitOffsets.CallUnary(ctx, req)
+}
+
+// FetchOffsets calls krake.v1.KrakeBrokerService.FetchOffsets.
+func (c *krakeBrokerServiceClient) FetchOffsets(ctx context.Context, req *connect_go.Request[v1.FetchOffsetsRequest]) (*connect_go.Response[v1.FetchOffsetsResponse], error) {
+	return c.fetchOffsets.CallUnary(ctx, req)
+}
+
 // ReadMessage calls krake.v1.KrakeBrokerService.ReadMessage.
 func (c *krakeBrokerServiceClient) ReadMessage(ctx context.Context, req *connect_go.Request[v1.ReadMessageRequest]) (*connect_go.Response[v1.ReadMessageResponse], error) {
 	return c.readMessage.CallUnary(ctx, req)
 }
 
+// OffsetsForTimes calls krake.v1.KrakeBrokerService.OffsetsForTimes.
+func (c *krakeBrokerServiceClient) OffsetsForTimes(ctx context.Context, req *connect_go.Request[v1.OffsetsForTimesRequest]) (*connect_go.Response[v1.OffsetsForTimesResponse], error) {
+	return c.offsetsForTimes.CallUnary(ctx, req)
+}
+
 // KrakeBrokerServiceHandler is an implementation of the krake.v1.KrakeBrokerService service.
 type KrakeBrokerServiceHandler interface {
 	Produce(context.Context, *connect_go.Request[v1.ProduceRequest]) (*connect_go.Response[v1.ProduceResponse], error)
+	// appends the records with a single write per partition.
+	ProduceBatch(context.Context, *connect_go.Request[v1.ProduceBatchRequest]) (*connect_go.Response[v1.ProduceBatchResponse], error)
+	// hands out a producer id for an idempotent producer, whose retries
+	// are then never written twice.
+	InitProducerId(context.Context, *connect_go.Request[v1.InitProducerIdRequest]) (*connect_go.Response[v1.InitProducerIdResponse], error)
+	// transactions write to several partitions atomically, their
+	// partitions must be added before producing to them.
+	BeginTransaction(context.Context, *connect_go.Request[v1.BeginTransactionRequest]) (*connect_go.Response[v1.BeginTransactionResponse], error)
+	AddPartitionsToTxn(context.Context, *connect_go.Request[v1.AddPartitionsToTxnRequest]) (*connect_go.Response[v1.AddPartitionsToTxnResponse], error)
+	CommitTransaction(context.Context, *connect_go.Request[v1.CommitTransactionRequest]) (*connect_go.Response[v1.CommitTransactionResponse], error)
+	AbortTransaction(context.Context, *connect_go.Request[v1.AbortTransactionRequest]) (*connect_go.Response[v1.AbortTransactionResponse], error)
 	RegisterConsumer(context.Context, *connect_go.Request[v1.RegisterConsumerRequest]) (*connect_go.Response[v1.RegisterConsumerResponse], error)
 	AddSubscriptions(context.Context, *connect_go.Request[v1.AddSubscriptionsRequest]) (*connect_go.Response[v1.AddSubscriptionsResponse], error)
+	// consumer groups share the partitions of their topics between
+	// their members, which send heartbeats to stay in the group.
+	JoinGroup(context.Context, *connect_go.Request[v1.JoinGroupRequest]) (*connect_go.Response[v1.JoinGroupResponse], error)
+	Heartbeat(context.Context, *connect_go.Request[v1.HeartbeatRequest]) (*connect_go.Response[v1.HeartbeatResponse], error)
+	LeaveGroup(context.Context, *connect_go.Request[v1.LeaveGroupRequest]) (*connect_go.Response[v1.LeaveGroupResponse], error)
+	CommitOffsets(context.Context, *connect_go.Request[v1.CommitOffsetsRequest]) (*connect_go.Response[v1.CommitOffsetsResponse], error)
+	FetchOffsets(context.Context, *connect_go.Request[v1.FetchOffsetsRequest]) (*connect_go.Response[v1.FetchOffsetsResponse], error)
 	ReadMessage(context.Context, *connect_go.Request[v1.ReadMessageRequest]) (*connect_go.Response[v1.ReadMessageResponse], error)
+	OffsetsForTimes(context.Context, *connect_go.Request[v1.OffsetsForTimesRequest]) (*connect_go.Response[v1.OffsetsForTimesResponse], error)
 }
 
 // NewKrakeBrokerServiceHandler builds an HTTP handler from the service implementation. It returns
@@ -136,6 +342,36 @@ func NewKrakeBrokerServiceHandler(svc KrakeBrokerServiceHandler, opts ...connect
 		svc.Produce,
 		opts...,
 	))
+	mux.Handle(KrakeBrokerServiceProduceBatchProcedure, connect_go.NewUnaryHandler(
+		KrakeBrokerServiceProduceBatchProcedure,
+		svc.ProduceBatch,
+		opts...,
+	))
+	mux.Handle(KrakeBrokerServiceInitProducerIdProcedure, connect_go.NewUnaryHandler(
+		KrakeBrokerServiceInitProducerIdProcedure,
+		svc.InitProducerId,
+		opts...,
+	))
+	mux.Handle(KrakeBrokerServiceBeginTransactionProcedure, connect_go.NewUnaryHandler(
+		KrakeBrokerServiceBeginTransactionProcedure,
+		svc.BeginTransaction,
+		opts...,
+	))
+	mux.Handle(KrakeBrokerServiceAddPartitionsToTxnProcedure, connect_go.NewUnaryHandler(
+		KrakeBrokerServiceAddPartitionsToTxnProcedure,
+		svc.AddPartitionsToTxn,
+		opts...,
+	))
+	mux.Handle(KrakeBrokerServiceCommitTransactionProcedure, connect_go.NewUnaryHandler(
+		KrakeBrokerServiceCommitTransactionProcedure,
+		svc.CommitTransaction,
+		opts...,
+	))
+	mux.Handle(KrakeBrokerServiceAbortTransactionProcedure, connect_go.NewUnaryHandler(
+		KrakeBrokerServiceAbortTransactionProcedure,
+		svc.AbortTransaction,
+		opts...,
+	))
 	mux.Handle(KrakeBrokerServiceRegisterConsumerProcedure, connect_go.NewUnaryHandler(
 		KrakeBrokerServiceRegisterConsumerProcedure,
 		svc.RegisterConsumer,
@@ -146,11 +382,41 @@ func NewKrakeBrokerServiceHandler(svc KrakeBrokerServiceHandler, opts ...connect
 		svc.AddSubscriptions,
 		opts...,
 	))
+	mux.Handle(KrakeBrokerServiceJoinGroupProcedure, connect_go.NewUnaryHandler(
+		KrakeBrokerServiceJoinGroupProcedure,
+		svc.JoinGroup,
+		opts...,
+	))
+	mux.Handle(KrakeBrokerServiceHeartbeatProcedure, connect_go.NewUnaryHandler(
+		KrakeBrokerServiceHeartbeatProcedure,
+		svc.Heartbeat,
+		opts...,
+	))
+	mux.Handle(KrakeBrokerServiceLeaveGroupProcedure, connect_go.NewUnaryHandler(
+		KrakeBrokerServiceLeaveGroupProcedure,
+		svc.LeaveGroup,
+		opts...,
+	))
+	mux.Handle(KrakeBrokerServiceCommitOffsetsProcedure, connect_go.NewUnaryHandler(
+		KrakeBrokerServiceCommitOffsetsProcedure,
+		svc.CommitOffsets,
+		opts...,
+	))
+	mux.Handle(KrakeBrokerServiceFetchOffsetsProcedure, connect_go.NewUnaryHandler(
+		KrakeBrokerServiceFetchOffsetsProcedure,
+		svc.FetchOffsets,
+		opts...,
+	))
 	mux.Handle(KrakeBrokerServiceReadMessageProcedure, connect_go.NewUnaryHandler(
 		KrakeBrokerServiceReadMessageProcedure,
 		svc.ReadMessage,
 		opts...,
 	))
+	mux.Handle(KrakeBrokerServiceOffsetsForTimesProcedure, connect_go.NewUnaryHandler(
+		KrakeBrokerServiceOffsetsForTimesProcedure,
+		svc.OffsetsForTimes,
+		opts...,
+	))
 	return "/krake.v1.KrakeBrokerService/", mux
 }
 
@@ -161,6 +427,30 @@ func (UnimplementedKrakeBrokerServiceHandler) Produce(context.Context, *connect_
 	return nil, connect_go.NewError(connect_go.CodeUnimplemented, errors.New("krake.v1.KrakeBrokerService.Produce is not implemented"))
 }
 
+func (UnimplementedKrakeBrokerServiceHandler) ProduceBatch(context.Context, *connect_go.Request[v1.ProduceBatchRequest]) (*connect_go.Response[v1.ProduceBatchResponse], error) {
+	return nil, connect_go.NewError(connect_go.CodeUnimplemented, errors.New("krake.v1.KrakeBrokerService.ProduceBatch is not implemented"))
+}
+
+func (UnimplementedKrakeBrokerServiceHandler) InitProducerId(context.Context, *connect_go.Request[v1.InitProducerIdRequest]) (*connect_go.Response[v1.InitProducerIdResponse], error) {
+	return nil, connect_go.NewError(connect_go.CodeUnimplemented, errors.New("krake.v1.KrakeBrokerService.InitProducerId is not implemented"))
+}
+
+func (UnimplementedKrakeBrokerServiceHandler) BeginTransaction(context.Context, *connect_go.Request[v1.BeginTransactionRequest]) (*connect_go.Response[v1.BeginTransactionResponse], error) {
+	return nil, connect_go.NewError(connect_go.CodeUnimplemented, errors.New("krake.v1.KrakeBrokerService.BeginTransaction is not implemented"))
+}
+
+func (UnimplementedKrakeBrokerServiceHandler) AddPartitionsToTxn(context.Context, *connect_go.Request[v1.AddPartitionsToTxnRequest]) (*connect_go.Response[v1.AddPartitionsToTxnResponse], error) {
+	return nil, connect_go.NewError(connect_go.CodeUnimplemented, errors.New("krake.v1.KrakeBrokerService.AddPartitionsToTxn is not implemented"))
+}
+
+func (UnimplementedKrakeBrokerServiceHandler) CommitTransaction(context.Context, *connect_go.Request[v1.CommitTransactionRequest]) (*connect_go.Response[v1.CommitTransactionResponse], error) {
+	return nil, connect_go.NewError(connect_go.CodeUnimplemented, errors.New("krake.v1.KrakeBrokerService.CommitTransaction is not implemented"))
+}
+
+func (UnimplementedKrakeBrokerServiceHandler) AbortTransaction(context.Context, *connect_go.Request[v1.AbortTransactionRequest]) (*connect_go.Response[v1.AbortTransactionResponse], error) {
+	return nil, connect_go.NewError(connect_go.CodeUnimplemented, errors.New("krake.v1.KrakeBrokerService.AbortTransaction is not implemented"))
+}
+
 func (UnimplementedKrakeBrokerServiceHandler) RegisterConsumer(context.Context, *connect_go.Request[v1.RegisterConsumerRequest]) (*connect_go.Response[v1.RegisterConsumerResponse], error) {
 	return nil, connect_go.NewError(connect_go.CodeUnimplemented, errors.New("krake.v1.KrakeBrokerService.RegisterConsumer is not implemented"))
 }
@@ -169,6 +459,30 @@ func (UnimplementedKrakeBrokerServiceHandler) AddSubscriptions(context.Context,
 	return nil, connect_go.NewError(connect_go.CodeUnimplemented, errors.New("krake.v1.KrakeBrokerService.AddSubscriptions is not implemented"))
 }
 
+func (UnimplementedKrakeBrokerServiceHandler) JoinGroup(context.Context, *connect_go.Request[v1.JoinGroupRequest]) (*connect_go.Response[v1.JoinGroupResponse], error) {
+	return nil, connect_go.NewError(connect_go.CodeUnimplemented, errors.New("krake.v1.KrakeBrokerService.JoinGroup is not implemented"))
+}
+
+func (UnimplementedKrakeBrokerServiceHandler) Heartbeat(context.Context, *connect_go.Request[v1.HeartbeatRequest]) (*connect_go.Response[v1.HeartbeatResponse], error) {
+	return nil, connect_go.NewError(connect_go.CodeUnimplemented, errors.New("krake.v1.KrakeBrokerService.Heartbeat is not implemented"))
+}
+
+func (UnimplementedKrakeBrokerServiceHandler) LeaveGroup(context.Context, *connect_go.Request[v1.LeaveGroupRequest]) (*connect_go.Response[v1.LeaveGroupResponse], error) {
+	return nil, connect_go.NewError(connect_go.CodeUnimplemented, errors.New("krake.v1.KrakeBrokerService.LeaveGroup is not implemented"))
+}
+
+func (UnimplementedKrakeBrokerServiceHandler) CommitOffsets(context.Context, *connect_go.Request[v1.CommitOffsetsRequest]) (*connect_go.Response[v1.CommitOffsetsResponse], error) {
+	return nil, connect_go.NewError(connect_go.CodeUnimplemented, errors.New("krake.v1.KrakeBrokerService.CommitOffsets is not implemented"))
+}
+
+func (UnimplementedKrakeBrokerServiceHandler) FetchOffsets(context.Context, *connect_go.Request[v1.FetchOffsetsRequest]) (*connect_go.Response[v1.FetchOffsetsResponse], error) {
+	return nil, connect_go.NewError(connect_go.CodeUnimplemented, errors.New("krake.v1.KrakeBrokerService.FetchOffsets is not implemented"))
+}
+
 func (UnimplementedKrakeBrokerServiceHandler) ReadMessage(context.Context, *connect_go.Request[v1.ReadMessageRequest]) (*connect_go.Response[v1.ReadMessageResponse], error) {
 	return nil, connect_go.NewError(connect_go.CodeUnimplemented, errors.New("krake.v1.KrakeBrokerService.ReadMessage is not implemented"))
 }
+
+func (UnimplementedKrakeBrokerServiceHandler) OffsetsForTimes(context.Context, *connect_go.Request[v1.OffsetsForTimesRequest]) (*connect_go.Response[v1.OffsetsForTimesResponse], error) {
+	return nil, connect_go.NewError(connect_go.CodeUnimplemented, errors.New("krake.v1.KrakeBrokerService.OffsetsForTimes is not implemented"))
+}
@@ -5,7 +5,10 @@ go 1.19
 require (
 	github.com/bufbuild/connect-go v1.7.0
 	github.com/confluentinc/confluent-kafka-go v1.9.2
+	github.com/golang/snappy v0.0.4
 	github.com/google/uuid v1.3.0
+	github.com/klauspost/compress v1.16.7
+	github.com/pierrec/lz4/v4 v4.1.18
 	github.com/stretchr/testify v1.8.2
 	golang.org/x/net v0.10.0
 	google.golang.org/protobuf v1.28.1
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 
@@ -13,9 +14,21 @@ import (
 const address = "localhost:8080"
 
 func main() {
+	srv := pkg.NewKrakeServiceServer()
+	if err := srv.LoadLogs(); err != nil {
+		panic(err)
+	}
+	srv.StartRetention(context.Background())
+	srv.StartCleaner(context.Background())
+	srv.StartFlusher(context.Background())
+	srv.StartTiering(context.Background())
+	srv.StartTransactionExpiry(context.Background())
+	srv.StartGroupExpiry(context.Background())
+
 	mux := http.NewServeMux()
-	path, handler := krakev1connect.NewKrakeBrokerServiceHandler(pkg.NewKrakeServiceServer())
+	path, handler := krakev1connect.NewKrakeBrokerServiceHandler(srv)
 	mux.Handle(path, handler)
+	mux.Handle(pkg.FetchPath, pkg.NewFetchHandler(srv.KrakeBroker))
 	fmt.Println("... Listening on", address)
 
 	err := http.ListenAndServe(
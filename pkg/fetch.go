@@ -0,0 +1,81 @@
+package pkg
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/krake-labs/krake/api"
+)
+
+const (
+	FetchPath = "/fetch"
+
+	// the default max_bytes, max.partition.fetch.bytes in Kafka.
+	defaultFetchMaxBytes = 1024 * 1024
+)
+
+// FetchHandler serves the record batches of a partition straight from
+// its segment files:
+//
+//	GET /fetch?topic=my-topic&partition=0&offset=42&max_bytes=1048576
+//
+// The body is the batches from the one containing offset in the v2
+// batch format. Over HTTP/1 it is sent with sendfile, the records are
+// never copied into the broker.
+type FetchHandler struct {
+	broker *api.KrakeBroker
+}
+
+func NewFetchHandler(broker *api.KrakeBroker) *FetchHandler {
+	return &FetchHandler{broker: broker}
+}
+
+func (h *FetchHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := req.URL.Query()
+	topic := query.Get("topic")
+	partition, err := strconv.ParseInt(query.Get("partition"), 10, 32)
+	if err != nil {
+		http.Error(w, "invalid partition", http.StatusBadRequest)
+		return
+	}
+	offset, err := strconv.ParseInt(query.Get("offset"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid offset", http.StatusBadRequest)
+		return
+	}
+	maxBytes := int64(defaultFetchMaxBytes)
+	if v := query.Get("max_bytes"); v != "" {
+		maxBytes, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || maxBytes <= 0 {
+			http.Error(w, "invalid max_bytes", http.StatusBadRequest)
+			return
+		}
+	}
+
+	r, err := h.broker.FetchFile(topic, int32(partition), offset, maxBytes)
+	switch {
+	case errors.Is(err, api.ErrNoSuchTopic), errors.Is(err, api.ErrUnknownPartition):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, api.ErrOffsetOutOfRange):
+		http.Error(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer r.Close()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(r.Size(), 10))
+	if _, err = r.WriteTo(w); err != nil {
+		log.Println("failed to send fetch response", err)
+	}
+}
@@ -0,0 +1,142 @@
+package pkg
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/krake-labs/krake/api"
+	"github.com/krake-labs/krake/api/record"
+	"github.com/stretchr/testify/assert"
+)
+
+func newFetchServer(t testing.TB, messages int, size int) (*api.KrakeBroker, *httptest.Server) {
+	pw := api.NewPartitionWriter()
+	b := api.NewKrakeBroker(pw)
+	b.Configure(map[string]interface{}{
+		"log.dirs":          t.TempDir(),
+		"log.segment.bytes": 64 * 1024 * 1024,
+	})
+	assert.NoError(t, b.CreateTopic(api.TopicConfiguration{Name: "my-topic", PartitionCount: 1}))
+	for i := 0; i < messages; i++ {
+		payload := make([]byte, size)
+		copy(payload, fmt.Sprintf("message-%d", i))
+		_, err := b.Produce("my-topic", &api.Message{Message: payload})
+		assert.NoError(t, err)
+	}
+
+	srv := httptest.NewServer(NewFetchHandler(b))
+	t.Cleanup(func() {
+		srv.Close()
+		b.Close()
+	})
+	return b, srv
+}
+
+func TestFetchHandler(t *testing.T) {
+	_, srv := newFetchServer(t, 10, 16)
+
+	resp, err := http.Get(srv.URL + "/fetch?topic=my-topic&partition=0&offset=4")
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/octet-stream", resp.Header.Get("Content-Type"))
+
+	var offsets []int64
+	for {
+		batch, err := record.ReadBatch(resp.Body)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		assert.NoError(t, err)
+		for _, r := range batch.Records {
+			offset := batch.BaseOffset + int64(r.OffsetDelta)
+			offsets = append(offsets, offset)
+			assert.True(t, bytes.HasPrefix(r.Value, []byte(fmt.Sprintf("message-%d", offset))))
+		}
+	}
+	assert.Equal(t, []int64{4, 5, 6, 7, 8, 9}, offsets)
+}
+
+func TestFetchHandler_Errors(t *testing.T) {
+	_, srv := newFetchServer(t, 1, 16)
+
+	for query, status := range map[string]int{
+		"topic=other-topic&partition=0&offset=0":          http.StatusNotFound,
+		"topic=my-topic&partition=1&offset=0":             http.StatusNotFound,
+		"topic=my-topic&partition=0&offset=1":             http.StatusRequestedRangeNotSatisfiable,
+		"topic=my-topic&partition=0":                      http.StatusBadRequest,
+		"topic=my-topic&offset=0":                         http.StatusBadRequest,
+		"topic=my-topic&partition=0&offset=0&max_bytes=0": http.StatusBadRequest,
+	} {
+		resp, err := http.Get(srv.URL + "/fetch?" + query)
+		assert.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, status, resp.StatusCode, query)
+	}
+}
+
+// readAtHandler serves a fetch the way the broker reads batches for
+// ReadMessage, each batch is read into a buffer and decoded before
+// being written out.
+type readAtHandler struct {
+	broker *api.KrakeBroker
+}
+
+func (h readAtHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	key := api.TopicPartitionKey{Topic: "my-topic"}
+	var buf bytes.Buffer
+	for offset := int64(0); ; {
+		batch, err := h.broker.Fetch(key, offset)
+		if errors.Is(err, api.ErrOffsetOutOfRange) {
+			break
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		buf.Write(batch.Encode())
+		offset = batch.NextOffset()
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(buf.Bytes())
+}
+
+func BenchmarkFetch(b *testing.B) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	broker, srv := newFetchServer(b, 10_000, 1000)
+	readAt := httptest.NewServer(readAtHandler{broker})
+	defer readAt.Close()
+
+	modes := []struct {
+		name string
+		url  string
+	}{
+		{"sendfile", srv.URL + "/fetch?topic=my-topic&partition=0&offset=0&max_bytes=67108864"},
+		{"read-at", readAt.URL},
+	}
+	for _, mode := range modes {
+		b.Run(mode.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				resp, err := http.Get(mode.url)
+				if err != nil {
+					b.Fatal(err)
+				}
+				n, err := io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+				if err != nil {
+					b.Fatal(err)
+				}
+				b.SetBytes(n)
+			}
+		})
+	}
+}
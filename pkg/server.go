@@ -2,23 +2,175 @@ package pkg
 
 import (
 	"context"
+	"errors"
+	"sort"
+	"time"
 
 	connect_go "github.com/bufbuild/connect-go"
 	"github.com/krake-labs/krake/api"
+	"github.com/krake-labs/krake/api/record"
 	v1 "github.com/krake-labs/krake/gen/krake/v1"
 )
 
 type KrakeServiceServer struct {
-	api.KrakeBroker
+	*api.KrakeBroker
 }
 
 func NewKrakeServiceServer() *KrakeServiceServer {
-	return &KrakeServiceServer{}
+	return &KrakeServiceServer{
+		KrakeBroker: api.NewKrakeBroker(api.NewPartitionWriter()),
+	}
+}
+
+// toError converts a broker error into the Error returned in responses.
+func toError(err error) *v1.Error {
+	if err == nil {
+		return nil
+	}
+
+	code := connect_go.CodeInternal
+	switch {
+	case errors.Is(err, api.ErrNoSuchTopic):
+		code = connect_go.CodeNotFound
+	case errors.Is(err, api.ErrOffsetOutOfRange):
+		code = connect_go.CodeOutOfRange
+	case errors.Is(err, record.ErrUnsupportedCompression):
+		code = connect_go.CodeInvalidArgument
+	case errors.Is(err, api.ErrUnknownConsumer), errors.Is(err, api.ErrUnknownPartition):
+		code = connect_go.CodeNotFound
+	case errors.Is(err, api.ErrInvalidAcks):
+		code = connect_go.CodeInvalidArgument
+	case errors.Is(err, api.ErrRequestTimeout):
+		code = connect_go.CodeDeadlineExceeded
+	case errors.Is(err, api.ErrUnknownProducerID):
+		code = connect_go.CodeNotFound
+	case errors.Is(err, api.ErrOutOfOrderSequence), errors.Is(err, api.ErrInvalidProducerEpoch):
+		code = connect_go.CodeFailedPrecondition
+	case errors.Is(err, api.ErrInvalidTxnState):
+		code = connect_go.CodeFailedPrecondition
+	case errors.Is(err, api.ErrUnknownTransactionalID):
+		code = connect_go.CodeNotFound
+	case errors.Is(err, api.ErrInvalidIsolationLevel), errors.Is(err, api.ErrInvalidGroupID):
+		code = connect_go.CodeInvalidArgument
+	case errors.Is(err, api.ErrUnknownMemberID):
+		code = connect_go.CodeNotFound
+	case errors.Is(err, api.ErrIllegalGeneration):
+		code = connect_go.CodeFailedPrecondition
+	}
+	return &v1.Error{
+		Message: err.Error(),
+		Code:    int32(code),
+	}
+}
+
+// produceOptions converts the acks, timeout, producer, transaction and
+// compression of a produce request.
+func produceOptions(acks string, timeoutMs int32, producerID int64, producerEpoch int32, transactionalID string, compression string) (api.ProduceOptions, error) {
+	a, err := api.ParseAcks(acks)
+	if err != nil {
+		return api.ProduceOptions{}, err
+	}
+	c, err := record.ParseCompression(compression)
+	if err != nil {
+		return api.ProduceOptions{}, err
+	}
+	return api.ProduceOptions{
+		Acks:    a,
+		Timeout: time.Duration(timeoutMs) * time.Millisecond,
+		Producer: api.ProducerIdentity{
+			ID:    producerID,
+			Epoch: int16(producerEpoch),
+		},
+		TransactionalID: transactionalID,
+		Compression:     c,
+	}, nil
 }
 
 func (k KrakeServiceServer) Produce(ctx context.Context, c *connect_go.Request[v1.ProduceRequest]) (*connect_go.Response[v1.ProduceResponse], error) {
-	k.KrakeBroker.Produce("", nil)
-	panic("implement me")
+	opts, err := produceOptions(c.Msg.Acks, c.Msg.TimeoutMs, c.Msg.ProducerId, c.Msg.ProducerEpoch, c.Msg.TransactionalId, c.Msg.Compression)
+	if err != nil {
+		return connect_go.NewResponse(&v1.ProduceResponse{Error: toError(err)}), nil
+	}
+	msg := fromProtoMessage(c.Msg.GetMessage())
+	msg.TargetPartition = c.Msg.Partition
+	msg.Sequence = c.Msg.Sequence
+
+	results, err := k.KrakeBroker.ProduceBatch(c.Msg.Topic, []*api.Message{msg}, opts)
+	if err != nil {
+		return connect_go.NewResponse(&v1.ProduceResponse{Error: toError(err)}), nil
+	}
+	return connect_go.NewResponse(&v1.ProduceResponse{
+		Error:     toError(results[0].Err),
+		Partition: results[0].Partition,
+		Offset:    results[0].Offset,
+	}), nil
+}
+
+func (k KrakeServiceServer) ProduceBatch(ctx context.Context, c *connect_go.Request[v1.ProduceBatchRequest]) (*connect_go.Response[v1.ProduceBatchResponse], error) {
+	opts, err := produceOptions(c.Msg.Acks, c.Msg.TimeoutMs, c.Msg.ProducerId, c.Msg.ProducerEpoch, c.Msg.TransactionalId, c.Msg.Compression)
+	if err != nil {
+		return connect_go.NewResponse(&v1.ProduceBatchResponse{Error: toError(err)}), nil
+	}
+	msgs := make([]*api.Message, len(c.Msg.Records))
+	for i, r := range c.Msg.Records {
+		msgs[i] = fromProtoMessage(r.GetMessage())
+		msgs[i].TargetPartition = r.Partition
+		msgs[i].Sequence = r.Sequence
+	}
+
+	results, err := k.KrakeBroker.ProduceBatch(c.Msg.Topic, msgs, opts)
+	if err != nil {
+		return connect_go.NewResponse(&v1.ProduceBatchResponse{Error: toError(err)}), nil
+	}
+	resp := &v1.ProduceBatchResponse{}
+	for _, r := range results {
+		resp.Results = append(resp.Results, &v1.ProduceResponse{
+			Error:     toError(r.Err),
+			Partition: r.Partition,
+			Offset:    r.Offset,
+		})
+	}
+	return connect_go.NewResponse(resp), nil
+}
+
+func (k KrakeServiceServer) InitProducerId(ctx context.Context, c *connect_go.Request[v1.InitProducerIdRequest]) (*connect_go.Response[v1.InitProducerIdResponse], error) {
+	producer, err := k.KrakeBroker.InitProducerID()
+	return connect_go.NewResponse(&v1.InitProducerIdResponse{
+		Error:         toError(err),
+		ProducerId:    producer.ID,
+		ProducerEpoch: int32(producer.Epoch),
+	}), nil
+}
+
+func (k KrakeServiceServer) BeginTransaction(ctx context.Context, c *connect_go.Request[v1.BeginTransactionRequest]) (*connect_go.Response[v1.BeginTransactionResponse], error) {
+	producer, err := k.KrakeBroker.BeginTransaction(c.Msg.TransactionalId)
+	return connect_go.NewResponse(&v1.BeginTransactionResponse{
+		Error:         toError(err),
+		ProducerId:    producer.ID,
+		ProducerEpoch: int32(producer.Epoch),
+	}), nil
+}
+
+func (k KrakeServiceServer) AddPartitionsToTxn(ctx context.Context, c *connect_go.Request[v1.AddPartitionsToTxnRequest]) (*connect_go.Response[v1.AddPartitionsToTxnResponse], error) {
+	partitions := make([]api.TopicPartitionKey, len(c.Msg.Partitions))
+	for i, p := range c.Msg.Partitions {
+		partitions[i] = api.TopicPartitionKey{Topic: p.Topic, PartitionIndex: p.Partition}
+	}
+	producer := api.ProducerIdentity{ID: c.Msg.ProducerId, Epoch: int16(c.Msg.ProducerEpoch)}
+	err := k.KrakeBroker.AddPartitionsToTxn(c.Msg.TransactionalId, producer, partitions)
+	return connect_go.NewResponse(&v1.AddPartitionsToTxnResponse{Error: toError(err)}), nil
+}
+
+func (k KrakeServiceServer) CommitTransaction(ctx context.Context, c *connect_go.Request[v1.CommitTransactionRequest]) (*connect_go.Response[v1.CommitTransactionResponse], error) {
+	producer := api.ProducerIdentity{ID: c.Msg.ProducerId, Epoch: int16(c.Msg.ProducerEpoch)}
+	err := k.KrakeBroker.CommitTransaction(c.Msg.TransactionalId, producer)
+	return connect_go.NewResponse(&v1.CommitTransactionResponse{Error: toError(err)}), nil
+}
+
+func (k KrakeServiceServer) AbortTransaction(ctx context.Context, c *connect_go.Request[v1.AbortTransactionRequest]) (*connect_go.Response[v1.AbortTransactionResponse], error) {
+	producer := api.ProducerIdentity{ID: c.Msg.ProducerId, Epoch: int16(c.Msg.ProducerEpoch)}
+	err := k.KrakeBroker.AbortTransaction(c.Msg.TransactionalId, producer)
+	return connect_go.NewResponse(&v1.AbortTransactionResponse{Error: toError(err)}), nil
 }
 
 func (k KrakeServiceServer) RegisterConsumer(ctx context.Context, c *connect_go.Request[v1.RegisterConsumerRequest]) (*connect_go.Response[v1.RegisterConsumerResponse], error) {
@@ -27,11 +179,134 @@ func (k KrakeServiceServer) RegisterConsumer(ctx context.Context, c *connect_go.
 }
 
 func (k KrakeServiceServer) AddSubscriptions(ctx context.Context, c *connect_go.Request[v1.AddSubscriptionsRequest]) (*connect_go.Response[v1.AddSubscriptionsResponse], error) {
-	//TODO implement me
-	panic("implement me")
+	if len(c.Msg.Topics) == 0 {
+		return connect_go.NewResponse(&v1.AddSubscriptionsResponse{
+			Error: &v1.Error{
+				Message: "no topics to subscribe to",
+				Code:    int32(connect_go.CodeInvalidArgument),
+			},
+		}), nil
+	}
+	level, err := api.ParseIsolationLevel(c.Msg.IsolationLevel)
+	if err != nil {
+		return connect_go.NewResponse(&v1.AddSubscriptionsResponse{Error: toError(err)}), nil
+	}
+	consumerID := k.KrakeBroker.Subscribe(c.Msg.Topics)
+	if err = k.KrakeBroker.SetIsolationLevel(consumerID, level); err != nil {
+		return connect_go.NewResponse(&v1.AddSubscriptionsResponse{Error: toError(err)}), nil
+	}
+	return connect_go.NewResponse(&v1.AddSubscriptionsResponse{
+		ConsumerId: consumerID,
+	}), nil
+}
+
+func (k KrakeServiceServer) JoinGroup(ctx context.Context, c *connect_go.Request[v1.JoinGroupRequest]) (*connect_go.Response[v1.JoinGroupResponse], error) {
+	level, err := api.ParseIsolationLevel(c.Msg.IsolationLevel)
+	if err != nil {
+		return connect_go.NewResponse(&v1.JoinGroupResponse{Error: toError(err)}), nil
+	}
+	membership, err := k.KrakeBroker.JoinGroup(c.Msg.GroupId, c.Msg.MemberId, c.Msg.Topics)
+	if err == nil {
+		err = k.KrakeBroker.SetIsolationLevel(membership.MemberID, level)
+	}
+	if err != nil {
+		return connect_go.NewResponse(&v1.JoinGroupResponse{Error: toError(err)}), nil
+	}
+
+	resp := &v1.JoinGroupResponse{
+		MemberId:   membership.MemberID,
+		Generation: membership.Generation,
+	}
+	for _, key := range membership.Assignment {
+		resp.Assignment = append(resp.Assignment, &v1.TopicPartition{Topic: key.Topic, Partition: key.PartitionIndex})
+	}
+	return connect_go.NewResponse(resp), nil
+}
+
+func (k KrakeServiceServer) Heartbeat(ctx context.Context, c *connect_go.Request[v1.HeartbeatRequest]) (*connect_go.Response[v1.HeartbeatResponse], error) {
+	err := k.KrakeBroker.Heartbeat(c.Msg.GroupId, c.Msg.MemberId, c.Msg.Generation)
+	return connect_go.NewResponse(&v1.HeartbeatResponse{Error: toError(err)}), nil
+}
+
+func (k KrakeServiceServer) LeaveGroup(ctx context.Context, c *connect_go.Request[v1.LeaveGroupRequest]) (*connect_go.Response[v1.LeaveGroupResponse], error) {
+	err := k.KrakeBroker.LeaveGroup(c.Msg.GroupId, c.Msg.MemberId)
+	return connect_go.NewResponse(&v1.LeaveGroupResponse{Error: toError(err)}), nil
+}
+
+func (k KrakeServiceServer) CommitOffsets(ctx context.Context, c *connect_go.Request[v1.CommitOffsetsRequest]) (*connect_go.Response[v1.CommitOffsetsResponse], error) {
+	offsets := map[api.TopicPartitionKey]int64{}
+	for _, o := range c.Msg.Offsets {
+		offsets[api.TopicPartitionKey{Topic: o.Topic, PartitionIndex: o.Partition}] = o.Offset
+	}
+	err := k.KrakeBroker.CommitOffsets(c.Msg.GroupId, c.Msg.MemberId, c.Msg.Generation, offsets)
+	return connect_go.NewResponse(&v1.CommitOffsetsResponse{Error: toError(err)}), nil
+}
+
+func (k KrakeServiceServer) FetchOffsets(ctx context.Context, c *connect_go.Request[v1.FetchOffsetsRequest]) (*connect_go.Response[v1.FetchOffsetsResponse], error) {
+	offsets, err := k.KrakeBroker.FetchOffsets(c.Msg.GroupId)
+	if err != nil {
+		return connect_go.NewResponse(&v1.FetchOffsetsResponse{Error: toError(err)}), nil
+	}
+
+	resp := &v1.FetchOffsetsResponse{}
+	for key, offset := range offsets {
+		resp.Offsets = append(resp.Offsets, &v1.PartitionOffset{Topic: key.Topic, Partition: key.PartitionIndex, Offset: offset})
+	}
+	sort.Slice(resp.Offsets, func(i, j int) bool {
+		a, b := resp.Offsets[i], resp.Offsets[j]
+		if a.Topic != b.Topic {
+			return a.Topic < b.Topic
+		}
+		return a.Partition < b.Partition
+	})
+	return connect_go.NewResponse(resp), nil
 }
 
 func (k KrakeServiceServer) ReadMessage(ctx context.Context, c *connect_go.Request[v1.ReadMessageRequest]) (*connect_go.Response[v1.ReadMessageResponse], error) {
-	//TODO implement me
-	panic("implement me")
+	msg, err := k.KrakeBroker.ReadMessage(c.Msg.Topic, c.Msg.ConsumerId, -1)
+	if err != nil {
+		return connect_go.NewResponse(&v1.ReadMessageResponse{Error: toError(err)}), nil
+	}
+	return connect_go.NewResponse(&v1.ReadMessageResponse{
+		Message: toProtoMessage(msg),
+	}), nil
+}
+
+func fromProtoMessage(m *v1.Message) *api.Message {
+	msg := &api.Message{
+		Key:     m.GetKey(),
+		Message: m.GetMessage(),
+	}
+	for _, h := range m.GetHeaders() {
+		msg.Headers = append(msg.Headers, record.Header{Key: h.Key, Value: h.Value})
+	}
+	if m.GetTimestamp() != 0 {
+		msg.Timestamp = time.UnixMilli(m.GetTimestamp())
+	}
+	return msg
+}
+
+func toProtoMessage(msg *api.Message) *v1.Message {
+	m := &v1.Message{
+		Key:       msg.Key,
+		Message:   msg.Message,
+		Timestamp: msg.Timestamp.UnixMilli(),
+		Partition: msg.Partition,
+		Offset:    msg.Offset,
+	}
+	for _, h := range msg.Headers {
+		m.Headers = append(m.Headers, &v1.Header{Key: h.Key, Value: h.Value})
+	}
+	if msg.TimestampType == record.LogAppendTime {
+		m.TimestampType = v1.TimestampType_TIMESTAMP_TYPE_LOG_APPEND_TIME
+	}
+	return m
+}
+
+func (k KrakeServiceServer) OffsetsForTimes(ctx context.Context, c *connect_go.Request[v1.OffsetsForTimesRequest]) (*connect_go.Response[v1.OffsetsForTimesResponse], error) {
+	offset, err := k.KrakeBroker.OffsetsForTimes(c.Msg.Topic, c.Msg.Partition, time.UnixMilli(c.Msg.Timestamp))
+	return connect_go.NewResponse(&v1.OffsetsForTimesResponse{
+		Error:  toError(err),
+		Offset: offset,
+	}), nil
 }
@@ -0,0 +1,386 @@
+package pkg
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	connect_go "github.com/bufbuild/connect-go"
+	"github.com/krake-labs/krake/api"
+	v1 "github.com/krake-labs/krake/gen/krake/v1"
+	"github.com/krake-labs/krake/gen/krake/v1/krakev1connect"
+	"github.com/stretchr/testify/assert"
+)
+
+func newServiceClient(t *testing.T, topic api.TopicConfiguration) krakev1connect.KrakeBrokerServiceClient {
+	pw := api.NewPartitionWriterWithStore(api.NewMemoryStore())
+	srv := &KrakeServiceServer{KrakeBroker: api.NewKrakeBroker(pw)}
+	srv.Configure(map[string]interface{}{
+		"log.dirs":          "/var/lib/krake",
+		"log.segment.bytes": 1 << 20,
+	})
+	assert.NoError(t, srv.CreateTopic(topic))
+
+	mux := http.NewServeMux()
+	mux.Handle(krakev1connect.NewKrakeBrokerServiceHandler(srv))
+	server := httptest.NewServer(mux)
+	t.Cleanup(func() {
+		server.Close()
+		pw.Close()
+	})
+	return krakev1connect.NewKrakeBrokerServiceClient(server.Client(), server.URL)
+}
+
+func TestKrakeServiceServer_ProduceAndRead(t *testing.T) {
+	ctx := context.Background()
+	client := newServiceClient(t, api.TopicConfiguration{Name: "events", PartitionCount: 1})
+
+	produced, err := client.Produce(ctx, connect_go.NewRequest(&v1.ProduceRequest{
+		Topic: "events",
+		Message: &v1.Message{
+			Message:   []byte("hello"),
+			Headers:   []*v1.Header{{Key: "trace-id", Value: []byte("abc")}},
+			Timestamp: 1_682_931_600_000,
+		},
+		Compression: "gzip",
+	}))
+	assert.NoError(t, err)
+	assert.Nil(t, produced.Msg.Error)
+
+	subscribed, err := client.AddSubscriptions(ctx, connect_go.NewRequest(&v1.AddSubscriptionsRequest{
+		Topics: []string{"events"},
+	}))
+	assert.NoError(t, err)
+	assert.Nil(t, subscribed.Msg.Error)
+
+	read, err := client.ReadMessage(ctx, connect_go.NewRequest(&v1.ReadMessageRequest{
+		Topic:      "events",
+		ConsumerId: subscribed.Msg.ConsumerId,
+	}))
+	assert.NoError(t, err)
+	assert.Nil(t, read.Msg.Error)
+	msg := read.Msg.Message
+	assert.Equal(t, []byte("hello"), msg.Message)
+	if assert.Len(t, msg.Headers, 1) {
+		assert.Equal(t, "trace-id", msg.Headers[0].Key)
+		assert.Equal(t, []byte("abc"), msg.Headers[0].Value)
+	}
+	assert.Equal(t, int64(1_682_931_600_000), msg.Timestamp)
+	assert.Equal(t, v1.TimestampType_TIMESTAMP_TYPE_CREATE_TIME, msg.TimestampType)
+	assert.Equal(t, produced.Msg.Partition, msg.Partition)
+	assert.Equal(t, produced.Msg.Offset, msg.Offset)
+}
+
+func TestKrakeServiceServer_LogAppendTime(t *testing.T) {
+	ctx := context.Background()
+	client := newServiceClient(t, api.TopicConfiguration{
+		Name:                 "events",
+		PartitionCount:       1,
+		MessageTimestampType: "LogAppendTime",
+	})
+
+	_, err := client.Produce(ctx, connect_go.NewRequest(&v1.ProduceRequest{
+		Topic:   "events",
+		Message: &v1.Message{Message: []byte("hello"), Timestamp: 1},
+	}))
+	assert.NoError(t, err)
+
+	subscribed, err := client.AddSubscriptions(ctx, connect_go.NewRequest(&v1.AddSubscriptionsRequest{
+		Topics: []string{"events"},
+	}))
+	assert.NoError(t, err)
+	read, err := client.ReadMessage(ctx, connect_go.NewRequest(&v1.ReadMessageRequest{
+		Topic:      "events",
+		ConsumerId: subscribed.Msg.ConsumerId,
+	}))
+	assert.NoError(t, err)
+	assert.Equal(t, v1.TimestampType_TIMESTAMP_TYPE_LOG_APPEND_TIME, read.Msg.Message.TimestampType)
+	assert.Greater(t, read.Msg.Message.Timestamp, int64(1))
+}
+
+func TestKrakeServiceServer_Errors(t *testing.T) {
+	ctx := context.Background()
+	client := newServiceClient(t, api.TopicConfiguration{Name: "events", PartitionCount: 1})
+
+	produced, err := client.Produce(ctx, connect_go.NewRequest(&v1.ProduceRequest{
+		Topic:       "events",
+		Message:     &v1.Message{Message: []byte("hello")},
+		Compression: "brotli",
+	}))
+	assert.NoError(t, err)
+	assert.Equal(t, int32(connect_go.CodeInvalidArgument), produced.Msg.Error.GetCode())
+
+	subscribed, err := client.AddSubscriptions(ctx, connect_go.NewRequest(&v1.AddSubscriptionsRequest{}))
+	assert.NoError(t, err)
+	assert.Equal(t, int32(connect_go.CodeInvalidArgument), subscribed.Msg.Error.GetCode())
+
+	read, err := client.ReadMessage(ctx, connect_go.NewRequest(&v1.ReadMessageRequest{
+		Topic:      "events",
+		ConsumerId: 42,
+	}))
+	assert.NoError(t, err)
+	assert.Equal(t, int32(connect_go.CodeNotFound), read.Msg.Error.GetCode())
+
+	partition := int32(1)
+	produced, err = client.Produce(ctx, connect_go.NewRequest(&v1.ProduceRequest{
+		Topic:     "events",
+		Message:   &v1.Message{Message: []byte("hello")},
+		Partition: &partition,
+	}))
+	assert.NoError(t, err)
+	assert.Equal(t, int32(connect_go.CodeNotFound), produced.Msg.Error.GetCode())
+	assert.Contains(t, produced.Msg.Error.GetMessage(), "unknown partition")
+}
+
+func TestKrakeServiceServer_Produce_Partition(t *testing.T) {
+	ctx := context.Background()
+	client := newServiceClient(t, api.TopicConfiguration{Name: "events", PartitionCount: 4})
+
+	for _, partition := range []int32{2, 0, 3} {
+		partition := partition
+		produced, err := client.Produce(ctx, connect_go.NewRequest(&v1.ProduceRequest{
+			Topic:     "events",
+			Message:   &v1.Message{Key: []byte("key"), Message: []byte("hello")},
+			Partition: &partition,
+		}))
+		assert.NoError(t, err)
+		assert.Nil(t, produced.Msg.Error)
+		assert.Equal(t, partition, produced.Msg.Partition)
+	}
+}
+
+func TestKrakeServiceServer_ProduceBatch(t *testing.T) {
+	ctx := context.Background()
+	client := newServiceClient(t, api.TopicConfiguration{Name: "events", PartitionCount: 2})
+
+	p0, p1, missing := int32(0), int32(1), int32(5)
+	produced, err := client.ProduceBatch(ctx, connect_go.NewRequest(&v1.ProduceBatchRequest{
+		Topic: "events",
+		Records: []*v1.ProduceBatchRequest_Record{
+			{Message: &v1.Message{Message: []byte("a")}, Partition: &p1},
+			{Message: &v1.Message{Message: []byte("b")}, Partition: &missing},
+			{Message: &v1.Message{Message: []byte("c")}, Partition: &p1},
+			{Message: &v1.Message{Message: []byte("d")}, Partition: &p0},
+		},
+		Compression: "snappy",
+	}))
+	assert.NoError(t, err)
+	assert.Nil(t, produced.Msg.Error)
+	if assert.Len(t, produced.Msg.Results, 4) {
+		results := produced.Msg.Results
+		assert.Equal(t, int32(connect_go.CodeNotFound), results[1].Error.GetCode())
+		for i, want := range []struct{ partition, offset int64 }{{1, 0}, {}, {1, 1}, {0, 0}} {
+			if i == 1 {
+				continue
+			}
+			assert.Nil(t, results[i].Error)
+			assert.Equal(t, int32(want.partition), results[i].Partition)
+			assert.Equal(t, want.offset, results[i].Offset)
+		}
+	}
+
+	produced, err = client.ProduceBatch(ctx, connect_go.NewRequest(&v1.ProduceBatchRequest{
+		Topic:   "missing",
+		Records: []*v1.ProduceBatchRequest_Record{{Message: &v1.Message{Message: []byte("a")}}},
+	}))
+	assert.NoError(t, err)
+	assert.Equal(t, int32(connect_go.CodeNotFound), produced.Msg.Error.GetCode())
+	assert.Empty(t, produced.Msg.Results)
+}
+
+func TestKrakeServiceServer_Produce_Acks(t *testing.T) {
+	ctx := context.Background()
+	client := newServiceClient(t, api.TopicConfiguration{Name: "events", PartitionCount: 1})
+
+	for _, tc := range []struct {
+		acks   string
+		offset int64
+	}{
+		{"0", -1},
+		{"all", 1},
+		{"", 2},
+	} {
+		produced, err := client.Produce(ctx, connect_go.NewRequest(&v1.ProduceRequest{
+			Topic:     "events",
+			Message:   &v1.Message{Message: []byte("hello")},
+			Acks:      tc.acks,
+			TimeoutMs: 1000,
+		}))
+		assert.NoError(t, err)
+		assert.Nil(t, produced.Msg.Error)
+		assert.Equal(t, tc.offset, produced.Msg.Offset)
+	}
+
+	produced, err := client.ProduceBatch(ctx, connect_go.NewRequest(&v1.ProduceBatchRequest{
+		Topic:   "events",
+		Records: []*v1.ProduceBatchRequest_Record{{Message: &v1.Message{Message: []byte("hello")}}},
+		Acks:    "2",
+	}))
+	assert.NoError(t, err)
+	assert.Equal(t, int32(connect_go.CodeInvalidArgument), produced.Msg.Error.GetCode())
+
+	assert.Equal(t, int32(connect_go.CodeDeadlineExceeded), toError(api.ErrRequestTimeout).GetCode())
+}
+
+func TestKrakeServiceServer_InitProducerId(t *testing.T) {
+	ctx := context.Background()
+	client := newServiceClient(t, api.TopicConfiguration{Name: "events", PartitionCount: 1})
+
+	initialised, err := client.InitProducerId(ctx, connect_go.NewRequest(&v1.InitProducerIdRequest{}))
+	assert.NoError(t, err)
+	assert.Nil(t, initialised.Msg.Error)
+	assert.NotZero(t, initialised.Msg.ProducerId)
+
+	produce := func(sequence int32) *v1.ProduceResponse {
+		produced, err := client.Produce(ctx, connect_go.NewRequest(&v1.ProduceRequest{
+			Topic:         "events",
+			Message:       &v1.Message{Message: []byte("hello")},
+			ProducerId:    initialised.Msg.ProducerId,
+			ProducerEpoch: initialised.Msg.ProducerEpoch,
+			Sequence:      sequence,
+		}))
+		assert.NoError(t, err)
+		return produced.Msg
+	}
+
+	assert.Nil(t, produce(0).Error)
+	assert.Nil(t, produce(1).Error)
+	// the retry is not written twice
+	retried := produce(1)
+	assert.Nil(t, retried.Error)
+	assert.Equal(t, int64(1), retried.Offset)
+	assert.Equal(t, int32(connect_go.CodeFailedPrecondition), produce(5).Error.GetCode())
+}
+
+func TestKrakeServiceServer_Transactions(t *testing.T) {
+	ctx := context.Background()
+	client := newServiceClient(t, api.TopicConfiguration{Name: "events", PartitionCount: 1})
+
+	subscribed, err := client.AddSubscriptions(ctx, connect_go.NewRequest(&v1.AddSubscriptionsRequest{
+		Topics:         []string{"events"},
+		IsolationLevel: "read_committed",
+	}))
+	assert.NoError(t, err)
+	assert.Nil(t, subscribed.Msg.Error)
+	read := func() *v1.ReadMessageResponse {
+		read, err := client.ReadMessage(ctx, connect_go.NewRequest(&v1.ReadMessageRequest{
+			Topic:      "events",
+			ConsumerId: subscribed.Msg.ConsumerId,
+		}))
+		assert.NoError(t, err)
+		return read.Msg
+	}
+
+	begun, err := client.BeginTransaction(ctx, connect_go.NewRequest(&v1.BeginTransactionRequest{TransactionalId: "checkout"}))
+	assert.NoError(t, err)
+	assert.Nil(t, begun.Msg.Error)
+
+	added, err := client.AddPartitionsToTxn(ctx, connect_go.NewRequest(&v1.AddPartitionsToTxnRequest{
+		TransactionalId: "checkout",
+		ProducerId:      begun.Msg.ProducerId,
+		ProducerEpoch:   begun.Msg.ProducerEpoch,
+		Partitions:      []*v1.TopicPartition{{Topic: "events", Partition: 0}},
+	}))
+	assert.NoError(t, err)
+	assert.Nil(t, added.Msg.Error)
+
+	partition := int32(0)
+	produced, err := client.Produce(ctx, connect_go.NewRequest(&v1.ProduceRequest{
+		Topic:           "events",
+		Message:         &v1.Message{Message: []byte("order")},
+		Partition:       &partition,
+		ProducerId:      begun.Msg.ProducerId,
+		ProducerEpoch:   begun.Msg.ProducerEpoch,
+		TransactionalId: "checkout",
+	}))
+	assert.NoError(t, err)
+	assert.Nil(t, produced.Msg.Error)
+	assert.Equal(t, int32(connect_go.CodeOutOfRange), read().Error.GetCode())
+
+	committed, err := client.CommitTransaction(ctx, connect_go.NewRequest(&v1.CommitTransactionRequest{
+		TransactionalId: "checkout",
+		ProducerId:      begun.Msg.ProducerId,
+		ProducerEpoch:   begun.Msg.ProducerEpoch,
+	}))
+	assert.NoError(t, err)
+	assert.Nil(t, committed.Msg.Error)
+	assert.Equal(t, []byte("order"), read().Message.GetMessage())
+
+	aborted, err := client.AbortTransaction(ctx, connect_go.NewRequest(&v1.AbortTransactionRequest{TransactionalId: "payments"}))
+	assert.NoError(t, err)
+	assert.Equal(t, int32(connect_go.CodeNotFound), aborted.Msg.Error.GetCode())
+
+	subscribed, err = client.AddSubscriptions(ctx, connect_go.NewRequest(&v1.AddSubscriptionsRequest{
+		Topics:         []string{"events"},
+		IsolationLevel: "serializable",
+	}))
+	assert.NoError(t, err)
+	assert.Equal(t, int32(connect_go.CodeInvalidArgument), subscribed.Msg.Error.GetCode())
+}
+
+func TestKrakeServiceServer_ConsumerGroup(t *testing.T) {
+	ctx := context.Background()
+	client := newServiceClient(t, api.TopicConfiguration{Name: "events", PartitionCount: 2})
+
+	produced, err := client.Produce(ctx, connect_go.NewRequest(&v1.ProduceRequest{
+		Topic:   "events",
+		Message: &v1.Message{Message: []byte("hello")},
+	}))
+	assert.NoError(t, err)
+	assert.Nil(t, produced.Msg.Error)
+
+	joined, err := client.JoinGroup(ctx, connect_go.NewRequest(&v1.JoinGroupRequest{
+		GroupId: "billing",
+		Topics:  []string{"events"},
+	}))
+	assert.NoError(t, err)
+	assert.Nil(t, joined.Msg.Error)
+	assert.Len(t, joined.Msg.Assignment, 2)
+
+	read, err := client.ReadMessage(ctx, connect_go.NewRequest(&v1.ReadMessageRequest{
+		Topic:      "events",
+		ConsumerId: joined.Msg.MemberId,
+	}))
+	assert.NoError(t, err)
+	assert.Nil(t, read.Msg.Error)
+	assert.Equal(t, []byte("hello"), read.Msg.Message.GetMessage())
+
+	committed, err := client.CommitOffsets(ctx, connect_go.NewRequest(&v1.CommitOffsetsRequest{
+		GroupId:    "billing",
+		MemberId:   joined.Msg.MemberId,
+		Generation: joined.Msg.Generation,
+		Offsets:    []*v1.PartitionOffset{{Topic: "events", Partition: read.Msg.Message.Partition, Offset: 1}},
+	}))
+	assert.NoError(t, err)
+	assert.Nil(t, committed.Msg.Error)
+
+	fetched, err := client.FetchOffsets(ctx, connect_go.NewRequest(&v1.FetchOffsetsRequest{GroupId: "billing"}))
+	assert.NoError(t, err)
+	assert.Nil(t, fetched.Msg.Error)
+	if assert.Len(t, fetched.Msg.Offsets, 1) {
+		assert.Equal(t, int64(1), fetched.Msg.Offsets[0].Offset)
+	}
+
+	heartbeat, err := client.Heartbeat(ctx, connect_go.NewRequest(&v1.HeartbeatRequest{
+		GroupId:    "billing",
+		MemberId:   joined.Msg.MemberId,
+		Generation: joined.Msg.Generation - 1,
+	}))
+	assert.NoError(t, err)
+	assert.Equal(t, int32(connect_go.CodeFailedPrecondition), heartbeat.Msg.Error.GetCode())
+
+	left, err := client.LeaveGroup(ctx, connect_go.NewRequest(&v1.LeaveGroupRequest{
+		GroupId:  "billing",
+		MemberId: joined.Msg.MemberId,
+	}))
+	assert.NoError(t, err)
+	assert.Nil(t, left.Msg.Error)
+
+	heartbeat, err = client.Heartbeat(ctx, connect_go.NewRequest(&v1.HeartbeatRequest{
+		GroupId:  "billing",
+		MemberId: joined.Msg.MemberId,
+	}))
+	assert.NoError(t, err)
+	assert.Equal(t, int32(connect_go.CodeNotFound), heartbeat.Msg.Error.GetCode())
+}
@@ -15,7 +15,7 @@ func main() {
 
 	b.CreateTopic(api.TopicConfiguration{
 		Name:            "",
-		PartitionCount:  0,
+		PartitionCount:  1,
 		RetentionPeriod: 0,
 	})
 }